@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// load-bench drives a repeatable mix of GET, PUT and DELETE requests against
+// a running API server and reports throughput and latency percentiles per
+// operation. Run it against the compose environment before and after a change
+// to measure it; -seed fixes the sequence of operations and keys.
+//
+// The keyspace is seeded with a PUT per key before the clock starts, so GETs
+// mostly hit live keys. Every key lives under -prefix and is deleted again at
+// the end.
+
+type result struct {
+	op      string
+	status  int
+	latency time.Duration
+	err     error
+}
+
+type opStats struct {
+	latencies []time.Duration
+	errors    int
+	statuses  map[int]int
+}
+
+func main() {
+	serverURL := flag.String("url", "http://localhost:8080", "base URL of the API server")
+	duration := flag.Duration("duration", 30*time.Second, "how long to generate load")
+	concurrency := flag.Int("concurrency", 32, "number of concurrent clients")
+	keys := flag.Int("keys", 1000, "number of distinct keys")
+	valueSize := flag.Int("value-size", 256, "bytes per written value")
+	mix := flag.String("mix", "80/15/5", "GET/PUT/DELETE percentages")
+	prefix := flag.String("prefix", fmt.Sprintf("bench-%d/", time.Now().Unix()), "prefix of every benchmark key")
+	seed := flag.Uint64("seed", 1, "seed for the operation and key sequence")
+	flag.Parse()
+
+	getPct, putPct, err := parseMix(*mix)
+	if err != nil {
+		log.Fatalf("Invalid -mix: %v", err)
+	}
+	if *concurrency <= 0 || *keys <= 0 || *valueSize < 0 || *duration <= 0 {
+		log.Fatal("-concurrency, -keys and -duration must be positive")
+	}
+
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency},
+	}
+	value := strings.Repeat("x", *valueSize)
+	keyName := func(i int) string { return fmt.Sprintf("%skey-%06d", *prefix, i) }
+
+	log.Printf("Seeding %d keys under '%s'...", *keys, *prefix)
+	for i := 0; i < *keys; i++ {
+		if r := do(client, *serverURL, "PUT", keyName(i), value); r.err != nil || r.status != http.StatusCreated {
+			log.Fatalf("Seeding key '%s' failed (status %d): %v", keyName(i), r.status, r.err)
+		}
+	}
+
+	log.Printf("Running %v of %s GET/PUT/DELETE with %d clients...", *duration, *mix, *concurrency)
+	results := make(chan result, 1024)
+	start := time.Now()
+	deadline := start.Add(*duration)
+	var wg sync.WaitGroup
+	for c := 0; c < *concurrency; c++ {
+		wg.Add(1)
+		go func(rng *rand.Rand) {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				key := keyName(rng.IntN(*keys))
+				op := "DELETE"
+				switch pick := rng.IntN(100); {
+				case pick < getPct:
+					op = "GET"
+				case pick < getPct+putPct:
+					op = "PUT"
+				}
+				results <- do(client, *serverURL, op, key, value)
+			}
+		}(rand.New(rand.NewPCG(*seed, uint64(c))))
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	stats := map[string]*opStats{}
+	for r := range results {
+		s := stats[r.op]
+		if s == nil {
+			s = &opStats{statuses: map[int]int{}}
+			stats[r.op] = s
+		}
+		if r.err != nil {
+			s.errors++
+			continue
+		}
+		s.statuses[r.status]++
+		s.latencies = append(s.latencies, r.latency)
+	}
+	report(stats, time.Since(start))
+
+	log.Printf("Deleting benchmark keys...")
+	for i := 0; i < *keys; i++ {
+		do(client, *serverURL, "DELETE", keyName(i)+"?force=true", "")
+	}
+}
+
+// parseMix parses "get/put/delete" percentages, which must add up to 100.
+func parseMix(mix string) (getPct, putPct int, err error) {
+	var deletePct int
+	if _, err := fmt.Sscanf(mix, "%d/%d/%d", &getPct, &putPct, &deletePct); err != nil {
+		return 0, 0, err
+	}
+	if getPct < 0 || putPct < 0 || deletePct < 0 || getPct+putPct+deletePct != 100 {
+		return 0, 0, fmt.Errorf("percentages must be non-negative and add up to 100")
+	}
+	return getPct, putPct, nil
+}
+
+// do sends one request and times it, including reading the response body.
+func do(client *http.Client, serverURL, op, key, value string) result {
+	var body io.Reader
+	if op == "PUT" {
+		payload, _ := json.Marshal(map[string]string{"value": value})
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequest(op, serverURL+"/kv/"+key, body)
+	if err != nil {
+		return result{op: op, err: err}
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return result{op: op, err: err}
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return result{op: op, status: resp.StatusCode, latency: time.Since(start), err: err}
+}
+
+// report prints throughput and latency percentiles per operation.
+func report(stats map[string]*opStats, elapsed time.Duration) {
+	total := 0
+	fmt.Printf("\n%-7s %9s %9s %9s %9s %9s %9s %7s  %s\n", "op", "requests", "req/s", "p50", "p95", "p99", "max", "errors", "statuses")
+	for _, op := range []string{"GET", "PUT", "DELETE"} {
+		s := stats[op]
+		if s == nil {
+			continue
+		}
+		slices.Sort(s.latencies)
+		n := len(s.latencies)
+		total += n + s.errors
+		statuses := make([]string, 0, len(s.statuses))
+		for code, count := range s.statuses {
+			statuses = append(statuses, fmt.Sprintf("%d:%d", code, count))
+		}
+		slices.Sort(statuses)
+		fmt.Printf("%-7s %9d %9.0f %9v %9v %9v %9v %7d  %s\n", op, n+s.errors, float64(n+s.errors)/elapsed.Seconds(),
+			percentile(s.latencies, 50), percentile(s.latencies, 95), percentile(s.latencies, 99), percentile(s.latencies, 100),
+			s.errors, strings.Join(statuses, " "))
+	}
+	fmt.Printf("\n%d requests in %v (%.0f req/s)\n", total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds())
+}
+
+// percentile returns the p-th percentile of sorted latencies.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p + 99) / 100
+	return sorted[max(i, 1)-1].Round(10 * time.Microsecond)
+}
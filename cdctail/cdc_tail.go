@@ -0,0 +1,199 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// cdc-tail prints the raw changefeed of kv_log to stdout, so the events the
+// hydrator receives can be watched without touching it. It opens its own core
+// changefeed, which lives only as long as its connection: nothing is written
+// to Redis, no cursor is persisted, and the hydrator's feed is unaffected.
+//
+// By default the feed starts at the current time; -cursor starts it at an
+// earlier HLC timestamp and -initial-scan emits the current row of every entry
+// first.
+
+// row is the subset of kv_log columns shown for each event.
+type row struct {
+	Namespace    string  `json:"namespace"`
+	Key          string  `json:"key"`
+	Value        *string `json:"value"`
+	Deleted      bool    `json:"deleted"`
+	OriginRegion string  `json:"origin_region"`
+	Version      int64   `json:"version"`
+	Timestamp    string  `json:"timestamp"`
+}
+
+type envelope struct {
+	After    *row   `json:"after"`
+	Updated  string `json:"updated"`
+	Resolved string `json:"resolved"`
+}
+
+func main() {
+	dbURL := flag.String("database-url", os.Getenv("DATABASE_URL"), "CockroachDB connection string (env DATABASE_URL)")
+	namespace := flag.String("namespace", "", "only show keys of this namespace (empty = all)")
+	key := flag.String("key", "", "only show this key")
+	prefix := flag.String("prefix", "", "only show keys starting with this prefix")
+	cursor := flag.String("cursor", "", "HLC timestamp to start from (empty = now)")
+	initialScan := flag.Bool("initial-scan", false, "emit the current rows of kv_log before new changes")
+	resolved := flag.Duration("resolved", 10*time.Second, "interval of resolved timestamps (0 hides them)")
+	maxValue := flag.Int("max-value-bytes", 200, "truncate printed values to this many bytes (0 = no limit)")
+	raw := flag.Bool("raw", false, "print each changefeed message as received instead of formatting it")
+	storageMode := flag.String("storage-mode", cmp.Or(os.Getenv("STORAGE_MODE"), "log"), "log or upsert, matching the servers (env STORAGE_MODE)")
+	flag.Parse()
+
+	if *dbURL == "" {
+		log.Fatal("-database-url (or DATABASE_URL) is required")
+	}
+	table, err := logTable(*storageMode)
+	if err != nil {
+		log.Fatalf("Invalid -storage-mode: %v", err)
+	}
+	db, err := sql.Open("postgres", *dbURL)
+	if err != nil {
+		log.Fatalf("Failed to connect to CockroachDB: %v", err)
+	}
+	// The changefeed ends with its connection, so closing the pool on
+	// interrupt is all the cleanup there is.
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupted
+		db.Close()
+		os.Exit(0)
+	}()
+
+	statement := changefeedStatement(table, *cursor, *initialScan, *resolved)
+	log.Printf("Starting changefeed: %s", statement)
+	rows, err := db.Query(statement)
+	if err != nil {
+		log.Fatalf("Failed to create changefeed: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var table, rowKey, value sql.NullString
+		if err := rows.Scan(&table, &rowKey, &value); err != nil {
+			log.Fatalf("Failed to read changefeed: %v", err)
+		}
+		if !value.Valid {
+			continue
+		}
+		var msg envelope
+		if err := json.Unmarshal([]byte(value.String), &msg); err != nil {
+			log.Printf("WARNING: Unparseable changefeed message %s: %v", value.String, err)
+			continue
+		}
+		if msg.After != nil && !matches(*msg.After, *namespace, *key, *prefix) {
+			continue
+		}
+		if msg.After == nil && msg.Resolved == "" && (*namespace != "" || *key != "" || *prefix != "") {
+			continue // A pruned row names only its id, so it cannot be filtered.
+		}
+		if *raw {
+			fmt.Println(value.String)
+			continue
+		}
+		fmt.Println(format(msg, rowKey.String, *maxValue))
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalf("Changefeed ended: %v", err)
+	}
+}
+
+func changefeedStatement(table, cursor string, initialScan bool, resolved time.Duration) string {
+	options := []string{"updated", "format = json", "envelope = wrapped"}
+	if resolved > 0 {
+		options = append(options, fmt.Sprintf("resolved = '%s'", resolved))
+	}
+	if cursor != "" {
+		options = append(options, fmt.Sprintf("cursor = '%s'", cursor))
+	}
+	if initialScan {
+		options = append(options, "initial_scan = 'yes'")
+	} else {
+		options = append(options, "initial_scan = 'no'")
+	}
+	return "CREATE CHANGEFEED FOR TABLE " + table + " WITH " + strings.Join(options, ", ")
+}
+
+// matches applies the -namespace, -key and -prefix filters to r.
+func matches(r row, namespace, key, prefix string) bool {
+	ns := r.Namespace
+	if ns == "" {
+		ns = "default"
+	}
+	return (namespace == "" || ns == namespace) &&
+		(key == "" || r.Key == key) &&
+		strings.HasPrefix(r.Key, prefix)
+}
+
+// format renders one message as a single line, led by its HLC timestamp and
+// the wall time it stands for.
+func format(msg envelope, rowKey string, maxValue int) string {
+	if msg.Resolved != "" {
+		return fmt.Sprintf("%s %s RESOLVED", hlcTime(msg.Resolved), msg.Resolved)
+	}
+	if msg.After == nil {
+		return fmt.Sprintf("%s %s PRUNED  row %s", hlcTime(msg.Updated), msg.Updated, rowKey)
+	}
+	r := msg.After
+	ns := r.Namespace
+	if ns == "" {
+		ns = "default"
+	}
+	origin := r.OriginRegion
+	if origin == "" {
+		origin = "unknown"
+	}
+	line := fmt.Sprintf("%s %s", hlcTime(msg.Updated), msg.Updated)
+	if r.Deleted {
+		line += fmt.Sprintf(" DELETE  %s/%s", ns, r.Key)
+	} else {
+		value := ""
+		if r.Value != nil {
+			value = *r.Value
+		}
+		if maxValue > 0 && len(value) > maxValue {
+			value = value[:maxValue] + "..."
+		}
+		line += fmt.Sprintf(" PUT     %s/%s = %s", ns, r.Key, strconv.Quote(value))
+	}
+	return line + fmt.Sprintf(" (version %d, origin %s, written %s)", r.Version, origin, r.Timestamp)
+}
+
+// hlcTime formats the wall-time part of an HLC timestamp.
+func hlcTime(hlc string) string {
+	wall, _, _ := strings.Cut(hlc, ".")
+	nanos, err := strconv.ParseInt(wall, 10, 64)
+	if err != nil {
+		return "?"
+	}
+	return time.Unix(0, nanos).UTC().Format("2006-01-02T15:04:05.000000Z")
+}
+
+// logTable names the table holding entries in storageMode, as STORAGE_MODE
+// does for the server.
+func logTable(storageMode string) (string, error) {
+	switch storageMode {
+	case "log":
+		return "kv_log", nil
+	case "upsert":
+		return "kv_current", nil
+	}
+	return "", fmt.Errorf("unknown storage mode %q (want log or upsert)", storageMode)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-redis/redis/v8"
+	_ "github.com/lib/pq"
+)
+
+// consistency-check compares the latest state of every key in kv_log against
+// the regional Redis cache and reports (and optionally repairs) divergence.
+//
+// A live key whose cached value differs is re-Set to the authoritative value;
+// a deleted key that is still cached is Del'd. A live key that is simply not
+// cached is fine: the next GET reads through.
+
+var ctx = context.Background()
+
+// redisKeyPrefix is prepended to every Redis key; see -redis-key-prefix.
+var redisKeyPrefix string
+
+// keyState is the latest log entry for one key.
+type keyState struct {
+	Key      string
+	CacheKey string // The key's Redis key; see qualifiedKey.
+	Value    string
+	Deleted  bool
+}
+
+type summary struct {
+	Checked, Mismatches, Repaired, Errors int
+}
+
+func main() {
+	dbURL := flag.String("database-url", os.Getenv("DATABASE_URL"), "CockroachDB connection string (env DATABASE_URL)")
+	redisURL := flag.String("redis-url", os.Getenv("REDIS_URL"), "Redis address or redis:// / rediss:// URL (env REDIS_URL)")
+	flag.StringVar(&redisKeyPrefix, "redis-key-prefix", os.Getenv("REDIS_KEY_PREFIX"), "prefix of every Redis key, matching the server (env REDIS_KEY_PREFIX)")
+	namespace := flag.String("namespace", "default", "namespace whose keys are checked")
+	prefix := flag.String("prefix", "", "only check keys starting with this prefix")
+	dryRun := flag.Bool("dry-run", true, "report mismatches without repairing them")
+	rate := flag.Int("rate", 500, "maximum keys checked per second")
+	pageSize := flag.Int("page-size", 200, "keys fetched from CockroachDB per query")
+	storageMode := flag.String("storage-mode", cmp.Or(os.Getenv("STORAGE_MODE"), "log"), "log or upsert, matching the servers (env STORAGE_MODE)")
+	flag.Parse()
+
+	if *dbURL == "" || *redisURL == "" {
+		log.Fatal("Both -database-url and -redis-url (or DATABASE_URL and REDIS_URL) are required")
+	}
+	if *rate <= 0 || *pageSize <= 0 {
+		log.Fatal("-rate and -page-size must be positive")
+	}
+	table, err := logTable(*storageMode)
+	if err != nil {
+		log.Fatalf("Invalid -storage-mode: %v", err)
+	}
+
+	db, err := sql.Open("postgres", *dbURL)
+	if err != nil {
+		log.Fatalf("Failed to connect to CockroachDB: %v", err)
+	}
+	defer db.Close()
+	redisOpts := &redis.Options{Addr: *redisURL}
+	if strings.Contains(*redisURL, "://") {
+		if redisOpts, err = redis.ParseURL(*redisURL); err != nil {
+			log.Fatalf("Invalid -redis-url: %v", err)
+		}
+	}
+	redisClient := redis.NewClient(redisOpts)
+	if err := redisClient.Ping(ctx).Err(); err != nil {
+		log.Fatalf("Failed to connect to Redis: %v", err)
+	}
+
+	log.Printf("Checking keys with prefix %q (dry_run=%t, rate=%d/s)", *prefix, *dryRun, *rate)
+	var sum summary
+	throttle := time.NewTicker(time.Second / time.Duration(*rate))
+	defer throttle.Stop()
+
+	cursor := ""
+	for {
+		page, err := latestStates(db, table, *namespace, *prefix, cursor, *pageSize)
+		if err != nil {
+			log.Fatalf("Failed to scan %s: %v", table, err)
+		}
+		for _, state := range page {
+			<-throttle.C
+			checkKey(redisClient, state, *dryRun, &sum)
+		}
+		if len(page) < *pageSize {
+			break
+		}
+		cursor = page[len(page)-1].Key
+	}
+
+	log.Printf("Consistency check complete: checked=%d mismatches=%d repaired=%d errors=%d",
+		sum.Checked, sum.Mismatches, sum.Repaired, sum.Errors)
+	if sum.Errors > 0 || (*dryRun && sum.Mismatches > 0) {
+		os.Exit(1)
+	}
+}
+
+// latestStates returns the latest entry in table of up to limit keys of
+// namespace after cursor that start with prefix, in key order.
+func latestStates(db *sql.DB, table, namespace, prefix, cursor string, limit int) ([]keyState, error) {
+	where := "namespace = $3 AND key > $2"
+	args := []any{limit, max(cursor, prefix), namespace}
+	if cursor < prefix {
+		where = "namespace = $3 AND key >= $2"
+	}
+	if end, ok := prefixEnd(prefix); ok && prefix != "" {
+		where += " AND key < $4"
+		args = append(args, end)
+	}
+	rows, err := db.Query(`
+    SELECT DISTINCT ON (key) key, value, deleted FROM `+table+`
+    WHERE `+where+`
+    ORDER BY key, hlc DESC, timestamp DESC
+    LIMIT $1;
+    `, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var states []keyState
+	for rows.Next() {
+		var state keyState
+		var value sql.NullString
+		if err := rows.Scan(&state.Key, &value, &state.Deleted); err != nil {
+			return nil, err
+		}
+		state.Value = value.String
+		state.CacheKey = redisKeyPrefix + qualifiedKey(namespace, state.Key)
+		states = append(states, state)
+	}
+	return states, rows.Err()
+}
+
+// checkKey compares one key's cache entry with its authoritative state.
+func checkKey(redisClient *redis.Client, state keyState, dryRun bool, sum *summary) {
+	sum.Checked++
+	cached, err := redisClient.Get(ctx, state.CacheKey).Result()
+	if err == redis.Nil {
+		return // Not cached; nothing can be stale.
+	}
+	if err != nil {
+		sum.Errors++
+		log.Printf("ERROR: Redis GET failed for key '%s': %v", state.CacheKey, err)
+		return
+	}
+	if !state.Deleted && cached == state.Value {
+		return
+	}
+
+	sum.Mismatches++
+	action := "set"
+	if state.Deleted {
+		action = "del"
+		log.Printf("MISMATCH: key '%s' is deleted in CockroachDB but cached as %q", state.CacheKey, cached)
+	} else {
+		log.Printf("MISMATCH: key '%s' is %q in CockroachDB but cached as %q", state.CacheKey, state.Value, cached)
+	}
+	if dryRun {
+		return
+	}
+	if state.Deleted {
+		err = redisClient.Del(ctx, state.CacheKey).Err()
+	} else {
+		err = redisClient.Set(ctx, state.CacheKey, state.Value, 0).Err()
+	}
+	if err != nil {
+		sum.Errors++
+		log.Printf("ERROR: Failed to repair key '%s' (%s): %v", state.CacheKey, action, err)
+		return
+	}
+	sum.Repaired++
+	log.Printf("REPAIRED: key '%s' (%s)", state.CacheKey, action)
+}
+
+// qualifiedKey is the Redis key of key in namespace, matching the server:
+// default-namespace keys are cached under their own name.
+func qualifiedKey(namespace, key string) string {
+	if namespace == "default" {
+		return key
+	}
+	return namespace + "/" + key
+}
+
+// prefixEnd returns the smallest string greater than every string with the
+// given prefix, working on runes so the bound stays valid UTF-8.
+func prefixEnd(prefix string) (string, bool) {
+	runes := []rune(prefix)
+	for i := len(runes) - 1; i >= 0; i-- {
+		if runes[i] < unicode.MaxRune {
+			runes[i]++
+			if runes[i] >= 0xD800 && runes[i] <= 0xDFFF {
+				runes[i] = 0xE000 // Surrogates cannot be encoded in UTF-8.
+			}
+			return string(runes[:i+1]), true
+		}
+	}
+	return "", false
+}
+
+// logTable names the table holding entries in storageMode, as STORAGE_MODE
+// does for the server.
+func logTable(storageMode string) (string, error) {
+	switch storageMode {
+	case "log":
+		return "kv_log", nil
+	case "upsert":
+		return "kv_current", nil
+	}
+	return "", fmt.Errorf("unknown storage mode %q (want log or upsert)", storageMode)
+}
@@ -0,0 +1,451 @@
+// Package client is a Go client for the key-value store's HTTP API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Client ---
+//
+// A Client talks to one server, given by its base URL such as
+// "http://localhost:8080", and addresses keys of one namespace, the default
+// one unless set with WithNamespace or Namespace. Keys are passed as stored
+// and escaped by the client, so a key may hold slashes, spaces or any other
+// character. Responses other than 2xx are returned as *Error, which matches
+// the sentinel errors of errors.go with errors.Is.
+//
+// Requests answered 503, which the server sends while CockroachDB is
+// overloaded, a region is read-only or the write queue is full, are retried
+// with exponential backoff, waiting at least as long as Retry-After asks.
+// Reads are also retried when the request fails before any response; writes
+// are not, since they may have been applied.
+
+const (
+	defaultTimeout = 10 * time.Second
+	defaultRetries = 3
+	defaultBackoff = 100 * time.Millisecond
+	// maxBackoff caps the wait between two attempts.
+	maxBackoff = 5 * time.Second
+
+	// defaultNamespace is addressed without a namespace in key paths.
+	defaultNamespace = "default"
+)
+
+// Client is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	namespace  string
+	httpClient *http.Client
+	retries    int
+	backoff    time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sends requests with hc instead of a client with a 10s
+// timeout. Watch ignores hc's Timeout, since streams stay open indefinitely.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithRetries retries a request up to n times, waiting backoff before the
+// first retry and doubling the wait after each. n of 0 disables retries.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(c *Client) { c.retries, c.backoff = n, backoff }
+}
+
+// WithNamespace addresses keys of namespace instead of the default one.
+func WithNamespace(namespace string) Option {
+	return func(c *Client) { c.namespace = namespace }
+}
+
+// New returns a Client of the server at baseURL.
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: defaultTimeout},
+		retries:    defaultRetries,
+		backoff:    defaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Namespace returns a copy of c addressing keys of namespace.
+func (c *Client) Namespace(namespace string) *Client {
+	copied := *c
+	copied.namespace = namespace
+	return &copied
+}
+
+// Value is a key's current value, as returned by Get.
+type Value struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Version int64  `json:"version"`
+}
+
+// Entry is an entry of a key's log, as returned by writes and GetMany.
+type Entry struct {
+	Namespace    string            `json:"namespace"`
+	Key          string            `json:"key"`
+	Value        string            `json:"value"`
+	Timestamp    time.Time         `json:"timestamp"`
+	Deleted      bool              `json:"deleted"`
+	OriginRegion string            `json:"origin_region,omitempty"`
+	Version      int64             `json:"version"`
+	TTLSeconds   int64             `json:"ttl_seconds,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	HLC          json.Number       `json:"hlc,omitempty"`
+	HomeRegion   string            `json:"home_region,omitempty"`
+	ValueType    string            `json:"value_type,omitempty"`
+}
+
+// keyURL is the URL of key, or of its sub-resource suffix such as "/_touch"
+// when suffix is not empty, with query appended when it is not empty.
+func (c *Client) keyURL(key, suffix string, query url.Values) string {
+	path := url.PathEscape(key)
+	if c.namespace != "" && c.namespace != defaultNamespace {
+		path = url.PathEscape(c.namespace) + "/" + path
+	}
+	return c.withQuery(c.baseURL+"/kv/"+path+suffix, query)
+}
+
+// collectionURL is the URL of a /kv/_ endpoint such as "_snapshot", in the
+// client's namespace.
+func (c *Client) collectionURL(endpoint string, query url.Values) string {
+	if c.namespace != "" {
+		if query == nil {
+			query = url.Values{}
+		}
+		query.Set("namespace", c.namespace)
+	}
+	return c.withQuery(c.baseURL+"/kv/"+endpoint, query)
+}
+
+func (c *Client) withQuery(u string, query url.Values) string {
+	if len(query) == 0 {
+		return u
+	}
+	return u + "?" + query.Encode()
+}
+
+// request describes one API call; body is re-read for every attempt.
+type request struct {
+	method string
+	url    string
+	body   []byte
+	header http.Header
+}
+
+// do sends req, retrying as described above, and decodes a 2xx response's
+// JSON body into out unless out is nil.
+func (c *Client) do(ctx context.Context, req request, out any) error {
+	resp, err := c.send(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding %s %s response: %w", req.method, req.url, err)
+	}
+	return nil
+}
+
+// send sends req, retrying as described above, and returns the first 2xx
+// response, whose body the caller must close.
+func (c *Client) send(ctx context.Context, req request) (*http.Response, error) {
+	wait := c.backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := c.attempt(ctx, req)
+		retryable := false
+		switch {
+		case err != nil:
+			retryable = req.method == http.MethodGet && ctx.Err() == nil
+		case resp.StatusCode < 300:
+			return resp, nil
+		default:
+			apiErr := readError(resp)
+			resp.Body.Close()
+			err = apiErr
+			retryable = apiErr.StatusCode == http.StatusServiceUnavailable
+			wait = max(wait, apiErr.RetryAfter)
+		}
+		if !retryable || attempt >= c.retries {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		wait = min(2*wait, maxBackoff)
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, req request) (*http.Response, error) {
+	var body io.Reader
+	if req.body != nil {
+		body = bytes.NewReader(req.body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, req.url, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range req.header {
+		httpReq.Header[name] = values
+	}
+	if req.body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	if httpReq.Header.Get("Accept") == "" {
+		httpReq.Header.Set("Accept", "application/json")
+	}
+	return c.httpClient.Do(httpReq)
+}
+
+// --- Keys ---
+
+// GetOption configures a Get.
+type GetOption func(http.Header)
+
+// Strong reads the key from CockroachDB instead of the cache, so the value
+// reflects every write committed before the Get, in any region.
+func Strong() GetOption {
+	return func(h http.Header) { h.Set("Consistency", "strong") }
+}
+
+// Get returns key's current value, or an error matching ErrNotFound when the
+// key has none.
+func (c *Client) Get(ctx context.Context, key string, opts ...GetOption) (Value, error) {
+	header := http.Header{}
+	for _, opt := range opts {
+		opt(header)
+	}
+	var value Value
+	err := c.do(ctx, request{method: http.MethodGet, url: c.keyURL(key, "", nil), header: header}, &value)
+	return value, err
+}
+
+// PutOption configures a Put.
+type PutOption func(*putOptions)
+
+type putOptions struct {
+	body struct {
+		Value      string            `json:"value"`
+		TTLSeconds int64             `json:"ttl_seconds,omitempty"`
+		Labels     map[string]string `json:"labels,omitempty"`
+		ValueType  string            `json:"value_type,omitempty"`
+	}
+	query  url.Values
+	header http.Header
+}
+
+// WithTTL makes the value expire after ttl, rounded down to whole seconds.
+func WithTTL(ttl time.Duration) PutOption {
+	return func(o *putOptions) { o.body.TTLSeconds = int64(ttl / time.Second) }
+}
+
+// WithLabels tags the value with labels.
+func WithLabels(labels map[string]string) PutOption {
+	return func(o *putOptions) { o.body.Labels = labels }
+}
+
+// AsNumber writes the value as a number, which range queries can find.
+func AsNumber() PutOption {
+	return func(o *putOptions) { o.body.ValueType = "number" }
+}
+
+// IfVersion writes only if the key's current version is version, failing
+// with an error matching ErrConflict otherwise.
+func IfVersion(version int64) PutOption {
+	return func(o *putOptions) { o.header.Set("If-Match", strconv.FormatInt(version, 10)) }
+}
+
+// IfAbsent writes only if the key has no live value, failing with an error
+// matching ErrConflict otherwise.
+func IfAbsent() PutOption {
+	return func(o *putOptions) { o.query.Set("if_absent", "true") }
+}
+
+// WithIdempotencyKey makes retries of the Put with the same idempotencyKey
+// apply it once.
+func WithIdempotencyKey(idempotencyKey string) PutOption {
+	return func(o *putOptions) { o.header.Set("Idempotency-Key", idempotencyKey) }
+}
+
+// Put writes value to key and returns the entry written.
+func (c *Client) Put(ctx context.Context, key, value string, opts ...PutOption) (Entry, error) {
+	o := putOptions{query: url.Values{}, header: http.Header{}}
+	o.body.Value = value
+	for _, opt := range opts {
+		opt(&o)
+	}
+	body, err := json.Marshal(o.body)
+	if err != nil {
+		return Entry{}, err
+	}
+	var entry Entry
+	err = c.do(ctx, request{method: http.MethodPut, url: c.keyURL(key, "", o.query), body: body, header: o.header}, &entry)
+	return entry, err
+}
+
+// DeleteOption configures a Delete.
+type DeleteOption func(url.Values)
+
+// Force writes a tombstone even if the key has no live value, instead of
+// failing with an error matching ErrNotFound.
+func Force() DeleteOption {
+	return func(q url.Values) { q.Set("force", "true") }
+}
+
+// IfValue deletes only if the key's current value is expected, failing with
+// an error matching ErrConflict otherwise.
+func IfValue(expected string) DeleteOption {
+	return func(q url.Values) { q.Set("expected_value", expected) }
+}
+
+// Delete deletes key.
+func (c *Client) Delete(ctx context.Context, key string, opts ...DeleteOption) error {
+	query := url.Values{}
+	for _, opt := range opts {
+		opt(query)
+	}
+	return c.do(ctx, request{method: http.MethodDelete, url: c.keyURL(key, "", query)}, nil)
+}
+
+// Touch sets key's expiry to ttl from now without changing its value, and
+// returns the entry written. A key that is missing, deleted or already
+// expired fails with an error matching ErrNotFound.
+func (c *Client) Touch(ctx context.Context, key string, ttl time.Duration) (Entry, error) {
+	query := url.Values{}
+	query.Set("ttl", ttl.String())
+	var entry Entry
+	err := c.do(ctx, request{method: http.MethodPost, url: c.keyURL(key, "/_touch", query)}, &entry)
+	return entry, err
+}
+
+// --- Batches ---
+
+// GetMany reads keys at a single point in time with /kv/_snapshot and
+// returns the latest entry of each key that has a live value.
+func (c *Client) GetMany(ctx context.Context, keys []string) (map[string]Entry, error) {
+	body, err := json.Marshal(map[string][]string{"keys": keys})
+	if err != nil {
+		return nil, err
+	}
+	var snapshot struct {
+		Entries []Entry `json:"entries"`
+	}
+	if err := c.do(ctx, request{method: http.MethodPost, url: c.collectionURL("_snapshot", nil), body: body}, &snapshot); err != nil {
+		return nil, err
+	}
+	entries := make(map[string]Entry, len(snapshot.Entries))
+	for _, entry := range snapshot.Entries {
+		entries[entry.Key] = entry
+	}
+	return entries, nil
+}
+
+// DeleteManyResult lists the keys a DeleteMany deleted and those that had
+// no live value.
+type DeleteManyResult struct {
+	Deleted  []string `json:"deleted"`
+	NotFound []string `json:"not_found"`
+}
+
+// DeleteMany deletes keys with /kv/_batch/delete.
+func (c *Client) DeleteMany(ctx context.Context, keys []string) (DeleteManyResult, error) {
+	var result DeleteManyResult
+	body, err := json.Marshal(map[string][]string{"keys": keys})
+	if err != nil {
+		return result, err
+	}
+	err = c.do(ctx, request{method: http.MethodPost, url: c.collectionURL("_batch/delete", nil), body: body}, &result)
+	return result, err
+}
+
+// TouchManyResult lists the keys a TouchMany touched and those that had no
+// live value.
+type TouchManyResult struct {
+	Touched  []string `json:"touched"`
+	NotFound []string `json:"not_found"`
+}
+
+// TouchMany sets the expiry of keys to ttl from now with /kv/_batch/touch.
+func (c *Client) TouchMany(ctx context.Context, keys []string, ttl time.Duration) (TouchManyResult, error) {
+	var result TouchManyResult
+	body, err := json.Marshal(map[string][]string{"keys": keys})
+	if err != nil {
+		return result, err
+	}
+	query := url.Values{}
+	query.Set("ttl", ttl.String())
+	err = c.do(ctx, request{method: http.MethodPost, url: c.collectionURL("_batch/touch", query), body: body}, &result)
+	return result, err
+}
+
+// Import modes, saying what Import does with a key listed twice or already
+// present.
+const (
+	ImportAppendAll    = "append_all"    // every entry is written, in order
+	ImportLastWins     = "last_wins"     // only the last entry of a key is written
+	ImportSkipExisting = "skip_existing" // keys with a live value are left alone
+)
+
+// ImportEntry is one entry of an Import.
+type ImportEntry struct {
+	Key        string            `json:"key"`
+	Value      string            `json:"value"`
+	TTLSeconds int64             `json:"ttl_seconds,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	ValueType  string            `json:"value_type,omitempty"`
+}
+
+// ImportResult is what Import did with one entry: its Disposition is
+// "written", "superseded", "skipped_existing" or "skipped_duplicate", and
+// Version is set for written entries.
+type ImportResult struct {
+	Key         string `json:"key"`
+	Disposition string `json:"disposition"`
+	Version     int64  `json:"version,omitempty"`
+}
+
+// ImportResponse is the answer to an Import, with a result per entry in the
+// order they were given.
+type ImportResponse struct {
+	Mode    string         `json:"mode"`
+	Written int            `json:"written"`
+	Skipped int            `json:"skipped"`
+	Results []ImportResult `json:"results"`
+}
+
+// Import writes entries in one transaction with /kv/_batch/import, handling
+// duplicate and existing keys per mode.
+func (c *Client) Import(ctx context.Context, mode string, entries []ImportEntry) (ImportResponse, error) {
+	var result ImportResponse
+	body, err := json.Marshal(map[string][]ImportEntry{"entries": entries})
+	if err != nil {
+		return result, err
+	}
+	query := url.Values{}
+	query.Set("mode", mode)
+	err = c.do(ctx, request{method: http.MethodPost, url: c.collectionURL("_batch/import", query), body: body}, &result)
+	return result, err
+}
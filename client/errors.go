@@ -0,0 +1,108 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// --- Errors ---
+//
+// Every non-2xx response is returned as an *Error holding the status and the
+// server's error body. errors.Is matches it against the sentinel for its
+// status, so callers can branch without knowing the codes:
+//
+//	if errors.Is(err, client.ErrNotFound) { ... }
+//
+// Code is the server's stable error code, such as "KEY_EXISTS" or
+// "VERSION_CONFLICT", for callers that need to tell finer cases apart.
+
+var (
+	ErrInvalid       = errors.New("invalid request")          // 400, 422
+	ErrUnauthorized  = errors.New("unauthorized")             // 401, 403
+	ErrNotFound      = errors.New("not found")                // 404
+	ErrConflict      = errors.New("conflict")                 // 409
+	ErrTooLarge      = errors.New("payload too large")        // 413
+	ErrMisdirected   = errors.New("key homed elsewhere")      // 421
+	ErrUnavailable   = errors.New("service unavailable")      // 503
+	ErrQuotaExceeded = errors.New("namespace quota exceeded") // 507
+)
+
+// sentinels maps statuses to the sentinel errors they match.
+var sentinels = map[int]error{
+	http.StatusBadRequest:            ErrInvalid,
+	http.StatusUnprocessableEntity:   ErrInvalid,
+	http.StatusUnauthorized:          ErrUnauthorized,
+	http.StatusForbidden:             ErrUnauthorized,
+	http.StatusNotFound:              ErrNotFound,
+	http.StatusConflict:              ErrConflict,
+	http.StatusRequestEntityTooLarge: ErrTooLarge,
+	http.StatusMisdirectedRequest:    ErrMisdirected,
+	http.StatusServiceUnavailable:    ErrUnavailable,
+	http.StatusInsufficientStorage:   ErrQuotaExceeded,
+}
+
+// Error is a non-2xx response of the server.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RequestID  string
+	// Details holds the fields some errors add next to code, message and
+	// request_id, such as a quota's limit or a schema violation's errors.
+	Details map[string]any
+	// RetryAfter is the response's Retry-After, or 0 without one.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("kv server answered %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("kv server answered %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Unwrap returns the sentinel error of e's status, if any.
+func (e *Error) Unwrap() error {
+	return sentinels[e.StatusCode]
+}
+
+// readError reads resp's error body. A body that is not the server's error
+// JSON, from a proxy for instance, leaves Code and Message empty.
+func readError(resp *http.Response) *Error {
+	apiErr := &Error{StatusCode: resp.StatusCode}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	var body struct {
+		Error map[string]any `json:"error"`
+	}
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if json.Unmarshal(raw, &body) != nil || body.Error == nil {
+		return apiErr
+	}
+	apiErr.Code, _ = body.Error["code"].(string)
+	apiErr.Message, _ = body.Error["message"].(string)
+	apiErr.RequestID, _ = body.Error["request_id"].(string)
+	for _, field := range []string{"code", "message", "request_id"} {
+		delete(body.Error, field)
+	}
+	if len(body.Error) > 0 {
+		apiErr.Details = body.Error
+	}
+	return apiErr
+}
+
+// StatusCode returns the HTTP status of err when it is or wraps an *Error,
+// and 0 otherwise.
+func StatusCode(err error) int {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode
+	}
+	return 0
+}
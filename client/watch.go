@@ -0,0 +1,83 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// --- Watch ---
+//
+// Watch follows /kv/_watch: a "snapshot" event per live key under the prefix,
+// one "ready" event, then a "change" event per later write, deletes included.
+// The channel is closed when the stream ends, after an "overflow" event when
+// the server dropped the client for falling behind; the caller must then
+// watch again to resynchronize. Cancel ctx to stop watching.
+
+// Event types of a watch stream.
+const (
+	EventSnapshot = "snapshot"
+	EventReady    = "ready"
+	EventChange   = "change"
+	EventOverflow = "overflow"
+)
+
+// Event is one event of a watch stream. Only snapshot and change events
+// carry a key.
+type Event struct {
+	Type      string            `json:"-"`
+	Key       string            `json:"key"`
+	Value     string            `json:"value"`
+	Timestamp time.Time         `json:"timestamp"`
+	Deleted   bool              `json:"deleted"`
+	Version   int64             `json:"version,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	HLC       json.Number       `json:"hlc,omitempty"`
+}
+
+// Watch streams the keys under prefix and their changes.
+func (c *Client) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	query := url.Values{}
+	query.Set("prefix", prefix)
+	// The stream stays open indefinitely, so the client's timeout, which
+	// bounds whole requests, must not apply.
+	stream := *c
+	httpClient := *c.httpClient
+	httpClient.Timeout = 0
+	stream.httpClient = &httpClient
+	req := request{method: http.MethodGet, url: c.collectionURL("_watch", query), header: http.Header{}}
+	req.header.Set("Accept", "text/event-stream")
+	resp, err := stream.send(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan Event, 16)
+	go func() {
+		defer resp.Body.Close()
+		defer close(events)
+		var event Event
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(nil, 16<<20)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event.Type = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event)
+			case line == "" && event.Type != "":
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+				event = Event{}
+			}
+		}
+	}()
+	return events, nil
+}
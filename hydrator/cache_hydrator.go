@@ -1,52 +1,833 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"kvstore-cdc/migrations"
+
 	"github.com/go-redis/redis/v8"
 	_ "github.com/lib/pq"
 )
 
 var (
-	redisClient *redis.Client
+	redisClient redis.UniversalClient
 	ctx         = context.Background()
 )
 
 // Represents the actual row data within the changefeed message
 type ChangefeedMessage struct {
-	Key     string `json:"key"`
-	Value   string `json:"value"`
-	Deleted bool   `json:"deleted"`
+	Namespace    string `json:"namespace"`
+	Key          string `json:"key"`
+	Value        string `json:"value"`
+	Deleted      bool   `json:"deleted"`
+	OriginRegion string `json:"origin_region"`
+	Version      int64  `json:"version"`
+	Timestamp    string `json:"timestamp"`
+	TTLSeconds   int64  `json:"ttl_seconds"`
+	// Labels is the JSONB labels column, passed through to watchers.
+	Labels map[string]string `json:"labels,omitempty"`
+	// HLC is the row's commit timestamp, the same clock as the envelope's
+	// updated field. It is passed through to watchers.
+	HLC json.Number `json:"hlc,omitempty"`
+	// TargetKey is set on alias entries, which the server resolves on every
+	// read, so they are never cached.
+	TargetKey string `json:"target_key,omitempty"`
+}
+
+// expiry is how long the value may stay cached, from the row's timestamp
+// plus its ttl_seconds. Zero means no expiry; negative means already expired.
+func (m ChangefeedMessage) expiry() time.Duration {
+	if m.TTLSeconds <= 0 {
+		return 0
+	}
+	written, err := time.Parse(time.RFC3339Nano, m.Timestamp)
+	if err != nil {
+		// Fall back to the full TTL from now rather than caching forever.
+		return time.Duration(m.TTLSeconds) * time.Second
+	}
+	remaining := time.Until(written.Add(time.Duration(m.TTLSeconds) * time.Second))
+	if remaining <= 0 {
+		return -1
+	}
+	return remaining
+}
+
+// --- Changefeed Lag Tracking ---
+
+// lastResolvedNanos holds the newest resolved timestamp (wall-clock nanos)
+// seen on the changefeed. Zero means no resolved message has arrived yet.
+var lastResolvedNanos atomic.Int64
+
+// lastResolvedHLC holds the same timestamp as the HLC CockroachDB sent, the
+// form snapshots and the servers' /kv/_resolved use. Every event before it
+// has been applied to the cache.
+var lastResolvedHLC atomic.Value
+
+// parseHLCTimestamp converts a CockroachDB HLC timestamp of the form
+// "<wall nanos>.<logical>" into wall-clock time. The logical part is dropped.
+func parseHLCTimestamp(ts string) (time.Time, error) {
+	wall, _, _ := strings.Cut(ts, ".")
+	nanos, err := strconv.ParseInt(wall, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid HLC timestamp %q: %w", ts, err)
+	}
+	return time.Unix(0, nanos).UTC(), nil
+}
+
+// recordResolved advances the resolved watermark to hlc, whose wall time is
+// ts. Older timestamps are ignored.
+func recordResolved(hlc string, ts time.Time) {
+	if n := ts.UnixNano(); n >= lastResolvedNanos.Load() {
+		lastResolvedHLC.Store(hlc)
+		lastResolvedNanos.Store(n)
+	}
+}
+
+// resolvedWatermark is the body of /lag and of a ready /readyz: the last
+// resolved timestamp as an HLC and as a time, both nil before the first one.
+func resolvedWatermark(maxLag time.Duration) map[string]any {
+	resp := map[string]any{"resolved": nil, "resolved_hlc": nil, "lag_seconds": nil, "max_lag_seconds": maxLag.Seconds()}
+	if lag, ok := changefeedLag(); ok {
+		resp["resolved"] = time.Unix(0, lastResolvedNanos.Load()).UTC()
+		resp["resolved_hlc"] = json.Number(lastResolvedHLC.Load().(string))
+		resp["lag_seconds"] = lag.Seconds()
+	}
+	return resp
+}
+
+// changefeedLag reports how far the last resolved timestamp trails wall-clock
+// time. The boolean is false until the first resolved message is processed.
+func changefeedLag() (time.Duration, bool) {
+	n := lastResolvedNanos.Load()
+	if n == 0 {
+		return 0, false
+	}
+	return time.Since(time.Unix(0, n)), true
+}
+
+func init() {
+	expvar.Publish("changefeed_lag_seconds", expvar.Func(func() any {
+		lag, ok := changefeedLag()
+		if !ok {
+			return nil
+		}
+		return lag.Seconds()
+	}))
+}
+
+// --- Multi-Region Locality ---
+// Mirrors the API server so kv_log gets the same locality whichever binary
+// creates it first. See server/locality.go for the trade-offs.
+
+func parseRegions(raw string) []string {
+	var regions []string
+	for _, r := range strings.Split(raw, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			regions = append(regions, r)
+		}
+	}
+	return regions
 }
 
-// Represents the full "wrapped" envelope from the changefeed
-type WrappedChangefeedMessage struct {
-	After ChangefeedMessage `json:"after"`
+func configureLocality(db *sql.DB, regions []string, locality string) error {
+	if len(regions) == 0 {
+		if locality != "" {
+			return fmt.Errorf("TABLE_LOCALITY %q requires DB_REGIONS", locality)
+		}
+		return nil
+	}
+	var dbName string
+	if err := db.QueryRow(`SELECT current_database()`).Scan(&dbName); err != nil {
+		return err
+	}
+	statements := []string{fmt.Sprintf(`ALTER DATABASE %q SET PRIMARY REGION %q`, dbName, regions[0])}
+	for _, region := range regions[1:] {
+		statements = append(statements, fmt.Sprintf(`ALTER DATABASE %q ADD REGION IF NOT EXISTS %q`, dbName, region))
+	}
+	switch locality {
+	case "":
+	case "regional_by_row":
+		statements = append(statements, `ALTER TABLE `+logTable+` SET LOCALITY REGIONAL BY ROW`)
+	case "global":
+		statements = append(statements, `ALTER TABLE `+logTable+` SET LOCALITY GLOBAL`)
+	default:
+		return fmt.Errorf("unknown TABLE_LOCALITY %q (want regional_by_row or global)", locality)
+	}
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("%s: %w", stmt, err)
+		}
+	}
+	log.Printf("Database %s is multi-region (regions=%v); %s locality=%s", dbName, regions, logTable, locality)
+	return nil
+}
+
+// --- Logging ---
+//
+// Per-event lines are DEBUG so that a busy changefeed does not drown out
+// failures; at the default INFO level the hydrator logs periodic summaries,
+// warnings and errors only.
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[string]logLevel{"debug": levelDebug, "info": levelInfo, "warn": levelWarn, "error": levelError}
+
+// minLogLevel is set once from LOG_LEVEL at startup.
+var minLogLevel = levelInfo
+
+func parseLogLevel(raw string) (logLevel, error) {
+	if raw == "" {
+		return levelInfo, nil
+	}
+	level, ok := logLevelNames[strings.ToLower(raw)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", raw)
+	}
+	return level, nil
+}
+
+func logf(level logLevel, prefix, format string, args ...any) {
+	if level >= minLogLevel {
+		log.Printf(prefix+format, args...)
+	}
+}
+
+func debugf(format string, args ...any) { logf(levelDebug, "DEBUG: ", format, args...) }
+func infof(format string, args ...any)  { logf(levelInfo, "", format, args...) }
+func warnf(format string, args ...any)  { logf(levelWarn, "WARNING: ", format, args...) }
+func errorf(format string, args ...any) { logf(levelError, "ERROR: ", format, args...) }
+
+// --- Cache Interaction ---
+
+var (
+	// redisErrors counts failed Redis commands issued by the hydrator.
+	redisErrors = expvar.NewInt("redis_errors_total")
+	// eventsApplied and eventsSkipped count row events written to the cache
+	// and those dropped as older than what the cache already holds.
+	eventsApplied = expvar.NewInt("events_applied_total")
+	eventsSkipped = expvar.NewInt("events_skipped_total")
+	// eventErrors counts changefeed rows that could not be read or decoded.
+	eventErrors = expvar.NewInt("event_errors_total")
+	// cacheSkippedOversize counts values not cached for exceeding
+	// MAX_CACHEABLE_SIZE.
+	cacheSkippedOversize = expvar.NewInt("cache_skipped_oversize_total")
+	// eventsNotOwned counts row events left to the hydrator owning their
+	// key's partition.
+	eventsNotOwned = expvar.NewInt("events_not_owned_total")
+)
+
+// maxCacheableSize is MAX_CACHEABLE_SIZE: values larger than this many bytes
+// are never cached, 0 meaning no limit. It is set once at startup.
+var maxCacheableSize int
+
+// connectRedis builds a retrying Redis client and waits for Redis to become
+// reachable, backing off between attempts. redisURL may list several
+// comma-separated addresses: Sentinels when masterName is set, otherwise
+// Cluster seeds. Each may be host:port or a redis:// or rediss:// URL.
+func connectRedis(redisURL, masterName string, conn redisConnOptions) {
+	addrs, conn, err := parseRedisURL(redisURL, conn)
+	if err != nil {
+		log.Fatalf("Invalid REDIS_URL: %v", err)
+	}
+	var topology string
+	redisClient, topology = newRedisClient(addrs, masterName, conn)
+	log.Printf("Redis topology: %s (tls=%t)", topology, conn.TLSConfig != nil)
+	maxRetries := 10
+	retryDelay := 500 * time.Millisecond
+	for i := 0; i < maxRetries; i++ {
+		if _, err = redisClient.Ping(ctx).Result(); err == nil {
+			log.Println("Cache Hydrator connected to Redis.")
+			return
+		}
+		redisErrors.Add(1)
+		if isRedisAuthError(err) {
+			log.Fatalf("Redis rejected the configured credentials (check REDIS_PASSWORD or the password in REDIS_URL): %v", err)
+		}
+		log.Printf("Could not connect to Redis, retrying in %v... (%d/%d)", retryDelay, i+1, maxRetries)
+		time.Sleep(retryDelay)
+		retryDelay = min(retryDelay*2, 8*time.Second)
+	}
+	log.Fatalf("Failed to connect to Redis after %d retries: %v", maxRetries, err)
+}
+
+// redisConnOptions are the connection settings shared by every topology.
+type redisConnOptions struct {
+	Username, Password string
+	DB                 int
+	TLSConfig          *tls.Config // nil for plaintext.
+}
+
+// parseRedisURL splits a comma-separated REDIS_URL into addresses. Each entry
+// is either host:port or a redis:// or rediss:// URL parsed with
+// redis.ParseURL; credentials, a DB index or TLS given in a URL override
+// those in conn.
+func parseRedisURL(raw string, conn redisConnOptions) ([]string, redisConnOptions, error) {
+	var addrs []string
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "://") {
+			addrs = append(addrs, entry)
+			continue
+		}
+		opts, err := redis.ParseURL(entry)
+		if err != nil {
+			return nil, conn, err
+		}
+		addrs = append(addrs, opts.Addr)
+		if opts.Username != "" {
+			conn.Username = opts.Username
+		}
+		if opts.Password != "" {
+			conn.Password = opts.Password
+		}
+		if opts.DB != 0 {
+			conn.DB = opts.DB
+		}
+		if opts.TLSConfig != nil {
+			conn.TLSConfig = opts.TLSConfig
+		}
+	}
+	return addrs, conn, nil
+}
+
+// isRedisAuthError reports whether Redis refused the connection's AUTH, or
+// requires one that was not sent.
+func isRedisAuthError(err error) bool {
+	msg := err.Error()
+	return strings.HasPrefix(msg, "NOAUTH") || strings.HasPrefix(msg, "WRONGPASS") ||
+		strings.Contains(msg, "invalid password") || strings.Contains(msg, "without any password configured")
+}
+
+// newRedisClient builds a client for the topology the configuration implies:
+// Sentinel when a master name is set, Cluster when several addresses are
+// listed, otherwise a single node. It also returns a description for logging.
+func newRedisClient(addrs []string, masterName string, conn redisConnOptions) (redis.UniversalClient, string) {
+	const (
+		maxRetries      = 3
+		minRetryBackoff = 8 * time.Millisecond
+		maxRetryBackoff = 512 * time.Millisecond
+	)
+	switch {
+	case masterName != "":
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:      masterName,
+			SentinelAddrs:   addrs,
+			Username:        conn.Username,
+			Password:        conn.Password,
+			DB:              conn.DB,
+			TLSConfig:       conn.TLSConfig,
+			MaxRetries:      maxRetries,
+			MinRetryBackoff: minRetryBackoff,
+			MaxRetryBackoff: maxRetryBackoff,
+		}), fmt.Sprintf("sentinel (master %q via %v)", masterName, addrs)
+	case len(addrs) > 1:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:           addrs,
+			Username:        conn.Username,
+			Password:        conn.Password,
+			TLSConfig:       conn.TLSConfig,
+			MaxRetries:      maxRetries,
+			MinRetryBackoff: minRetryBackoff,
+			MaxRetryBackoff: maxRetryBackoff,
+		}), fmt.Sprintf("cluster (seeds %v)", addrs)
+	default:
+		return redis.NewClient(&redis.Options{
+			Addr:            addrs[0],
+			Username:        conn.Username,
+			Password:        conn.Password,
+			DB:              conn.DB,
+			TLSConfig:       conn.TLSConfig,
+			MaxRetries:      maxRetries,
+			MinRetryBackoff: minRetryBackoff,
+			MaxRetryBackoff: maxRetryBackoff,
+		}), fmt.Sprintf("single node (%s)", addrs[0])
+	}
+}
+
+// cacheTx runs fn as a MULTI/EXEC transaction. Redis Cluster rejects
+// transactions spanning hash slots, so in cluster mode the commands are only
+// pipelined.
+func cacheTx(fn func(redis.Pipeliner) error) error {
+	if _, ok := redisClient.(*redis.ClusterClient); ok {
+		_, err := redisClient.Pipelined(ctx, fn)
+		return err
+	}
+	_, err := redisClient.TxPipelined(ctx, fn)
+	return err
+}
+
+// defaultNamespace holds keys written without a namespace. Its keys are
+// cached under their own name; other namespaces' keys as "namespace/key".
+const defaultNamespace = "default"
+
+// qualifiedKey is the Redis key of key in namespace before REDIS_KEY_PREFIX,
+// matching the server. Events from before the namespace column existed have
+// no namespace.
+func qualifiedKey(namespace, key string) string {
+	if namespace == "" || namespace == defaultNamespace {
+		return key
+	}
+	return namespace + "/" + key
+}
+
+// logTable is the table the changefeed watches: kv_log, or kv_current with
+// STORAGE_MODE=upsert, where each key has a single row that every write
+// replaces. Its rows have the same columns either way.
+var logTable = "kv_log"
+
+// redisKeyPrefix is prepended to every Redis key the hydrator touches. It
+// must match the servers' REDIS_KEY_PREFIX.
+var redisKeyPrefix string
+
+func redisKey(namespace, key string) string {
+	return redisKeyPrefix + qualifiedKey(namespace, key)
+}
+
+// --- Idempotent Application ---
+
+// appliedTimestampsKey is a Redis hash mapping each key to the MVCC timestamp
+// of the last changefeed event applied to the cache for it. Changefeeds are
+// at-least-once and unordered across rows, so an event is only applied when
+// it is strictly newer than what the cache already reflects.
+func appliedTimestampsKey() string {
+	return redisKeyPrefix + "hydrator:applied_ts"
+}
+
+// versionsHashKey maps each cached key to the version of its cached value.
+// The server reads it on cache hits so GET can return the version.
+func versionsHashKey() string {
+	return redisKeyPrefix + "kv:versions"
+}
+
+// compareHLC orders two HLC timestamps ("<wall nanos>.<logical>").
+func compareHLC(a, b string) int {
+	aWall, aLogical, _ := strings.Cut(a, ".")
+	bWall, bLogical, _ := strings.Cut(b, ".")
+	aw, _ := strconv.ParseInt(aWall, 10, 64)
+	bw, _ := strconv.ParseInt(bWall, 10, 64)
+	if aw != bw {
+		return cmp.Compare(aw, bw)
+	}
+	al, _ := strconv.ParseInt(aLogical, 10, 64)
+	bl, _ := strconv.ParseInt(bLogical, 10, 64)
+	return cmp.Compare(al, bl)
+}
+
+// applyChangeScript applies one event atomically: it compares the event's
+// HLC timestamp with the one recorded for the key and, only if the event is
+// newer, sets or deletes the value and records the new timestamp and version.
+// Doing the compare and the write in one script closes the read-then-write
+// race between hydrators sharing a cache. Run uses EVALSHA, falling back to
+// EVAL the first time.
+//
+// KEYS: cache key, appliedTimestampsKey, versionsHashKey.
+// ARGV: HLC timestamp ("" applies unconditionally), "set" or "del", value,
+// version, expiry in milliseconds (0 = none).
+var applyChangeScript = redis.NewScript(`
+local ts = ARGV[1]
+if ts ~= "" then
+  local applied = redis.call("HGET", KEYS[2], KEYS[1])
+  if applied then
+    local aw, al = string.match(ts, "^0*(%d+)%.?(%d*)$")
+    local bw, bl = string.match(applied, "^0*(%d+)%.?(%d*)$")
+    if aw and bw then
+      -- Wall times are compared as digit strings; Lua numbers are doubles
+      -- and cannot hold nanosecond timestamps exactly.
+      local newer
+      if #aw ~= #bw then
+        newer = #aw > #bw
+      elseif aw ~= bw then
+        newer = aw > bw
+      else
+        newer = (tonumber(al) or 0) > (tonumber(bl) or 0)
+      end
+      if not newer then
+        return 0
+      end
+    end
+  end
+end
+if ARGV[2] == "del" then
+  redis.call("DEL", KEYS[1])
+  redis.call("HDEL", KEYS[3], KEYS[1])
+else
+  if tonumber(ARGV[5]) > 0 then
+    redis.call("SET", KEYS[1], ARGV[3], "PX", ARGV[5])
+  else
+    redis.call("SET", KEYS[1], ARGV[3])
+  end
+  redis.call("HSET", KEYS[3], KEYS[1], ARGV[4])
+end
+if ts ~= "" then
+  redis.call("HSET", KEYS[2], KEYS[1], ts)
+end
+return 1
+`)
+
+// applyChange writes one row event to the cache unless an event with the
+// same or a newer MVCC timestamp has already been applied for the key.
+func applyChange(msg ChangefeedMessage, updated string) {
+	cacheKey := redisKey(msg.Namespace, msg.Key)
+	expiry := msg.expiry()
+	op, verb := "set", "Setting"
+	if msg.Deleted || expiry < 0 {
+		op, verb = "del", "Deleting"
+	} else if msg.TargetKey != "" {
+		// Drop whatever the key held before it became an alias.
+		op, verb = "del", "Deleting alias"
+	} else if maxCacheableSize > 0 && len(msg.Value) > maxCacheableSize {
+		// Too large to cache: drop any older value so reads go to CockroachDB.
+		cacheSkippedOversize.Add(1)
+		op, verb = "del", "Deleting oversized"
+	}
+	if _, ok := redisClient.(*redis.ClusterClient); ok {
+		// The script touches the key and two shared hashes, which Redis
+		// Cluster only allows when they share a hash slot.
+		applyChangeNonAtomic(msg, cacheKey, updated, op == "del", expiry)
+		return
+	}
+	expiryMillis := int64(0)
+	if expiry > 0 {
+		expiryMillis = max(expiry.Milliseconds(), 1)
+	}
+	applied, err := applyChangeScript.Run(ctx, redisClient,
+		[]string{cacheKey, appliedTimestampsKey(), versionsHashKey()},
+		updated, op, msg.Value, msg.Version, expiryMillis).Int()
+	if err != nil {
+		redisErrors.Add(1)
+		errorf("Failed to apply change for key '%s' to Redis: %v", cacheKey, err)
+		return
+	}
+	if applied == 0 {
+		eventsSkipped.Add(1)
+		debugf("CDC Event: Skipping key '%s' at %s (an equal or newer event was already applied).", cacheKey, updated)
+		return
+	}
+	eventsApplied.Add(1)
+	debugf("CDC Event: %s key '%s' in Redis (origin %s).", verb, cacheKey, originOrUnknown(msg.OriginRegion))
+	publishChange(msg)
+	notifyWebhooks(msg)
+}
+
+// applyChangeNonAtomic is applyChange for Redis Cluster: the timestamp check
+// and the write are separate round trips, so two hydrators racing on the same
+// key can still apply an older event last.
+func applyChangeNonAtomic(msg ChangefeedMessage, cacheKey, updated string, del bool, expiry time.Duration) {
+	if updated != "" {
+		applied, err := redisClient.HGet(ctx, appliedTimestampsKey(), cacheKey).Result()
+		if err != nil && err != redis.Nil {
+			redisErrors.Add(1)
+			errorf("Failed to read applied timestamp for key '%s': %v", cacheKey, err)
+			return
+		}
+		if err == nil && compareHLC(updated, applied) <= 0 {
+			eventsSkipped.Add(1)
+			debugf("CDC Event: Skipping key '%s' at %s (already applied %s).", cacheKey, updated, applied)
+			return
+		}
+	}
+
+	err := cacheTx(func(pipe redis.Pipeliner) error {
+		if del {
+			debugf("CDC Event: Deleting key '%s' from Redis (origin %s).", cacheKey, originOrUnknown(msg.OriginRegion))
+			pipe.Del(ctx, cacheKey)
+			pipe.HDel(ctx, versionsHashKey(), cacheKey)
+		} else {
+			debugf("CDC Event: Setting key '%s' in Redis (origin %s).", cacheKey, originOrUnknown(msg.OriginRegion))
+			pipe.Set(ctx, cacheKey, msg.Value, expiry)
+			pipe.HSet(ctx, versionsHashKey(), cacheKey, msg.Version)
+		}
+		if updated != "" {
+			pipe.HSet(ctx, appliedTimestampsKey(), cacheKey, updated)
+		}
+		return nil
+	})
+	if err != nil {
+		redisErrors.Add(1)
+		errorf("Failed to apply change for key '%s' to Redis: %v", cacheKey, err)
+		return
+	}
+	eventsApplied.Add(1)
+	publishChange(msg)
+	notifyWebhooks(msg)
+}
+
+// changesChannel is the Redis Pub/Sub channel applied changes are published
+// on. Servers relay it to /kv/_watch streams.
+func changesChannel() string {
+	return redisKeyPrefix + "kv:changes"
+}
+
+// publishChange announces an event that was just applied to the cache.
+// Skipped duplicates are not published, so watchers see each write once per
+// region. Pub/Sub is fire-and-forget: a failure only costs live watchers the
+// change, and they resynchronize when they reconnect.
+func publishChange(msg ChangefeedMessage) {
+	payload, err := json.Marshal(msg)
+	if err == nil {
+		err = redisClient.Publish(ctx, changesChannel(), payload).Err()
+	}
+	if err != nil {
+		redisErrors.Add(1)
+		warnf("Failed to publish change for key '%s': %v", msg.Key, err)
+	}
+}
+
+// originOrUnknown labels events written before origin regions were recorded.
+func originOrUnknown(region string) string {
+	if region == "" {
+		return "unknown"
+	}
+	return region
+}
+
+// --- Health Endpoints ---
+func startHealthServer(port string, maxLag time.Duration) {
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		lag, ok := changefeedLag()
+		switch {
+		case !changefeedRunning.Load():
+			http.Error(w, "changefeed is not running", http.StatusServiceUnavailable)
+		case !ok:
+			http.Error(w, "no resolved timestamp received yet", http.StatusServiceUnavailable)
+		case lag > maxLag:
+			http.Error(w, fmt.Sprintf("changefeed lag %v exceeds threshold %v", lag.Round(time.Millisecond), maxLag), http.StatusServiceUnavailable)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resolvedWatermark(maxLag))
+		}
+	})
+	http.HandleFunc("/lag", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resolvedWatermark(maxLag))
+	})
+	go func() {
+		log.Printf("Hydrator health server listening on port :%s", port)
+		if err := http.ListenAndServe(":"+port, nil); err != nil {
+			log.Fatalf("Health server failed to start: %v", err)
+		}
+	}()
+}
+
+// logSummaryPeriodically emits, on every tick, the events handled since the
+// previous tick and the current changefeed lag. The summary is a warning
+// when the lag exceeds maxLag.
+func logSummaryPeriodically(interval, maxLag time.Duration) {
+	var lastApplied, lastSkipped, lastFailed int64
+	last := time.Now()
+	for now := range time.Tick(interval) {
+		applied, skipped := eventsApplied.Value(), eventsSkipped.Value()
+		failed := eventErrors.Value() + redisErrors.Value()
+		events := (applied - lastApplied) + (skipped - lastSkipped)
+		counts := fmt.Sprintf("events=%d events_per_sec=%.1f applied=%d skipped=%d errors=%d",
+			events, float64(events)/now.Sub(last).Seconds(), applied-lastApplied, skipped-lastSkipped, failed-lastFailed)
+		lastApplied, lastSkipped, lastFailed, last = applied, skipped, failed, now
+
+		lag, ok := changefeedLag()
+		switch {
+		case !changefeedRunning.Load():
+			warnf("changefeed status: %s changefeed=not_running restarts=%d", counts, changefeedRestarts.Value())
+		case !ok:
+			infof("changefeed status: %s lag_seconds=unknown resolved=none", counts)
+		case lag > maxLag:
+			warnf("changefeed status: %s lag_seconds=%.3f resolved=%s (exceeds %v)", counts, lag.Seconds(), time.Unix(0, lastResolvedNanos.Load()).UTC().Format(time.RFC3339Nano), maxLag)
+		default:
+			infof("changefeed status: %s lag_seconds=%.3f resolved=%s", counts, lag.Seconds(), time.Unix(0, lastResolvedNanos.Load()).UTC().Format(time.RFC3339Nano))
+		}
+	}
+}
+
+// changefeedStatement builds the CREATE CHANGEFEED statement. A zero
+// resolvedInterval or minCheckpointFrequency keeps CockroachDB's default.
+func changefeedStatement(envelope string, resolvedInterval, minCheckpointFrequency time.Duration, cursor string) string {
+	options := []string{"updated", "resolved"}
+	if resolvedInterval > 0 {
+		options[1] = fmt.Sprintf("resolved = '%s'", resolvedInterval)
+	}
+	if minCheckpointFrequency > 0 {
+		options = append(options, fmt.Sprintf("min_checkpoint_frequency = '%s'", minCheckpointFrequency))
+	}
+	if cursor != "" {
+		options = append(options, fmt.Sprintf("cursor = '%s'", cursor))
+	}
+	options = append(options, "format = json", "envelope = "+envelope)
+	return "CREATE CHANGEFEED FOR TABLE " + logTable + " WITH " + strings.Join(options, ", ")
+}
+
+// databaseURLFromEnv returns DATABASE_URL or, when it is unset, assembles
+// one from the same DB_* variables and defaults as the server. DB_HOST has no
+// default here. The user and password are URL-escaped.
+func databaseURLFromEnv() (string, error) {
+	if dsn := os.Getenv("DATABASE_URL"); dsn != "" {
+		return dsn, nil
+	}
+	host := os.Getenv("DB_HOST")
+	if host == "" {
+		return "", errors.New("neither DATABASE_URL nor DB_HOST is set")
+	}
+	port := cmp.Or(os.Getenv("DB_PORT"), "26257")
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("DB_PORT %q is not a valid port", port)
+	}
+	sslMode := cmp.Or(os.Getenv("DB_SSLMODE"), "disable")
+	switch sslMode {
+	case "disable", "require", "verify-ca", "verify-full":
+	default:
+		return "", fmt.Errorf("DB_SSLMODE %q is not one of disable, require, verify-ca or verify-full", sslMode)
+	}
+	user := cmp.Or(os.Getenv("DB_USER"), "root")
+	u := url.URL{
+		Scheme: "postgresql",
+		User:   url.User(user),
+		Host:   net.JoinHostPort(host, port),
+		Path:   "/" + cmp.Or(os.Getenv("DB_NAME"), "defaultdb"),
+	}
+	if password := os.Getenv("DB_PASSWORD"); password != "" {
+		u.User = url.UserPassword(user, password)
+	}
+	query := url.Values{"sslmode": {sslMode}}
+	if rootCert := os.Getenv("DB_SSLROOTCERT"); rootCert != "" {
+		query.Set("sslrootcert", rootCert)
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// durationFromEnv reads a Go duration string from the environment, falling
+// back to def when unset.
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		log.Fatalf("Invalid %s %q: must be a positive duration", name, raw)
+	}
+	return d
+}
+
+// intFromEnv reads a positive integer from the environment, falling back to
+// def when unset.
+func intFromEnv(name string, def int) int {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n <= 0 {
+		log.Fatalf("Invalid %s %q: must be a positive integer", name, raw)
+	}
+	return n
 }
 
 func main() {
-	dbURL := os.Getenv("DATABASE_URL")
-	if dbURL == "" {
-		log.Fatal("DATABASE_URL environment variable is not set")
+	level, err := parseLogLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		log.Fatalf("Invalid LOG_LEVEL: %v", err)
+	}
+	minLogLevel = level
+
+	dbURL, err := databaseURLFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid database settings: %v", err)
 	}
 	redisURL := os.Getenv("REDIS_URL")
 	if redisURL == "" {
-		log.Fatal("REDIS_URL environment variable is not set")
+		if os.Getenv("REDIS_HOST") == "" {
+			log.Fatal("Neither REDIS_URL nor REDIS_HOST is set")
+		}
+		redisURL = net.JoinHostPort(os.Getenv("REDIS_HOST"), cmp.Or(os.Getenv("REDIS_PORT"), "6379"))
+	}
+	redisDB, err := strconv.Atoi(cmp.Or(os.Getenv("REDIS_DB"), "0"))
+	if err != nil || redisDB < 0 {
+		log.Fatalf("Invalid REDIS_DB %q: must be a non-negative integer", os.Getenv("REDIS_DB"))
+	}
+	redisConn := redisConnOptions{Password: os.Getenv("REDIS_PASSWORD"), DB: redisDB}
+	if tlsEnv := os.Getenv("REDIS_TLS"); tlsEnv != "" {
+		useTLS, err := strconv.ParseBool(tlsEnv)
+		if err != nil {
+			log.Fatalf("Invalid REDIS_TLS %q: must be a boolean", tlsEnv)
+		}
+		if useTLS {
+			redisConn.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+	}
+	healthPort := os.Getenv("HEALTH_PORT")
+	if healthPort == "" {
+		healthPort = "8090"
+	}
+	maxLag := durationFromEnv("MAX_CHANGEFEED_LAG", 2*time.Minute)
+	summaryInterval := durationFromEnv("LAG_LOG_INTERVAL", 30*time.Second)
+	resolvedInterval := durationFromEnv("CHANGEFEED_RESOLVED_INTERVAL", 0)
+	minCheckpointFrequency := durationFromEnv("CHANGEFEED_MIN_CHECKPOINT_FREQUENCY", 0)
+	if resolvedInterval > 0 && minCheckpointFrequency > resolvedInterval {
+		log.Fatalf("CHANGEFEED_RESOLVED_INTERVAL (%v) must not be shorter than CHANGEFEED_MIN_CHECKPOINT_FREQUENCY (%v)", resolvedInterval, minCheckpointFrequency)
+	}
+	envelope := cmp.Or(os.Getenv("CHANGEFEED_ENVELOPE"), envelopeWrapped)
+	if envelope != envelopeWrapped && envelope != envelopeBare {
+		log.Fatalf("Invalid CHANGEFEED_ENVELOPE %q: must be %s or %s", envelope, envelopeWrapped, envelopeBare)
+	}
+	switch storageMode := cmp.Or(os.Getenv("STORAGE_MODE"), "log"); storageMode {
+	case "log":
+	case "upsert":
+		logTable = "kv_current"
+	default:
+		log.Fatalf("Invalid STORAGE_MODE %q: must be log or upsert", storageMode)
+	}
+	partitions, err = parseKeyPartitions(os.Getenv("KEY_PREFIX_FILTER"), os.Getenv("KEY_PREFIX_PARTITIONS"))
+	if err != nil {
+		log.Fatalf("Invalid key partitioning: %v", err)
+	}
+	if partitions != nil {
+		log.Printf("Applying only keys of partition %q (of %d prefixes).", partitions.shard, len(partitions.prefixes))
 	}
 
-	redisClient = redis.NewClient(&redis.Options{Addr: redisURL})
-	if _, err := redisClient.Ping(ctx).Result(); err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+	startHealthServer(healthPort, maxLag)
+	go logSummaryPeriodically(summaryInterval, maxLag)
+
+	redisKeyPrefix = os.Getenv("REDIS_KEY_PREFIX")
+	maxCacheableSize = intFromEnv("MAX_CACHEABLE_SIZE", 0)
+	connectRedis(redisURL, os.Getenv("REDIS_MASTER_NAME"), redisConn)
+
+	endpoints, err := parseWebhooks(os.Getenv("WEBHOOKS"))
+	if err != nil {
+		log.Fatalf("Invalid WEBHOOKS: %v", err)
 	}
-	log.Println("Cache Hydrator connected to Redis.")
+	startWebhooks(endpoints, webhookSettings{
+		queueSize:      intFromEnv("WEBHOOK_QUEUE_SIZE", 1000),
+		maxAttempts:    intFromEnv("WEBHOOK_MAX_ATTEMPTS", 5),
+		timeout:        durationFromEnv("WEBHOOK_TIMEOUT", 5*time.Second),
+		deadLetterSize: int64(intFromEnv("WEBHOOK_DEAD_LETTER_SIZE", 1000)),
+	})
 
 	var db *sql.DB
-	var err error
 	maxRetries := 10
 	retryDelay := 2 * time.Second
 
@@ -68,21 +849,17 @@ func main() {
 	}
 	defer db.Close()
 
-	// Hydrator is now responsible for creating the table
-	createTableSQL := `
-    CREATE TABLE IF NOT EXISTS kv_log (
-        id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-        key STRING NOT NULL,
-        value STRING,
-        timestamp TIMESTAMPTZ NOT NULL,
-        deleted BOOL DEFAULT FALSE
-    );
-    CREATE INDEX IF NOT EXISTS idx_key_timestamp ON kv_log (key, timestamp DESC);
-    `
-	if _, err := db.Exec(createTableSQL); err != nil {
-		log.Fatalf("Failed to create kv_log table in CockroachDB: %v", err)
-	}
-	log.Println("Table 'kv_log' ensured to exist.")
+	// The server runs the same migrations; whichever binary starts first
+	// applies them.
+	if err := migrations.Run(ctx, db); err != nil {
+		log.Fatalf("Failed to migrate the CockroachDB schema: %v", err)
+	}
+	log.Println("CockroachDB schema is up to date.")
+
+	regions := parseRegions(os.Getenv("DB_REGIONS"))
+	if err := configureLocality(db, regions, os.Getenv("TABLE_LOCALITY")); err != nil {
+		log.Fatalf("Failed to configure multi-region locality: %v", err)
+	}
 
 	log.Println("Ensuring kv.rangefeed.enabled is set to true...")
 	_, err = db.Exec("SET CLUSTER SETTING kv.rangefeed.enabled = true;")
@@ -90,14 +867,117 @@ func main() {
 		log.Printf("Could not enable kv.rangefeed.enabled (might already be set): %v", err)
 	}
 
-	changefeedQuery := `CREATE CHANGEFEED FOR TABLE kv_log WITH updated, resolved, format = json, envelope = wrapped`
+	superviseChangefeed(db, envelope, resolvedInterval, minCheckpointFrequency)
+}
+
+// --- Changefeed Supervision ---
+//
+// A core changefeed ends whenever its connection or the job hits an error,
+// and the cache would silently go stale. The hydrator therefore re-creates it
+// with backoff, resuming from the last resolved timestamp, which it persists
+// in Redis. Events between that timestamp and the failure are delivered
+// again; the applied-timestamp check makes replaying them harmless.
+
+var (
+	changefeedRestarts = expvar.NewInt("changefeed_restarts_total")
+	// changefeedRunning is false while the changefeed is being (re)created;
+	// /readyz fails meanwhile.
+	changefeedRunning atomic.Bool
+)
+
+// cursorKey holds the newest resolved HLC timestamp, the changefeed cursor.
+func cursorKey() string {
+	return redisKeyPrefix + "hydrator:cursor"
+}
+
+// cursorsKey is a hash holding the cursors of partitioned hydrators, one
+// field per shard, so hydrators owning different keys never resume from each
+// other's position.
+func cursorsKey() string {
+	return redisKeyPrefix + "hydrator:cursors"
+}
+
+// loadCursor reads this hydrator's cursor, "" when there is none.
+func loadCursor() (string, error) {
+	var cursor string
+	var err error
+	if partitions == nil {
+		cursor, err = redisClient.Get(ctx, cursorKey()).Result()
+	} else {
+		cursor, err = redisClient.HGet(ctx, cursorsKey(), partitions.shard).Result()
+	}
+	if err == redis.Nil {
+		return "", nil
+	}
+	return cursor, err
+}
 
-	log.Println("Starting CockroachDB changefeed...")
-	rows, err := db.Query(changefeedQuery)
+// saveCursor persists this hydrator's cursor.
+func saveCursor(cursor string) error {
+	if partitions == nil {
+		return redisClient.Set(ctx, cursorKey(), cursor, 0).Err()
+	}
+	return redisClient.HSet(ctx, cursorsKey(), partitions.shard, cursor).Err()
+}
+
+// discardCursor removes this hydrator's cursor.
+func discardCursor() error {
+	if partitions == nil {
+		return redisClient.Del(ctx, cursorKey()).Err()
+	}
+	return redisClient.HDel(ctx, cursorsKey(), partitions.shard).Err()
+}
+
+// superviseChangefeed runs the changefeed forever, restarting it with
+// exponential backoff whenever it ends. A feed that ran for longer than the
+// maximum backoff resets the delay.
+func superviseChangefeed(db *sql.DB, envelope string, resolvedInterval, minCheckpointFrequency time.Duration) {
+	const minDelay, maxDelay = time.Second, 30 * time.Second
+	delay := minDelay
+	for {
+		cursor, err := loadCursor()
+		if err != nil {
+			redisErrors.Add(1)
+			warnf("Could not read changefeed cursor, starting without one: %v", err)
+		}
+		started := time.Now()
+		err = runChangefeed(db, envelope, changefeedStatement(envelope, resolvedInterval, minCheckpointFrequency, cursor))
+		if cursor != "" && isCursorTooOld(err) {
+			// Rows older than the GC threshold are gone, so the feed cannot
+			// resume; a fresh feed rescans the whole table instead.
+			warnf("Changefeed cursor %s is past the GC threshold; discarding it and rescanning %s.", cursor, logTable)
+			if err := discardCursor(); err != nil {
+				redisErrors.Add(1)
+				errorf("Failed to discard changefeed cursor: %v", err)
+			}
+		}
+		if time.Since(started) > maxDelay {
+			delay = minDelay
+		}
+		changefeedRestarts.Add(1)
+		errorf("Changefeed ended (%v); restarting in %v.", err, delay)
+		time.Sleep(delay)
+		delay = min(delay*2, maxDelay)
+	}
+}
+
+// isCursorTooOld reports whether a changefeed was rejected because its
+// cursor precedes the table's garbage collection threshold.
+func isCursorTooOld(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "GC threshold")
+}
+
+// runChangefeed creates a changefeed with statement and applies its events,
+// parsed as envelope, until it ends, returning why.
+func runChangefeed(db *sql.DB, envelope, statement string) error {
+	infof("Starting CockroachDB changefeed: %s", statement)
+	rows, err := db.Query(statement)
 	if err != nil {
-		log.Fatalf("Failed to create changefeed: %v", err)
+		return fmt.Errorf("create changefeed: %w", err)
 	}
 	defer rows.Close()
+	changefeedRunning.Store(true)
+	defer changefeedRunning.Store(false)
 
 	for rows.Next() {
 		var topic sql.NullString
@@ -105,7 +985,8 @@ func main() {
 		var value sql.NullString
 
 		if err := rows.Scan(&topic, &key, &value); err != nil {
-			log.Printf("Error scanning changefeed row: %v", err)
+			eventErrors.Add(1)
+			errorf("Failed to scan changefeed row: %v", err)
 			continue
 		}
 
@@ -113,22 +994,54 @@ func main() {
 			continue
 		}
 
-		var wrappedMsg WrappedChangefeedMessage
-		// Unmarshal into the wrapper struct to handle the nested "after" field
-		if err := json.Unmarshal([]byte(value.String), &wrappedMsg); err != nil {
-			log.Printf("Error unmarshaling changefeed message: %v", err)
+		event, err := parseChangefeedValue(envelope, []byte(value.String))
+		if err != nil {
+			eventErrors.Add(1)
+			errorf("Failed to unmarshal changefeed message: %v", err)
 			continue
 		}
 
-		// Use the nested 'After' field which contains the actual row data
-		msg := wrappedMsg.After
+		if event.Resolved != "" {
+			ts, err := parseHLCTimestamp(event.Resolved)
+			if err != nil {
+				eventErrors.Add(1)
+				errorf("Failed to parse resolved timestamp: %v", err)
+				continue
+			}
+			recordResolved(event.Resolved, ts)
+			if err := saveCursor(event.Resolved); err != nil {
+				redisErrors.Add(1)
+				errorf("Failed to persist changefeed cursor %s: %v", event.Resolved, err)
+			}
+			continue
+		}
 
-		if msg.Deleted {
-			log.Printf("CDC Event: Deleting key '%s' from Redis.", msg.Key)
-			redisClient.Del(ctx, msg.Key)
-		} else {
-			log.Printf("CDC Event: Setting key '%s' in Redis.", msg.Key)
-			redisClient.Set(ctx, msg.Key, msg.Value, 0)
+		row, err := changedRow(event, key.String)
+		if err != nil {
+			eventErrors.Add(1)
+			errorf("Ignoring removal of %s row at %s: %v", logTable, event.Updated, err)
+			continue
 		}
+		if row == nil {
+			// A pruned old version; the key's latest entry is unaffected.
+			debugf("CDC Event: Ignoring removal of kv_log row %s (a pruned old version).", key.String)
+			continue
+		}
+		event.Row = row
+		if event.Row.Key == "" {
+			// Every kv_log row has a key; never touch the cache without one.
+			eventErrors.Add(1)
+			errorf("Ignoring changefeed row %s without a key at %s.", key.String, event.Updated)
+			continue
+		}
+		if !partitions.owns(qualifiedKey(event.Row.Namespace, event.Row.Key)) {
+			eventsNotOwned.Add(1)
+			continue
+		}
+		applyChange(*event.Row, event.Updated)
+	}
+	if err := rows.Err(); err != nil {
+		return err
 	}
+	return errors.New("changefeed closed")
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// --- Changefeed Envelopes ---
+//
+// CHANGEFEED_ENVELOPE selects how the changefeed wraps each kv_log row.
+//
+// wrapped (the default) nests the row under "after", with the MVCC timestamp
+// beside it and resolved timestamps in a message of their own:
+//
+//	{"after": {"namespace": "default", "key": "a", "value": "1", "deleted": false, ...}, "updated": "1718000000000000000.0000000000"}
+//	{"after": null, "updated": "1718000000000000000.0000000000"}
+//	{"resolved": "1718000000000000000.0000000000"}
+//
+// bare puts the row's columns at the top level and CockroachDB's metadata
+// under "__crdb__":
+//
+//	{"namespace": "default", "key": "a", "value": "1", "deleted": false, ..., "__crdb__": {"updated": "1718000000000000000.0000000000"}}
+//	{"__crdb__": {"resolved": "1718000000000000000.0000000000"}}
+//
+// A write, including a DELETE, always writes a row; a DELETE's row has
+// deleted set. A message without a row (after is null, or a bare message
+// with no columns) means a row was removed. From kv_log that only happens
+// when old versions are pruned, so it never deletes the cached value, and
+// the changefeed's key, kv_log's primary key, is only a row id. kv_current
+// holds one row per key under the primary key (namespace, key), so a removed
+// row is a removed key: its cache key is decoded from the changefeed's key,
+// a JSON array such as ["default", "a"], and the key is deleted like a
+// tombstone.
+
+const (
+	envelopeWrapped = "wrapped"
+	envelopeBare    = "bare"
+)
+
+// changefeedEvent is one changefeed message, whatever its envelope. Exactly
+// one of Resolved and Row is set, or neither for a removed row.
+type changefeedEvent struct {
+	Row      *ChangefeedMessage
+	Updated  string
+	Resolved string
+}
+
+// WrappedChangefeedMessage is a message of the wrapped envelope.
+type WrappedChangefeedMessage struct {
+	After    *ChangefeedMessage `json:"after"`
+	Updated  string             `json:"updated"`
+	Resolved string             `json:"resolved"`
+}
+
+// BareChangefeedMessage is a message of the bare envelope. The embedded row
+// stays nil unless the message has at least one column.
+type BareChangefeedMessage struct {
+	*ChangefeedMessage
+	CRDB struct {
+		Updated  string `json:"updated"`
+		Resolved string `json:"resolved"`
+	} `json:"__crdb__"`
+}
+
+// parseChangefeedValue decodes the value column of a changefeed row.
+func parseChangefeedValue(envelope string, value []byte) (changefeedEvent, error) {
+	if envelope == envelopeBare {
+		var msg BareChangefeedMessage
+		if err := json.Unmarshal(value, &msg); err != nil {
+			return changefeedEvent{}, err
+		}
+		event := changefeedEvent{Updated: msg.CRDB.Updated, Resolved: msg.CRDB.Resolved}
+		if event.Resolved == "" && msg.ChangefeedMessage != nil && msg.Key != "" {
+			event.Row = msg.ChangefeedMessage
+		}
+		return event, nil
+	}
+	var msg WrappedChangefeedMessage
+	if err := json.Unmarshal(value, &msg); err != nil {
+		return changefeedEvent{}, err
+	}
+	event := changefeedEvent{Updated: msg.Updated, Resolved: msg.Resolved}
+	if event.Resolved == "" {
+		event.Row = msg.After
+	}
+	return event, nil
+}
+
+// changedRow returns the row a changefeed event applies to the cache: the
+// event's own row, or for a removed kv_current row the tombstone of its key,
+// decoded from key, the changefeed's primary key. It returns nil for a
+// removed kv_log row, whose key is only a row id.
+func changedRow(event changefeedEvent, key string) (*ChangefeedMessage, error) {
+	if event.Row != nil {
+		return event.Row, nil
+	}
+	if logTable != "kv_current" {
+		return nil, nil
+	}
+	return removedRow(key)
+}
+
+// removedRow returns the tombstone of the key whose kv_current row was
+// removed, decoding it from key, the changefeed's JSON-array primary key.
+func removedRow(key string) (*ChangefeedMessage, error) {
+	var columns []string
+	if err := json.Unmarshal([]byte(key), &columns); err != nil {
+		return nil, fmt.Errorf("decode changefeed key %s: %w", key, err)
+	}
+	if len(columns) != 2 || columns[1] == "" {
+		return nil, fmt.Errorf("changefeed key %s is not [namespace, key]", key)
+	}
+	return &ChangefeedMessage{Namespace: columns[0], Key: columns[1], Deleted: true}, nil
+}
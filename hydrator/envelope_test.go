@@ -0,0 +1,80 @@
+package main
+
+import "testing"
+
+// nullAfter is a removed row in each envelope.
+var nullAfter = map[string]string{
+	envelopeWrapped: `{"after": null, "updated": "1718000000000000000.0000000001"}`,
+	envelopeBare:    `{"__crdb__": {"updated": "1718000000000000000.0000000001"}}`,
+}
+
+// withLogTable runs f with the changefeed watching table.
+func withLogTable(t *testing.T, table string, f func()) {
+	t.Helper()
+	previous := logTable
+	logTable = table
+	defer func() { logTable = previous }()
+	f()
+}
+
+func TestRemovedCurrentRowDeletesItsKey(t *testing.T) {
+	withLogTable(t, "kv_current", func() {
+		for envelope, value := range nullAfter {
+			event, err := parseChangefeedValue(envelope, []byte(value))
+			if err != nil {
+				t.Fatalf("%s: parse: %v", envelope, err)
+			}
+			row, err := changedRow(event, `["orders", "order/42"]`)
+			if err != nil {
+				t.Fatalf("%s: changedRow: %v", envelope, err)
+			}
+			if row == nil || row.Namespace != "orders" || row.Key != "order/42" || !row.Deleted {
+				t.Errorf("%s: got %+v; want a tombstone of orders/order/42", envelope, row)
+			}
+		}
+	})
+}
+
+func TestRemovedLogRowIsIgnored(t *testing.T) {
+	withLogTable(t, "kv_log", func() {
+		for envelope, value := range nullAfter {
+			event, err := parseChangefeedValue(envelope, []byte(value))
+			if err != nil {
+				t.Fatalf("%s: parse: %v", envelope, err)
+			}
+			row, err := changedRow(event, `["4f1c2a9e-0000-4000-8000-000000000000"]`)
+			if row != nil || err != nil {
+				t.Errorf("%s: got %+v, %v; want the pruned version ignored", envelope, row, err)
+			}
+		}
+	})
+}
+
+func TestWrittenRowIsApplied(t *testing.T) {
+	for _, table := range []string{"kv_log", "kv_current"} {
+		withLogTable(t, table, func() {
+			event, err := parseChangefeedValue(envelopeWrapped, []byte(`{"after": {"namespace": "default", "key": "a", "value": "1"}, "updated": "1718000000000000000.0000000001"}`))
+			if err != nil {
+				t.Fatalf("%s: parse: %v", table, err)
+			}
+			row, err := changedRow(event, `["default", "a"]`)
+			if err != nil || row != event.Row {
+				t.Errorf("%s: got %+v, %v; want the event's own row", table, row, err)
+			}
+		})
+	}
+}
+
+func TestRemovedRowRejectsOtherKeys(t *testing.T) {
+	for _, key := range []string{
+		`["4f1c2a9e-0000-4000-8000-000000000000"]`, // a kv_log row id
+		`["default"]`,
+		`["default", ""]`,
+		`["default", "a", "b"]`,
+		`not json`,
+	} {
+		if row, err := removedRow(key); err == nil {
+			t.Errorf("removedRow(%s) = %+v; want an error", key, row)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// --- Key Partitioning ---
+//
+// Several hydrators can split one changefeed's cache updates between them.
+// Every hydrator is given the same KEY_PREFIX_PARTITIONS, a comma-separated
+// list of key prefixes, and KEY_PREFIX_FILTER, the ones among them it owns.
+// A key belongs to the longest partition prefix it starts with, or to the
+// remainder when it starts with none, and only the remainder's hydrator, the
+// one with KEY_PREFIX_FILTER unset, applies those. Since every hydrator maps
+// a key to the same partition, each event is applied by exactly one of them
+// as long as every partition, the remainder included, is owned by exactly one
+// hydrator. Prefixes are matched against the cache key before
+// REDIS_KEY_PREFIX, so "orders/" selects the orders namespace.
+//
+// Every hydrator still reads the whole changefeed and skips the events it
+// does not own: CDC queries (AS SELECT ... WHERE) would filter in
+// CockroachDB, but are not available on every version the hydrator runs
+// against. Each partition keeps its own cursor; see loadCursor.
+
+// remainderShard names the partition of keys no prefix matches.
+const remainderShard = "*"
+
+// keyPartitions is the parsed KEY_PREFIX_PARTITIONS and KEY_PREFIX_FILTER.
+type keyPartitions struct {
+	// prefixes holds every partition's prefix, longest first.
+	prefixes []string
+	owned    map[string]bool
+	// shard names this hydrator's share, for its cursor: the owned prefixes
+	// in order, or remainderShard.
+	shard string
+}
+
+// partitions is nil unless KEY_PREFIX_PARTITIONS is set, in which case the
+// hydrator applies only the keys it owns.
+var partitions *keyPartitions
+
+// parseKeyPartitions parses the two variables. Both unset returns nil; the
+// hydrator then owns every key.
+func parseKeyPartitions(filterRaw, partitionsRaw string) (*keyPartitions, error) {
+	all := splitPrefixes(partitionsRaw)
+	filter := splitPrefixes(filterRaw)
+	if len(all) == 0 {
+		if len(filter) > 0 {
+			return nil, fmt.Errorf("KEY_PREFIX_FILTER requires KEY_PREFIX_PARTITIONS listing every hydrator's prefixes")
+		}
+		return nil, nil
+	}
+	p := &keyPartitions{owned: make(map[string]bool), shard: remainderShard}
+	for _, prefix := range all {
+		if prefix == "" {
+			return nil, fmt.Errorf("KEY_PREFIX_PARTITIONS has an empty prefix")
+		}
+		if slices.Contains(p.prefixes, prefix) {
+			return nil, fmt.Errorf("KEY_PREFIX_PARTITIONS lists %q twice", prefix)
+		}
+		p.prefixes = append(p.prefixes, prefix)
+	}
+	slices.SortStableFunc(p.prefixes, func(a, b string) int { return len(b) - len(a) })
+	for _, prefix := range filter {
+		if !slices.Contains(p.prefixes, prefix) {
+			return nil, fmt.Errorf("KEY_PREFIX_FILTER prefix %q is not in KEY_PREFIX_PARTITIONS", prefix)
+		}
+		p.owned[prefix] = true
+	}
+	if len(filter) > 0 {
+		p.shard = strings.Join(slices.Sorted(maps.Keys(p.owned)), ",")
+	}
+	return p, nil
+}
+
+// splitPrefixes splits a comma-separated list, dropping surrounding spaces.
+func splitPrefixes(raw string) []string {
+	if strings.TrimSpace(raw) == "" {
+		return nil
+	}
+	var prefixes []string
+	for _, prefix := range strings.Split(raw, ",") {
+		prefixes = append(prefixes, strings.TrimSpace(prefix))
+	}
+	return prefixes
+}
+
+// partitionOf returns the prefix of the partition key belongs to, or "" for
+// the remainder.
+func (p *keyPartitions) partitionOf(key string) string {
+	for _, prefix := range p.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return prefix
+		}
+	}
+	return ""
+}
+
+// owns reports whether this hydrator applies changes to the cache key
+// qualified, as qualifiedKey builds it. A nil p owns every key.
+func (p *keyPartitions) owns(qualified string) bool {
+	if p == nil {
+		return true
+	}
+	partition := p.partitionOf(qualified)
+	if partition == "" {
+		return p.shard == remainderShard
+	}
+	return p.owned[partition]
+}
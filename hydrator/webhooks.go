@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Webhooks ---
+//
+// WEBHOOKS configures HTTP endpoints that receive a POST for every change the
+// hydrator applies, so integrations can react to writes without reading Redis
+// or the changefeed themselves. Each endpoint has its own bounded queue and a
+// worker that delivers events in order, retrying failures with exponential
+// backoff. An event that still fails after the last attempt, is rejected with
+// a 4xx, or finds the queue full is pushed to a dead-letter list in Redis
+// instead, so the changefeed never waits for a slow endpoint.
+//
+// Deliveries carry X-Webhook-Timestamp and X-Webhook-Signature, the hex
+// HMAC-SHA256 of "<timestamp>.<body>" keyed with the endpoint's secret.
+// Delivery is at-least-once: a changefeed replay after a restart is filtered
+// by the applied-timestamp check, but a retried POST may reach the receiver
+// twice.
+
+// webhookEndpoint is one entry of WEBHOOKS.
+type webhookEndpoint struct {
+	URL string `json:"url"`
+	// Namespace and Prefix select the keys whose changes are delivered;
+	// empty means all.
+	Namespace string `json:"namespace"`
+	Prefix    string `json:"prefix"`
+	// Secret keys the signature header. Without it, no signature is sent.
+	Secret string `json:"secret"`
+}
+
+// webhookSettings are the delivery limits shared by every endpoint.
+type webhookSettings struct {
+	queueSize      int
+	maxAttempts    int
+	timeout        time.Duration
+	deadLetterSize int64
+}
+
+// webhook delivers events to one endpoint from its queue.
+type webhook struct {
+	endpoint webhookEndpoint
+	settings webhookSettings
+	client   *http.Client
+	queue    chan webhookDelivery
+}
+
+// webhookDelivery is one event waiting to be delivered.
+type webhookDelivery struct {
+	payload []byte
+	key     string
+}
+
+// deadLetter is the record kept for a delivery that was given up on.
+type deadLetter struct {
+	URL      string          `json:"url"`
+	Payload  json.RawMessage `json:"payload"`
+	Error    string          `json:"error"`
+	Attempts int             `json:"attempts"`
+	FailedAt time.Time       `json:"failed_at"`
+}
+
+const (
+	webhookMinBackoff = time.Second
+	webhookMaxBackoff = 30 * time.Second
+)
+
+var (
+	webhooks []*webhook
+
+	webhookDeliveries   = expvar.NewInt("webhook_deliveries_total")
+	webhookFailures     = expvar.NewInt("webhook_delivery_failures_total")
+	webhookDeadLettered = expvar.NewInt("webhook_dead_letters_total")
+)
+
+func init() {
+	expvar.Publish("webhook_queue_depth", expvar.Func(func() any {
+		depth := 0
+		for _, h := range webhooks {
+			depth += len(h.queue)
+		}
+		return depth
+	}))
+}
+
+// deadLetterKey is the Redis list holding given-up deliveries, newest first.
+func deadLetterKey() string {
+	return redisKeyPrefix + "hydrator:webhooks:dead"
+}
+
+// parseWebhooks parses the JSON array of WEBHOOKS.
+func parseWebhooks(raw string) ([]webhookEndpoint, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var endpoints []webhookEndpoint
+	if err := json.Unmarshal([]byte(raw), &endpoints); err != nil {
+		return nil, fmt.Errorf("must be a JSON array of endpoints: %w", err)
+	}
+	for i, e := range endpoints {
+		u, err := url.Parse(e.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("endpoint %d: url %q must be an absolute http or https URL", i, e.URL)
+		}
+	}
+	return endpoints, nil
+}
+
+// startWebhooks starts a delivery worker per endpoint.
+func startWebhooks(endpoints []webhookEndpoint, settings webhookSettings) {
+	for _, e := range endpoints {
+		h := &webhook{
+			endpoint: e,
+			settings: settings,
+			client:   &http.Client{Timeout: settings.timeout},
+			queue:    make(chan webhookDelivery, settings.queueSize),
+		}
+		webhooks = append(webhooks, h)
+		go h.run()
+		infof("Webhook enabled: %s (namespace %q, prefix %q, signed=%t)", redactURL(e.URL), e.Namespace, e.Prefix, e.Secret != "")
+	}
+}
+
+// notifyWebhooks queues msg for every endpoint whose filters it matches. It
+// never blocks: an event that finds a queue full is dead-lettered.
+func notifyWebhooks(msg ChangefeedMessage) {
+	if len(webhooks) == 0 {
+		return
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		errorf("Failed to encode webhook payload for key '%s': %v", msg.Key, err)
+		return
+	}
+	namespace := cmp.Or(msg.Namespace, defaultNamespace)
+	for _, h := range webhooks {
+		if (h.endpoint.Namespace != "" && h.endpoint.Namespace != namespace) || !strings.HasPrefix(msg.Key, h.endpoint.Prefix) {
+			continue
+		}
+		d := webhookDelivery{payload: payload, key: qualifiedKey(namespace, msg.Key)}
+		select {
+		case h.queue <- d:
+		default:
+			h.deadLetter(d, errors.New("delivery queue full"), 0)
+		}
+	}
+}
+
+func (h *webhook) run() {
+	for d := range h.queue {
+		h.deliver(d)
+	}
+}
+
+// deliver POSTs d until it succeeds, is rejected permanently, or runs out of
+// attempts, backing off exponentially between attempts.
+func (h *webhook) deliver(d webhookDelivery) {
+	backoff := webhookMinBackoff
+	for attempt := 1; ; attempt++ {
+		err := h.post(d.payload)
+		if err == nil {
+			webhookDeliveries.Add(1)
+			debugf("Webhook: delivered change of key '%s' to %s.", d.key, redactURL(h.endpoint.URL))
+			return
+		}
+		webhookFailures.Add(1)
+		var permanent *permanentError
+		if errors.As(err, &permanent) || attempt >= h.settings.maxAttempts {
+			h.deadLetter(d, err, attempt)
+			return
+		}
+		warnf("Webhook delivery of key '%s' to %s failed (attempt %d/%d), retrying in %v: %v",
+			d.key, redactURL(h.endpoint.URL), attempt, h.settings.maxAttempts, backoff, err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, webhookMaxBackoff)
+	}
+}
+
+// permanentError is a rejection that retrying cannot fix.
+type permanentError struct{ status int }
+
+func (e *permanentError) Error() string {
+	return fmt.Sprintf("endpoint rejected the event with status %d", e.status)
+}
+
+// post sends one signed delivery. 2xx is success; other 4xx except 408 and
+// 429 are permanent failures; everything else is retried.
+func (h *webhook) post(payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, h.endpoint.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.endpoint.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Webhook-Timestamp", timestamp)
+		req.Header.Set("X-Webhook-Signature", "sha256="+signWebhook(h.endpoint.Secret, timestamp, payload))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		return &permanentError{status: resp.StatusCode}
+	default:
+		return fmt.Errorf("endpoint answered with status %d", resp.StatusCode)
+	}
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "<timestamp>.<payload>".
+func signWebhook(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deadLetter records a delivery that was given up on, keeping the newest
+// deadLetterSize records.
+func (h *webhook) deadLetter(d webhookDelivery, cause error, attempts int) {
+	webhookDeadLettered.Add(1)
+	errorf("Webhook delivery of key '%s' to %s dead-lettered after %d attempt(s): %v", d.key, redactURL(h.endpoint.URL), attempts, cause)
+	record, _ := json.Marshal(deadLetter{
+		URL:      redactURL(h.endpoint.URL),
+		Payload:  d.payload,
+		Error:    cause.Error(),
+		Attempts: attempts,
+		FailedAt: time.Now().UTC(),
+	})
+	err := cacheTx(func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, deadLetterKey(), record)
+		pipe.LTrim(ctx, deadLetterKey(), 0, h.settings.deadLetterSize-1)
+		return nil
+	})
+	if err != nil {
+		redisErrors.Add(1)
+		errorf("Failed to store dead-lettered webhook delivery of key '%s': %v", d.key, err)
+	}
+}
+
+// redactURL hides credentials in an endpoint URL for logs and dead letters.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,295 @@
+// Package migrations owns the CockroachDB schema shared by the server and the
+// hydrator. Both binaries call Run at startup, so the schema no longer
+// depends on which of them reaches an empty database first.
+//
+// Migrations are numbered and applied in order, each in its own
+// transaction together with its row in schema_migrations, so a migration is
+// either recorded as applied or not applied at all. Two binaries starting at
+// once may both run a pending migration; its statements must therefore be
+// idempotent (IF NOT EXISTS, IF EXISTS), and the second insert into
+// schema_migrations is a no-op. CockroachDB cannot index a column in the
+// transaction that adds it, so a column and its index are separate
+// migrations.
+//
+// To change the schema, append a migration with the next number. Never edit
+// or renumber one that has shipped: databases that already applied it will
+// not run it again.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/lib/pq"
+)
+
+// migration is one numbered schema change.
+type migration struct {
+	version    int
+	name       string
+	statements []string
+}
+
+// all lists every migration in order. The first ones reproduce the schema
+// the binaries used to create themselves, so databases created before
+// schema_migrations existed converge on the same definition.
+var all = []migration{
+	{1, "create_kv_log", []string{
+		`CREATE TABLE IF NOT EXISTS kv_log (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            key STRING NOT NULL,
+            value STRING,
+            timestamp TIMESTAMPTZ NOT NULL,
+            deleted BOOL DEFAULT FALSE,
+            FAMILY "primary" (id, key, value, timestamp, deleted)
+        )`,
+		`CREATE INDEX IF NOT EXISTS idx_key_timestamp ON kv_log (key, timestamp DESC)`,
+	}},
+	// Old MVCC versions of kv_log rows are garbage collected after an hour.
+	{2, "kv_log_gc_ttl", []string{
+		`ALTER TABLE kv_log CONFIGURE ZONE USING gc.ttlseconds = 3600`,
+	}},
+	{3, "add_origin_region_version_ttl", []string{
+		`ALTER TABLE kv_log ADD COLUMN IF NOT EXISTS origin_region STRING FAMILY "primary"`,
+		`ALTER TABLE kv_log ADD COLUMN IF NOT EXISTS version INT8 FAMILY "primary"`,
+		`ALTER TABLE kv_log ADD COLUMN IF NOT EXISTS ttl_seconds INT8 FAMILY "primary"`,
+	}},
+	{4, "index_ttl_keys", []string{
+		`CREATE INDEX IF NOT EXISTS idx_ttl_keys ON kv_log (key) WHERE ttl_seconds IS NOT NULL`,
+	}},
+	{5, "add_namespace", []string{
+		`ALTER TABLE kv_log ADD COLUMN IF NOT EXISTS namespace STRING NOT NULL DEFAULT 'default' FAMILY "primary"`,
+	}},
+	// Versions are per key within a namespace; this replaces idx_key_version.
+	{6, "index_namespace_key_version", []string{
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_namespace_key_version ON kv_log (namespace, key, version)`,
+		`DROP INDEX IF EXISTS kv_log@idx_key_version`,
+	}},
+	{7, "add_labels", []string{
+		`ALTER TABLE kv_log ADD COLUMN IF NOT EXISTS labels JSONB FAMILY "primary"`,
+	}},
+	{8, "index_labels", []string{
+		`CREATE INVERTED INDEX IF NOT EXISTS idx_labels ON kv_log (namespace, labels)`,
+	}},
+	{9, "add_hlc", []string{
+		`ALTER TABLE kv_log ADD COLUMN IF NOT EXISTS hlc DECIMAL FAMILY "primary"`,
+	}},
+	// Entries are ordered by commit timestamp; this replaces
+	// idx_namespace_key_timestamp.
+	{10, "index_namespace_key_hlc", []string{
+		`CREATE INDEX IF NOT EXISTS idx_namespace_key_hlc ON kv_log (namespace, key, hlc DESC, timestamp DESC)`,
+		`DROP INDEX IF EXISTS kv_log@idx_namespace_key_timestamp`,
+	}},
+	{11, "create_kv_namespaces", []string{
+		`CREATE TABLE IF NOT EXISTS kv_namespaces (
+            name STRING PRIMARY KEY,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )`,
+	}},
+	{12, "create_kv_schemas", []string{
+		`CREATE TABLE IF NOT EXISTS kv_schemas (
+            namespace STRING NOT NULL,
+            prefix STRING NOT NULL,
+            schema STRING NOT NULL,
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            PRIMARY KEY (namespace, prefix)
+        )`,
+	}},
+	// Responses of writes made with an Idempotency-Key. Rows are expired by
+	// CockroachDB's row-level TTL.
+	{13, "create_request_dedup", []string{
+		`CREATE TABLE IF NOT EXISTS request_dedup (
+            idempotency_key STRING PRIMARY KEY,
+            fingerprint STRING NOT NULL,
+            status INT NOT NULL,
+            response STRING NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        ) WITH (ttl_expire_after = '24 hours')`,
+	}},
+	// The region that alone accepts writes to a key; see server/homeregion.go.
+	{14, "add_home_region", []string{
+		`ALTER TABLE kv_log ADD COLUMN IF NOT EXISTS home_region STRING FAMILY "primary"`,
+	}},
+	// Values written with value_type "number" also store the number, for
+	// range queries; see server/numeric.go.
+	{15, "add_value_type_numeric_value", []string{
+		`ALTER TABLE kv_log ADD COLUMN IF NOT EXISTS value_type STRING FAMILY "primary"`,
+		`ALTER TABLE kv_log ADD COLUMN IF NOT EXISTS numeric_value DECIMAL FAMILY "primary"`,
+	}},
+	{16, "index_namespace_numeric_value", []string{
+		`CREATE INDEX IF NOT EXISTS idx_namespace_numeric_value ON kv_log (namespace, numeric_value, key) WHERE numeric_value IS NOT NULL`,
+	}},
+	// Incremental sync pages through a namespace's log in timestamp order;
+	// see server/changes.go.
+	{17, "index_namespace_timestamp", []string{
+		`CREATE INDEX IF NOT EXISTS idx_namespace_timestamp ON kv_log (namespace, timestamp, id)`,
+	}},
+	// An alias entry names the key it resolves to; see server/aliases.go.
+	{18, "add_target_key", []string{
+		`ALTER TABLE kv_log ADD COLUMN IF NOT EXISTS target_key STRING FAMILY "primary"`,
+	}},
+	// One row per key, replaced on every write, for STORAGE_MODE=upsert; see
+	// server/storage.go. Its columns and indexes mirror kv_log's.
+	{19, "create_kv_current", []string{
+		`CREATE TABLE IF NOT EXISTS kv_current (
+            namespace STRING NOT NULL DEFAULT 'default',
+            key STRING NOT NULL,
+            id UUID NOT NULL DEFAULT gen_random_uuid(),
+            value STRING,
+            timestamp TIMESTAMPTZ NOT NULL,
+            deleted BOOL DEFAULT FALSE,
+            origin_region STRING,
+            version INT8,
+            ttl_seconds INT8,
+            labels JSONB,
+            hlc DECIMAL,
+            home_region STRING,
+            value_type STRING,
+            numeric_value DECIMAL,
+            target_key STRING,
+            PRIMARY KEY (namespace, key),
+            INDEX idx_current_ttl_keys (key) WHERE ttl_seconds IS NOT NULL,
+            INVERTED INDEX idx_current_labels (namespace, labels),
+            INDEX idx_current_namespace_numeric_value (namespace, numeric_value, key) WHERE numeric_value IS NOT NULL,
+            INDEX idx_current_namespace_timestamp (namespace, timestamp, id)
+        )`,
+	}},
+	{20, "kv_current_gc_ttl", []string{
+		`ALTER TABLE kv_current CONFIGURE ZONE USING gc.ttlseconds = 3600`,
+	}},
+	// History is pruned by the server's retention policy (server/retention.go);
+	// the tables fall back to the cluster's GC TTL, which bounds only AS OF
+	// SYSTEM TIME reads and changefeed cursors, never rows.
+	{21, "discard_gc_ttl_zones", []string{
+		`ALTER TABLE kv_log CONFIGURE ZONE DISCARD`,
+		`ALTER TABLE kv_current CONFIGURE ZONE DISCARD`,
+	}},
+	// Live keys and bytes per namespace, kept up to date by every write; see
+	// server/quotas.go. Each namespace's usage is spread over 16 rows by a
+	// hash of the key.
+	{22, "create_namespace_usage", []string{
+		`CREATE TABLE IF NOT EXISTS namespace_usage (
+            namespace STRING NOT NULL,
+            shard INT8 NOT NULL,
+            live_keys INT8 NOT NULL DEFAULT 0,
+            live_bytes INT8 NOT NULL DEFAULT 0,
+            PRIMARY KEY (namespace, shard)
+        )`,
+	}},
+	// Counts what was written before usage was kept. Only one of the tables
+	// has entries, depending on STORAGE_MODE.
+	{23, "backfill_namespace_usage", []string{
+		`INSERT INTO namespace_usage (namespace, shard, live_keys, live_bytes)
+        SELECT namespace, mod(fnv32(key), 16), count(*), sum(octet_length(key) + coalesce(octet_length(value), 0))
+        FROM (
+            SELECT DISTINCT ON (namespace, key) namespace, key, value, deleted FROM kv_log
+            ORDER BY namespace, key, hlc DESC, timestamp DESC
+        ) AS latest
+        WHERE NOT deleted
+        GROUP BY 1, 2
+        ON CONFLICT (namespace, shard) DO NOTHING`,
+		`INSERT INTO namespace_usage (namespace, shard, live_keys, live_bytes)
+        SELECT namespace, mod(fnv32(key), 16), count(*), sum(octet_length(key) + coalesce(octet_length(value), 0))
+        FROM kv_current
+        WHERE NOT deleted
+        GROUP BY 1, 2
+        ON CONFLICT (namespace, shard) DO UPDATE SET
+            live_keys = namespace_usage.live_keys + excluded.live_keys,
+            live_bytes = namespace_usage.live_bytes + excluded.live_bytes`,
+	}},
+}
+
+// Conn is satisfied by *sql.DB and *sql.Conn. Callers whose pool sets a
+// statement_timeout should pass a connection without one, since backfilling
+// a column or index on a large kv_log can take a long time.
+type Conn interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// maxAttempts bounds the retries of a migration that conflicted with a
+// concurrent one.
+const maxAttempts = 5
+
+// Run applies every migration not yet recorded in schema_migrations, in
+// order, logging each one it applies.
+func Run(ctx context.Context, conn Conn) error {
+	if _, err := conn.ExecContext(ctx, `
+    CREATE TABLE IF NOT EXISTS schema_migrations (
+        version INT8 PRIMARY KEY,
+        name STRING NOT NULL,
+        applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    )`); err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+	applied, err := appliedVersions(ctx, conn)
+	if err != nil {
+		return err
+	}
+	for _, m := range all {
+		if applied[m.version] {
+			continue
+		}
+		for attempt := 1; ; attempt++ {
+			err = apply(ctx, conn, m)
+			if err == nil || !isRetryable(err) || attempt == maxAttempts {
+				break
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		log.Printf("Applied schema migration %d (%s).", m.version, m.name)
+	}
+	return nil
+}
+
+func appliedVersions(ctx context.Context, conn Conn) (map[int]bool, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+	applied := map[int]bool{}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// apply runs m's statements and records it in one transaction. The record is
+// written last because CockroachDB rejects a schema change that follows a
+// write in the same transaction.
+func apply(ctx context.Context, conn Conn, m migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range m.statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `
+    INSERT INTO schema_migrations (version, name) VALUES ($1, $2)
+    ON CONFLICT (version) DO NOTHING`, m.version, m.name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// isRetryable reports whether err is a serialization failure, as when two
+// binaries apply the same migration at once.
+func isRetryable(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "40001"
+}
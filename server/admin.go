@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Admin Authorization ---
+
+// requireAdmin only runs h for requests carrying "Authorization: Bearer <ADMIN_TOKEN>".
+// Every admin endpoint is disabled when no admin token is configured.
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.AdminToken == "" {
+			writeError(w, http.StatusForbidden, codeForbidden, "Admin endpoints are disabled")
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// --- Debug Endpoint ---
+
+// handleDebug reports the cached and authoritative state of a key side by
+// side so cache divergence and CDC lag are immediately visible.
+func handleDebug(w http.ResponseWriter, r *http.Request) {
+	namespace, key := requestKey(r)
+	cacheKey := redisKey(namespace, key)
+
+	cache := map[string]any{"hit": false, "value": nil, "ttl_seconds": nil}
+	val, err := redisClient.Get(ctx, cacheKey).Result()
+	switch {
+	case err == nil:
+		cache["hit"] = true
+		cache["value"] = val
+		ttl, err := redisClient.TTL(ctx, cacheKey).Result()
+		if err != nil {
+			redisErrors.Add(1)
+			cache["error"] = err.Error()
+		} else if ttl == -1 {
+			// -1 means the key exists but has no expiry.
+			cache["ttl_seconds"] = -1
+		} else if ttl > 0 {
+			cache["ttl_seconds"] = ttl.Round(time.Second).Seconds()
+		}
+	case err != redis.Nil:
+		redisErrors.Add(1)
+		cache["error"] = err.Error()
+	}
+
+	database := map[string]any{"found": false}
+	entry, err := latestForKey(r.Context(), namespace, key, false)
+	if err != nil {
+		log.Printf("ERROR: CockroachDB query failed for key '%s': %v", key, err)
+		database["error"] = err.Error()
+	} else if entry != nil {
+		database["found"] = true
+		database["value"] = entry.Value
+		database["deleted"] = entry.Deleted
+		database["timestamp"] = entry.Timestamp
+		database["origin_region"] = entry.OriginRegion
+		database["home_region"] = entry.HomeRegion
+	}
+
+	inSync := err == nil && cache["error"] == nil
+	if inSync {
+		live := entry != nil && !entry.Deleted
+		if cache["hit"] == true {
+			inSync = live && entry.Value == val
+		} else {
+			inSync = true // A miss is always safe; the next GET reads through.
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]any{
+		"namespace": namespace,
+		"key":       key,
+		"cache":     cache,
+		"db":        database,
+		"in_sync":   inSync,
+	})
+}
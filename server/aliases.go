@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// --- Key Aliases ---
+//
+// With ALIASES enabled, a PUT with {"target_key": "v3"} instead of a value
+// makes the key an alias: an entry with an empty value whose target_key
+// column names another key of the same namespace. A GET of the alias follows
+// target_key, through further aliases if need be, and returns the final
+// key's current value and version. Aliases are never cached, since a cached
+// copy of the target's value would go stale when the target changes, so
+// every alias read goes to CockroachDB, one read per hop; the hydrator drops
+// an alias key from the cache like a delete. A chain longer than
+// maxAliasDepth, or one that loops, gets 508.
+//
+// ALIASES also decides what a plain PUT to an alias does: "reject" answers
+// 409, "write_through" writes the value to the key the alias resolves to.
+// Either way a PUT with target_key re-points the alias and DELETE removes
+// the alias itself. Other writes, history, lists and existence checks act
+// on the alias entry like on any other key.
+
+const (
+	aliasesOff          = "off"
+	aliasesReject       = "reject"
+	aliasesWriteThrough = "write_through"
+)
+
+// maxAliasDepth bounds the hops a read follows from an alias.
+const maxAliasDepth = 8
+
+var errAliasLoop = errors.New("alias chain loops or is too deep")
+
+// isAlias reports whether entry is a live alias.
+func isAlias(entry *LogEntry) bool {
+	return entry != nil && entry.TargetKey != "" && !entry.Deleted && !entry.Expired
+}
+
+// resolveAlias follows the alias entry to the key it finally names and
+// returns that key with its latest entry, which is nil, deleted or expired
+// when the target does not exist.
+func resolveAlias(ctx context.Context, alias *LogEntry, followerRead bool) (string, *LogEntry, error) {
+	seen := map[string]bool{alias.Key: true}
+	entry := alias
+	for hop := 0; hop < maxAliasDepth; hop++ {
+		target := entry.TargetKey
+		if seen[target] {
+			return "", nil, errAliasLoop
+		}
+		seen[target] = true
+		var err error
+		entry, err = latestForKey(ctx, alias.Namespace, target, followerRead)
+		if err != nil || !isAlias(entry) {
+			return target, entry, err
+		}
+	}
+	return "", nil, errAliasLoop
+}
+
+// aliasReadFailed answers a request whose alias resolution failed.
+func aliasReadFailed(w http.ResponseWriter, key string, err error) {
+	switch {
+	case errors.Is(err, errAliasLoop):
+		writeError(w, http.StatusLoopDetected, codeAliasLoop, fmt.Sprintf("Alias chain loops or is longer than %d hops", maxAliasDepth))
+	case errors.Is(err, errDBUnavailable):
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Duration(cfg.DBBreakerCooldown).Seconds())))
+		writeError(w, http.StatusServiceUnavailable, codeDBUnavailable, "Service unavailable: CockroachDB is overloaded")
+	default:
+		log.Printf("ERROR: Resolving alias '%s' in CockroachDB failed: %v", key, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+	}
+}
+
+// handleAliasGet answers a GET of the alias entry with its final target's
+// value. X-Alias-Target names that key; the body keeps the alias's own key.
+func handleAliasGet(w http.ResponseWriter, r *http.Request, alias *LogEntry, followerRead bool) {
+	target, entry, err := resolveAlias(r.Context(), alias, followerRead)
+	if err != nil {
+		aliasReadFailed(w, alias.Key, err)
+		return
+	}
+	if entry == nil || entry.Deleted || entry.Expired {
+		writeError(w, http.StatusNotFound, codeKeyNotFound, "Key not found: alias target does not exist")
+		return
+	}
+	log.Printf("GET resolved alias '%s' to key '%s'", alias.Key, target)
+	w.Header().Set("X-Alias-Target", target)
+	resolved := *entry
+	resolved.Key = alias.Key
+	writeEntryValue(w, r, &resolved)
+}
+
+// validateAliasPut checks a PUT that sets target_key.
+func validateAliasPut(key, target, value, valueType string) error {
+	switch {
+	case cfg.Aliases == aliasesOff:
+		return fmt.Errorf("target_key requires ALIASES")
+	case target == "":
+		return fmt.Errorf("target_key must not be empty")
+	case target == key:
+		return fmt.Errorf("an alias cannot target itself")
+	case value != "" || valueType != "":
+		return fmt.Errorf("target_key cannot be combined with value or value_type")
+	}
+	return nil
+}
+
+// aliasWriteTarget returns the key a plain PUT to key should write: key
+// itself unless it is an alias, in which case ALIASES decides. When the
+// write must not proceed it answers the request and returns false.
+func aliasWriteTarget(w http.ResponseWriter, r *http.Request, namespace, key string) (string, bool) {
+	if cfg.Aliases == aliasesOff {
+		return key, true
+	}
+	current, err := latestForKey(r.Context(), namespace, key, false)
+	if err != nil {
+		aliasReadFailed(w, key, err)
+		return "", false
+	}
+	if !isAlias(current) {
+		return key, true
+	}
+	if cfg.Aliases == aliasesReject {
+		writeError(w, http.StatusConflict, codeConflict, fmt.Sprintf("Conflict: key is an alias of '%s'; write to the target or re-point it with target_key", current.TargetKey))
+		return "", false
+	}
+	target, _, err := resolveAlias(r.Context(), current, false)
+	if err != nil {
+		aliasReadFailed(w, key, err)
+		return "", false
+	}
+	return target, true
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// --- Append ---
+//
+// POST /kv/{key}/_append treats the key's value as a JSON array and appends
+// one element to it, using the same transactional read-modify-write as PATCH:
+// the new version is conditioned on the one read, so concurrent appends are
+// retried on top of each other rather than losing elements. A missing or
+// deleted key starts as an empty array. With max_length set, the oldest
+// elements are dropped to keep at most that many, making the value a ring
+// buffer.
+
+var errValueNotArray = errors.New("stored value is not a JSON array")
+
+// handleAppend serves POST /kv/{key}/_append with a body of
+// {"element": <any JSON value>, "max_length": N}.
+func handleAppend(w http.ResponseWriter, r *http.Request) {
+	if rejectIfReadOnly(w) {
+		return
+	}
+	namespace, key := requestKey(r)
+	var payload struct {
+		Element   json.RawMessage `json:"element"`
+		MaxLength int             `json:"max_length"`
+	}
+	if !decodeJSONBody(w, r.Body, &payload) {
+		return
+	}
+	if len(payload.Element) == 0 {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "Missing element")
+		return
+	}
+	if payload.MaxLength < 0 {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "max_length must not be negative")
+		return
+	}
+	element, err := decodeJSONValue(payload.Element)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "Invalid element")
+		return
+	}
+
+	schema := schemaFor(namespace, key)
+	entry, err := patchLogEntry(r.Context(), namespace, key, []any{}, func(document any) (any, error) {
+		array, ok := document.([]any)
+		if !ok {
+			return nil, errValueNotArray
+		}
+		array = append(array, element)
+		if payload.MaxLength > 0 && len(array) > payload.MaxLength {
+			array = array[len(array)-payload.MaxLength:]
+		}
+		if schema != nil {
+			return array, validateDocument(schema, array)
+		}
+		return array, nil
+	})
+	var schemaErr *schemaValidationError
+	var quotaErr *errQuotaExceeded
+	switch {
+	case errors.Is(err, errValueNotJSON), errors.Is(err, errValueNotArray):
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "Existing value is not a JSON array")
+		return
+	case errors.As(err, &schemaErr):
+		writeSchemaValidationError(w, schemaErr)
+		return
+	case errors.As(err, &quotaErr):
+		writeQuotaExceeded(w, quotaErr)
+		return
+	case errors.Is(err, errVersionConflict):
+		writeError(w, http.StatusConflict, codeWriteConflict, "Conflict: key kept changing, retry the append")
+		return
+	case err != nil:
+		log.Printf("ERROR: Failed to append to key '%s' in CockroachDB: %v", key, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	applyWriteToCache(*entry)
+	log.Printf("APPEND successful for key: %s (version %d)", key, entry.Version)
+	json.NewEncoder(w).Encode(entry)
+}
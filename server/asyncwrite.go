@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"net/http"
+	"time"
+)
+
+// --- Async Writes ---
+//
+// With WRITE_MODE=async, a plain PUT (no If-Match, Idempotency-Key or
+// Consistency: strong) is written to the local cache and queued in memory,
+// and answered with 202 before it reaches CockroachDB. A single background
+// writer drains the queue in arrival order, in batches of up to
+// ASYNC_FLUSH_BATCH_SIZE rows.
+//
+// This trades durability for latency. Queued writes are lost if the process
+// exits, and until a write is flushed other regions cannot see it and it has
+// no version. Its timestamp is assigned at flush time, so the log orders it
+// after any write that reached CockroachDB first. A synchronous write to the
+// same key, such as a DELETE, can therefore be overtaken by an earlier async
+// PUT that is still queued. When the queue holds ASYNC_QUEUE_SIZE writes, new
+// ones get 503 or, with ASYNC_QUEUE_FULL=block, wait for room.
+
+const (
+	writeModeSync  = "sync"
+	writeModeAsync = "async"
+)
+
+// asyncFlushAttempts bounds how often a row is tried before it is dropped.
+const asyncFlushAttempts = 5
+
+var errAsyncQueueFull = errors.New("async write queue is full")
+
+var (
+	asyncWritesRejected = expvar.NewInt("async_writes_rejected_total")
+	asyncWriteFailures  = expvar.NewInt("async_write_failures_total")
+)
+
+type asyncWriter struct {
+	queue     chan *LogEntry
+	batchSize int
+	block     bool
+}
+
+// asyncWrites is nil in sync mode.
+var asyncWrites *asyncWriter
+
+func newAsyncWriter(queueSize, batchSize int, block bool) *asyncWriter {
+	a := &asyncWriter{queue: make(chan *LogEntry, queueSize), batchSize: batchSize, block: block}
+	expvar.Publish("async_queue_depth", expvar.Func(func() any { return len(a.queue) }))
+	go a.run()
+	return a
+}
+
+// enqueue queues entry. When the queue is full it returns errAsyncQueueFull,
+// or in blocking mode waits for room until reqCtx ends.
+func (a *asyncWriter) enqueue(reqCtx context.Context, entry *LogEntry) error {
+	if a.block {
+		select {
+		case a.queue <- entry:
+			return nil
+		case <-reqCtx.Done():
+			return reqCtx.Err()
+		}
+	}
+	select {
+	case a.queue <- entry:
+		return nil
+	default:
+		asyncWritesRejected.Add(1)
+		return errAsyncQueueFull
+	}
+}
+
+func (a *asyncWriter) run() {
+	for first := range a.queue {
+		batch := []*LogEntry{first}
+	drain:
+		for len(batch) < a.batchSize {
+			select {
+			case entry := <-a.queue:
+				batch = append(batch, entry)
+			default:
+				break drain
+			}
+		}
+		a.flush(batch)
+	}
+}
+
+// flush persists batch, retrying failed rows with backoff. A row that still
+// fails is also removed from the cache, so the region stops serving a value
+// the log never received.
+func (a *asyncWriter) flush(batch []*LogEntry) {
+	// Rows get distinct timestamps a microsecond apart, the column's
+	// precision, so writes to one key keep their queue order.
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	writes := make([]batchedWrite, len(batch))
+	for i, entry := range batch {
+		entry.Timestamp = now.Add(time.Duration(i) * time.Microsecond)
+		writes[i] = batchedWrite{entry: entry, done: make(chan error, 1)}
+	}
+	flushBatch(writes)
+	retryDelay := 100 * time.Millisecond
+	for _, w := range writes {
+		err := <-w.done
+		for attempt := 1; err != nil && attempt < asyncFlushAttempts; attempt++ {
+			log.Printf("WARNING: Async write of key '%s' failed, retrying in %v (%d/%d): %v", w.entry.Key, retryDelay, attempt, asyncFlushAttempts, err)
+			time.Sleep(retryDelay)
+			retryDelay = min(retryDelay*2, 5*time.Second)
+			err = appendDirect(ctx, w.entry)
+		}
+		if err != nil {
+			asyncWriteFailures.Add(1)
+			log.Printf("ERROR: Dropping async write of key '%s' after %d attempts: %v", w.entry.Key, asyncFlushAttempts, err)
+			if err := cacheDel(redisKey(w.entry.Namespace, w.entry.Key)); err != nil {
+				redisErrors.Add(1)
+				log.Printf("ERROR: Failed to remove unpersisted key '%s' from the cache: %v", w.entry.Key, err)
+			}
+		}
+	}
+}
+
+// putAsync answers a plain PUT in async mode: the entry is queued, then
+// cached, and the client gets 202 with the entry as accepted. Its version is
+// 0 and its timestamp provisional until the write is flushed.
+func putAsync(w http.ResponseWriter, r *http.Request, entry LogEntry) {
+	queued := entry // The writer sets its timestamp and version.
+	err := asyncWrites.enqueue(r.Context(), &queued)
+	if errors.Is(err, errAsyncQueueFull) {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusServiceUnavailable, codeQueueFull, "Write queue is full")
+		return
+	}
+	if err != nil {
+		return // The client went away while waiting for room.
+	}
+	if err := cacheSet(entry); err != nil {
+		redisErrors.Add(1)
+		log.Printf("ERROR: Failed to cache async write for key '%s': %v", entry.Key, err)
+	}
+	log.Printf("PUT accepted for key: %s (queued for async persistence)", entry.Key)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(entry)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// --- Batch Delete ---
+//
+// POST /kv/_batch/delete tombstones an explicit list of keys of one namespace
+// in a single transaction: either every key that was live is deleted, or
+// none is. Each key is locked with lockLatestEntry and its tombstone is
+// conditioned on the version read, exactly like a conditional DELETE, so a
+// concurrent write to any of the keys makes the whole batch retry.
+
+// maxBatchKeys bounds the keys of one batch, and so the size of its
+// transaction.
+const maxBatchKeys = 1000
+
+// batchDeleteResponse lists which of the requested keys were deleted and
+// which were already missing or deleted.
+type batchDeleteResponse struct {
+	Deleted  []string `json:"deleted"`
+	NotFound []string `json:"not_found"`
+}
+
+// handleBatchDelete serves POST /kv/_batch/delete with a body of
+// {"keys": [...]}, in the namespace given by ?namespace=.
+func handleBatchDelete(w http.ResponseWriter, r *http.Request) {
+	if rejectIfReadOnly(w) {
+		return
+	}
+	namespace, ok := namespaceQuery(r)
+	if !ok {
+		writeError(w, http.StatusNotFound, codeNamespaceNotFound, "Unknown namespace")
+		return
+	}
+	var payload struct {
+		Keys []string `json:"keys"`
+	}
+	if !decodeJSONBody(w, r.Body, &payload) {
+		return
+	}
+	keys, err := batchKeys(payload.Keys)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, err.Error())
+		return
+	}
+
+	resp, entries, err := deleteKeys(r.Context(), namespace, keys)
+	var homed *errHomedElsewhere
+	if errors.As(err, &homed) {
+		writeMisdirected(w, homed.key, homed.home)
+		return
+	}
+	if errors.Is(err, errVersionConflict) {
+		writeError(w, http.StatusConflict, codeWriteConflict, "Conflict: keys kept changing, retry the delete")
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: Failed to write batch delete of %d keys to CockroachDB: %v", len(keys), err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	for _, entry := range entries {
+		applyWriteToCache(entry)
+	}
+	log.Printf("Batch DELETE successful in namespace '%s': %d deleted, %d not found", namespace, len(resp.Deleted), len(resp.NotFound))
+	json.NewEncoder(w).Encode(resp)
+}
+
+// batchKeys validates the keys of a batch and drops duplicates, keeping the
+// order of their first appearance.
+func batchKeys(keys []string) ([]string, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("keys must list at least one key")
+	}
+	if len(keys) > maxBatchKeys {
+		return nil, fmt.Errorf("at most %d keys may be listed in one batch", maxBatchKeys)
+	}
+	seen := make(map[string]bool, len(keys))
+	unique := keys[:0]
+	for _, key := range keys {
+		if key == "" {
+			return nil, errors.New("keys must not be empty")
+		}
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+	return unique, nil
+}
+
+// deleteKeys tombstones every live key of keys in one transaction, retrying
+// when a concurrent writer changes one of them. It returns the tombstones it
+// wrote, for the caller to apply to the cache.
+func deleteKeys(ctx context.Context, namespace string, keys []string) (batchDeleteResponse, []LogEntry, error) {
+	var err error
+	for attempt := 0; attempt < 5; attempt++ {
+		var resp batchDeleteResponse
+		var entries []LogEntry
+		resp, entries, err = tryDeleteKeys(ctx, namespace, keys)
+		if !errors.Is(err, errVersionConflict) {
+			return resp, entries, err
+		}
+	}
+	return batchDeleteResponse{}, nil, err
+}
+
+func tryDeleteKeys(ctx context.Context, namespace string, keys []string) (batchDeleteResponse, []LogEntry, error) {
+	resp := batchDeleteResponse{Deleted: []string{}, NotFound: []string{}}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return resp, nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	var entries []LogEntry
+	for _, key := range keys {
+		current, err := lockLatestEntry(ctx, tx, namespace, key)
+		if errors.Is(err, errKeyNotFound) {
+			resp.NotFound = append(resp.NotFound, key)
+			continue
+		}
+		if err != nil {
+			return resp, nil, err
+		}
+		if isHomedElsewhere(current.HomeRegion) {
+			return resp, nil, &errHomedElsewhere{key: key, home: current.HomeRegion}
+		}
+		entry := LogEntry{
+			Namespace:    namespace,
+			Key:          key,
+			Timestamp:    now,
+			Deleted:      true,
+			OriginRegion: cfg.OriginRegion,
+		}
+		if err := insertLogEntry(ctx, tx, &entry, &current.Version); err != nil {
+			return resp, nil, err
+		}
+		if err := pruneVersions(ctx, tx, namespace, key); err != nil {
+			return resp, nil, err
+		}
+		entries = append(entries, entry)
+		resp.Deleted = append(resp.Deleted, key)
+	}
+	if err := tx.Commit(); err != nil {
+		if isWriteConflict(err) {
+			return resp, nil, errVersionConflict
+		}
+		return resp, nil, err
+	}
+	return resp, entries, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Write Batching ---
+
+// logBatcher coalesces concurrent appends arriving within a short window into
+// a single multi-row INSERT. Each caller still receives its own result: if the
+// batch statement fails, the rows are retried one by one so only the
+// offending rows report an error.
+type logBatcher struct {
+	requests chan batchedWrite
+	maxSize  int
+	window   time.Duration
+}
+
+type batchedWrite struct {
+	entry *LogEntry
+	done  chan error
+}
+
+// writeBatcher is nil when batching is disabled.
+var writeBatcher *logBatcher
+
+func newLogBatcher(maxSize int, window time.Duration) *logBatcher {
+	b := &logBatcher{
+		requests: make(chan batchedWrite, maxSize),
+		maxSize:  maxSize,
+		window:   window,
+	}
+	go b.run()
+	return b
+}
+
+// append queues entry and blocks until its batch has been written, then sets
+// entry.Version.
+func (b *logBatcher) append(entry *LogEntry) error {
+	done := make(chan error, 1)
+	b.requests <- batchedWrite{entry: entry, done: done}
+	return <-done
+}
+
+func (b *logBatcher) run() {
+	for first := range b.requests {
+		batch := []batchedWrite{first}
+		timer := time.NewTimer(b.window)
+	collect:
+		for len(batch) < b.maxSize {
+			select {
+			case w := <-b.requests:
+				batch = append(batch, w)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		go flushBatch(batch)
+	}
+}
+
+// flushBatch writes batch in one statement. Each row claims the next version of its
+// key with a subquery, which cannot see the other rows of the same statement,
+// so a second write to a key already in the batch is held back and written
+// on its own afterwards. The statement also adds the batch's change to
+// namespace_usage, from the keys' latest entries before it.
+func flushBatch(batch []batchedWrite) {
+	if len(batch) == 1 {
+		batch[0].done <- appendDirect(ctx, batch[0].entry)
+		return
+	}
+	var rows, deferred []batchedWrite
+	seen := make(map[string]bool, len(batch))
+	for _, w := range batch {
+		id := qualifiedKey(w.entry.Namespace, w.entry.Key)
+		if seen[id] {
+			deferred = append(deferred, w)
+			continue
+		}
+		seen[id] = true
+		rows = append(rows, w)
+	}
+	defer func() {
+		for _, w := range deferred {
+			w.done <- appendDirect(ctx, w.entry)
+		}
+	}()
+
+	var sb strings.Builder
+	sb.WriteString("WITH previous AS (SELECT DISTINCT ON (namespace, key) namespace, key, deleted, value FROM " + logTable() + " WHERE (namespace, key) IN (")
+	for i := range rows {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString("($" + strconv.Itoa(i*10+1) + ", $" + strconv.Itoa(i*10+2) + ")")
+	}
+	sb.WriteString(") ORDER BY namespace, key, " + newestFirst + "), written AS (")
+	sb.WriteString(writeVerb() + ` (namespace, key, value, timestamp, deleted, origin_region, ttl_seconds, labels, version, hlc, home_region, value_type, numeric_value) VALUES `)
+	args := make([]any, 0, len(rows)*10)
+	for i, w := range rows {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		n := len(args)
+		sb.WriteString("(")
+		for col := 1; col <= 7; col++ {
+			sb.WriteString("$" + strconv.Itoa(n+col) + ", ")
+		}
+		sb.WriteString("$" + strconv.Itoa(n+8) + "::JSONB, ")
+		sb.WriteString("(SELECT coalesce(max(version), 0) + 1 FROM " + logTable() + " WHERE namespace = $" + strconv.Itoa(n+1) + " AND key = $" + strconv.Itoa(n+2) + "), cluster_logical_timestamp(), ")
+		sb.WriteString("(" + latestHomeRegionQuery("$"+strconv.Itoa(n+1), "$"+strconv.Itoa(n+2)) + "), ")
+		sb.WriteString("$" + strconv.Itoa(n+9) + "::STRING, $" + strconv.Itoa(n+10) + "::DECIMAL)")
+		args = append(args, w.entry.Namespace, w.entry.Key, w.entry.Value, w.entry.Timestamp, w.entry.Deleted, nullIfEmpty(w.entry.OriginRegion), nullIfZero(w.entry.TTLSeconds), labelsParam(w.entry.Labels), nullIfEmpty(w.entry.ValueType), numericParam(w.entry))
+	}
+	sb.WriteString(" RETURNING namespace, key, deleted, value, version), " + usageUpdateSQL())
+	sb.WriteString(" SELECT namespace, key, version FROM written, (SELECT count(*) FROM usage) AS applied")
+	versions, err := insertBatch(sb.String(), args, rows)
+	if err == nil {
+		for _, w := range rows {
+			w.entry.Version = versions[qualifiedKey(w.entry.Namespace, w.entry.Key)]
+			w.done <- nil
+		}
+		return
+	}
+	log.Printf("WARNING: Batched insert of %d rows failed, retrying rows individually: %v", len(rows), err)
+	for _, w := range rows {
+		w.done <- appendDirect(ctx, w.entry)
+	}
+}
+
+// insertBatch runs a batched INSERT ... RETURNING namespace, key, version and
+// maps each qualifiedKey to the version it was assigned. With
+// MAX_VERSIONS_PER_KEY set, the keys of rows are pruned in the same
+// transaction.
+func insertBatch(query string, args []any, rows []batchedWrite) (map[string]int64, error) {
+	if cfg.MaxVersionsPerKey <= 0 {
+		return scanBatchVersions(db.QueryContext(ctx, query, args...))
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	versions, err := scanBatchVersions(tx.QueryContext(ctx, query, args...))
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range rows {
+		if err := pruneVersions(ctx, tx, w.entry.Namespace, w.entry.Key); err != nil {
+			return nil, err
+		}
+	}
+	return versions, tx.Commit()
+}
+
+func scanBatchVersions(result *sql.Rows, err error) (map[string]int64, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	versions := make(map[string]int64)
+	for result.Next() {
+		var namespace, key string
+		var version int64
+		if err := result.Scan(&namespace, &key, &version); err != nil {
+			return nil, err
+		}
+		versions[qualifiedKey(namespace, key)] = version
+	}
+	return versions, result.Err()
+}
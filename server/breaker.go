@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// --- CockroachDB Circuit Breaker ---
+//
+// When CockroachDB is struggling, every cache miss adds another query to the
+// pile. After enough consecutive failed reads the breaker opens and reads fail
+// fast with errDBUnavailable, which handlers turn into 503. After a cooldown
+// one probe read is let through (half-open): success closes the breaker,
+// failure reopens it. Writes are not gated; they must reach the log or fail.
+
+var errDBUnavailable = errors.New("CockroachDB reads are temporarily suspended by the circuit breaker")
+
+type breakerState string
+
+const (
+	breakerClosed   breakerState = "closed"
+	breakerOpen     breakerState = "open"
+	breakerHalfOpen breakerState = "half_open"
+)
+
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+// dbReadBreaker is nil when the breaker is disabled.
+var dbReadBreaker *circuitBreaker
+
+var breakerRejections = expvar.NewInt("db_breaker_rejections_total")
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	b := &circuitBreaker{threshold: threshold, cooldown: cooldown, state: breakerClosed}
+	expvar.Publish("db_breaker_state", expvar.Func(func() any { return string(b.currentState()) }))
+	return b
+}
+
+// allow reports whether a read may go to CockroachDB. In the half-open state
+// only one probe is admitted at a time.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		b.state = breakerHalfOpen
+	}
+	switch {
+	case b.state == breakerClosed:
+		return true
+	case b.state == breakerHalfOpen && !b.probing:
+		b.probing = true
+		return true
+	}
+	breakerRejections.Add(1)
+	return false
+}
+
+// record reports the outcome of a read admitted by allow.
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// abandon releases a read admitted by allow without counting it either way,
+// for reads cut short because their client went away.
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *circuitBreaker) currentState() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
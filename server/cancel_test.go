@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// --- Request Cancellation Tests ---
+//
+// A fake database/sql driver whose statements block until their context is
+// done stands in for a slow CockroachDB, so the tests can see whether a
+// client going away reaches the statement it was waiting on.
+
+// blockingDriver reports each statement it starts on started, and the error
+// of its context once that is done on cancelled. Closing released ends the
+// statements still blocked, for a test that has failed.
+type blockingDriver struct {
+	started   chan string
+	cancelled chan error
+	released  chan struct{}
+}
+
+func (d *blockingDriver) Open(string) (driver.Conn, error) { return blockingConn{d}, nil }
+
+type blockingConn struct{ d *blockingDriver }
+
+func (c blockingConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("blockingConn: Prepare is not supported")
+}
+
+func (c blockingConn) Close() error { return nil }
+
+func (c blockingConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("blockingConn: Begin is not supported")
+}
+
+func (c blockingConn) QueryContext(ctx context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	return nil, c.block(ctx, query)
+}
+
+func (c blockingConn) ExecContext(ctx context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	return nil, c.block(ctx, query)
+}
+
+func (c blockingConn) block(ctx context.Context, query string) error {
+	c.d.started <- query
+	select {
+	case <-ctx.Done():
+		c.d.cancelled <- ctx.Err()
+		return ctx.Err()
+	case <-c.d.released:
+		return errors.New("blockingConn: released")
+	}
+}
+
+// blockingConnector hands database/sql the driver without registering it.
+type blockingConnector struct{ d *blockingDriver }
+
+func (c blockingConnector) Connect(context.Context) (driver.Conn, error) { return c.d.Open("") }
+func (c blockingConnector) Driver() driver.Driver                        { return c.d }
+
+// openBlockingDB points db at a blockingDriver, with the default
+// configuration and no read timeout, so only the caller's context can end a
+// statement.
+func openBlockingDB(t *testing.T) *blockingDriver {
+	t.Helper()
+	d := &blockingDriver{started: make(chan string, 1), cancelled: make(chan error, 1), released: make(chan struct{})}
+	previousDB, previousCfg := db, cfg
+	db, cfg = sql.OpenDB(blockingConnector{d}), defaultConfig()
+	cfg.DBReadTimeout = 0
+	t.Cleanup(func() {
+		db.Close()
+		db, cfg = previousDB, previousCfg
+	})
+	return d
+}
+
+// awaitCancelled fails t unless the statement d started is cancelled soon.
+func awaitCancelled(t *testing.T, d *blockingDriver) {
+	t.Helper()
+	select {
+	case err := <-d.cancelled:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("statement ended with %v; want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		close(d.released)
+		t.Fatal("statement was still running 5s after its request was cancelled")
+	}
+}
+
+func TestLatestForKeyIsCancelledWithItsContext(t *testing.T) {
+	d := openBlockingDB(t)
+	reqCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := latestForKey(reqCtx, defaultNamespace, "a", false)
+		done <- err
+	}()
+	<-d.started
+	cancel()
+	awaitCancelled(t, d)
+	if err := <-done; err == nil {
+		t.Error("latestForKey returned no error for a cancelled read")
+	}
+}
+
+func TestClientDisconnectCancelsQuery(t *testing.T) {
+	d := openBlockingDB(t)
+	srv := httptest.NewServer(http.HandlerFunc(handleList))
+	defer srv.Close()
+
+	reqCtx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, srv.URL+"/kv/_list?prefix=a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	<-d.started
+	// Cancelling the client's request closes its connection, as a client
+	// that goes away would.
+	cancel()
+	awaitCancelled(t, d)
+	if err := <-done; err == nil {
+		t.Error("the request completed although its client had gone away")
+	}
+}
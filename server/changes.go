@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// --- Changes Since ---
+//
+// GET /kv/_changes?since=<RFC3339>&limit=N lets a client replicate a
+// namespace by polling instead of running a changefeed: it returns every log
+// entry, tombstones included, written after since, oldest first. Entries are
+// ordered by timestamp and then id, both in idx_namespace_timestamp, and the
+// last one of a page is the cursor for the next, so a poller keeps the
+// newest cursor it has seen and never needs since again.
+//
+// timestamp is the wall clock of the server that wrote the entry, not the
+// commit timestamp, so a write still in flight, or from a server whose clock
+// lags, can land behind a cursor already handed out. Pollers that must not
+// miss a change should start each poll from a cursor a little older than the
+// last one and skip entries they have seen.
+
+const (
+	changePut    = "put"
+	changeDelete = "delete"
+)
+
+// uuidPattern matches a kv_log id as CockroachDB renders it.
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// changeItem is one log entry of a /kv/_changes page.
+type changeItem struct {
+	Key       string            `json:"key"`
+	Change    string            `json:"change"`
+	Value     string            `json:"value,omitempty"`
+	Version   int64             `json:"version"`
+	Timestamp time.Time         `json:"timestamp"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	id        string
+}
+
+// changesCursor is the position after item: its timestamp and id joined by a
+// comma, which neither contains.
+func changesCursor(item changeItem) string {
+	return item.Timestamp.Format(time.RFC3339Nano) + "," + item.id
+}
+
+func parseChangesCursor(cursor string) (time.Time, string, bool) {
+	raw, id, ok := strings.Cut(cursor, ",")
+	ts, err := time.Parse(time.RFC3339Nano, raw)
+	return ts, id, ok && err == nil && uuidPattern.MatchString(id)
+}
+
+// handleChanges serves GET /kv/_changes?namespace=&since=&cursor=&limit=,
+// returning the entries of namespace written after since, or after the entry
+// cursor names, oldest first. Pages hold at most LIST_MAX_LIMIT entries; when
+// one is full, truncated is true and next_cursor continues it. resolved is
+// the region's watermark; see watermark.go.
+func handleChanges(w http.ResponseWriter, r *http.Request) {
+	limit, ok := queryLimit(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "Invalid limit")
+		return
+	}
+	namespace, ok := namespaceQuery(r)
+	if !ok {
+		writeError(w, http.StatusNotFound, codeNamespaceNotFound, "Namespace not found")
+		return
+	}
+	query := r.URL.Query()
+	var since time.Time
+	var afterID string
+	switch {
+	case query.Get("cursor") != "":
+		if since, afterID, ok = parseChangesCursor(query.Get("cursor")); !ok {
+			writeError(w, http.StatusBadRequest, codeValidationFailed, "Invalid cursor")
+			return
+		}
+	case query.Get("since") != "":
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, query.Get("since")); err != nil {
+			writeError(w, http.StatusBadRequest, codeValidationFailed, "since must be an RFC 3339 timestamp")
+			return
+		}
+	default:
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "since or cursor is required")
+		return
+	}
+	limit = clampLimitTo(limit, cfg.ListMaxLimit)
+	items, err := changesSince(r.Context(), namespace, since, afterID, limit)
+	if err != nil {
+		log.Printf("ERROR: CockroachDB changes query failed for namespace '%s': %v", namespace, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	resp := map[string]any{"changes": items, "next_cursor": nil, "truncated": len(items) == limit, "resolved": watermarkJSON(resolvedWatermark())}
+	if len(items) == limit {
+		resp["next_cursor"] = changesCursor(items[len(items)-1])
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// changesSince returns up to limit entries of namespace, oldest first, that
+// were written after since or, with afterID set, that sort after the entry
+// (since, afterID).
+func changesSince(ctx context.Context, namespace string, since time.Time, afterID string, limit int) ([]changeItem, error) {
+	args := []any{clampLimit(limit), namespace, since}
+	where := "namespace = $2 AND timestamp > $3"
+	if afterID != "" {
+		args = append(args, afterID)
+		where = "namespace = $2 AND (timestamp, id) > ($3, $4::UUID)"
+	}
+	rows, err := db.QueryContext(ctx, `
+    SELECT id::STRING, key, value, deleted, version, timestamp, labels FROM `+logTable()+`
+    WHERE `+where+`
+    ORDER BY timestamp, id
+    LIMIT $1;
+    `, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []changeItem{}
+	for rows.Next() {
+		var item changeItem
+		var value sql.NullString
+		var version sql.NullInt64
+		var deleted bool
+		var labels []byte
+		if err := rows.Scan(&item.id, &item.Key, &value, &deleted, &version, &item.Timestamp, &labels); err != nil {
+			return nil, err
+		}
+		item.Change, item.Value, item.Version = changePut, value.String, version.Int64
+		if deleted {
+			item.Change = changeDelete
+		}
+		if item.Labels, err = decodeLabels(labels); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
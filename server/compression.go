@@ -0,0 +1,158 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// --- Response Compression ---
+
+// withGzip compresses responses of at least minBytes for clients that accept
+// gzip. Bodies are buffered only until minBytes is reached, so small
+// responses go out unchanged and large or streamed ones are compressed as
+// they are written. A handler that flushes is treated as streaming and is
+// compressed from that point on, flushing the compressor with it.
+func withGzip(minBytes int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, minBytes: minBytes}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether Accept-Encoding allows gzip with a non-zero q.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		q := 1.0
+		if name, val, ok := strings.Cut(strings.TrimSpace(params), "="); ok && name == "q" {
+			if parsed, err := strconv.ParseFloat(val, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter holds back the status and the first minBytes of the body
+// until it knows whether the response is worth compressing.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minBytes int
+	status   int
+	buf      []byte
+	started  bool
+	gz       *gzip.Writer
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.started || g.status != 0 {
+		return
+	}
+	g.status = status
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !g.started {
+		g.buf = append(g.buf, b...)
+		if len(g.buf) < g.minBytes {
+			return len(b), nil
+		}
+		if err := g.start(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+// Flush sends everything written so far, compressing from here on.
+func (g *gzipResponseWriter) Flush() {
+	if !g.started {
+		g.start(true)
+	}
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// start writes the status and any buffered body, switching to gzip when
+// compress is set and the response is eligible.
+func (g *gzipResponseWriter) start(compress bool) error {
+	g.started = true
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	h := g.ResponseWriter.Header()
+	if compress && compressible(g.status, h) {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+	if len(g.buf) == 0 {
+		return nil
+	}
+	buf := g.buf
+	g.buf = nil
+	if g.gz != nil {
+		_, err := g.gz.Write(buf)
+		return err
+	}
+	_, err := g.ResponseWriter.Write(buf)
+	return err
+}
+
+// close completes the response: short bodies are sent uncompressed.
+func (g *gzipResponseWriter) close() {
+	if !g.started {
+		if g.status == 0 && len(g.buf) == 0 {
+			return // Nothing was written; let net/http send its default 200.
+		}
+		g.start(false)
+	}
+	if g.gz != nil {
+		g.gz.Close()
+	}
+}
+
+// compressible reports whether a response may be gzipped: it must have a body,
+// not already be encoded, and not carry a format that is compressed already.
+func compressible(status int, h http.Header) bool {
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	contentType := strings.ToLower(h.Get("Content-Type"))
+	for _, prefix := range []string{"image/", "video/", "audio/", "application/gzip", "application/x-gzip", "application/zip", "application/zstd"} {
+		if strings.HasPrefix(contentType, prefix) && contentType != "image/svg+xml" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,622 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Configuration ---
+
+// Config is the server's effective configuration. Values are resolved in
+// order of increasing precedence: built-in defaults, the JSON config file,
+// environment variables, then command-line flags.
+type Config struct {
+	DatabaseURL           string   `json:"database_url"`
+	DBHost                string   `json:"db_host"`
+	DBPort                string   `json:"db_port"`
+	DBUser                string   `json:"db_user"`
+	DBPassword            string   `json:"db_password"`
+	DBName                string   `json:"db_name"`
+	DBSSLMode             string   `json:"db_sslmode"`
+	DBSSLRootCert         string   `json:"db_sslrootcert"`
+	RedisURL              string   `json:"redis_url"`
+	RedisHost             string   `json:"redis_host"`
+	RedisPort             string   `json:"redis_port"`
+	RedisPassword         string   `json:"redis_password"`
+	RedisDB               int      `json:"redis_db"`
+	RedisTLS              bool     `json:"redis_tls"`
+	Port                  string   `json:"port"`
+	AdminToken            string   `json:"admin_token"`
+	CacheMode             string   `json:"cache_mode"`
+	CacheTTL              Duration `json:"cache_ttl"`
+	MaxBodyBytes          int64    `json:"max_body_bytes"`
+	DBMaxOpenConns        int      `json:"db_max_open_conns"`
+	DBMaxIdleConns        int      `json:"db_max_idle_conns"`
+	DBConnMaxLifetime     Duration `json:"db_conn_max_lifetime"`
+	DBStatementTimeout    Duration `json:"db_statement_timeout"`
+	RedisPoolSize         int      `json:"redis_pool_size"`
+	RedisMasterName       string   `json:"redis_master_name"`
+	RedisKeyPrefix        string   `json:"redis_key_prefix"`
+	RedisReplicaURL       string   `json:"redis_replica_url"`
+	RedisReadFromReplicas bool     `json:"redis_read_from_replicas"`
+	AccessLogRedactKeys   bool     `json:"access_log_redact_keys"`
+	SlowRequestThreshold  Duration `json:"slow_request_threshold"`
+	ReadHeaderTimeout     Duration `json:"read_header_timeout"`
+	ReadTimeout           Duration `json:"read_timeout"`
+	WriteTimeout          Duration `json:"write_timeout"`
+	IdleTimeout           Duration `json:"idle_timeout"`
+	EnableH2C             bool     `json:"enable_h2c"`
+	TLSCertFile           string   `json:"tls_cert_file"`
+	TLSKeyFile            string   `json:"tls_key_file"`
+	DBRegions             string   `json:"db_regions"`
+	TableLocality         string   `json:"table_locality"`
+	WriteBatchSize        int      `json:"write_batch_size"`
+	WriteBatchWindow      Duration `json:"write_batch_window"`
+	WriteMode             string   `json:"write_mode"`
+	AsyncQueueSize        int      `json:"async_queue_size"`
+	AsyncFlushBatchSize   int      `json:"async_flush_batch_size"`
+	AsyncQueueFull        string   `json:"async_queue_full"`
+	OriginRegion          string   `json:"origin_region"`
+	ExpirerInterval       Duration `json:"expirer_interval"`
+	ExpirerBatchSize      int      `json:"expirer_batch_size"`
+	RedisExpiryEvents     bool     `json:"redis_expiry_events"`
+	MaxVersionsPerKey     int      `json:"max_versions_per_key"`
+	RetentionMaxAge       Duration `json:"retention_max_age"`
+	RetentionInterval     Duration `json:"retention_interval"`
+	StorageMode           string   `json:"storage_mode"`
+	FallbackURL           string   `json:"fallback_url"`
+	FallbackTimeout       Duration `json:"fallback_timeout"`
+	GzipMinBytes          int      `json:"gzip_min_bytes"`
+	DBReadTimeout         Duration `json:"db_read_timeout"`
+	DBBreakerThreshold    int      `json:"db_breaker_threshold"`
+	DBBreakerCooldown     Duration `json:"db_breaker_cooldown"`
+	ServeStaleOnOutage    bool     `json:"serve_stale_on_outage"`
+	CountCacheTTL         Duration `json:"count_cache_ttl"`
+	SelftestInterval      Duration `json:"selftest_interval"`
+	WatchBufferSize       int      `json:"watch_buffer_size"`
+	ReadOnly              bool     `json:"read_only"`
+	AllowEmptyValues      bool     `json:"allow_empty_values"`
+	Aliases               string   `json:"aliases"`
+	AdminAddr             string   `json:"admin_addr"`
+	HotKeysCapacity       int      `json:"hot_keys_capacity"`
+	ListMaxLimit          int      `json:"list_max_limit"`
+	HistoryMaxLimit       int      `json:"history_max_limit"`
+	DBReadConcurrency     int      `json:"db_read_concurrency"`
+	DBReadQueueTimeout    Duration `json:"db_read_queue_timeout"`
+	HomeRegionFencing     bool     `json:"home_region_fencing"`
+	RegionAddresses       string   `json:"region_addresses"`
+	NamespaceQuotas       string   `json:"namespace_quotas"`
+	RegionsTimeout        Duration `json:"regions_timeout"`
+	MaxCacheableSize      int      `json:"max_cacheable_size"`
+	HydratorMaxLag        Duration `json:"hydrator_max_lag"`
+	CacheFillLockTTL      Duration `json:"cache_fill_lock_ttl"`
+	CacheFillWait         Duration `json:"cache_fill_wait"`
+	RedisStatsInterval    Duration `json:"redis_stats_interval"`
+	RedisStatsSampleSize  int      `json:"redis_stats_sample_size"`
+}
+
+// cfg is populated once at startup by loadConfig.
+var cfg Config
+
+func defaultConfig() Config {
+	return Config{
+		DBHost:               "localhost",
+		DBPort:               "26257",
+		DBUser:               "root",
+		DBName:               "defaultdb",
+		DBSSLMode:            "disable",
+		RedisHost:            "localhost",
+		RedisPort:            "6379",
+		Port:                 "8080",
+		CacheMode:            string(cacheModeCDCOnly),
+		MaxBodyBytes:         1 << 20,
+		DBMaxOpenConns:       25,
+		DBMaxIdleConns:       25,
+		DBConnMaxLifetime:    Duration(5 * time.Minute),
+		DBStatementTimeout:   Duration(30 * time.Second),
+		RedisPoolSize:        0, // 0 lets go-redis pick 10 per CPU.
+		SlowRequestThreshold: Duration(500 * time.Millisecond),
+		ReadHeaderTimeout:    Duration(5 * time.Second),
+		ReadTimeout:          Duration(15 * time.Second),
+		WriteTimeout:         Duration(30 * time.Second),
+		IdleTimeout:          Duration(2 * time.Minute),
+		EnableH2C:            true,
+		WriteBatchWindow:     Duration(2 * time.Millisecond),
+		WriteMode:            writeModeSync,
+		AsyncQueueSize:       10000,
+		AsyncFlushBatchSize:  100,
+		AsyncQueueFull:       "reject",
+		Aliases:              aliasesOff,
+		RetentionInterval:    Duration(10 * time.Minute),
+		StorageMode:          storageLog,
+		ExpirerInterval:      Duration(30 * time.Second),
+		ExpirerBatchSize:     500,
+		RedisExpiryEvents:    true,
+		FallbackTimeout:      Duration(2 * time.Second),
+		GzipMinBytes:         1024,
+		DBReadTimeout:        Duration(5 * time.Second),
+		DBBreakerThreshold:   5,
+		DBBreakerCooldown:    Duration(10 * time.Second),
+		CountCacheTTL:        Duration(10 * time.Second),
+		SelftestInterval:     Duration(10 * time.Second),
+		WatchBufferSize:      256,
+		HotKeysCapacity:      1000,
+		ListMaxLimit:         maxQueryLimit,
+		HistoryMaxLimit:      maxQueryLimit,
+		DBReadQueueTimeout:   Duration(100 * time.Millisecond),
+		RegionsTimeout:       Duration(2 * time.Second),
+		CacheFillWait:        Duration(200 * time.Millisecond),
+		RedisStatsInterval:   Duration(time.Minute),
+		RedisStatsSampleSize: 1000,
+	}
+}
+
+// Duration is a time.Duration that reads and writes strings like "30s" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var raw string
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(raw)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// configField binds one setting to its environment variable and flag.
+type configField struct {
+	env, flag, usage string
+	set              func(c *Config, raw string) error
+}
+
+func stringField(env, flagName, usage string, field func(c *Config) *string) configField {
+	return configField{env, flagName, usage, func(c *Config, raw string) error {
+		*field(c) = raw
+		return nil
+	}}
+}
+
+func intField(env, flagName, usage string, field func(c *Config) *int) configField {
+	return configField{env, flagName, usage, func(c *Config, raw string) error {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		*field(c) = n
+		return nil
+	}}
+}
+
+func int64Field(env, flagName, usage string, field func(c *Config) *int64) configField {
+	return configField{env, flagName, usage, func(c *Config, raw string) error {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		*field(c) = n
+		return nil
+	}}
+}
+
+func boolField(env, flagName, usage string, field func(c *Config) *bool) configField {
+	return configField{env, flagName, usage, func(c *Config, raw string) error {
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		*field(c) = b
+		return nil
+	}}
+}
+
+func durationField(env, flagName, usage string, field func(c *Config) *Duration) configField {
+	return configField{env, flagName, usage, func(c *Config, raw string) error {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		*field(c) = Duration(d)
+		return nil
+	}}
+}
+
+var configFields = []configField{
+	stringField("DATABASE_URL", "database-url", "CockroachDB connection string (overrides the DB_* settings)", func(c *Config) *string { return &c.DatabaseURL }),
+	stringField("DB_HOST", "db-host", "CockroachDB host, used when no database URL is set", func(c *Config) *string { return &c.DBHost }),
+	stringField("DB_PORT", "db-port", "CockroachDB port, used when no database URL is set", func(c *Config) *string { return &c.DBPort }),
+	stringField("DB_USER", "db-user", "CockroachDB user, used when no database URL is set", func(c *Config) *string { return &c.DBUser }),
+	stringField("DB_PASSWORD", "db-password", "CockroachDB password, used when no database URL is set", func(c *Config) *string { return &c.DBPassword }),
+	stringField("DB_NAME", "db-name", "CockroachDB database, used when no database URL is set", func(c *Config) *string { return &c.DBName }),
+	stringField("DB_SSLMODE", "db-sslmode", "sslmode (disable, require, verify-ca, verify-full...), used when no database URL is set", func(c *Config) *string { return &c.DBSSLMode }),
+	stringField("DB_SSLROOTCERT", "db-sslrootcert", "CA certificate file, used when no database URL is set", func(c *Config) *string { return &c.DBSSLRootCert }),
+	stringField("REDIS_URL", "redis-url", "Redis address (host:port, overrides REDIS_HOST/REDIS_PORT); several comma-separated addresses mean Cluster seeds, or Sentinels with -redis-master-name", func(c *Config) *string { return &c.RedisURL }),
+	stringField("REDIS_HOST", "redis-host", "Redis host, used when no Redis address is set", func(c *Config) *string { return &c.RedisHost }),
+	stringField("REDIS_PORT", "redis-port", "Redis port, used when no Redis address is set", func(c *Config) *string { return &c.RedisPort }),
+	stringField("REDIS_PASSWORD", "redis-password", "Redis password (empty = no AUTH)", func(c *Config) *string { return &c.RedisPassword }),
+	intField("REDIS_DB", "redis-db", "Redis logical database (not supported by Redis Cluster)", func(c *Config) *int { return &c.RedisDB }),
+	boolField("REDIS_TLS", "redis-tls", "connect to Redis over TLS (implied by rediss:// URLs)", func(c *Config) *bool { return &c.RedisTLS }),
+	stringField("REDIS_MASTER_NAME", "redis-master-name", "Sentinel master name (empty = no Sentinel)", func(c *Config) *string { return &c.RedisMasterName }),
+	stringField("REDIS_KEY_PREFIX", "redis-key-prefix", "prepended to every Redis key the server uses (empty = none)", func(c *Config) *string { return &c.RedisKeyPrefix }),
+	stringField("REDIS_REPLICA_URL", "redis-replica-url", "comma-separated read replicas of a single Redis node to spread cache lookups over (empty = none)", func(c *Config) *string { return &c.RedisReplicaURL }),
+	boolField("REDIS_READ_FROM_REPLICAS", "redis-read-from-replicas", "spread cache lookups over the replicas of a Sentinel master or Redis Cluster", func(c *Config) *bool { return &c.RedisReadFromReplicas }),
+	stringField("PORT", "port", "HTTP listen port", func(c *Config) *string { return &c.Port }),
+	stringField("ADMIN_ADDR", "admin-addr", "listen address for pprof and /debug/vars, e.g. 127.0.0.1:6060 (empty disables)", func(c *Config) *string { return &c.AdminAddr }),
+	stringField("ADMIN_TOKEN", "admin-token", "bearer token for admin endpoints (empty disables them)", func(c *Config) *string { return &c.AdminToken }),
+	stringField("CACHE_MODE", "cache-mode", "cdc_only, invalidate or write_through", func(c *Config) *string { return &c.CacheMode }),
+	durationField("CACHE_TTL", "cache-ttl", "expiry for entries the server writes to Redis (0 = none)", func(c *Config) *Duration { return &c.CacheTTL }),
+	int64Field("MAX_BODY_BYTES", "max-body-bytes", "maximum request body size in bytes", func(c *Config) *int64 { return &c.MaxBodyBytes }),
+	intField("DB_MAX_OPEN_CONNS", "db-max-open-conns", "maximum open CockroachDB connections", func(c *Config) *int { return &c.DBMaxOpenConns }),
+	intField("DB_MAX_IDLE_CONNS", "db-max-idle-conns", "maximum idle CockroachDB connections", func(c *Config) *int { return &c.DBMaxIdleConns }),
+	durationField("DB_CONN_MAX_LIFETIME", "db-conn-max-lifetime", "maximum lifetime of a CockroachDB connection", func(c *Config) *Duration { return &c.DBConnMaxLifetime }),
+	durationField("DB_STATEMENT_TIMEOUT", "db-statement-timeout", "session statement_timeout after which CockroachDB cancels a statement (0 = none)", func(c *Config) *Duration { return &c.DBStatementTimeout }),
+	intField("REDIS_POOL_SIZE", "redis-pool-size", "Redis connection pool size (0 = go-redis default)", func(c *Config) *int { return &c.RedisPoolSize }),
+	boolField("ACCESS_LOG_REDACT_KEYS", "access-log-redact-keys", "replace keys with {key} in access logs", func(c *Config) *bool { return &c.AccessLogRedactKeys }),
+	durationField("SLOW_REQUEST_THRESHOLD", "slow-request-threshold", "log requests slower than this at WARN (0 disables)", func(c *Config) *Duration { return &c.SlowRequestThreshold }),
+	durationField("READ_HEADER_TIMEOUT", "read-header-timeout", "time allowed to read request headers", func(c *Config) *Duration { return &c.ReadHeaderTimeout }),
+	durationField("READ_TIMEOUT", "read-timeout", "time allowed to read a whole request", func(c *Config) *Duration { return &c.ReadTimeout }),
+	durationField("WRITE_TIMEOUT", "write-timeout", "time allowed to write a response", func(c *Config) *Duration { return &c.WriteTimeout }),
+	durationField("IDLE_TIMEOUT", "idle-timeout", "how long idle keep-alive connections are kept open", func(c *Config) *Duration { return &c.IdleTimeout }),
+	boolField("ENABLE_H2C", "enable-h2c", "accept unencrypted HTTP/2 (h2c) when TLS is off", func(c *Config) *bool { return &c.EnableH2C }),
+	stringField("TLS_CERT_FILE", "tls-cert-file", "serve HTTPS with this certificate (enables HTTP/2 via ALPN)", func(c *Config) *string { return &c.TLSCertFile }),
+	stringField("TLS_KEY_FILE", "tls-key-file", "private key for -tls-cert-file", func(c *Config) *string { return &c.TLSKeyFile }),
+	stringField("DB_REGIONS", "db-regions", "comma-separated database regions, primary first (empty = single-region)", func(c *Config) *string { return &c.DBRegions }),
+	intField("WRITE_BATCH_SIZE", "write-batch-size", "coalesce up to this many concurrent writes per INSERT (0 or 1 disables)", func(c *Config) *int { return &c.WriteBatchSize }),
+	durationField("WRITE_BATCH_WINDOW", "write-batch-window", "how long a batch waits for more writes before flushing", func(c *Config) *Duration { return &c.WriteBatchWindow }),
+	stringField("WRITE_MODE", "write-mode", "sync, or async to acknowledge plain PUTs before they reach CockroachDB", func(c *Config) *string { return &c.WriteMode }),
+	intField("ASYNC_QUEUE_SIZE", "async-queue-size", "maximum async writes waiting to be persisted", func(c *Config) *int { return &c.AsyncQueueSize }),
+	intField("ASYNC_FLUSH_BATCH_SIZE", "async-flush-batch-size", "maximum async writes persisted per INSERT", func(c *Config) *int { return &c.AsyncFlushBatchSize }),
+	stringField("ASYNC_QUEUE_FULL", "async-queue-full", "reject (503) or block when the async queue is full", func(c *Config) *string { return &c.AsyncQueueFull }),
+	stringField("ORIGIN_REGION", "origin-region", "region name recorded on every write this server accepts", func(c *Config) *string { return &c.OriginRegion }),
+	boolField("HOME_REGION_FENCING", "home-region-fencing", "let PUTs give keys a home region and answer 421 to writes to keys homed elsewhere (requires origin-region)", func(c *Config) *bool { return &c.HomeRegionFencing }),
+	stringField("REGION_ADDRESSES", "region-addresses", "comma-separated region=url pairs naming each region's server in 421 responses and /_regions", func(c *Config) *string { return &c.RegionAddresses }),
+	stringField("NAMESPACE_QUOTAS", "namespace-quotas", "comma-separated namespace=max_keys:max_bytes limits, answered with 507 when a write would exceed them (0 or empty = unlimited)", func(c *Config) *string { return &c.NamespaceQuotas }),
+	durationField("REGIONS_TIMEOUT", "regions-timeout", "timeout for each region's answer to /kv/{key}/_regions", func(c *Config) *Duration { return &c.RegionsTimeout }),
+	stringField("TABLE_LOCALITY", "table-locality", "kv_log locality: regional_by_row or global (requires db-regions)", func(c *Config) *string { return &c.TableLocality }),
+	durationField("EXPIRER_INTERVAL", "expirer-interval", "how often to tombstone keys whose ttl_seconds has passed (0 disables)", func(c *Config) *Duration { return &c.ExpirerInterval }),
+	intField("EXPIRER_BATCH_SIZE", "expirer-batch-size", "maximum expired keys tombstoned per query", func(c *Config) *int { return &c.ExpirerBatchSize }),
+	intField("MAX_CACHEABLE_SIZE", "max-cacheable-size", "never cache values larger than this many bytes in Redis (0 = no limit)", func(c *Config) *int { return &c.MaxCacheableSize }),
+	durationField("HYDRATOR_MAX_LAG", "hydrator-max-lag", "bypass the cache for reads while the hydrator's changefeed cursor is older than this (0 disables)", func(c *Config) *Duration { return &c.HydratorMaxLag }),
+	durationField("CACHE_FILL_LOCK_TTL", "cache-fill-lock-ttl", "let one server at a time fill a missed key from CockroachDB, holding a Redis lock for at most this long (0 disables)", func(c *Config) *Duration { return &c.CacheFillLockTTL }),
+	durationField("CACHE_FILL_WAIT", "cache-fill-wait", "how long other servers wait for the fill lock's holder before reading CockroachDB themselves", func(c *Config) *Duration { return &c.CacheFillWait }),
+	durationField("REDIS_STATS_INTERVAL", "redis-stats-interval", "how often to sample Redis memory, TTL coverage and evictions into /debug/vars (0 disables)", func(c *Config) *Duration { return &c.RedisStatsInterval }),
+	intField("REDIS_STATS_SAMPLE_SIZE", "redis-stats-sample-size", "maximum keys per Redis node whose TTL and memory are sampled each interval", func(c *Config) *int { return &c.RedisStatsSampleSize }),
+	boolField("REDIS_EXPIRY_EVENTS", "redis-expiry-events", "tombstone TTL'd keys as soon as Redis reports them expired", func(c *Config) *bool { return &c.RedisExpiryEvents }),
+	durationField("RETENTION_MAX_AGE", "retention-max-age", "keep every entry younger than this, on top of the newest MAX_VERSIONS_PER_KEY (0 = no age limit)", func(c *Config) *Duration { return &c.RetentionMaxAge }),
+	durationField("RETENTION_INTERVAL", "retention-interval", "how often entries past RETENTION_MAX_AGE are pruned", func(c *Config) *Duration { return &c.RetentionInterval }),
+	stringField("STORAGE_MODE", "storage-mode", "log to append every write to kv_log, or upsert to keep only each key's latest entry in kv_current", func(c *Config) *string { return &c.StorageMode }),
+	intField("MAX_VERSIONS_PER_KEY", "max-versions-per-key", "prune each key's log to its newest N entries on write (0 = unlimited)", func(c *Config) *int { return &c.MaxVersionsPerKey }),
+	stringField("FALLBACK_URL", "fallback-url", "base URL of an instance to read through to when a key was never written here (empty disables)", func(c *Config) *string { return &c.FallbackURL }),
+	durationField("FALLBACK_TIMEOUT", "fallback-timeout", "timeout for each fallback read", func(c *Config) *Duration { return &c.FallbackTimeout }),
+	intField("GZIP_MIN_BYTES", "gzip-min-bytes", "gzip responses of at least this many bytes for clients that accept it (0 disables)", func(c *Config) *int { return &c.GzipMinBytes }),
+	durationField("DB_READ_TIMEOUT", "db-read-timeout", "timeout for a single-key CockroachDB read (0 = none)", func(c *Config) *Duration { return &c.DBReadTimeout }),
+	intField("DB_BREAKER_THRESHOLD", "db-breaker-threshold", "consecutive failed reads that open the CockroachDB circuit breaker (0 disables)", func(c *Config) *int { return &c.DBBreakerThreshold }),
+	durationField("DB_BREAKER_COOLDOWN", "db-breaker-cooldown", "how long the breaker stays open before probing CockroachDB again", func(c *Config) *Duration { return &c.DBBreakerCooldown }),
+	boolField("SERVE_STALE_ON_OUTAGE", "serve-stale-on-outage", "answer GETs whose CockroachDB read fails from the cache, marked X-Stale, when it holds the key", func(c *Config) *bool { return &c.ServeStaleOnOutage }),
+	intField("DB_READ_CONCURRENCY", "db-read-concurrency", "most single-key CockroachDB reads running at once (0 = unlimited)", func(c *Config) *int { return &c.DBReadConcurrency }),
+	durationField("DB_READ_QUEUE_TIMEOUT", "db-read-queue-timeout", "how long a read waits for a DB_READ_CONCURRENCY slot before answering 503", func(c *Config) *Duration { return &c.DBReadQueueTimeout }),
+	durationField("COUNT_CACHE_TTL", "count-cache-ttl", "how long /kv/_count results are reused (0 disables caching)", func(c *Config) *Duration { return &c.CountCacheTTL }),
+	durationField("SELFTEST_INTERVAL", "selftest-interval", "how long a /kv/_selftest result is reused before the next run (0 runs every call)", func(c *Config) *Duration { return &c.SelftestInterval }),
+	boolField("ALLOW_EMPTY_VALUES", "allow-empty-values", "accept PUTs of the empty string instead of answering 400", func(c *Config) *bool { return &c.AllowEmptyValues }),
+	stringField("ALIASES", "aliases", "off, or enable aliases and reject (reject) or write through (write_through) plain PUTs to them", func(c *Config) *string { return &c.Aliases }),
+	boolField("READ_ONLY", "read-only", "start in read-only mode, rejecting PUT, PATCH and DELETE with 503", func(c *Config) *bool { return &c.ReadOnly }),
+	intField("WATCH_BUFFER_SIZE", "watch-buffer-size", "changes buffered per /kv/_watch stream before a slow client is disconnected", func(c *Config) *int { return &c.WatchBufferSize }),
+	intField("HOT_KEYS_CAPACITY", "hot-keys-capacity", "keys tracked for read and write counts in /kv/_hot_keys (0 disables)", func(c *Config) *int { return &c.HotKeysCapacity }),
+	intField("LIST_MAX_LIMIT", "list-max-limit", "most keys one /kv/_list page may return", func(c *Config) *int { return &c.ListMaxLimit }),
+	intField("HISTORY_MAX_LIMIT", "history-max-limit", "most entries one /_history page may return", func(c *Config) *int { return &c.HistoryMaxLimit }),
+}
+
+// loadConfig resolves the configuration from defaults, the file named by
+// -config (or CONFIG_FILE), environment variables and flags, then validates it.
+func loadConfig(args []string) (Config, error) {
+	fs := flag.NewFlagSet("kv-server", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a JSON config file")
+	flagValues := map[string]string{}
+	for _, field := range configFields {
+		name := field.flag
+		fs.Func(name, field.usage+" (env "+field.env+")", func(raw string) error {
+			flagValues[name] = raw
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	c := defaultConfig()
+	if *configPath != "" {
+		raw, err := os.ReadFile(*configPath)
+		if err != nil {
+			return Config{}, fmt.Errorf("reading config file: %w", err)
+		}
+		if err := json.Unmarshal(raw, &c); err != nil {
+			return Config{}, fmt.Errorf("parsing config file %s: %w", *configPath, err)
+		}
+	}
+	for _, field := range configFields {
+		if raw := os.Getenv(field.env); raw != "" {
+			if err := field.set(&c, raw); err != nil {
+				return Config{}, fmt.Errorf("invalid %s %q: %w", field.env, raw, err)
+			}
+		}
+	}
+	for _, field := range configFields {
+		if raw, ok := flagValues[field.flag]; ok {
+			if err := field.set(&c, raw); err != nil {
+				return Config{}, fmt.Errorf("invalid -%s %q: %w", field.flag, raw, err)
+			}
+		}
+	}
+	if c.DatabaseURL == "" {
+		dsn, err := buildDatabaseURL(c)
+		if err != nil {
+			return Config{}, err
+		}
+		c.DatabaseURL = dsn
+	}
+	if c.RedisURL == "" {
+		if c.RedisHost == "" || c.RedisPort == "" {
+			return Config{}, errors.New("redis_url, or redis_host and redis_port, must be set")
+		}
+		c.RedisURL = net.JoinHostPort(c.RedisHost, c.RedisPort)
+	}
+	return c, c.validate()
+}
+
+// redisConnOptions returns the Redis settings that do not depend on the
+// topology. REDIS_URL entries may still override them.
+func (c Config) redisConnOptions() redisConnOptions {
+	conn := redisConnOptions{Password: c.RedisPassword, DB: c.RedisDB}
+	if c.RedisTLS {
+		conn.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	return conn
+}
+
+// validSSLModes are the sslmode values lib/pq accepts.
+var validSSLModes = map[string]bool{"disable": true, "require": true, "verify-ca": true, "verify-full": true}
+
+// buildDatabaseURL assembles a postgresql:// URL from the DB_* settings for
+// deployments that do not provide a full database URL. The user and
+// password are escaped, so they may contain any character.
+func buildDatabaseURL(c Config) (string, error) {
+	var errs []error
+	for _, required := range []struct{ name, value string }{
+		{"db_host", c.DBHost}, {"db_port", c.DBPort}, {"db_user", c.DBUser}, {"db_name", c.DBName},
+	} {
+		if required.value == "" {
+			errs = append(errs, fmt.Errorf("%s is required when database_url is not set", required.name))
+		}
+	}
+	if _, err := strconv.ParseUint(c.DBPort, 10, 16); c.DBPort != "" && err != nil {
+		errs = append(errs, fmt.Errorf("db_port %q is not a valid port", c.DBPort))
+	}
+	if c.DBSSLMode != "" && !validSSLModes[c.DBSSLMode] {
+		errs = append(errs, fmt.Errorf("db_sslmode %q is not one of disable, require, verify-ca or verify-full", c.DBSSLMode))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return "", err
+	}
+	u := url.URL{
+		Scheme: "postgresql",
+		User:   url.User(c.DBUser),
+		Host:   net.JoinHostPort(c.DBHost, c.DBPort),
+		Path:   "/" + c.DBName,
+	}
+	if c.DBPassword != "" {
+		u.User = url.UserPassword(c.DBUser, c.DBPassword)
+	}
+	query := url.Values{}
+	if c.DBSSLMode != "" {
+		query.Set("sslmode", c.DBSSLMode)
+	}
+	if c.DBSSLRootCert != "" {
+		query.Set("sslrootcert", c.DBSSLRootCert)
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+func (c Config) validate() error {
+	var errs []error
+	if c.DatabaseURL == "" {
+		errs = append(errs, errors.New("database_url is required"))
+	}
+	if c.RedisURL == "" {
+		errs = append(errs, errors.New("redis_url is required"))
+	}
+	if c.Port == "" {
+		errs = append(errs, errors.New("port is required"))
+	}
+	if c.AdminAddr != "" {
+		if _, _, err := net.SplitHostPort(c.AdminAddr); err != nil {
+			errs = append(errs, fmt.Errorf("admin_addr must be host:port: %v", err))
+		}
+	}
+	if _, err := parseCacheMode(c.CacheMode); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateLocality(parseRegions(c.DBRegions), c.TableLocality); err != nil {
+		errs = append(errs, err)
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		errs = append(errs, errors.New("tls_cert_file and tls_key_file must be set together"))
+	}
+	if c.CacheTTL < 0 || c.CountCacheTTL < 0 || c.SelftestInterval < 0 || c.HydratorMaxLag < 0 || c.SlowRequestThreshold < 0 || c.ReadHeaderTimeout < 0 || c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.IdleTimeout < 0 {
+		errs = append(errs, errors.New("durations must not be negative"))
+	}
+	if c.WatchBufferSize <= 0 {
+		errs = append(errs, errors.New("watch_buffer_size must be positive"))
+	}
+	if c.MaxBodyBytes <= 0 {
+		errs = append(errs, errors.New("max_body_bytes must be positive"))
+	}
+	if c.WriteMode != writeModeSync && c.WriteMode != writeModeAsync {
+		errs = append(errs, fmt.Errorf("write_mode %q must be sync or async", c.WriteMode))
+	}
+	if c.WriteMode == writeModeAsync && (c.AsyncQueueSize <= 0 || c.AsyncFlushBatchSize <= 0) {
+		errs = append(errs, errors.New("async_queue_size and async_flush_batch_size must be positive in async mode"))
+	}
+	if c.AsyncQueueFull != "reject" && c.AsyncQueueFull != "block" {
+		errs = append(errs, fmt.Errorf("async_queue_full %q must be reject or block", c.AsyncQueueFull))
+	}
+	if c.Aliases != aliasesOff && c.Aliases != aliasesReject && c.Aliases != aliasesWriteThrough {
+		errs = append(errs, fmt.Errorf("aliases %q must be off, reject or write_through", c.Aliases))
+	}
+	if c.WriteBatchSize > 1 && c.WriteBatchWindow <= 0 {
+		errs = append(errs, errors.New("write_batch_window must be positive when batching is enabled"))
+	}
+	if c.FallbackURL != "" {
+		if u, err := url.Parse(c.FallbackURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("fallback_url %q must be an http or https URL", c.FallbackURL))
+		}
+		if c.FallbackTimeout <= 0 {
+			errs = append(errs, errors.New("fallback_timeout must be positive when a fallback is configured"))
+		}
+	}
+	if c.ExpirerInterval < 0 {
+		errs = append(errs, errors.New("expirer_interval must not be negative"))
+	}
+	if c.ExpirerInterval > 0 && c.ExpirerBatchSize <= 0 {
+		errs = append(errs, errors.New("expirer_batch_size must be positive when the expirer is enabled"))
+	}
+	if c.CacheFillLockTTL < 0 {
+		errs = append(errs, errors.New("cache_fill_lock_ttl must not be negative"))
+	}
+	if c.CacheFillLockTTL > 0 && c.CacheFillWait <= 0 {
+		errs = append(errs, errors.New("cache_fill_wait must be positive when cache fill locks are enabled"))
+	}
+	if c.RedisStatsInterval < 0 {
+		errs = append(errs, errors.New("redis_stats_interval must not be negative"))
+	}
+	if c.RedisStatsInterval > 0 && c.RedisStatsSampleSize <= 0 {
+		errs = append(errs, errors.New("redis_stats_sample_size must be positive when Redis stats are enabled"))
+	}
+	if c.DBReadTimeout < 0 || c.DBBreakerThreshold < 0 || c.DBStatementTimeout < 0 {
+		errs = append(errs, errors.New("db_read_timeout, db_breaker_threshold and db_statement_timeout must not be negative"))
+	}
+	if c.DBReadConcurrency < 0 {
+		errs = append(errs, errors.New("db_read_concurrency must not be negative"))
+	}
+	if c.DBReadConcurrency > 0 && c.DBReadQueueTimeout <= 0 {
+		errs = append(errs, errors.New("db_read_queue_timeout must be positive when db_read_concurrency is set"))
+	}
+	if c.HomeRegionFencing && c.OriginRegion == "" {
+		errs = append(errs, errors.New("home_region_fencing requires origin_region"))
+	}
+	if _, err := parseRegionAddresses(c.RegionAddresses); err != nil {
+		errs = append(errs, fmt.Errorf("region_addresses: %w", err))
+	}
+	if _, err := parseNamespaceQuotas(c.NamespaceQuotas); err != nil {
+		errs = append(errs, fmt.Errorf("namespace_quotas: %w", err))
+	}
+	if c.RegionsTimeout <= 0 {
+		errs = append(errs, errors.New("regions_timeout must be positive"))
+	}
+	if c.DBBreakerThreshold > 0 && c.DBBreakerCooldown < Duration(time.Second) {
+		errs = append(errs, errors.New("db_breaker_cooldown must be at least 1s when the breaker is enabled"))
+	}
+	if c.MaxVersionsPerKey < 0 {
+		errs = append(errs, errors.New("max_versions_per_key must not be negative"))
+	}
+	if c.StorageMode != storageLog && c.StorageMode != storageUpsert {
+		errs = append(errs, fmt.Errorf("storage_mode %q must be log or upsert", c.StorageMode))
+	}
+	if c.StorageMode == storageUpsert && c.MaxVersionsPerKey > 0 {
+		errs = append(errs, errors.New("max_versions_per_key cannot be set with storage_mode upsert, which keeps one entry per key"))
+	}
+	if c.RetentionMaxAge < 0 {
+		errs = append(errs, errors.New("retention_max_age must not be negative"))
+	}
+	if c.RetentionMaxAge > 0 && c.RetentionInterval <= 0 {
+		errs = append(errs, errors.New("retention_interval must be positive when retention_max_age is set"))
+	}
+	if c.StorageMode == storageUpsert && c.RetentionMaxAge > 0 {
+		errs = append(errs, errors.New("retention_max_age cannot be set with storage_mode upsert, which keeps one entry per key"))
+	}
+	if c.MaxCacheableSize < 0 {
+		errs = append(errs, errors.New("max_cacheable_size must not be negative"))
+	}
+	if c.HotKeysCapacity < 0 {
+		errs = append(errs, errors.New("hot_keys_capacity must not be negative"))
+	}
+	if c.ListMaxLimit < 1 || c.ListMaxLimit > maxQueryLimit || c.HistoryMaxLimit < 1 || c.HistoryMaxLimit > maxQueryLimit {
+		errs = append(errs, fmt.Errorf("list_max_limit and history_max_limit must be between 1 and %d", maxQueryLimit))
+	}
+	if addrs, conn, err := parseRedisURL(c.RedisURL, c.redisConnOptions()); err != nil {
+		errs = append(errs, fmt.Errorf("redis_url: %w", err))
+	} else if conn.DB < 0 || (conn.DB > 0 && c.RedisMasterName == "" && len(addrs) > 1) {
+		errs = append(errs, errors.New("redis_db must not be negative, and must be 0 with Redis Cluster"))
+	}
+	if addrs, conn, err := parseRedisURL(c.RedisURL, c.redisConnOptions()); err == nil {
+		topologyReplicas := c.RedisMasterName != "" || len(addrs) > 1
+		switch {
+		case c.RedisReplicaURL != "" && topologyReplicas:
+			errs = append(errs, errors.New("redis_replica_url only applies to a single Redis node; use redis_read_from_replicas with Sentinel or Cluster"))
+		case c.RedisReadFromReplicas && !topologyReplicas && c.RedisReplicaURL == "":
+			errs = append(errs, errors.New("redis_read_from_replicas needs Sentinel or Cluster, or redis_replica_url for a single node"))
+		case (c.RedisReadFromReplicas || c.RedisReplicaURL != "") && conn.DB != 0:
+			errs = append(errs, errors.New("redis_db must be 0 when cache lookups read from replicas"))
+		}
+	}
+	if _, _, err := parseRedisURL(c.RedisReplicaURL, c.redisConnOptions()); c.RedisReplicaURL != "" && err != nil {
+		errs = append(errs, fmt.Errorf("redis_replica_url: %w", err))
+	}
+	if c.GzipMinBytes < 0 {
+		errs = append(errs, errors.New("gzip_min_bytes must not be negative"))
+	}
+	if c.DBMaxOpenConns < 0 || c.DBMaxIdleConns < 0 || c.RedisPoolSize < 0 || c.WriteBatchSize < 0 {
+		errs = append(errs, errors.New("pool sizes must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// redacted returns a copy of c that is safe to log.
+func (c Config) redacted() Config {
+	if u, err := url.Parse(c.DatabaseURL); err == nil {
+		c.DatabaseURL = u.Redacted()
+	}
+	if u, err := url.Parse(c.FallbackURL); err == nil {
+		c.FallbackURL = u.Redacted()
+	}
+	if c.AdminToken != "" {
+		c.AdminToken = "xxxxx"
+	}
+	if c.DBPassword != "" {
+		c.DBPassword = "xxxxx"
+	}
+	if c.RedisPassword != "" {
+		c.RedisPassword = "xxxxx"
+	}
+	c.RedisURL = redactRedisURL(c.RedisURL)
+	c.RedisReplicaURL = redactRedisURL(c.RedisReplicaURL)
+	return c
+}
+
+// redactRedisURL redacts the passwords of the URLs in a comma-separated
+// Redis address list.
+func redactRedisURL(raw string) string {
+	entries := strings.Split(raw, ",")
+	for i, entry := range entries {
+		if u, err := url.Parse(strings.TrimSpace(entry)); err == nil && u.Scheme != "" {
+			entries[i] = u.Redacted()
+		}
+	}
+	return strings.Join(entries, ",")
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// --- Consistency Levels ---
+//
+// A request picks its consistency with the Consistency header. "eventual",
+// the default, is the usual behavior: a GET is answered from Redis when the
+// key is cached there, which may trail a write accepted in another region
+// until the hydrator applies it. "strong" makes a GET skip Redis and read the
+// key's latest entry from CockroachDB, whose reads are serializable, so it
+// sees every write committed before it began, wherever it was accepted. A
+// strong GET takes no part in cache-fill coordination, is never answered with
+// a stale cached value during an outage and cannot be combined with a follower
+// read; like any miss it still populates the cache. A PUT with Consistency:
+// strong is written synchronously even with WRITE_MODE=async, so it is in
+// CockroachDB by the time it is acknowledged. Other values get 400.
+
+const (
+	consistencyEventual = "eventual"
+	consistencyStrong   = "strong"
+)
+
+// requestedConsistency returns the consistency level of r, answering 400 when
+// the Consistency header names an unknown one.
+func requestedConsistency(w http.ResponseWriter, r *http.Request) (string, bool) {
+	switch level := strings.ToLower(strings.TrimSpace(r.Header.Get("Consistency"))); level {
+	case "", consistencyEventual:
+		return consistencyEventual, true
+	case consistencyStrong:
+		return consistencyStrong, true
+	default:
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "Consistency must be strong or eventual")
+		return "", false
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// --- Dry-Run Writes ---
+
+// dryRunPut answers PUT ?dry_run=true once the request has passed
+// validation. It evaluates the Idempotency-Key, If-Match and if_absent
+// conditions against the current state with plain reads, and reports the
+// response the write would have produced. Nothing is appended, cached or
+// recorded in request_dedup.
+func dryRunPut(w http.ResponseWriter, r *http.Request, body []byte, entry LogEntry, expectedVersion *int64, ifAbsent bool) {
+	if idempotencyKey := r.Header.Get("Idempotency-Key"); idempotencyKey != "" {
+		var storedFingerprint, storedResponse string
+		var status int
+		err := db.QueryRowContext(r.Context(), `
+    SELECT fingerprint, status, response FROM request_dedup
+    WHERE idempotency_key = $1 AND created_at >= now() - INTERVAL '24 hours'
+    `, idempotencyKey).Scan(&storedFingerprint, &status, &storedResponse)
+		switch {
+		case err == sql.ErrNoRows:
+			// First use of the key; evaluate the write itself below.
+		case err != nil:
+			log.Printf("ERROR: Dry-run idempotency lookup failed for key '%s': %v", entry.Key, err)
+			writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+			return
+		case storedFingerprint != requestFingerprint(http.MethodPut, qualifiedKey(entry.Namespace, entry.Key), bytes.TrimSpace(body)):
+			writeError(w, http.StatusUnprocessableEntity, codeIdempotencyReused, "Idempotency-Key was already used for a different request")
+			return
+		default:
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(storedResponse))
+			return
+		}
+	}
+
+	latest, err := latestForKey(r.Context(), entry.Namespace, entry.Key, false)
+	if err != nil {
+		log.Printf("ERROR: Dry-run read failed for key '%s': %v", entry.Key, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	var current int64
+	if latest != nil {
+		current = latest.Version
+	}
+	if ifAbsent && latest != nil && !latest.Deleted {
+		writeError(w, http.StatusConflict, codeKeyExists, "Conflict: key already exists")
+		return
+	}
+	if expectedVersion != nil && *expectedVersion != current {
+		writeError(w, http.StatusConflict, codeVersionConflict, fmt.Sprintf("Version conflict: key is no longer at version %d", *expectedVersion))
+		return
+	}
+	// The version a real write would claim now; a concurrent write may still
+	// take it first.
+	entry.Version = current + 1
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(entry)
+}
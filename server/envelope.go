@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Response Envelope Versions ---
+//
+// A JSON GET names the shape of its response with the Accept-Version header
+// or the v query parameter, which wins when both are given:
+//
+//	1 (the default)  {"key","value","version"}
+//	2                adds the entry's metadata; see valueEnvelopeV2
+//
+// "v1" and "v2" are accepted as well. Version 1 never changes, so existing
+// clients keep working as fields are added; new fields only go into new
+// versions. The cache holds values and versions but no metadata, so a
+// version 2 read always goes to CockroachDB. Plain-text reads are unaffected.
+//
+// For debugging, GET /kv/{key}?full=true instead returns the key's latest
+// entry exactly as the log holds it, every LogEntry field included, even when
+// it is a tombstone, an expired value or an alias. Its shape follows LogEntry
+// and grows with it, so clients should use version 2.
+
+const (
+	envelopeV1 = 1
+	envelopeV2 = 2
+)
+
+// requestedEnvelope returns the envelope version a request asks for, and
+// false when it names one that does not exist.
+func requestedEnvelope(r *http.Request) (int, bool) {
+	requested := r.Header.Get("Accept-Version")
+	if r.URL.Query().Has("v") {
+		requested = r.URL.Query().Get("v")
+	}
+	switch strings.TrimPrefix(strings.TrimSpace(requested), "v") {
+	case "", "1":
+		return envelopeV1, true
+	case "2":
+		return envelopeV2, true
+	}
+	return 0, false
+}
+
+// valueEnvelopeV2 is the version 2 body of a JSON GET.
+type valueEnvelopeV2 struct {
+	Namespace    string            `json:"namespace"`
+	Key          string            `json:"key"`
+	Value        string            `json:"value"`
+	Version      int64             `json:"version"`
+	Timestamp    time.Time         `json:"timestamp"`
+	OriginRegion string            `json:"origin_region,omitempty"`
+	TTLSeconds   int64             `json:"ttl_seconds,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	ValueType    string            `json:"value_type,omitempty"`
+	HomeRegion   string            `json:"home_region,omitempty"`
+}
+
+// needsEntryMetadata reports whether a GET must be answered from the log
+// because its envelope carries metadata the cache does not hold.
+func needsEntryMetadata(r *http.Request) bool {
+	envelope, _ := requestedEnvelope(r)
+	return envelope == envelopeV2 && !wantsPlainText(r)
+}
+
+// writeEntryValue is writeValue for a GET answered from a log entry, which
+// can fill in any envelope version.
+func writeEntryValue(w http.ResponseWriter, r *http.Request, entry *LogEntry) {
+	if !needsEntryMetadata(r) {
+		writeValue(w, r, entry.Key, entry.Value, entry.Version)
+		return
+	}
+	value, ok := projectValue(w, r, entry.Value)
+	if !ok {
+		return
+	}
+	w.Header().Set("X-Version", strconv.FormatInt(entry.Version, 10))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(valueEnvelopeV2{
+		Namespace:    entry.Namespace,
+		Key:          entry.Key,
+		Value:        value,
+		Version:      entry.Version,
+		Timestamp:    entry.Timestamp,
+		OriginRegion: entry.OriginRegion,
+		TTLSeconds:   entry.TTLSeconds,
+		Labels:       entry.Labels,
+		ValueType:    entry.ValueType,
+		HomeRegion:   entry.HomeRegion,
+	})
+}
+
+// fullEntry is the body of a ?full=true GET.
+type fullEntry struct {
+	*LogEntry
+	Expired bool `json:"expired,omitempty"`
+}
+
+// wantsFullEntry reports whether a GET asks for the raw latest entry.
+func wantsFullEntry(r *http.Request) bool {
+	return r.URL.Query().Get("full") == "true"
+}
+
+// handleGetFull serves GET /kv/{key}?full=true from CockroachDB, answering
+// 404 only for a key that was never written.
+func handleGetFull(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Has("jsonpath") {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "full=true cannot be combined with jsonpath")
+		return
+	}
+	namespace, key := requestKey(r)
+	entry, err := latestForKey(r.Context(), namespace, key, allowsStaleRead(r))
+	if errors.Is(err, errDBUnavailable) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Duration(cfg.DBBreakerCooldown).Seconds())))
+		writeError(w, http.StatusServiceUnavailable, codeDBUnavailable, "Service unavailable: CockroachDB is overloaded")
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: CockroachDB query failed for key '%s': %v", key, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	if entry == nil {
+		writeError(w, http.StatusNotFound, codeKeyNotFound, "Key not found")
+		return
+	}
+	setReadSource(w, sourceCockroachDB)
+	w.Header().Set("X-Version", strconv.FormatInt(entry.Version, 10))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fullEntry{LogEntry: entry, Expired: entry.Expired})
+}
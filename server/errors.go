@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+)
+
+// --- Error Responses ---
+//
+// Every error a handler answers with is JSON of the same shape:
+//
+//	{"error": {"code": "KEY_NOT_FOUND", "message": "Key not found", "request_id": "..."}}
+//
+// The HTTP status stays what it always was. code is stable and meant for
+// programs to branch on; message is meant for people and may be reworded.
+// request_id is the X-Request-ID of the request, so a failure reported by a
+// client can be found in the access log. Some errors add fields of their
+// own, such as a schema violation's errors, next to these three.
+// errors_total in /debug/vars counts responses by code.
+
+const (
+	codeInvalidRequest    = "INVALID_REQUEST"
+	codeValidationFailed  = "VALIDATION_FAILED"
+	codeUnauthorized      = "UNAUTHORIZED"
+	codeForbidden         = "FORBIDDEN"
+	codeNotFound          = "NOT_FOUND"
+	codeKeyNotFound       = "KEY_NOT_FOUND"
+	codeNamespaceNotFound = "NAMESPACE_NOT_FOUND"
+	codeMethodNotAllowed  = "METHOD_NOT_ALLOWED"
+	codeConflict          = "CONFLICT"
+	codeKeyExists         = "KEY_EXISTS"
+	codeVersionConflict   = "VERSION_CONFLICT"
+	codeWriteConflict     = "WRITE_CONFLICT"
+	codeSnapshotExpired   = "SNAPSHOT_EXPIRED"
+	codePayloadTooLarge   = "PAYLOAD_TOO_LARGE"
+	codeQuotaExceeded     = "QUOTA_EXCEEDED"
+	codeIdempotencyReused = "IDEMPOTENCY_KEY_REUSED"
+	codeWrongRegion       = "WRONG_REGION"
+	codeAliasLoop         = "ALIAS_LOOP"
+	codeReadOnly          = "READ_ONLY"
+	codeQueueFull         = "QUEUE_FULL"
+	codeDBUnavailable     = "DB_UNAVAILABLE"
+	codeUnavailable       = "UNAVAILABLE"
+	codeInternal          = "INTERNAL"
+)
+
+var errorsByCode = expvar.NewMap("errors_total")
+
+// writeError answers with status and an error of code carrying message.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeErrorDetails(w, status, code, message, nil)
+}
+
+// writeErrorDetails is writeError adding details' fields to the error.
+func writeErrorDetails(w http.ResponseWriter, status int, code, message string, details map[string]any) {
+	body := make(map[string]any, len(details)+3)
+	for field, value := range details {
+		body[field] = value
+	}
+	body["code"] = code
+	body["message"] = message
+	// withRequestID set the header before any handler ran, which saves
+	// threading the request through every helper that answers errors.
+	body["request_id"] = w.Header().Get("X-Request-ID")
+	errorsByCode.Add(code, 1)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"error": body})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Existence Checks ---
+
+// valueETag is the strong ETag for a value. The DB path computes the same
+// digest with CockroachDB's sha256() so both paths agree.
+func valueETag(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// keyMetadata describes a live key without carrying its value.
+type keyMetadata struct {
+	ETag         string
+	Length       int64
+	LastModified time.Time // Zero when served from the cache.
+}
+
+// latestMetadataForKey reads a key's metadata without transferring the value
+// column: length and digest are computed inside CockroachDB. It returns nil
+// when the key is missing, deleted or expired.
+func latestMetadataForKey(ctx context.Context, namespace, key string) (*keyMetadata, error) {
+	var deleted, expired bool
+	var length sql.NullInt64
+	var digest sql.NullString
+	var meta keyMetadata
+	err := db.QueryRowContext(ctx, `
+    SELECT deleted, `+expiredColumn+`, timestamp, octet_length(value), sha256(value) FROM `+logTable()+`
+    WHERE namespace = $1 AND key = $2
+    ORDER BY `+newestFirst+`
+    LIMIT 1;
+    `, namespace, key).Scan(&deleted, &expired, &meta.LastModified, &length, &digest)
+	if err == sql.ErrNoRows || (err == nil && (deleted || expired)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta.Length = length.Int64
+	if digest.Valid {
+		meta.ETag = `"` + digest.String + `"`
+	} else {
+		meta.ETag = valueETag("")
+	}
+	return &meta, nil
+}
+
+// handleExists answers HEAD /kv/{key} and GET /kv/{key}/_exists with 200 and
+// the value's ETag, length (Content-Length for HEAD, X-Value-Length for GET)
+// and, when read from the log, Last-Modified, but no body. Missing and
+// deleted keys get 404.
+func handleExists(w http.ResponseWriter, r *http.Request) {
+	namespace, key := requestKey(r)
+	var meta *keyMetadata
+	val, err := "", error(redis.Nil)
+	if cacheReadable() {
+		val, err = redisReadClient.Get(ctx, redisKey(namespace, key)).Result()
+	}
+	switch {
+	case err == nil:
+		meta = &keyMetadata{ETag: valueETag(val), Length: int64(len(val))}
+		setReadSource(w, sourceRedis)
+	default:
+		if err != redis.Nil {
+			redisErrors.Add(1)
+			log.Printf("WARNING: Redis GET failed for key '%s', falling back to CockroachDB: %v", key, err)
+		}
+		meta, err = latestMetadataForKey(r.Context(), namespace, key)
+		if err != nil {
+			log.Printf("ERROR: CockroachDB query failed for key '%s': %v", key, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		setReadSource(w, sourceCockroachDB)
+	}
+	if meta == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("ETag", meta.ETag)
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Length", strconv.FormatInt(meta.Length, 10))
+	} else {
+		// A GET must not declare a length it does not send.
+		w.Header().Set("X-Value-Length", strconv.FormatInt(meta.Length, 10))
+	}
+	if !meta.LastModified.IsZero() {
+		w.Header().Set("Last-Modified", meta.LastModified.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- TTL Expirer ---
+//
+// Redis drops a key once its ttl_seconds has passed, but the last entry in
+// kv_log would still be live and a cold read would resurrect it. The expirer
+// appends tombstones for such keys so the log agrees with the cache. Every
+// server runs it; each tombstone is conditioned on the version it expires,
+// so concurrent expirers, or a client rewriting the key, cannot race it.
+
+var (
+	expiredKeys    = expvar.NewInt("expired_keys_total")
+	expiredByEvent = expvar.NewInt("expiry_events_total")
+)
+
+// runExpirer tombstones expired keys every interval, forever.
+func runExpirer(interval time.Duration, batchSize int) {
+	log.Printf("TTL expirer running every %v (batch size %d).", interval, batchSize)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for {
+			n, err := expireBatch(batchSize)
+			if err != nil {
+				log.Printf("ERROR: TTL expirer failed: %v", err)
+				break
+			}
+			if n < batchSize {
+				break
+			}
+		}
+	}
+}
+
+// expireBatch tombstones up to batchSize keys whose latest entry is live and
+// past its TTL, and returns how many candidates it found.
+func expireBatch(batchSize int) (int, error) {
+	rows, err := db.Query(`
+    SELECT namespace, key, version FROM (
+        SELECT DISTINCT ON (namespace, key) namespace, key, timestamp, deleted, ttl_seconds, version FROM `+logTable()+`
+        WHERE key IN (SELECT key FROM `+logTable()+` WHERE ttl_seconds IS NOT NULL)
+        ORDER BY namespace, key, `+newestFirst+`
+    ) AS latest
+    WHERE NOT deleted AND ttl_seconds IS NOT NULL
+      AND timestamp + ttl_seconds * INTERVAL '1 second' < now()
+    ORDER BY namespace, key
+    LIMIT $1;
+    `, batchSize)
+	if err != nil {
+		return 0, err
+	}
+	type candidate struct {
+		namespace, key string
+		version        int64
+	}
+	var candidates []candidate
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.namespace, &c.key, &c.version); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		candidates = append(candidates, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, c := range candidates {
+		if _, err := expireKey(c.namespace, c.key, c.version); err != nil {
+			return len(candidates), err
+		}
+	}
+	return len(candidates), nil
+}
+
+// expireKey appends a tombstone for key provided its latest version is still
+// version, and reports whether it did.
+func expireKey(namespace, key string, version int64) (bool, error) {
+	tombstone := LogEntry{
+		Namespace:    namespace,
+		Key:          key,
+		Timestamp:    time.Now().UTC(),
+		Deleted:      true,
+		OriginRegion: cfg.OriginRegion,
+	}
+	err := writeLogEntry(ctx, &tombstone, &version)
+	if errors.Is(err, errVersionConflict) {
+		return false, nil // Rewritten or already expired by another server.
+	}
+	if err != nil {
+		return false, err
+	}
+	expiredKeys.Add(1)
+	applyWriteToCache(tombstone)
+	log.Printf("TTL expirer: tombstoned key '%s' at version %d.", qualifiedKey(namespace, key), tombstone.Version)
+	return true, nil
+}
+
+// --- Redis Expiry Events ---
+//
+// The periodic expirer can lag a key's expiry by a whole interval, during
+// which other regions keep serving the value. With REDIS_EXPIRY_EVENTS set the
+// server also subscribes to Redis keyspace "expired" events and tombstones the
+// key as soon as Redis drops it. An event only leads to a tombstone when the
+// key's latest log entry is live, carries ttl_seconds and is past it: keys
+// evicted by CACHE_TTL alone are left alone, and so is a key the hydrator or
+// a client has written again since, which breaks any expire/re-set loop.
+
+// expiryEventsPattern matches expired events from every Redis database.
+const expiryEventsPattern = "__keyevent@*__:expired"
+
+// runExpiryEventListener consumes Redis expired events until the subscription
+// is closed. go-redis resubscribes on reconnect.
+func runExpiryEventListener() {
+	if _, ok := redisClient.(*redis.ClusterClient); ok {
+		log.Printf("WARNING: Redis expiry events are not supported in cluster mode; relying on the periodic expirer.")
+		return
+	}
+	enableExpiryEvents()
+	sub := redisClient.PSubscribe(ctx, expiryEventsPattern)
+	defer sub.Close()
+	log.Printf("Listening for Redis expiry events on %s.", expiryEventsPattern)
+	for msg := range sub.Channel() {
+		path, ok := strings.CutPrefix(msg.Payload, cfg.RedisKeyPrefix)
+		if !ok {
+			continue // Another application's key in a shared Redis.
+		}
+		namespace, key := resolveKey(path)
+		if err := expireOnEvent(namespace, key); err != nil {
+			log.Printf("ERROR: Failed to handle Redis expiry of key '%s': %v", msg.Payload, err)
+		}
+	}
+}
+
+// enableExpiryEvents turns on expired-event notifications, keeping any other
+// classes already configured. Managed Redis often forbids CONFIG, so failure
+// is only a warning; the events then have to be enabled by the operator.
+func enableExpiryEvents() {
+	current, err := redisClient.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil || len(current) < 2 {
+		log.Printf("WARNING: Could not read notify-keyspace-events; expiry events may not be delivered: %v", err)
+		return
+	}
+	flags, _ := current[1].(string)
+	hasEvents, hasExpired := strings.Contains(flags, "E"), strings.ContainsAny(flags, "xA")
+	if hasEvents && hasExpired {
+		return
+	}
+	if !hasEvents {
+		flags += "E"
+	}
+	if !hasExpired {
+		flags += "x"
+	}
+	if err := redisClient.ConfigSet(ctx, "notify-keyspace-events", flags).Err(); err != nil {
+		log.Printf("WARNING: Could not enable Redis expiry events (notify-keyspace-events %q): %v", flags, err)
+	}
+}
+
+// expireOnEvent tombstones key if its latest log entry has outlived its TTL.
+func expireOnEvent(namespace, key string) error {
+	entry, err := latestForKey(ctx, namespace, key, false)
+	if err != nil || entry == nil || entry.Deleted || entry.TTLSeconds <= 0 {
+		return err
+	}
+	if time.Since(entry.Timestamp) < time.Duration(entry.TTLSeconds)*time.Second {
+		return nil // Redis expired it early; the periodic expirer will catch up.
+	}
+	expired, err := expireKey(namespace, key, entry.Version)
+	if expired {
+		expiredByEvent.Add(1)
+	}
+	return err
+}
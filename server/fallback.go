@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// --- Fallback Reads ---
+//
+// During a migration the service can be pointed at an old data source. A GET
+// that misses both the cache and kv_log then asks the fallback; a value found
+// there is appended to our log and cached, so each key is migrated on first
+// read. Keys that exist in kv_log, tombstones included, never consult it.
+
+// FallbackReader looks a key up in a secondary store. It reports found=false,
+// with a nil error, when the store does not have the key.
+type FallbackReader interface {
+	Read(namespace, key string) (value string, found bool, err error)
+}
+
+// fallbackReader is nil when no fallback is configured.
+var fallbackReader FallbackReader
+
+var fallbackHits = expvar.NewInt("fallback_hits_total")
+
+// httpFallback reads from another instance's /kv/ endpoint.
+type httpFallback struct {
+	baseURL string
+	client  *http.Client
+}
+
+func newHTTPFallback(baseURL string, timeout time.Duration) *httpFallback {
+	return &httpFallback{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+// Read assumes the other instance has the same namespaces registered.
+func (f *httpFallback) Read(namespace, key string) (string, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, f.baseURL+"/kv/"+escapedKeyPath(namespace, key), nil)
+	if err != nil {
+		return "", false, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", false, nil
+	default:
+		return "", false, fmt.Errorf("fallback returned %s", resp.Status)
+	}
+	var payload struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return "", false, fmt.Errorf("decoding fallback response: %w", err)
+	}
+	return payload.Value, true, nil
+}
+
+// readThroughFallback fetches key from the fallback and, if found, migrates
+// it into the log and cache. The append only succeeds while the key has
+// never been written here, so a concurrent write or read-through wins and
+// the fetched value is not logged twice. It returns nil if the fallback
+// does not have the key.
+func readThroughFallback(ctx context.Context, namespace, key string) (*LogEntry, error) {
+	value, found, err := fallbackReader.Read(namespace, key)
+	if err != nil || !found {
+		return nil, err
+	}
+	fallbackHits.Add(1)
+	entry := LogEntry{
+		Namespace:    namespace,
+		Key:          key,
+		Value:        value,
+		Timestamp:    time.Now().UTC(),
+		OriginRegion: cfg.OriginRegion,
+	}
+	neverWritten := int64(0)
+	err = writeLogEntry(ctx, &entry, &neverWritten)
+	if errors.Is(err, errVersionConflict) {
+		// Someone else wrote the key meanwhile; serve what is now current.
+		return latestForKey(ctx, namespace, key, false)
+	}
+	var quotaErr *errQuotaExceeded
+	if errors.As(err, &quotaErr) {
+		// The value is served but stays in the fallback until there is room.
+		log.Printf("WARNING: Not migrating key '%s' from fallback: %v", key, err)
+		return &entry, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := cacheSet(entry); err != nil {
+		redisErrors.Add(1)
+		log.Printf("ERROR: Failed to cache migrated key '%s': %v", key, err)
+	}
+	log.Printf("GET migrated key '%s' from fallback at version %d", key, entry.Version)
+	return &entry, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"expvar"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Cross-Instance Cache Fills ---
+//
+// When a hot key is missing from the cache, every server that receives a GET
+// for it reads CockroachDB at once. With CACHE_FILL_LOCK_TTL set, a server
+// that misses first takes a short-lived Redis lock on the key (SET NX PX).
+// The holder reads CockroachDB and populates the cache as usual, then
+// releases the lock. Servers that find the lock taken poll the cache instead,
+// for at most CACHE_FILL_WAIT, and serve the value once it appears. If the
+// lock is released or expires without the key being cached (it may not
+// exist, or the holder stalled), or the wait runs out, they read CockroachDB
+// themselves, so a stuck holder costs latency but never a failed read.
+
+// cacheFillPollInterval is how often a waiting server checks the cache.
+const cacheFillPollInterval = 10 * time.Millisecond
+
+var (
+	cacheFillDedupHits = expvar.NewInt("cache_fill_dedup_hits_total")
+	cacheFillTimeouts  = expvar.NewInt("cache_fill_wait_timeouts_total")
+)
+
+// releaseFillLockScript deletes a fill lock only if it still holds our token,
+// so a holder whose lock expired cannot release its successor's.
+var releaseFillLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+    return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// fillLockKey is the Redis key of namespace/key's fill lock.
+func fillLockKey(namespace, key string) string {
+	return cfg.RedisKeyPrefix + "kv:fill:" + qualifiedKey(namespace, key)
+}
+
+// coordinateCacheFill is called after a cache miss. It either takes the fill
+// lock, returning a release func to call once the cache is populated, or
+// waits for the holder: hit reports that the holder cached the key, whose
+// value and version are returned. Without hit the caller reads CockroachDB.
+// Redis errors skip the coordination. The wait ends early when ctx, the
+// request's, is cancelled; the lock is released even then, so the next
+// server does not wait out its TTL.
+func coordinateCacheFill(ctx context.Context, namespace, key string) (release func(), value string, version int64, hit bool) {
+	release = func() {}
+	if cfg.CacheFillLockTTL <= 0 {
+		return release, "", 0, false
+	}
+	lockKey := fillLockKey(namespace, key)
+	token := make([]byte, 8)
+	rand.Read(token)
+	acquired, err := redisClient.SetNX(ctx, lockKey, hex.EncodeToString(token), time.Duration(cfg.CacheFillLockTTL)).Result()
+	if err != nil {
+		if ctx.Err() == nil {
+			redisErrors.Add(1)
+		}
+		return release, "", 0, false
+	}
+	if acquired {
+		return func() {
+			if err := releaseFillLockScript.Run(context.WithoutCancel(ctx), redisClient, []string{lockKey}, hex.EncodeToString(token)).Err(); err != nil {
+				redisErrors.Add(1)
+			}
+		}, "", 0, false
+	}
+	deadline := time.NewTimer(time.Duration(cfg.CacheFillWait))
+	defer deadline.Stop()
+	poll := time.NewTicker(cacheFillPollInterval)
+	defer poll.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return release, "", 0, false
+		case <-deadline.C:
+			cacheFillTimeouts.Add(1)
+			return release, "", 0, false
+		case <-poll.C:
+		}
+		value, version, hit, err := cacheGet(redisKey(namespace, key))
+		if hit {
+			cacheFillDedupHits.Add(1)
+			return release, value, version, true
+		}
+		if err != nil {
+			redisErrors.Add(1)
+			return release, "", 0, false
+		}
+		held, err := redisClient.Exists(ctx, lockKey).Result()
+		if err != nil || held == 0 {
+			// The holder is done without caching the key; read it directly.
+			return release, "", 0, false
+		}
+	}
+}
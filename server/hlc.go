@@ -0,0 +1,44 @@
+package main
+
+import (
+	"cmp"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// --- Commit Ordering ---
+//
+// Entries are ordered by the CockroachDB commit timestamp of the transaction
+// that wrote them, recorded in the hlc column via cluster_logical_timestamp().
+// Unlike the wall-clock timestamp column, which each server fills from its
+// own clock, commit timestamps are consistent across regions: of two writes
+// to a key, the one that committed later always has the larger hlc. It is the
+// same clock as the changefeed's updated field, which the hydrator compares
+// before applying an event.
+//
+// Rows written before hlc existed have none. Descending order puts NULLs
+// last, and every such row is older than every row that has one, so ordering
+// by hlc and then timestamp keeps them in their original order at the end.
+
+// newestFirst is the ORDER BY term listing a key's entries latest first.
+const newestFirst = "hlc DESC, timestamp DESC"
+
+// hlcPattern matches an HLC timestamp as CockroachDB renders it:
+// "<wall nanos>.<logical>", the logical part being optional.
+var hlcPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+
+// compareHLC orders two HLC timestamps. The logical part is a counter written
+// with ten digits, so it is compared as an integer rather than a fraction.
+func compareHLC(a, b string) int {
+	aWall, aLogical, _ := strings.Cut(a, ".")
+	bWall, bLogical, _ := strings.Cut(b, ".")
+	aw, _ := strconv.ParseInt(aWall, 10, 64)
+	bw, _ := strconv.ParseInt(bWall, 10, 64)
+	if aw != bw {
+		return cmp.Compare(aw, bw)
+	}
+	al, _ := strconv.ParseInt(aLogical, 10, 64)
+	bl, _ := strconv.ParseInt(bLogical, 10, 64)
+	return cmp.Compare(al, bl)
+}
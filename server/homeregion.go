@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// --- Home Regions ---
+//
+// With HOME_REGION_FENCING enabled, a PUT may give its key a home region with
+// "home_region" in the body. From then on only the server whose ORIGIN_REGION
+// matches accepts writes to the key; the others answer 421 Misdirected
+// Request naming the home region and, from REGION_ADDRESSES, its address, so
+// the client can re-route. Every region still serves reads. A homed key thus
+// has a single writer, and a partitioned region cannot accept writes to it
+// that conflict with the home region's once the partition heals.
+//
+// The home region is stored in kv_log's home_region column and carried
+// forward by every write that does not set it, tombstones included, so
+// deleting a key does not unfence it; "home_region": "" clears it. Keys
+// without one accept writes anywhere, as before. The check reads the key's
+// latest entry before the write, so a write racing a change of home region
+// may still land once.
+
+// regionAddresses maps region names to the base URL of their servers, from
+// REGION_ADDRESSES. It is set once at startup.
+var regionAddresses map[string]string
+
+// parseRegionAddresses parses REGION_ADDRESSES, a comma-separated list of
+// region=url pairs.
+func parseRegionAddresses(raw string) (map[string]string, error) {
+	addresses := map[string]string{}
+	for _, pair := range strings.Split(raw, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		region, address, ok := strings.Cut(pair, "=")
+		region, address = strings.TrimSpace(region), strings.TrimSpace(address)
+		if !ok || region == "" {
+			return nil, fmt.Errorf("%q is not region=url", pair)
+		}
+		if u, err := url.Parse(address); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("address %q of region %s must be an http or https URL", address, region)
+		}
+		addresses[region] = strings.TrimSuffix(address, "/")
+	}
+	return addresses, nil
+}
+
+// validateHomeRegion checks a home_region given in a PUT. An empty region
+// clears the key's home; with REGION_ADDRESSES set, others must be listed.
+func validateHomeRegion(region string) error {
+	if !cfg.HomeRegionFencing {
+		return fmt.Errorf("home_region requires HOME_REGION_FENCING")
+	}
+	if region == "" || len(regionAddresses) == 0 {
+		return nil
+	}
+	if _, ok := regionAddresses[region]; !ok {
+		return fmt.Errorf("home_region %q is not listed in REGION_ADDRESSES", region)
+	}
+	return nil
+}
+
+// homeRegionParam is the home_region argument of a log insert: NULL carries
+// the key's current home region forward, and a string sets it ("" clears).
+func homeRegionParam(entry *LogEntry) sql.NullString {
+	if entry.homeRegionUpdate == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: *entry.homeRegionUpdate, Valid: true}
+}
+
+// latestHomeRegionQuery selects the home region of the key's latest entry,
+// given the placeholders of its namespace and key, for log inserts to carry
+// forward.
+func latestHomeRegionQuery(namespace, key string) string {
+	return `SELECT home_region FROM ` + logTable() + ` WHERE namespace = ` + namespace + ` AND key = ` + key + ` ORDER BY ` + newestFirst + ` LIMIT 1`
+}
+
+// homeRegionOf returns the home region of key's latest entry, "" if it has
+// none or the key was never written.
+func homeRegionOf(ctx context.Context, namespace, key string) (string, error) {
+	var home sql.NullString
+	err := db.QueryRowContext(ctx, `
+    SELECT home_region FROM `+logTable()+`
+    WHERE namespace = $1 AND key = $2
+    ORDER BY `+newestFirst+`
+    LIMIT 1;
+    `, namespace, key).Scan(&home)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return home.String, err
+}
+
+// isHomedElsewhere reports whether a key with the given home region may not
+// be written by this server.
+func isHomedElsewhere(home string) bool {
+	return cfg.HomeRegionFencing && home != "" && home != cfg.OriginRegion
+}
+
+// rejectIfNotHome answers 421 and returns true when r writes to a key whose
+// home region is another region.
+func rejectIfNotHome(w http.ResponseWriter, r *http.Request, namespace, key string) bool {
+	if !cfg.HomeRegionFencing {
+		return false
+	}
+	switch r.Method {
+	case http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodPost:
+	default:
+		return false
+	}
+	home, err := homeRegionOf(r.Context(), namespace, key)
+	if err != nil {
+		log.Printf("ERROR: Failed to read the home region of key '%s' from CockroachDB: %v", key, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return true
+	}
+	if !isHomedElsewhere(home) {
+		return false
+	}
+	writeMisdirected(w, key, home)
+	return true
+}
+
+// writeMisdirected answers 421 for a write to key, whose home region is home,
+// with what a client needs to retry it there.
+func writeMisdirected(w http.ResponseWriter, key, home string) {
+	details := map[string]any{
+		"key":         key,
+		"home_region": home,
+	}
+	if address, ok := regionAddresses[home]; ok {
+		details["home_address"] = address
+	}
+	w.Header().Set("X-Home-Region", home)
+	writeErrorDetails(w, http.StatusMisdirectedRequest, codeWrongRegion, "Key is homed in another region; send writes there", details)
+}
+
+// errHomedElsewhere is returned by transactional writes that find a key homed
+// in another region.
+type errHomedElsewhere struct {
+	key, home string
+}
+
+func (e *errHomedElsewhere) Error() string {
+	return fmt.Sprintf("key %q is homed in region %s", e.key, e.home)
+}
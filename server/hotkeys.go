@@ -0,0 +1,205 @@
+package main
+
+import (
+	"cmp"
+	"container/heap"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Hot Keys ---
+//
+// The server keeps approximate per-key read and write counts so operators can
+// find the hottest keys, e.g. to pre-warm them or to choose what to make
+// GLOBAL in a multi-region cluster. Each is a Space-Saving summary of
+// HOT_KEYS_CAPACITY counters: a key already tracked has its counter
+// incremented, and a new key replaces the key with the smallest counter,
+// inheriting that count as its possible error. Memory is fixed at capacity
+// counters, and an observation costs O(log capacity) under a mutex.
+//
+// With N observations since the last reset, the smallest counter is at most
+// N/capacity. Every key that was really seen more often than that is tracked,
+// and a tracked key's count exceeds its true count by at most its error,
+// which is never more than the smallest counter. Counts are per process and
+// start over on restart or DELETE /kv/_hot_keys.
+
+// hotKeyTracker is a Space-Saving summary: a map of the tracked keys plus a
+// min-heap of their counters.
+type hotKeyTracker struct {
+	mu       sync.Mutex
+	capacity int
+	counters map[string]*hotKeyCounter
+	heap     hotKeyHeap
+	total    int64
+}
+
+type hotKeyCounter struct {
+	key   string
+	count int64
+	err   int64
+	index int // Position in the heap.
+}
+
+// hotKeyHeap orders counters by count, smallest first.
+type hotKeyHeap []*hotKeyCounter
+
+func (h hotKeyHeap) Len() int           { return len(h) }
+func (h hotKeyHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h hotKeyHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *hotKeyHeap) Push(x any) {
+	c := x.(*hotKeyCounter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+func (h *hotKeyHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+var (
+	hotReads, hotWrites *hotKeyTracker // nil when HOT_KEYS_CAPACITY is 0.
+	hotKeysSince        time.Time
+	hotKeysSinceMu      sync.Mutex
+)
+
+func newHotKeyTracker(capacity int) *hotKeyTracker {
+	return &hotKeyTracker{capacity: capacity, counters: make(map[string]*hotKeyCounter, capacity)}
+}
+
+// initHotKeys enables tracking with capacity counters per operation.
+func initHotKeys(capacity int) {
+	if capacity <= 0 {
+		return
+	}
+	hotReads, hotWrites = newHotKeyTracker(capacity), newHotKeyTracker(capacity)
+	hotKeysSince = time.Now().UTC()
+}
+
+// recordAccess counts a request to key: GET and HEAD as reads, PUT, PATCH,
+// DELETE and POST (appends) as writes.
+func recordAccess(method, namespace, key string) {
+	if hotReads == nil {
+		return
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		hotReads.observe(qualifiedKey(namespace, key))
+	case http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodPost:
+		hotWrites.observe(qualifiedKey(namespace, key))
+	}
+}
+
+func (t *hotKeyTracker) observe(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total++
+	if c, ok := t.counters[key]; ok {
+		c.count++
+		heap.Fix(&t.heap, c.index)
+		return
+	}
+	if len(t.heap) < t.capacity {
+		c := &hotKeyCounter{key: key, count: 1}
+		t.counters[key] = c
+		heap.Push(&t.heap, c)
+		return
+	}
+	// Evict the smallest counter; the newcomer inherits its count as error.
+	c := t.heap[0]
+	delete(t.counters, c.key)
+	c.key, c.err = key, c.count
+	c.count++
+	t.counters[key] = c
+	heap.Fix(&t.heap, 0)
+}
+
+// hotKey is one entry of the /kv/_hot_keys report.
+type hotKey struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+	Error int64  `json:"error"`
+}
+
+// hotKeyReport is a tracker's top keys with its error bound.
+type hotKeyReport struct {
+	Total int64 `json:"total"`
+	// ErrorBound is the smallest counter: no untracked key was seen more
+	// often, and no count is overestimated by more.
+	ErrorBound int64    `json:"error_bound"`
+	Keys       []hotKey `json:"keys"`
+}
+
+// top returns the n keys with the highest counts.
+func (t *hotKeyTracker) top(n int) hotKeyReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	report := hotKeyReport{Total: t.total, Keys: make([]hotKey, 0, len(t.heap))}
+	if len(t.heap) == t.capacity {
+		report.ErrorBound = t.heap[0].count
+	}
+	for _, c := range t.heap {
+		report.Keys = append(report.Keys, hotKey{c.key, c.count, c.err})
+	}
+	slices.SortFunc(report.Keys, func(a, b hotKey) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), strings.Compare(a.Key, b.Key))
+	})
+	report.Keys = report.Keys[:min(n, len(report.Keys))]
+	return report
+}
+
+func (t *hotKeyTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.counters = make(map[string]*hotKeyCounter, t.capacity)
+	t.heap = nil
+	t.total = 0
+}
+
+// handleHotKeys serves GET /kv/_hot_keys?n= with the n hottest keys for reads
+// and writes (default 20), and DELETE to reset the counts. Both are admin
+// only.
+func handleHotKeys(w http.ResponseWriter, r *http.Request) {
+	if hotReads == nil {
+		writeError(w, http.StatusNotFound, codeNotFound, "Hot key tracking is disabled (HOT_KEYS_CAPACITY=0)")
+		return
+	}
+	if r.Method == http.MethodDelete {
+		hotReads.reset()
+		hotWrites.reset()
+		hotKeysSinceMu.Lock()
+		hotKeysSince = time.Now().UTC()
+		hotKeysSinceMu.Unlock()
+		log.Printf("Hot key counts reset by %s", r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	n := 20
+	if raw := r.URL.Query().Get("n"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 {
+			writeError(w, http.StatusBadRequest, codeValidationFailed, "n must be a positive integer")
+			return
+		}
+		n = parsed
+	}
+	hotKeysSinceMu.Lock()
+	since := hotKeysSince
+	hotKeysSinceMu.Unlock()
+	json.NewEncoder(w).Encode(map[string]any{
+		"since":    since,
+		"capacity": hotReads.capacity,
+		"reads":    hotReads.top(n),
+		"writes":   hotWrites.top(n),
+	})
+}
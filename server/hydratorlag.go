@@ -0,0 +1,142 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Hydrator Staleness ---
+//
+// Only the hydrator moves other regions' writes, and with CACHE_MODE=cdc_only
+// this server's own writes too, into Redis. If it stops, the log keeps
+// growing but cached values never change, and reads serve them indefinitely.
+// With HYDRATOR_MAX_LAG set, the server watches the changefeed cursor the
+// hydrator stores in Redis after every resolved timestamp. When the cursor
+// trails the clock by more than HYDRATOR_MAX_LAG, or is missing, reads bypass
+// the cache and go to CockroachDB until the hydrator catches up again. Redis
+// errors leave the state unchanged; failed lookups already fall through.
+// Hydrators splitting the keys between them by prefix keep one cursor each,
+// and the oldest one counts.
+
+// hydratorCheckInterval is how often the cursor is read.
+const hydratorCheckInterval = 5 * time.Second
+
+var (
+	// cacheBypassed is true while reads skip the cache.
+	cacheBypassed      atomic.Bool
+	cacheBypassedReads = expvar.NewInt("cache_bypassed_reads_total")
+	// hydratorLagNanos is the last measured lag, -1 before the first one or
+	// while the cursor is missing.
+	hydratorLagNanos atomic.Int64
+)
+
+func init() {
+	hydratorLagNanos.Store(-1)
+	expvar.Publish("cache_bypassed", expvar.Func(func() any { return cacheBypassed.Load() }))
+	expvar.Publish("hydrator_lag_seconds", expvar.Func(func() any {
+		if n := hydratorLagNanos.Load(); n >= 0 {
+			return time.Duration(n).Seconds()
+		}
+		return nil
+	}))
+}
+
+// cacheReadable reports whether reads may use the cache, counting the ones
+// that may not.
+func cacheReadable() bool {
+	if cacheBypassed.Load() {
+		cacheBypassedReads.Add(1)
+		return false
+	}
+	return true
+}
+
+// hydratorCursorKey is the Redis key the hydrator keeps its changefeed
+// cursor, the newest resolved HLC timestamp, in.
+func hydratorCursorKey() string {
+	return cfg.RedisKeyPrefix + "hydrator:cursor"
+}
+
+// hydratorCursorsKey is the Redis hash of the cursors of hydrators that
+// partition the keys, one field per partition.
+func hydratorCursorsKey() string {
+	return cfg.RedisKeyPrefix + "hydrator:cursors"
+}
+
+// oldestHydratorCursor returns the oldest of the hydrators' cursors, or
+// redis.Nil when there is none.
+func oldestHydratorCursor() (string, error) {
+	pipe := redisClient.Pipeline()
+	single := pipe.Get(ctx, hydratorCursorKey())
+	partitioned := pipe.HVals(ctx, hydratorCursorsKey())
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return "", err
+	}
+	cursors := partitioned.Val()
+	if cursor, err := single.Result(); err == nil {
+		cursors = append(cursors, cursor)
+	}
+	if len(cursors) == 0 {
+		return "", redis.Nil
+	}
+	oldest := cursors[0]
+	for _, cursor := range cursors[1:] {
+		if compareHLC(cursor, oldest) < 0 {
+			oldest = cursor
+		}
+	}
+	return oldest, nil
+}
+
+// runHydratorWatch checks the hydrator's lag every hydratorCheckInterval and
+// switches cache bypass on or off.
+func runHydratorWatch(maxLag time.Duration) {
+	for {
+		checkHydratorLag(maxLag)
+		time.Sleep(hydratorCheckInterval)
+	}
+}
+
+func checkHydratorLag(maxLag time.Duration) {
+	cursor, err := oldestHydratorCursor()
+	if err == redis.Nil {
+		hydratorLagNanos.Store(-1)
+		setCacheBypass(true, "the hydrator has not recorded a changefeed cursor")
+		return
+	}
+	if err != nil {
+		redisErrors.Add(1)
+		return
+	}
+	wall, _, _ := strings.Cut(cursor, ".")
+	nanos, err := strconv.ParseInt(wall, 10, 64)
+	if err != nil {
+		log.Printf("WARNING: Ignoring malformed hydrator cursor %q: %v", cursor, err)
+		return
+	}
+	lag := max(time.Since(time.Unix(0, nanos)), 0)
+	hydratorLagNanos.Store(int64(lag))
+	if lag > maxLag {
+		setCacheBypass(true, "hydrator lag "+lag.Round(time.Second).String()+" exceeds HYDRATOR_MAX_LAG "+maxLag.String())
+		return
+	}
+	setCacheBypass(false, "hydrator lag "+lag.Round(time.Second).String()+" is within HYDRATOR_MAX_LAG")
+}
+
+// setCacheBypass switches cache bypass and logs the change.
+func setCacheBypass(enabled bool, reason string) {
+	if cacheBypassed.Swap(enabled) == enabled {
+		return
+	}
+	if enabled {
+		log.Printf("WARNING: Cache bypass enabled (%s); reads go to CockroachDB.", reason)
+	} else {
+		log.Printf("Cache bypass disabled (%s); reads use the cache again.", reason)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// --- Idempotent Writes ---
+
+// The request_dedup table (see the migrations package) holds the responses
+// of writes made with an Idempotency-Key. Rows are expired by CockroachDB's
+// row-level TTL; rows past their TTL that have not been collected yet are
+// treated as absent.
+
+var errIdempotencyKeyReused = errors.New("idempotency key reused with a different request")
+
+// requestFingerprint identifies the logical request an idempotency key was
+// first used for, so the same key cannot silently replay a different write.
+func requestFingerprint(method, key string, body []byte) string {
+	sum := sha256.New()
+	sum.Write([]byte(method + "\x00" + key + "\x00"))
+	sum.Write(body)
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// appendToLogIdempotent appends entry and records its response under
+// idempotencyKey in one transaction. If the key was already used, nothing is
+// appended and the stored status and response are returned with replayed set.
+// A concurrent duplicate blocks on the first transaction's dedup row and then
+// replays its result. expectedVersion is passed through to insertLogEntry;
+// unconditional writes that lose a version race are retried.
+func appendToLogIdempotent(ctx context.Context, idempotencyKey, fingerprint string, entry *LogEntry, expectedVersion *int64) (status int, response []byte, replayed bool, err error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		status, response, replayed, err = tryAppendToLogIdempotent(ctx, idempotencyKey, fingerprint, entry, expectedVersion)
+		if !errors.Is(err, errVersionConflict) || expectedVersion != nil {
+			break
+		}
+	}
+	return status, response, replayed, err
+}
+
+func tryAppendToLogIdempotent(ctx context.Context, idempotencyKey, fingerprint string, entry *LogEntry, expectedVersion *int64) (status int, response []byte, replayed bool, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	defer tx.Rollback()
+
+	// The response carries the version, which is only known after the log
+	// insert, so the dedup row is claimed first and filled in afterwards.
+	res, err := tx.ExecContext(ctx, `
+    INSERT INTO request_dedup (idempotency_key, fingerprint, status, response)
+    VALUES ($1, $2, $3, '')
+    ON CONFLICT (idempotency_key) DO UPDATE
+        SET fingerprint = excluded.fingerprint, status = excluded.status,
+            response = excluded.response, created_at = now()
+        WHERE request_dedup.created_at < now() - INTERVAL '24 hours'
+    `, idempotencyKey, fingerprint, http.StatusCreated)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return 0, nil, false, err
+	} else if n == 0 {
+		var storedFingerprint, storedResponse string
+		err := tx.QueryRowContext(ctx, `SELECT fingerprint, status, response FROM request_dedup WHERE idempotency_key = $1`, idempotencyKey).
+			Scan(&storedFingerprint, &status, &storedResponse)
+		if err != nil {
+			return 0, nil, false, err
+		}
+		if storedFingerprint != fingerprint {
+			return 0, nil, false, errIdempotencyKeyReused
+		}
+		return status, []byte(storedResponse), true, nil
+	}
+
+	if err := insertLogEntry(ctx, tx, entry, expectedVersion); err != nil {
+		return 0, nil, false, err
+	}
+	if err := pruneVersions(ctx, tx, entry.Namespace, entry.Key); err != nil {
+		return 0, nil, false, err
+	}
+	response, err = json.Marshal(entry)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	response = append(response, '\n')
+	if _, err := tx.ExecContext(ctx, `UPDATE request_dedup SET response = $2 WHERE idempotency_key = $1`, idempotencyKey, string(response)); err != nil {
+		return 0, nil, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, nil, false, err
+	}
+	return http.StatusCreated, response, false, nil
+}
+
+// handleIdempotentPut performs a PUT whose body has already been read, keyed
+// by the client's Idempotency-Key header.
+func handleIdempotentPut(w http.ResponseWriter, r *http.Request, idempotencyKey string, body []byte, entry *LogEntry, expectedVersion *int64) {
+	fingerprint := requestFingerprint(http.MethodPut, qualifiedKey(entry.Namespace, entry.Key), bytes.TrimSpace(body))
+	status, response, replayed, err := appendToLogIdempotent(r.Context(), idempotencyKey, fingerprint, entry, expectedVersion)
+	if errors.Is(err, errIdempotencyKeyReused) {
+		writeError(w, http.StatusUnprocessableEntity, codeIdempotencyReused, "Idempotency-Key was already used for a different request")
+		return
+	}
+	if errors.Is(err, errVersionConflict) && expectedVersion != nil {
+		writeError(w, http.StatusConflict, codeVersionConflict, fmt.Sprintf("Version conflict: key is no longer at version %d", *expectedVersion))
+		return
+	}
+	var quotaErr *errQuotaExceeded
+	if errors.As(err, &quotaErr) {
+		writeQuotaExceeded(w, quotaErr)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: Failed idempotent write to CockroachDB for key '%s': %v", entry.Key, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	if replayed {
+		log.Printf("PUT replayed for key: %s (Idempotency-Key %s)", entry.Key, idempotencyKey)
+		w.Header().Set("Idempotent-Replayed", "true")
+	} else {
+		applyWriteToCache(*entry)
+		log.Printf("PUT successful for key: %s (persisted to log, Idempotency-Key %s)", entry.Key, idempotencyKey)
+	}
+	w.WriteHeader(status)
+	w.Write(response)
+}
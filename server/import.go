@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// --- Bulk Import ---
+//
+// POST /kv/_batch/import?namespace=&mode= writes a list of entries of one
+// namespace in a single transaction, for seed scripts and migrations. The
+// mode says what happens to a key listed twice, or already present:
+//
+//   - append_all writes every entry, in order, so a key listed twice gets a
+//     version per entry and ends up with its last value.
+//   - last_wins writes only the last entry of each key; the earlier ones are
+//     superseded without ever being written.
+//   - skip_existing writes a key only if it has no live value, neither in the
+//     log nor from an earlier entry of the import, so running the same seed
+//     twice changes nothing.
+//
+// The response has a disposition per entry, in the order they were listed.
+// Duplicates are resolved before anything is written, and skip_existing reads
+// which keys are live with one query over all of them at the start of the
+// transaction; a concurrent write to any of the keys makes the whole import
+// retry. Entries are validated as PUTs are and write the key itself: an
+// import over an alias replaces it rather than writing through.
+
+// Import modes.
+const (
+	importAppendAll    = "append_all"
+	importLastWins     = "last_wins"
+	importSkipExisting = "skip_existing"
+)
+
+// Dispositions of an imported entry.
+const (
+	importWritten          = "written"
+	importSuperseded       = "superseded"
+	importSkippedExisting  = "skipped_existing"
+	importSkippedDuplicate = "skipped_duplicate"
+)
+
+// importEntry is one entry of an import request.
+type importEntry struct {
+	Key        string            `json:"key"`
+	Value      string            `json:"value"`
+	TTLSeconds int64             `json:"ttl_seconds"`
+	Labels     map[string]string `json:"labels"`
+	ValueType  string            `json:"value_type"`
+}
+
+// importResult is the disposition of one entry, with the version it was
+// written at.
+type importResult struct {
+	Key         string `json:"key"`
+	Disposition string `json:"disposition"`
+	Version     int64  `json:"version,omitempty"`
+}
+
+// importResponse is the answer to an import.
+type importResponse struct {
+	Mode    string         `json:"mode"`
+	Written int            `json:"written"`
+	Skipped int            `json:"skipped"`
+	Results []importResult `json:"results"`
+}
+
+// handleImport serves POST /kv/_batch/import?mode= with a body of
+// {"entries": [{"key": ..., "value": ...}, ...]}, in the namespace given by
+// ?namespace=.
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	if rejectIfReadOnly(w) {
+		return
+	}
+	namespace, ok := namespaceQuery(r)
+	if !ok {
+		writeError(w, http.StatusNotFound, codeNamespaceNotFound, "Unknown namespace")
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	switch mode {
+	case importAppendAll, importLastWins, importSkipExisting:
+	default:
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "mode must be append_all, last_wins or skip_existing")
+		return
+	}
+	var payload struct {
+		Entries []importEntry `json:"entries"`
+	}
+	if !decodeJSONBody(w, r.Body, &payload) {
+		return
+	}
+	entries, ok := validateImportEntries(w, namespace, payload.Entries)
+	if !ok {
+		return
+	}
+
+	resp, written, err := importEntries(r.Context(), namespace, mode, entries)
+	var homed *errHomedElsewhere
+	var quotaErr *errQuotaExceeded
+	switch {
+	case errors.As(err, &homed):
+		writeMisdirected(w, homed.key, homed.home)
+		return
+	case errors.As(err, &quotaErr):
+		writeQuotaExceeded(w, quotaErr)
+		return
+	case errors.Is(err, errVersionConflict):
+		writeError(w, http.StatusConflict, codeWriteConflict, "Conflict: keys kept changing, retry the import")
+		return
+	case err != nil:
+		log.Printf("ERROR: Failed to write import of %d entries to CockroachDB: %v", len(entries), err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	for _, entry := range written {
+		applyWriteToCache(entry)
+	}
+	log.Printf("Batch IMPORT (%s) successful in namespace '%s': %d written, %d skipped", mode, namespace, resp.Written, resp.Skipped)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// validateImportEntries checks every entry of an import as a PUT would and
+// returns them as log entries, answering 400 or 422 for the first invalid
+// one. It reports whether all were valid.
+func validateImportEntries(w http.ResponseWriter, namespace string, entries []importEntry) ([]LogEntry, bool) {
+	if len(entries) == 0 {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "entries must list at least one entry")
+		return nil, false
+	}
+	if len(entries) > maxBatchKeys {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, fmt.Sprintf("at most %d entries may be listed in one batch", maxBatchKeys))
+		return nil, false
+	}
+	logEntries := make([]LogEntry, len(entries))
+	for i, entry := range entries {
+		invalid := func(format string, args ...any) ([]LogEntry, bool) {
+			writeError(w, http.StatusBadRequest, codeValidationFailed, fmt.Sprintf("entries[%d]: ", i)+fmt.Sprintf(format, args...))
+			return nil, false
+		}
+		if entry.Key == "" {
+			return invalid("key must not be empty")
+		}
+		if entry.Value == "" && !cfg.AllowEmptyValues {
+			return invalid("value must not be empty")
+		}
+		if entry.TTLSeconds < 0 {
+			return invalid("ttl_seconds must not be negative")
+		}
+		if err := validateLabels(entry.Labels); err != nil {
+			return invalid("Invalid labels: %v", err)
+		}
+		valueType, err := parseValueType(entry.ValueType, entry.Value)
+		if err != nil {
+			return invalid("Invalid value_type: %v", err)
+		}
+		var schemaErr *schemaValidationError
+		if err := validateValue(namespace, entry.Key, entry.Value); errors.As(err, &schemaErr) {
+			writeSchemaValidationError(w, schemaErr)
+			return nil, false
+		}
+		logEntries[i] = LogEntry{
+			Namespace:    namespace,
+			Key:          entry.Key,
+			Value:        entry.Value,
+			OriginRegion: cfg.OriginRegion,
+			TTLSeconds:   entry.TTLSeconds,
+			Labels:       entry.Labels,
+			ValueType:    valueType,
+		}
+	}
+	return logEntries, true
+}
+
+// importEntries writes entries per mode in one transaction, retrying when a
+// concurrent writer changes one of their keys. It returns the entries it
+// wrote, for the caller to apply to the cache.
+func importEntries(ctx context.Context, namespace, mode string, entries []LogEntry) (importResponse, []LogEntry, error) {
+	var err error
+	for attempt := 0; attempt < 5; attempt++ {
+		var resp importResponse
+		var written []LogEntry
+		resp, written, err = tryImportEntries(ctx, namespace, mode, entries)
+		if !errors.Is(err, errVersionConflict) {
+			return resp, written, err
+		}
+	}
+	return importResponse{}, nil, err
+}
+
+func tryImportEntries(ctx context.Context, namespace, mode string, entries []LogEntry) (importResponse, []LogEntry, error) {
+	resp := importResponse{Mode: mode, Results: make([]importResult, len(entries))}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return resp, nil, err
+	}
+	defer tx.Rollback()
+
+	keys := make([]string, 0, len(entries))
+	last := make(map[string]int, len(entries))
+	for i, entry := range entries {
+		if _, ok := last[entry.Key]; !ok {
+			keys = append(keys, entry.Key)
+		}
+		last[entry.Key] = i
+	}
+	var live map[string]bool
+	if mode == importSkipExisting {
+		if live, err = liveImportKeys(ctx, tx, namespace, keys); err != nil {
+			return resp, nil, err
+		}
+	}
+
+	// Every row of the transaction gets the same HLC, so a key written more
+	// than once is ordered by timestamp; rows are a microsecond apart, the
+	// precision CockroachDB keeps.
+	now := time.Now().UTC()
+	var written []LogEntry
+	writtenKeys := make(map[string]bool, len(keys))
+	for i, entry := range entries {
+		result := &resp.Results[i]
+		result.Key = entry.Key
+		switch {
+		case mode == importLastWins && last[entry.Key] != i:
+			result.Disposition = importSuperseded
+		case mode == importSkipExisting && live[entry.Key]:
+			result.Disposition = importSkippedExisting
+		case mode == importSkipExisting && writtenKeys[entry.Key]:
+			result.Disposition = importSkippedDuplicate
+		}
+		if result.Disposition != "" {
+			resp.Skipped++
+			continue
+		}
+		entry.Timestamp = now.Add(time.Duration(i) * time.Microsecond)
+		if err := insertLogEntry(ctx, tx, &entry, nil); err != nil {
+			return resp, nil, err
+		}
+		// The entry inherits the key's home region, so a key homed in
+		// another region is caught here; the transaction is rolled back.
+		if isHomedElsewhere(entry.HomeRegion) {
+			return resp, nil, &errHomedElsewhere{key: entry.Key, home: entry.HomeRegion}
+		}
+		if err := pruneVersions(ctx, tx, namespace, entry.Key); err != nil {
+			return resp, nil, err
+		}
+		writtenKeys[entry.Key] = true
+		result.Disposition = importWritten
+		result.Version = entry.Version
+		resp.Written++
+		written = append(written, entry)
+	}
+	if err := tx.Commit(); err != nil {
+		if isWriteConflict(err) {
+			return resp, nil, errVersionConflict
+		}
+		return resp, nil, err
+	}
+	return resp, written, nil
+}
+
+// liveImportKeys reports which of keys have a live value, neither deleted
+// nor expired, reading their latest entries in one query.
+func liveImportKeys(ctx context.Context, tx *sql.Tx, namespace string, keys []string) (map[string]bool, error) {
+	rows, err := tx.QueryContext(ctx, `
+    SELECT key FROM (
+        SELECT DISTINCT ON (key) key, deleted, `+expiredColumn+` FROM `+logTable()+`
+        WHERE namespace = $1 AND key = ANY($2)
+        ORDER BY key, `+newestFirst+`
+    ) AS latest
+    WHERE NOT deleted AND NOT expired;
+    `, namespace, pq.Array(keys))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	live := make(map[string]bool, len(keys))
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		live[key] = true
+	}
+	return live, rows.Err()
+}
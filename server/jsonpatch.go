@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// --- JSON Patch ---
+//
+// RFC 6902 operations applied in order to a decoded document. A patch that
+// is not a well-formed operation list is rejected before anything is read;
+// an operation that does not fit the current document, including a failed
+// test, aborts the whole patch with a *jsonPatchError and nothing is written.
+
+// jsonPatchOp is one operation with its pointers already parsed.
+type jsonPatchOp struct {
+	Op    string
+	Path  []string
+	From  []string // move and copy only.
+	Value any      // add, replace and test only.
+	raw   string   // The path as sent, for error messages.
+}
+
+// jsonPatchError reports an operation that could not be applied.
+type jsonPatchError struct {
+	Index int
+	Op    string
+	Path  string
+	Err   error
+}
+
+func (e *jsonPatchError) Error() string {
+	return fmt.Sprintf("operation %d (%s %q): %v", e.Index, e.Op, e.Path, e.Err)
+}
+
+var errJSONPatchTestFailed = errors.New("test failed")
+
+// parseJSONPatch decodes and validates an operation list.
+func parseJSONPatch(body []byte) ([]jsonPatchOp, error) {
+	var rawOps []struct {
+		Op    string          `json:"op"`
+		Path  *string         `json:"path"`
+		From  *string         `json:"from"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(body, &rawOps); err != nil {
+		return nil, errors.New("body must be a JSON array of operations")
+	}
+	ops := make([]jsonPatchOp, 0, len(rawOps))
+	for i, raw := range rawOps {
+		if raw.Path == nil {
+			return nil, fmt.Errorf("operation %d: missing path", i)
+		}
+		op := jsonPatchOp{Op: raw.Op, raw: *raw.Path}
+		var err error
+		if op.Path, err = parseJSONPointer(*raw.Path); err != nil {
+			return nil, fmt.Errorf("operation %d: %v", i, err)
+		}
+		switch raw.Op {
+		case "add", "replace", "test":
+			if raw.Value == nil {
+				return nil, fmt.Errorf("operation %d (%s): missing value", i, raw.Op)
+			}
+			if op.Value, err = decodeJSONValue(raw.Value); err != nil {
+				return nil, fmt.Errorf("operation %d (%s): invalid value", i, raw.Op)
+			}
+		case "move", "copy":
+			if raw.From == nil {
+				return nil, fmt.Errorf("operation %d (%s): missing from", i, raw.Op)
+			}
+			if op.From, err = parseJSONPointer(*raw.From); err != nil {
+				return nil, fmt.Errorf("operation %d: %v", i, err)
+			}
+			if raw.Op == "move" && len(op.From) < len(op.Path) && isPointerPrefix(op.From, op.Path) {
+				return nil, fmt.Errorf("operation %d (move): cannot move a value into itself", i)
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("operation %d: unknown op %q", i, raw.Op)
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// parseJSONPointer splits an RFC 6901 pointer into its unescaped tokens. The
+// empty pointer refers to the whole document.
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func isPointerPrefix(prefix, path []string) bool {
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// applyJSONPatch applies ops to document in order and returns the result.
+// Values taken from ops are copied, so ops can be applied again on retry.
+func applyJSONPatch(document any, ops []jsonPatchOp) (any, error) {
+	for i, op := range ops {
+		var err error
+		switch op.Op {
+		case "add":
+			document, err = jsonAdd(document, op.Path, cloneJSON(op.Value))
+		case "remove":
+			document, _, err = jsonRemove(document, op.Path)
+		case "replace":
+			if _, err = jsonGet(document, op.Path); err == nil {
+				document, err = jsonSet(document, op.Path, cloneJSON(op.Value))
+			}
+		case "move":
+			var value any
+			if document, value, err = jsonRemove(document, op.From); err == nil {
+				document, err = jsonAdd(document, op.Path, value)
+			}
+		case "copy":
+			var value any
+			if value, err = jsonGet(document, op.From); err == nil {
+				document, err = jsonAdd(document, op.Path, cloneJSON(value))
+			}
+		case "test":
+			var value any
+			if value, err = jsonGet(document, op.Path); err == nil && !jsonEqual(value, op.Value) {
+				err = errJSONPatchTestFailed
+			}
+		}
+		if err != nil {
+			return nil, &jsonPatchError{Index: i, Op: op.Op, Path: op.raw, Err: err}
+		}
+	}
+	return document, nil
+}
+
+// jsonGet returns the value at path.
+func jsonGet(document any, path []string) (any, error) {
+	for _, token := range path {
+		switch node := document.(type) {
+		case map[string]any:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("member %q does not exist", token)
+			}
+			document = value
+		case []any:
+			i, err := arrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			document = node[i]
+		default:
+			return nil, fmt.Errorf("cannot index into a scalar with %q", token)
+		}
+	}
+	return document, nil
+}
+
+// jsonAdd inserts value at path: a new or replaced object member, or an array
+// element inserted before the index ("-" appends).
+func jsonAdd(document any, path []string, value any) (any, error) {
+	return jsonUpdateParent(document, path, value, func(parent any, token string) (any, error) {
+		switch node := parent.(type) {
+		case map[string]any:
+			node[token] = value
+			return node, nil
+		case []any:
+			if token == "-" {
+				return append(node, value), nil
+			}
+			i, err := arrayIndex(token, len(node))
+			if err != nil {
+				return nil, err
+			}
+			return append(node[:i], append([]any{value}, node[i:]...)...), nil
+		default:
+			return nil, fmt.Errorf("cannot add %q to a scalar", token)
+		}
+	})
+}
+
+// jsonSet replaces the existing value at path.
+func jsonSet(document any, path []string, value any) (any, error) {
+	return jsonUpdateParent(document, path, value, func(parent any, token string) (any, error) {
+		switch node := parent.(type) {
+		case map[string]any:
+			node[token] = value
+		case []any:
+			i, _ := arrayIndex(token, len(node)-1)
+			node[i] = value
+		}
+		return parent, nil
+	})
+}
+
+// jsonRemove deletes the value at path and returns it.
+func jsonRemove(document any, path []string) (any, any, error) {
+	if len(path) == 0 {
+		return nil, nil, errors.New("cannot remove the whole document")
+	}
+	removed, err := jsonGet(document, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	document, err = jsonUpdateParent(document, path, nil, func(parent any, token string) (any, error) {
+		switch node := parent.(type) {
+		case map[string]any:
+			delete(node, token)
+		case []any:
+			i, _ := arrayIndex(token, len(node)-1)
+			return append(node[:i:i], node[i+1:]...), nil
+		}
+		return parent, nil
+	})
+	return document, removed, err
+}
+
+// jsonUpdateParent rebuilds document with the container holding the last
+// token of path replaced by update's result. Arrays may be reallocated, so
+// every level is written back. An empty path replaces the whole document
+// with value.
+func jsonUpdateParent(document any, path []string, value any, update func(parent any, token string) (any, error)) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	if len(path) == 1 {
+		return update(document, path[0])
+	}
+	child, err := jsonGet(document, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err = jsonUpdateParent(child, path[1:], value, update)
+	if err != nil {
+		return nil, err
+	}
+	switch node := document.(type) {
+	case map[string]any:
+		node[path[0]] = child
+	case []any:
+		i, _ := arrayIndex(path[0], len(node)-1)
+		node[i] = child
+	}
+	return document, nil
+}
+
+// arrayIndex parses an array index token, which must lie in [0, limit].
+func arrayIndex(token string, limit int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (len(token) > 1 && token[0] == '0') || strings.HasPrefix(token, "+") {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if i > limit {
+		return 0, fmt.Errorf("array index %d out of range", i)
+	}
+	return i, nil
+}
+
+// cloneJSON deep-copies a decoded JSON value.
+func cloneJSON(v any) any {
+	switch node := v.(type) {
+	case map[string]any:
+		c := make(map[string]any, len(node))
+		for k, e := range node {
+			c[k] = cloneJSON(e)
+		}
+		return c
+	case []any:
+		c := make([]any, len(node))
+		for i, e := range node {
+			c[i] = cloneJSON(e)
+		}
+		return c
+	default:
+		return v
+	}
+}
+
+// jsonEqual compares decoded JSON values as RFC 6902's test requires:
+// numbers by numeric value, objects regardless of member order.
+func jsonEqual(a, b any) bool {
+	switch x := a.(type) {
+	case map[string]any:
+		y, ok := b.(map[string]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, e := range x {
+			if f, ok := y[k]; !ok || !jsonEqual(e, f) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		y, ok := b.([]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !jsonEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		fx, okx := new(big.Float).SetString(string(x))
+		fy, oky := new(big.Float).SetString(string(y))
+		return okx && oky && fx.Cmp(fy) == 0
+	default:
+		return a == b
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// --- JSONPath Projections ---
+//
+// GET /kv/{key}?jsonpath=$.user.name returns only the part of a JSON value
+// the path selects, serialized as JSON, in place of the whole value. The
+// projection is applied to whatever the read returned, from the cache or
+// CockroachDB, so it never changes how the value is fetched or cached. Only
+// paths naming a single element are supported: $ followed by .name,
+// ['name'] or ["name"] for object members and [n] for array elements, where
+// a negative n counts from the end. Wildcards, slices, filters and recursive
+// descent are rejected with 400, as are values that are not JSON and paths
+// that select nothing.
+
+// jsonPathStep is one member name or array index of a parsed path.
+type jsonPathStep struct {
+	name    string
+	index   int
+	isIndex bool
+}
+
+// parseJSONPath parses path into its steps.
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("jsonpath must start with $")
+	}
+	var steps []jsonPathStep
+	rest := path[1:]
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			return nil, fmt.Errorf("jsonpath recursive descent (..) is not supported")
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			name := rest[1 : end+1]
+			if name == "" || name == "*" {
+				return nil, fmt.Errorf("jsonpath has an empty or wildcard member at %q", rest)
+			}
+			steps = append(steps, jsonPathStep{name: name})
+			rest = rest[end+1:]
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("jsonpath has an unterminated [ at %q", rest)
+			}
+			inner := rest[1:end]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				steps = append(steps, jsonPathStep{name: inner[1 : len(inner)-1]})
+			} else if index, err := strconv.Atoi(inner); err == nil {
+				steps = append(steps, jsonPathStep{index: index, isIndex: true})
+			} else {
+				return nil, fmt.Errorf("jsonpath selector [%s] is not supported; use a quoted name or an integer index", inner)
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("jsonpath has an unexpected character at %q", rest)
+		}
+	}
+	return steps, nil
+}
+
+// projectJSONPath returns the element of the JSON value that steps select,
+// serialized as JSON.
+func projectJSONPath(value string, steps []jsonPathStep) (string, error) {
+	if !json.Valid([]byte(value)) {
+		return "", fmt.Errorf("value is not valid JSON")
+	}
+	decoder := json.NewDecoder(strings.NewReader(value))
+	// Numbers stay exactly as stored rather than passing through float64.
+	decoder.UseNumber()
+	var current any
+	if err := decoder.Decode(&current); err != nil {
+		return "", err
+	}
+	for _, step := range steps {
+		switch node := current.(type) {
+		case map[string]any:
+			member, ok := node[step.name]
+			if step.isIndex || !ok {
+				return "", fmt.Errorf("jsonpath does not match the value")
+			}
+			current = member
+		case []any:
+			index := step.index
+			if index < 0 {
+				index += len(node)
+			}
+			if !step.isIndex || index < 0 || index >= len(node) {
+				return "", fmt.Errorf("jsonpath does not match the value")
+			}
+			current = node[index]
+		default:
+			return "", fmt.Errorf("jsonpath does not match the value")
+		}
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(current); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// requestedJSONPath parses the jsonpath query parameter, answering 400 when
+// it is malformed. It returns nil steps when the request has none.
+func requestedJSONPath(w http.ResponseWriter, r *http.Request) ([]jsonPathStep, bool) {
+	path := r.URL.Query().Get("jsonpath")
+	if path == "" {
+		return nil, true
+	}
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "Invalid jsonpath: "+err.Error())
+		return nil, false
+	}
+	return steps, true
+}
+
+// projectValue applies the request's jsonpath, if any, to value, answering
+// 400 and reporting false when it cannot.
+func projectValue(w http.ResponseWriter, r *http.Request, value string) (string, bool) {
+	if r.URL.Query().Get("jsonpath") == "" {
+		return value, true
+	}
+	steps, ok := requestedJSONPath(w, r)
+	if !ok {
+		return "", false
+	}
+	projected, err := projectJSONPath(value, steps)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "Cannot apply jsonpath: "+err.Error())
+		return "", false
+	}
+	return projected, true
+}
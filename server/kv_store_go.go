@@ -1,208 +1,1096 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"kvstore-cdc/migrations"
+
 	"github.com/go-redis/redis/v8"
 	_ "github.com/lib/pq"
 )
 
 // --- Data Structures ---
 type LogEntry struct {
+	// Namespace is the keyspace the key belongs to; see defaultNamespace.
+	Namespace string    `json:"namespace"`
 	Key       string    `json:"key"`
 	Value     string    `json:"value"`
 	Timestamp time.Time `json:"timestamp"`
 	Deleted   bool      `json:"deleted"`
+	// OriginRegion is the ORIGIN_REGION of the server that accepted the write.
+	OriginRegion string `json:"origin_region,omitempty"`
+	// Version counts the writes to this key, starting at 1.
+	Version int64 `json:"version"`
+	// TTLSeconds, when positive, is how long after Timestamp the value
+	// expires. The expirer then appends a tombstone for it.
+	TTLSeconds int64 `json:"ttl_seconds,omitempty"`
+	// Labels are tags for filtering lists; see labels.go.
+	Labels map[string]string `json:"labels,omitempty"`
+	// HLC is the commit timestamp that orders the key's entries; see hlc.go.
+	// It is only known once the entry has been read back from the log.
+	HLC string `json:"hlc,omitempty"`
+	// HomeRegion, when set, is the only region that accepts writes to the
+	// key; see homeregion.go.
+	HomeRegion string `json:"home_region,omitempty"`
+	// ValueType is "number" for values written as numbers, which range
+	// queries can find; see numeric.go. It is empty for plain strings.
+	ValueType string `json:"value_type,omitempty"`
+	// TargetKey, when set, makes the entry an alias of that key in the same
+	// namespace; see aliases.go. Its value is empty.
+	TargetKey string `json:"target_key,omitempty"`
+	// Expired is set on entries read from the log whose TTLSeconds has
+	// passed. Until the expirer tombstones them, reads treat them as deleted.
+	Expired bool `json:"-"`
+	// homeRegionUpdate is the home region a write sets, "" to clear it. When
+	// nil the write keeps the key's current home region.
+	homeRegionUpdate *string
 }
 
 // --- Global Components ---
 var (
 	db          *sql.DB
-	redisClient *redis.Client
-	ctx         = context.Background()
-	keyLocks    sync.Map
+	redisClient redis.UniversalClient
+	// redisReadClient serves cache lookups. It is redisClient unless
+	// lookups may go to replicas; see newRedisReadClient.
+	redisReadClient redis.UniversalClient
+	ctx             = context.Background()
+	keyLocks        sync.Map
 )
 
 // --- Database Interaction (CockroachDB) ---
 func initDB(dbConnectionString string) {
-	var err error
-	db, err = sql.Open("postgres", dbConnectionString)
+	dsn, err := statementTimeoutDSN(dbConnectionString, time.Duration(cfg.DBStatementTimeout))
+	if err != nil {
+		log.Fatalf("Invalid database URL: %v", err)
+	}
+	db, err = sql.Open("postgres", dsn)
 	if err != nil {
 		log.Fatalf("Failed to connect to CockroachDB: %v", err)
 	}
-	// Enable CHANGEFEED on the table
-	createTableSQL := `
-    CREATE TABLE IF NOT EXISTS kv_log (
-        id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-        key STRING NOT NULL,
-        value STRING,
-        timestamp TIMESTAMPTZ NOT NULL,
-        deleted BOOL DEFAULT FALSE,
-		FAMILY "primary" (id, key, value, timestamp, deleted)
-    );
-	ALTER TABLE kv_log CONFIGURE ZONE USING gc.ttlseconds = 3600; -- Optional: Clean up old log entries
-    CREATE INDEX IF NOT EXISTS idx_key_timestamp ON kv_log (key, timestamp DESC);
-    `
-	if _, err := db.Exec(createTableSQL); err != nil {
-		log.Fatalf("Failed to create kv_log table in CockroachDB: %v", err)
+	db.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	db.SetMaxIdleConns(cfg.DBMaxIdleConns)
+	db.SetConnMaxLifetime(time.Duration(cfg.DBConnMaxLifetime))
+	// Backfilling a column or an index on a large kv_log can take far longer
+	// than DB_STATEMENT_TIMEOUT, so the migrations run without it.
+	err = withStatementTimeout(0, func(conn *sql.Conn) error {
+		return migrations.Run(ctx, conn)
+	})
+	if err != nil {
+		log.Fatalf("Failed to migrate the CockroachDB schema: %v", err)
+	}
+	if err := refreshNamespaces(); err != nil {
+		log.Fatalf("Failed to load namespaces from CockroachDB: %v", err)
+	}
+	if err := refreshSchemas(); err != nil {
+		log.Fatalf("Failed to load schemas from CockroachDB: %v", err)
+	}
+	if err := configureLocality(parseRegions(cfg.DBRegions), cfg.TableLocality); err != nil {
+		log.Fatalf("Failed to configure multi-region locality: %v", err)
 	}
 	log.Println("CockroachDB connection successful and table initialized.")
 }
 
-func appendToLog(entry LogEntry) error {
-	sqlStatement := `INSERT INTO kv_log (key, value, timestamp, deleted) VALUES ($1, $2, $3, $4)`
-	_, err := db.Exec(sqlStatement, entry.Key, entry.Value, entry.Timestamp, entry.Deleted)
-	return err
+// appendToLog persists entry, through the write batcher when it is enabled,
+// and sets entry.Version. Writes that set a home region or an alias bypass the
+// batcher, whose rows only carry the current home region forward and never
+// write target_key, as do writes to a namespace with a quota, which only a
+// direct write checks. A direct write is cancelled
+// with ctx; a batched one is shared with other requests and always runs to
+// completion.
+func appendToLog(ctx context.Context, entry *LogEntry) error {
+	if writeBatcher != nil && entry.homeRegionUpdate == nil && entry.TargetKey == "" && quotaFor(entry.Namespace) == nil {
+		return writeBatcher.append(entry)
+	}
+	return appendDirect(ctx, entry)
 }
 
-func getLatestValueFromLog(key string) (string, bool, error) {
-	var value string
-	var deleted bool
-	sqlStatement := `
-    SELECT value, deleted FROM kv_log
-    WHERE key = $1
-    ORDER BY timestamp DESC
-    LIMIT 1;
-    `
-	row := db.QueryRow(sqlStatement, key)
-	err := row.Scan(&value, &deleted)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return "", false, nil
+// appendDirect persists entry with its own INSERT, retrying when a concurrent
+// writer claims the next version first.
+func appendDirect(ctx context.Context, entry *LogEntry) error {
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if err = writeLogEntry(ctx, entry, nil); !errors.Is(err, errVersionConflict) {
+			return err
 		}
-		return "", false, err
 	}
-	if deleted {
-		return "", false, nil
+	return err
+}
+
+// nullIfEmpty maps "" to SQL NULL for optional columns.
+func nullIfEmpty(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// nullIfZero maps 0 to SQL NULL for optional numeric columns.
+func nullIfZero(n int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: n, Valid: n != 0}
+}
+
+// getLatestValueFromLog returns the newest live value for key in namespace.
+// Tombstoned, expired and never-written keys are reported as not found. See
+// latestForKey for followerRead.
+func getLatestValueFromLog(ctx context.Context, namespace, key string, followerRead bool) (string, bool, error) {
+	entry, err := latestForKey(ctx, namespace, key, followerRead)
+	if err != nil || entry == nil || entry.Deleted || entry.Expired {
+		return "", false, err
 	}
-	return value, true, nil
+	return entry.Value, true, nil
 }
 
 // --- Cache Interaction ---
+
+// redisErrors counts failed Redis commands. Cache misses are not errors.
+var redisErrors = expvar.NewInt("redis_errors_total")
+
+// cacheSkippedOversize counts values not cached for exceeding
+// MAX_CACHEABLE_SIZE.
+var cacheSkippedOversize = expvar.NewInt("cache_skipped_oversize_total")
+
+// initRedis connects to Redis, retrying with backoff. If Redis stays
+// unreachable the server keeps running and serves reads from CockroachDB;
+// the client reconnects on its own once Redis comes back.
 func initRedis(redisAddress string) {
-	redisClient = redis.NewClient(&redis.Options{
-		Addr: redisAddress,
+	addrs, conn, err := parseRedisURL(redisAddress, cfg.redisConnOptions())
+	if err != nil {
+		log.Fatalf("Invalid Redis address: %v", err)
+	}
+	var topology string
+	redisClient, topology = newRedisClient(addrs, cfg.RedisMasterName, conn, cfg.RedisPoolSize)
+	log.Printf("Redis topology: %s (tls=%t)", topology, conn.TLSConfig != nil)
+	redisReadClient = redisClient
+	if cfg.RedisReadFromReplicas || cfg.RedisReplicaURL != "" {
+		var replicas []string
+		if cfg.RedisReplicaURL != "" {
+			if replicas, _, err = parseRedisURL(cfg.RedisReplicaURL, conn); err != nil {
+				log.Fatalf("Invalid Redis replica address: %v", err)
+			}
+		}
+		var readTopology string
+		redisReadClient, readTopology = newRedisReadClient(addrs, replicas, cfg.RedisMasterName, conn, cfg.RedisPoolSize)
+		log.Printf("Redis cache lookups: %s", readTopology)
+	}
+	maxRetries := 10
+	retryDelay := 500 * time.Millisecond
+	for i := 0; i < maxRetries; i++ {
+		_, err := redisClient.Ping(ctx).Result()
+		if err == nil {
+			log.Println("Redis connection successful.")
+			return
+		}
+		redisErrors.Add(1)
+		if isRedisAuthError(err) {
+			// Retrying cannot fix credentials; reads go to CockroachDB.
+			log.Printf("ERROR: Redis rejected the configured credentials (check REDIS_PASSWORD or the password in REDIS_URL): %v", err)
+			return
+		}
+		log.Printf("Could not connect to Redis, retrying in %v... (%d/%d): %v", retryDelay, i+1, maxRetries, err)
+		time.Sleep(retryDelay)
+		retryDelay = min(retryDelay*2, 8*time.Second)
+	}
+	log.Printf("WARNING: Redis unreachable after %d retries; serving reads from CockroachDB until it recovers.", maxRetries)
+}
+
+// redisConnOptions are the connection settings shared by every topology.
+type redisConnOptions struct {
+	Username, Password string
+	DB                 int
+	TLSConfig          *tls.Config // nil for plaintext.
+}
+
+// parseRedisURL splits a comma-separated REDIS_URL into addresses. Each entry
+// is either host:port or a redis:// or rediss:// URL parsed with
+// redis.ParseURL; credentials, a DB index or TLS given in a URL override
+// those in conn.
+func parseRedisURL(raw string, conn redisConnOptions) ([]string, redisConnOptions, error) {
+	var addrs []string
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "://") {
+			addrs = append(addrs, entry)
+			continue
+		}
+		opts, err := redis.ParseURL(entry)
+		if err != nil {
+			return nil, conn, err
+		}
+		addrs = append(addrs, opts.Addr)
+		if opts.Username != "" {
+			conn.Username = opts.Username
+		}
+		if opts.Password != "" {
+			conn.Password = opts.Password
+		}
+		if opts.DB != 0 {
+			conn.DB = opts.DB
+		}
+		if opts.TLSConfig != nil {
+			conn.TLSConfig = opts.TLSConfig
+		}
+	}
+	return addrs, conn, nil
+}
+
+// isRedisAuthError reports whether Redis refused the connection's AUTH, or
+// requires one that was not sent.
+func isRedisAuthError(err error) bool {
+	msg := err.Error()
+	return strings.HasPrefix(msg, "NOAUTH") || strings.HasPrefix(msg, "WRONGPASS") ||
+		strings.Contains(msg, "invalid password") || strings.Contains(msg, "without any password configured")
+}
+
+// Retry settings shared by every Redis client the server builds.
+const (
+	maxRetries      = 3
+	minRetryBackoff = 8 * time.Millisecond
+	maxRetryBackoff = 512 * time.Millisecond
+)
+
+// newRedisClient builds a client for the topology the configuration implies:
+// Sentinel when a master name is set, Cluster when several addresses are
+// listed, otherwise a single node. It also returns a description for logging.
+func newRedisClient(addrs []string, masterName string, conn redisConnOptions, poolSize int) (redis.UniversalClient, string) {
+	switch {
+	case masterName != "":
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:      masterName,
+			SentinelAddrs:   addrs,
+			Username:        conn.Username,
+			Password:        conn.Password,
+			DB:              conn.DB,
+			TLSConfig:       conn.TLSConfig,
+			PoolSize:        poolSize,
+			MaxRetries:      maxRetries,
+			MinRetryBackoff: minRetryBackoff,
+			MaxRetryBackoff: maxRetryBackoff,
+		}), fmt.Sprintf("sentinel (master %q via %v)", masterName, addrs)
+	case len(addrs) > 1:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:           addrs,
+			Username:        conn.Username,
+			Password:        conn.Password,
+			TLSConfig:       conn.TLSConfig,
+			PoolSize:        poolSize,
+			MaxRetries:      maxRetries,
+			MinRetryBackoff: minRetryBackoff,
+			MaxRetryBackoff: maxRetryBackoff,
+		}), fmt.Sprintf("cluster (seeds %v)", addrs)
+	default:
+		return redis.NewClient(&redis.Options{
+			Addr:            addrs[0],
+			Username:        conn.Username,
+			Password:        conn.Password,
+			DB:              conn.DB,
+			TLSConfig:       conn.TLSConfig,
+			PoolSize:        poolSize,
+			MaxRetries:      maxRetries,
+			MinRetryBackoff: minRetryBackoff,
+			MaxRetryBackoff: maxRetryBackoff,
+		}), fmt.Sprintf("single node (%s)", addrs[0])
+	}
+}
+
+// newRedisReadClient builds the client for cache lookups when they may be
+// served by replicas: a ClusterClient that sends each read-only command to a
+// random node holding its slot, primary or replica. In Cluster mode those are
+// the cluster's own nodes, and go-redis finds a Sentinel master's replicas
+// through the Sentinels. A single node has no cluster slots, so one range
+// covering all of them lists the node and replicas. Writes and invalidations
+// never use this client. Cluster clients cannot SELECT a logical database, so
+// validate requires REDIS_DB 0.
+func newRedisReadClient(addrs, replicas []string, masterName string, conn redisConnOptions, poolSize int) (redis.UniversalClient, string) {
+	switch {
+	case masterName != "":
+		return redis.NewFailoverClusterClient(&redis.FailoverOptions{
+			MasterName:      masterName,
+			SentinelAddrs:   addrs,
+			Username:        conn.Username,
+			Password:        conn.Password,
+			TLSConfig:       conn.TLSConfig,
+			PoolSize:        poolSize,
+			RouteRandomly:   true,
+			MaxRetries:      maxRetries,
+			MinRetryBackoff: minRetryBackoff,
+			MaxRetryBackoff: maxRetryBackoff,
+		}), fmt.Sprintf("random node of sentinel master %q and its replicas", masterName)
+	case len(addrs) > 1:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:           addrs,
+			Username:        conn.Username,
+			Password:        conn.Password,
+			TLSConfig:       conn.TLSConfig,
+			PoolSize:        poolSize,
+			ReadOnly:        true,
+			RouteRandomly:   true,
+			MaxRetries:      maxRetries,
+			MinRetryBackoff: minRetryBackoff,
+			MaxRetryBackoff: maxRetryBackoff,
+		}), "random node of each cluster slot, replicas included"
+	default:
+		nodes := []redis.ClusterNode{{Addr: addrs[0]}}
+		for _, addr := range replicas {
+			nodes = append(nodes, redis.ClusterNode{Addr: addr})
+		}
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			ClusterSlots: func(context.Context) ([]redis.ClusterSlot, error) {
+				return []redis.ClusterSlot{{Start: 0, End: 16383, Nodes: nodes}}, nil
+			},
+			Username:        conn.Username,
+			Password:        conn.Password,
+			TLSConfig:       conn.TLSConfig,
+			PoolSize:        poolSize,
+			RouteRandomly:   true,
+			MaxRetries:      maxRetries,
+			MinRetryBackoff: minRetryBackoff,
+			MaxRetryBackoff: maxRetryBackoff,
+		}), fmt.Sprintf("random node of %s and replicas %v", addrs[0], replicas)
+	}
+}
+
+// cacheTx runs fn as a MULTI/EXEC transaction. Redis Cluster rejects
+// transactions spanning hash slots, and a key and the versions hash rarely
+// share one, so in cluster mode the commands are only pipelined.
+func cacheTx(fn func(redis.Pipeliner) error) error {
+	if _, ok := redisClient.(*redis.ClusterClient); ok {
+		_, err := redisClient.Pipelined(ctx, fn)
+		return err
+	}
+	_, err := redisClient.TxPipelined(ctx, fn)
+	return err
+}
+
+// redisKey is the Redis key of key in namespace: its qualifiedKey behind
+// REDIS_KEY_PREFIX, which keeps this store's keys apart from other users of a
+// shared Redis. The prefix never appears in kv_log or API responses.
+func redisKey(namespace, key string) string {
+	return cfg.RedisKeyPrefix + qualifiedKey(namespace, key)
+}
+
+// versionsHashKey is a Redis hash mapping each cached key to the version of
+// its cached value. The hydrator maintains it alongside the values.
+func versionsHashKey() string {
+	return cfg.RedisKeyPrefix + "kv:versions"
+}
+
+// cacheGet reads a key's cached value and version in one round trip. A value
+// cached without a version is treated as a miss so it gets repopulated. With
+// replica reads configured the lookup may hit a replica that lags the
+// primary, returning a slightly older value or missing a key just cached;
+// a miss falls through to CockroachDB like any other. While the cache is
+// bypassed every lookup is a miss.
+func cacheGet(key string) (value string, version int64, hit bool, err error) {
+	if !cacheReadable() {
+		return "", 0, false, nil
+	}
+	return cacheLookup(key)
+}
+
+// cacheLookup is cacheGet even while the cache is bypassed.
+func cacheLookup(key string) (value string, version int64, hit bool, err error) {
+	pipe := redisReadClient.Pipeline()
+	valueCmd := pipe.Get(ctx, key)
+	versionCmd := pipe.HGet(ctx, versionsHashKey(), key)
+	pipe.Exec(ctx)
+	if err := valueCmd.Err(); err != nil {
+		if err == redis.Nil {
+			return "", 0, false, nil
+		}
+		return "", 0, false, err
+	}
+	version, err = versionCmd.Int64()
+	if err == redis.Nil {
+		return "", 0, false, nil
+	}
+	if err != nil {
+		return "", 0, false, err
+	}
+	return valueCmd.Val(), version, true, nil
+}
+
+// cacheSet stores an entry's value and version atomically. An entry whose
+// own TTL has already passed is not cached, and one over MAX_CACHEABLE_SIZE
+// is removed from the cache instead.
+func cacheSet(entry LogEntry) error {
+	expiry, live := cacheExpiry(entry)
+	if !live {
+		return nil
+	}
+	cacheKey := redisKey(entry.Namespace, entry.Key)
+	if entry.TargetKey != "" {
+		// Aliases are resolved on every read; see aliases.go.
+		return cacheDel(cacheKey)
+	}
+	if !cacheable(entry.Value) {
+		// Drop any smaller value cached before, so reads go to CockroachDB.
+		cacheSkippedOversize.Add(1)
+		return cacheDel(cacheKey)
+	}
+	return cacheTx(func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, cacheKey, entry.Value, expiry)
+		pipe.HSet(ctx, versionsHashKey(), cacheKey, entry.Version)
+		return nil
+	})
+}
+
+// cacheable reports whether value is small enough to cache under
+// MAX_CACHEABLE_SIZE. Larger values are only ever read from CockroachDB, which
+// keeps Redis memory for small hot keys.
+func cacheable(value string) bool {
+	return cfg.MaxCacheableSize <= 0 || len(value) <= cfg.MaxCacheableSize
+}
+
+// cacheExpiry is how long entry may stay cached: CACHE_TTL, shortened to
+// whatever remains of the entry's own TTL. It reports false once that TTL
+// has passed.
+func cacheExpiry(entry LogEntry) (time.Duration, bool) {
+	expiry := time.Duration(cfg.CacheTTL)
+	if entry.TTLSeconds > 0 {
+		remaining := time.Until(entry.Timestamp.Add(time.Duration(entry.TTLSeconds) * time.Second))
+		if remaining <= 0 {
+			return 0, false
+		}
+		if expiry == 0 || remaining < expiry {
+			expiry = remaining
+		}
+	}
+	return expiry, true
+}
+
+// cacheDel removes a cached value and its version.
+func cacheDel(key string) error {
+	return cacheTx(func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.HDel(ctx, versionsHashKey(), key)
+		return nil
 	})
-	if _, err := redisClient.Ping(ctx).Result(); err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+}
+
+// --- Cache Modes ---
+
+// cacheMode selects how the write path treats the cache. The hydrator keeps
+// filling the cache from the changefeed in every mode.
+//   - cdc_only: writes never touch Redis. Cheapest writes, but a reader may see
+//     the old cached value until the hydrator catches up.
+//   - invalidate: writes delete the cached key after committing, so the next
+//     GET reads through to CockroachDB. Read-your-writes within a region at the
+//     cost of one extra miss per write.
+//   - write_through: writes set (or delete) the cached key after committing.
+//     Lowest read latency after a write, but a delayed hydrator event can still
+//     briefly overwrite it with an older value.
+type cacheMode string
+
+const (
+	cacheModeCDCOnly      cacheMode = "cdc_only"
+	cacheModeInvalidate   cacheMode = "invalidate"
+	cacheModeWriteThrough cacheMode = "write_through"
+)
+
+// activeCacheMode is parsed from cfg.CacheMode at startup.
+var activeCacheMode = cacheModeCDCOnly
+
+func parseCacheMode(raw string) (cacheMode, error) {
+	switch mode := cacheMode(raw); mode {
+	case cacheModeCDCOnly, cacheModeInvalidate, cacheModeWriteThrough:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown CACHE_MODE %q (want cdc_only, invalidate or write_through)", raw)
+}
+
+// applyWriteToCache updates Redis for an entry that has already been
+// persisted, according to the active cache mode. Failures are logged only;
+// the log remains the source of truth.
+func applyWriteToCache(entry LogEntry) {
+	var err error
+	switch {
+	case activeCacheMode == cacheModeWriteThrough && !entry.Deleted:
+		err = cacheSet(entry)
+	case activeCacheMode == cacheModeWriteThrough, activeCacheMode == cacheModeInvalidate:
+		err = cacheDel(redisKey(entry.Namespace, entry.Key))
+	}
+	if err != nil {
+		redisErrors.Add(1)
+		log.Printf("ERROR: Failed to apply %s cache update for key '%s': %v", activeCacheMode, entry.Key, err)
 	}
-	log.Println("Redis connection successful.")
 }
 
 // --- API Handlers ---
+
+// readBody reads the whole request body, answering 413 when it exceeds
+// the configured MaxBodyBytes. It reports whether the body was read.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, err)
+		return nil, false
+	}
+	return body, true
+}
+
+// decodeJSONBody decodes body into dst, answering 400 when it is not valid
+// JSON, or 413 when it is the request body and exceeds MaxBodyBytes. It
+// reports whether decoding succeeded.
+func decodeJSONBody(w http.ResponseWriter, body io.Reader, dst any) bool {
+	if err := json.NewDecoder(body).Decode(dst); err != nil {
+		writeBodyError(w, err)
+		return false
+	}
+	return true
+}
+
+// writeBodyError answers a request whose body could not be read or decoded:
+// 413 when reading it hit MaxBodyBytes, 400 otherwise.
+func writeBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, fmt.Sprintf("Request body too large (limit %d bytes)", tooLarge.Limit))
+		return
+	}
+	writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request body")
+}
+
+// rejectIfEmptyValue answers 400 to a write of the empty string unless
+// ALLOW_EMPTY_VALUES is set, and reports whether it did.
+func rejectIfEmptyValue(w http.ResponseWriter, value string) bool {
+	if value != "" || cfg.AllowEmptyValues {
+		return false
+	}
+	writeError(w, http.StatusBadRequest, codeValidationFailed, "Bad request: value must not be empty")
+	return true
+}
+
 func handlePut(w http.ResponseWriter, r *http.Request) {
-	key := strings.TrimPrefix(r.URL.Path, "/kv/")
+	if rejectIfReadOnly(w) {
+		return
+	}
+	namespace, key := requestKey(r)
 	var payload struct {
-		Value string `json:"value"`
+		Value      string            `json:"value"`
+		TTLSeconds int64             `json:"ttl_seconds"`
+		Labels     map[string]string `json:"labels"`
+		HomeRegion *string           `json:"home_region"`
+		ValueType  string            `json:"value_type"`
+		TargetKey  *string           `json:"target_key"`
+	}
+	body, ok := readBody(w, r)
+	if !ok || !decodeJSONBody(w, bytes.NewReader(body), &payload) {
+		return
 	}
-	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if payload.TargetKey != nil {
+		if err := validateAliasPut(key, *payload.TargetKey, payload.Value, payload.ValueType); err != nil {
+			writeError(w, http.StatusBadRequest, codeValidationFailed, fmt.Sprintf("Invalid target_key: %v", err))
+			return
+		}
+	} else if rejectIfEmptyValue(w, payload.Value) {
+		return
+	}
+	if payload.TTLSeconds < 0 {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "ttl_seconds must not be negative")
+		return
+	}
+	if err := validateLabels(payload.Labels); err != nil {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, fmt.Sprintf("Invalid labels: %v", err))
+		return
+	}
+	valueType, err := parseValueType(payload.ValueType, payload.Value)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, fmt.Sprintf("Invalid value_type: %v", err))
 		return
 	}
+	if payload.HomeRegion != nil {
+		if err := validateHomeRegion(*payload.HomeRegion); err != nil {
+			writeError(w, http.StatusBadRequest, codeValidationFailed, fmt.Sprintf("Invalid home_region: %v", err))
+			return
+		}
+	}
+	var schemaErr *schemaValidationError
+	if payload.TargetKey == nil {
+		if err := validateValue(namespace, key, payload.Value); errors.As(err, &schemaErr) {
+			writeSchemaValidationError(w, schemaErr)
+			return
+		}
+	}
 	entry := LogEntry{
-		Key:       key,
-		Value:     payload.Value,
-		Timestamp: time.Now().UTC(),
-		Deleted:   false,
-	}
-	// The server's ONLY job on a write is to append to the log.
-	// The CDC service will handle updating the cache.
-	if err := appendToLog(entry); err != nil {
+		Namespace:        namespace,
+		Key:              key,
+		Value:            payload.Value,
+		Timestamp:        time.Now().UTC(),
+		Deleted:          false,
+		OriginRegion:     cfg.OriginRegion,
+		TTLSeconds:       payload.TTLSeconds,
+		Labels:           payload.Labels,
+		ValueType:        valueType,
+		homeRegionUpdate: payload.HomeRegion,
+	}
+	if payload.TargetKey != nil {
+		entry.TargetKey = *payload.TargetKey
+	} else if target, ok := aliasWriteTarget(w, r, namespace, key); !ok {
+		return
+	} else if target != key {
+		if rejectIfNotHome(w, r, namespace, target) {
+			return
+		}
+		log.Printf("PUT to alias '%s' writes through to key '%s'", key, target)
+		entry.Key = target
+	}
+	expectedVersion, ok := parseIfMatch(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "If-Match must be a version number")
+		return
+	}
+	consistency, ok := requestedConsistency(w, r)
+	if !ok {
+		return
+	}
+	ifAbsent := r.URL.Query().Get("if_absent") == "true"
+	if ifAbsent && (expectedVersion != nil || r.Header.Get("Idempotency-Key") != "") {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "if_absent cannot be combined with If-Match or Idempotency-Key")
+		return
+	}
+	returnPrev := false
+	switch r.URL.Query().Get("return") {
+	case "":
+	case "prev":
+		returnPrev = true
+	default:
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "return must be prev")
+		return
+	}
+	if returnPrev && (ifAbsent || r.Header.Get("Idempotency-Key") != "") {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "return=prev cannot be combined with if_absent or Idempotency-Key")
+		return
+	}
+	if r.URL.Query().Get("dry_run") == "true" {
+		dryRunPut(w, r, body, entry, expectedVersion, ifAbsent)
+		return
+	}
+	if ifAbsent {
+		handlePutIfAbsent(w, r, entry)
+		return
+	}
+	if idempotencyKey := r.Header.Get("Idempotency-Key"); idempotencyKey != "" {
+		handleIdempotentPut(w, r, idempotencyKey, body, &entry, expectedVersion)
+		return
+	}
+	if returnPrev {
+		handlePutReturningPrev(w, r, entry, expectedVersion)
+		return
+	}
+	if asyncWrites != nil && consistency != consistencyStrong && expectedVersion == nil && entry.homeRegionUpdate == nil && entry.TargetKey == "" && quotaFor(namespace) == nil {
+		putAsync(w, r, entry)
+		return
+	}
+	// The log is the source of truth; the cache is only touched once the
+	// write has committed, and only as the cache mode allows.
+	if expectedVersion != nil {
+		err = writeLogEntry(r.Context(), &entry, expectedVersion)
+	} else {
+		err = appendToLog(r.Context(), &entry)
+	}
+	if errors.Is(err, errVersionConflict) {
+		writeError(w, http.StatusConflict, codeVersionConflict, fmt.Sprintf("Version conflict: key is no longer at version %d", *expectedVersion))
+		return
+	}
+	var quotaErr *errQuotaExceeded
+	if errors.As(err, &quotaErr) {
+		writeQuotaExceeded(w, quotaErr)
+		return
+	}
+	if err != nil {
 		log.Printf("ERROR: Failed to write to CockroachDB for key '%s': %v", key, err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
 		return
 	}
+	applyWriteToCache(entry)
 	log.Printf("PUT successful for key: %s (persisted to log)", key)
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(entry)
 }
 
+// handlePutIfAbsent creates key with entry, answering 409 if it already has
+// a live value.
+func handlePutIfAbsent(w http.ResponseWriter, r *http.Request, entry LogEntry) {
+	err := putIfAbsent(r.Context(), &entry)
+	var quotaErr *errQuotaExceeded
+	switch {
+	case errors.Is(err, errKeyExists):
+		writeError(w, http.StatusConflict, codeKeyExists, "Conflict: key already exists")
+		return
+	case errors.Is(err, errVersionConflict):
+		writeError(w, http.StatusConflict, codeWriteConflict, "Conflict: key kept changing, retry the write")
+		return
+	case errors.As(err, &quotaErr):
+		writeQuotaExceeded(w, quotaErr)
+		return
+	case err != nil:
+		log.Printf("ERROR: Failed to write to CockroachDB for key '%s': %v", entry.Key, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	applyWriteToCache(entry)
+	log.Printf("PUT successful for key: %s (created, version %d)", entry.Key, entry.Version)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(entry)
+}
+
+// wantsPlainText reports whether the Accept header prefers text/plain over
+// JSON. JSON wins ties and is the default when no Accept header is sent.
+func wantsPlainText(r *http.Request) bool {
+	var plainQ, jsonQ float64
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if name, val, ok := strings.Cut(strings.TrimSpace(param), "="); ok && name == "q" {
+				if parsed, err := strconv.ParseFloat(val, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "text/plain":
+			plainQ = max(plainQ, q)
+		case "application/json", "application/*", "*/*":
+			jsonQ = max(jsonQ, q)
+		}
+	}
+	return plainQ > 0 && plainQ > jsonQ
+}
+
+// writeValue writes a GET result, either as the raw value for text/plain
+// clients or wrapped in the default {"key","value","version"} JSON envelope.
+// The version is also sent as X-Version for use with If-Match.
+func writeValue(w http.ResponseWriter, r *http.Request, key, value string, version int64) {
+	value, ok := projectValue(w, r, value)
+	if !ok {
+		return
+	}
+	w.Header().Set("X-Version", strconv.FormatInt(version, 10))
+	if wantsPlainText(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		// WriteString avoids copying the value into a byte slice first.
+		io.WriteString(w, value)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"key": key, "value": value, "version": version})
+}
+
+// Values of the X-Source response header.
+const (
+	sourceRedis       = "redis"
+	sourceCockroachDB = "cockroachdb"
+	sourceFallback    = "fallback"
+)
+
+// setReadSource labels a read response with where its answer came from:
+// X-Source names the store and X-Cache is HIT only when Redis answered.
+func setReadSource(w http.ResponseWriter, source string) {
+	cache := "MISS"
+	if source == sourceRedis {
+		cache = "HIT"
+	}
+	w.Header().Set("X-Cache", cache)
+	w.Header().Set("X-Source", source)
+}
+
+// allowsStaleRead reports whether the client opted into bounded-staleness
+// reads via the X-Allow-Stale header or the stale query parameter.
+func allowsStaleRead(r *http.Request) bool {
+	return r.Header.Get("X-Allow-Stale") == "true" || r.URL.Query().Get("stale") == "true"
+}
+
 func handleGet(w http.ResponseWriter, r *http.Request) {
-	key := strings.TrimPrefix(r.URL.Path, "/kv/")
-	val, err := redisClient.Get(ctx, key).Result()
-	if err == nil {
+	if wantsFullEntry(r) {
+		handleGetFull(w, r)
+		return
+	}
+	if _, ok := requestedEnvelope(r); !ok {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "Unsupported response version: use 1 or 2")
+		return
+	}
+	if _, ok := requestedJSONPath(w, r); !ok {
+		return
+	}
+	consistency, ok := requestedConsistency(w, r)
+	if !ok {
+		return
+	}
+	strong := consistency == consistencyStrong
+	followerRead := allowsStaleRead(r)
+	if strong && followerRead {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "Consistency: strong cannot be combined with a stale read")
+		return
+	}
+	namespace, key := requestKey(r)
+	val, version, hit, err := "", int64(0), false, error(nil)
+	if !needsEntryMetadata(r) && !strong {
+		val, version, hit, err = cacheGet(redisKey(namespace, key))
+	}
+	if hit {
 		log.Printf("GET cache hit for key: %s", key)
-		json.NewEncoder(w).Encode(map[string]string{"key": key, "value": val})
+		setReadSource(w, sourceRedis)
+		writeValue(w, r, key, val, version)
+		return
+	}
+	if err != nil {
+		redisErrors.Add(1)
+		log.Printf("WARNING: Redis GET failed for key '%s', falling back to CockroachDB: %v", key, err)
+	}
+	if err == nil && !followerRead && !strong && !needsEntryMetadata(r) && cacheReadable() {
+		release, val, version, hit := coordinateCacheFill(r.Context(), namespace, key)
+		defer release()
+		if hit {
+			log.Printf("GET cache hit for key: %s after another server filled it", key)
+			setReadSource(w, sourceRedis)
+			writeValue(w, r, key, val, version)
+			return
+		}
+	}
+	log.Printf("GET cache miss for key: %s. Querying CockroachDB (follower_read=%t, consistency=%s).", key, followerRead, consistency)
+	entry, err := latestForKey(r.Context(), namespace, key, followerRead)
+	if err == nil && isAlias(entry) {
+		setReadSource(w, sourceCockroachDB)
+		handleAliasGet(w, r, entry, followerRead)
+		return
+	}
+	if err != nil && !strong && serveStale(w, r, namespace, key, err) {
+		return
+	}
+	if errors.Is(err, errDBUnavailable) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Duration(cfg.DBBreakerCooldown).Seconds())))
+		writeError(w, http.StatusServiceUnavailable, codeDBUnavailable, "Service unavailable: CockroachDB is overloaded")
 		return
 	}
-	log.Printf("GET cache miss for key: %s. Querying CockroachDB.", key)
-	dbValue, found, err := getLatestValueFromLog(key)
 	if err != nil {
 		log.Printf("ERROR: CockroachDB query failed for key '%s': %v", key, err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	setReadSource(w, sourceCockroachDB)
+	if entry == nil && fallbackReader != nil {
+		entry, err = readThroughFallback(r.Context(), namespace, key)
+		if err != nil {
+			log.Printf("ERROR: Fallback read failed for key '%s': %v", key, err)
+			writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+			return
+		}
+		if entry != nil && !entry.Deleted {
+			setReadSource(w, sourceFallback)
+			writeEntryValue(w, r, entry)
+			return
+		}
+	}
+	if entry == nil || entry.Deleted || entry.Expired {
+		// An expired value is not found even before the expirer tombstones it.
+		writeError(w, http.StatusNotFound, codeKeyNotFound, "Key not found")
 		return
 	}
-	if !found {
-		http.Error(w, "Key not found", http.StatusNotFound)
+	if followerRead {
+		// A follower read may trail the hydrator, so never let it overwrite the cache.
+		log.Printf("GET successful from CockroachDB follower read for key: %s", key)
+		writeEntryValue(w, r, entry)
 		return
 	}
 	// We still populate the cache on a miss for subsequent reads.
-	if err := redisClient.Set(ctx, key, dbValue, 0).Err(); err != nil {
+	if err := cacheSet(*entry); err != nil {
+		redisErrors.Add(1)
 		log.Printf("ERROR: Failed to populate cache for key '%s': %v", key, err)
 	}
 	log.Printf("GET successful from CockroachDB for key: %s", key)
-	json.NewEncoder(w).Encode(map[string]string{"key": key, "value": dbValue})
+	writeEntryValue(w, r, entry)
 }
 
 func handleDelete(w http.ResponseWriter, r *http.Request) {
-	key := strings.TrimPrefix(r.URL.Path, "/kv/")
+	if rejectIfReadOnly(w) {
+		return
+	}
+	namespace, key := requestKey(r)
+	if expected, ok := expectedValue(r); ok {
+		handleConditionalDelete(w, r, namespace, key, expected)
+		return
+	}
+	// Unless forced, only write a tombstone for keys that are currently live.
+	if r.URL.Query().Get("force") != "true" {
+		_, found, err := getLatestValueFromLog(r.Context(), namespace, key, false)
+		if errors.Is(err, errDBUnavailable) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Duration(cfg.DBBreakerCooldown).Seconds())))
+			writeError(w, http.StatusServiceUnavailable, codeDBUnavailable, "Service unavailable: CockroachDB is overloaded")
+			return
+		}
+		if err != nil {
+			log.Printf("ERROR: CockroachDB query failed for key '%s': %v", key, err)
+			writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+			return
+		}
+		if !found {
+			writeError(w, http.StatusNotFound, codeKeyNotFound, "Key not found")
+			return
+		}
+	}
 	entry := LogEntry{
-		Key:       key,
-		Value:     "",
-		Timestamp: time.Now().UTC(),
-		Deleted:   true,
+		Namespace:    namespace,
+		Key:          key,
+		Value:        "",
+		Timestamp:    time.Now().UTC(),
+		Deleted:      true,
+		OriginRegion: cfg.OriginRegion,
 	}
-	// The server's ONLY job on a delete is to write a tombstone to the log.
-	if err := appendToLog(entry); err != nil {
+	// A delete is a tombstone in the log, mirrored to the cache per the cache mode.
+	if err := appendToLog(r.Context(), &entry); err != nil {
 		log.Printf("ERROR: Failed to write delete log to CockroachDB for key '%s': %v", key, err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
 		return
 	}
+	applyWriteToCache(entry)
 	log.Printf("DELETE successful for key: %s (tombstone persisted to log)", key)
 	w.WriteHeader(http.StatusOK)
 }
 
+// handleConditionalDelete deletes key only if its current value is expected,
+// answering 409 if it differs and 404 if the key is missing or deleted.
+func handleConditionalDelete(w http.ResponseWriter, r *http.Request, namespace, key, expected string) {
+	entry, err := deleteIfValue(r.Context(), namespace, key, expected)
+	switch {
+	case errors.Is(err, errKeyNotFound):
+		writeError(w, http.StatusNotFound, codeKeyNotFound, "Key not found")
+		return
+	case errors.Is(err, errValueMismatch):
+		writeError(w, http.StatusConflict, codeConflict, "Conflict: current value does not match expected_value")
+		return
+	case errors.Is(err, errVersionConflict):
+		writeError(w, http.StatusConflict, codeWriteConflict, "Conflict: key kept changing, retry the delete")
+		return
+	case err != nil:
+		log.Printf("ERROR: Failed to write conditional delete to CockroachDB for key '%s': %v", key, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	applyWriteToCache(*entry)
+	log.Printf("DELETE successful for key: %s (expected value matched, version %d)", key, entry.Version)
+	w.WriteHeader(http.StatusOK)
+}
+
 func main() {
-	dbURL := os.Getenv("DATABASE_URL")
-	if dbURL == "" {
-		dbURL = "postgresql://root@localhost:26257/defaultdb?sslmode=disable"
-	}
-	redisURL := os.Getenv("REDIS_URL")
-	if redisURL == "" {
-		redisURL = "localhost:6379"
-	}
-	serverPort := os.Getenv("PORT")
-	if serverPort == "" {
-		serverPort = "8080"
-	}
-	log.Printf("Connecting to Database at: %s", dbURL)
-	log.Printf("Connecting to Redis at: %s", redisURL)
-	initDB(dbURL)
-	initRedis(redisURL)
+	var err error
+	cfg, err = loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	log.Printf("kv-server %s (commit %s, built %s, %s)", build.Version, build.Commit, build.BuildDate, build.GoVersion)
+	effective, _ := json.Marshal(cfg.redacted())
+	log.Printf("Effective configuration: %s", effective)
+	activeCacheMode, _ = parseCacheMode(cfg.CacheMode)
+	log.Printf("Cache mode: %s", activeCacheMode)
+	log.Printf("Connecting to Database at: %s", cfg.redacted().DatabaseURL)
+	log.Printf("Connecting to Redis at: %s", cfg.redacted().RedisURL)
+	if cfg.ReadOnly {
+		setReadOnly(true, "READ_ONLY is set")
+	}
+	initDB(cfg.DatabaseURL)
+	initRedis(cfg.RedisURL)
+	if cfg.WriteMode == writeModeAsync {
+		asyncWrites = newAsyncWriter(cfg.AsyncQueueSize, cfg.AsyncFlushBatchSize, cfg.AsyncQueueFull == "block")
+		log.Printf("Async writes enabled: queue of %d, flushed in batches of up to %d (when full: %s)", cfg.AsyncQueueSize, cfg.AsyncFlushBatchSize, cfg.AsyncQueueFull)
+	}
+	if cfg.WriteBatchSize > 1 {
+		writeBatcher = newLogBatcher(cfg.WriteBatchSize, time.Duration(cfg.WriteBatchWindow))
+		log.Printf("Write batching enabled: up to %d rows per INSERT, %v window", cfg.WriteBatchSize, time.Duration(cfg.WriteBatchWindow))
+	}
+	go runNamespaceRefresher(30 * time.Second)
+	initHotKeys(cfg.HotKeysCapacity)
+	if cfg.DBBreakerThreshold > 0 {
+		dbReadBreaker = newCircuitBreaker(cfg.DBBreakerThreshold, time.Duration(cfg.DBBreakerCooldown))
+	}
+	if cfg.DBReadConcurrency > 0 {
+		dbReadLimiter = newReadLimiter(cfg.DBReadConcurrency, time.Duration(cfg.DBReadQueueTimeout))
+		log.Printf("CockroachDB reads limited to %d at a time (queue timeout %v)", cfg.DBReadConcurrency, time.Duration(cfg.DBReadQueueTimeout))
+	}
+	regionAddresses, _ = parseRegionAddresses(cfg.RegionAddresses)
+	namespaceQuotas, _ = parseNamespaceQuotas(cfg.NamespaceQuotas)
+	if cfg.HomeRegionFencing {
+		log.Printf("Home region fencing enabled: writes to keys homed outside %s are answered with 421", cfg.OriginRegion)
+	}
+	if cfg.FallbackURL != "" {
+		fallbackReader = newHTTPFallback(cfg.FallbackURL, time.Duration(cfg.FallbackTimeout))
+		log.Printf("Read-through fallback enabled: %s", cfg.FallbackURL)
+	}
+	if cfg.HydratorMaxLag > 0 {
+		go runHydratorWatch(time.Duration(cfg.HydratorMaxLag))
+		log.Printf("Cache bypass enabled when the hydrator lags by more than %v", time.Duration(cfg.HydratorMaxLag))
+	}
+	if cfg.CacheFillLockTTL > 0 {
+		log.Printf("Cross-instance cache fills enabled: lock TTL %v, wait %v", time.Duration(cfg.CacheFillLockTTL), time.Duration(cfg.CacheFillWait))
+	}
+	if cfg.RedisStatsInterval > 0 {
+		go runRedisStatsSampler(time.Duration(cfg.RedisStatsInterval), cfg.RedisStatsSampleSize)
+	}
+	if cfg.ExpirerInterval > 0 {
+		go runExpirer(time.Duration(cfg.ExpirerInterval), cfg.ExpirerBatchSize)
+	}
+	if cfg.RetentionMaxAge > 0 {
+		go runRetention(time.Duration(cfg.RetentionInterval))
+	}
+	if cfg.RedisExpiryEvents {
+		go runExpiryEventListener()
+	}
 	defer db.Close()
-	http.HandleFunc("/kv/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		switch r.Method {
-		case http.MethodGet:
-			handleGet(w, r)
-		case http.MethodPut:
-			handlePut(w, r)
-		case http.MethodDelete:
-			handleDelete(w, r)
-		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		}
+	if cfg.AdminAddr != "" {
+		go runAdminServer(cfg.AdminAddr)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/kv/", routeKV)
+	mux.HandleFunc("/locks/", handleLock)
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		allowMethods(w, r, handleVersion, http.MethodGet, http.MethodHead)
 	})
-	log.Printf("Starting server on port :%s", serverPort)
-	if err := http.ListenAndServe(":"+serverPort, nil); err != nil {
+	mux.Handle("/debug/vars", expvar.Handler())
+	var handler http.Handler = mux
+	if cfg.GzipMinBytes > 0 {
+		handler = withGzip(cfg.GzipMinBytes, handler)
+	}
+	server := newHTTPServer(withRequestID(withAccessLog(handler)))
+	if cfg.TLSCertFile != "" {
+		log.Printf("Starting server on port :%s (HTTPS, HTTP/2 enabled)", cfg.Port)
+		err = server.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+	} else {
+		log.Printf("Starting server on port :%s (plaintext, h2c=%t)", cfg.Port, cfg.EnableH2C)
+		err = server.ListenAndServe()
+	}
+	if err != nil {
 		log.Fatalf("Server failed to start: %v", err)
 	}
 }
+
+// newHTTPServer builds the API server with explicit timeouts so idle
+// keep-alive connections are reused but never held forever. HTTP/2 is
+// negotiated automatically over TLS; for plaintext, EnableH2C also accepts
+// prior-knowledge HTTP/2 (h2c) alongside HTTP/1.1.
+func newHTTPServer(handler http.Handler) *http.Server {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(cfg.EnableH2C)
+	return &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           handler,
+		Protocols:         &protocols,
+		ReadHeaderTimeout: time.Duration(cfg.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(cfg.ReadTimeout),
+		WriteTimeout:      time.Duration(cfg.WriteTimeout),
+		IdleTimeout:       time.Duration(cfg.IdleTimeout),
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// --- Labels ---
+//
+// An entry can carry labels, string key-value tags such as env=prod, stored
+// in kv_log's JSONB labels column. A PUT sets the labels of the version it
+// writes, and a PATCH carries the current ones forward. /kv/_list?label=k=v
+// returns only keys whose latest version has all of the given labels; the
+// inverted index idx_labels narrows that scan to keys that ever had them.
+
+const (
+	maxLabels         = 64
+	maxLabelKeyLength = 128
+	maxLabelValLength = 256
+)
+
+// validateLabels checks labels from a PUT body. Keys and values may not
+// contain ',', and keys may not contain '=', so every label can be written
+// in a ?label= selector.
+func validateLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("at most %d labels are allowed", maxLabels)
+	}
+	for k, v := range labels {
+		switch {
+		case k == "":
+			return errors.New("label names must not be empty")
+		case len(k) > maxLabelKeyLength:
+			return fmt.Errorf("label name %q is longer than %d bytes", k, maxLabelKeyLength)
+		case len(v) > maxLabelValLength:
+			return fmt.Errorf("value of label %q is longer than %d bytes", k, maxLabelValLength)
+		case strings.ContainsAny(k, "=,"):
+			return fmt.Errorf("label name %q must not contain '=' or ','", k)
+		case strings.Contains(v, ","):
+			return fmt.Errorf("value of label %q must not contain ','", k)
+		}
+	}
+	return nil
+}
+
+// parseLabelSelector parses the ?label= parameters of a list request. Each
+// may hold several comma-separated name=value pairs, and all pairs must
+// match. It returns nil when no label was given.
+func parseLabelSelector(params []string) (map[string]string, error) {
+	var selector map[string]string
+	for _, param := range params {
+		for _, pair := range strings.Split(param, ",") {
+			name, value, ok := strings.Cut(pair, "=")
+			if !ok || name == "" {
+				return nil, fmt.Errorf("label selector %q is not name=value", pair)
+			}
+			if selector == nil {
+				selector = map[string]string{}
+			}
+			if existing, dup := selector[name]; dup && existing != value {
+				return nil, fmt.Errorf("label %q is selected with two values", name)
+			}
+			selector[name] = value
+		}
+	}
+	return selector, nil
+}
+
+// labelsParam encodes labels for the JSONB column, as NULL when there are none.
+func labelsParam(labels map[string]string) any {
+	if len(labels) == 0 {
+		return nil
+	}
+	encoded, _ := json.Marshal(labels)
+	return string(encoded)
+}
+
+// decodeLabels decodes the labels column, which is NULL for entries without
+// labels.
+func decodeLabels(raw []byte) (map[string]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var labels map[string]string
+	if err := json.Unmarshal(raw, &labels); err != nil {
+		return nil, fmt.Errorf("decoding labels: %w", err)
+	}
+	return labels, nil
+}
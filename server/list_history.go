@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --- List and History Endpoints ---
+
+// queryLimit parses the optional limit query parameter. Out-of-range values
+// are clamped by the query layer.
+func queryLimit(r *http.Request) (int, bool) {
+	raw := r.URL.Query().Get("limit")
+	if raw == "" {
+		return 0, true
+	}
+	limit, err := strconv.Atoi(raw)
+	return limit, err == nil
+}
+
+// handleList serves GET /kv/_list?namespace=&prefix=&label=&cursor=&limit=,
+// returning live keys in key order, at most LIST_MAX_LIMIT per page. When a
+// page is full, truncated is true and next_cursor continues it.
+func handleList(w http.ResponseWriter, r *http.Request) {
+	limit, ok := queryLimit(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "Invalid limit")
+		return
+	}
+	namespace, ok := namespaceQuery(r)
+	if !ok {
+		writeError(w, http.StatusNotFound, codeNamespaceNotFound, "Namespace not found")
+		return
+	}
+	query := r.URL.Query()
+	selector, err := parseLabelSelector(query["label"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, fmt.Sprintf("Invalid label: %v", err))
+		return
+	}
+	limit = clampLimitTo(limit, cfg.ListMaxLimit)
+	entries, err := liveKeysByPrefix(r.Context(), namespace, query.Get("prefix"), query.Get("cursor"), selector, limit)
+	if err != nil {
+		log.Printf("ERROR: CockroachDB list query failed for prefix '%s': %v", query.Get("prefix"), err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	type item struct {
+		Key       string            `json:"key"`
+		Value     string            `json:"value"`
+		Timestamp time.Time         `json:"timestamp"`
+		Labels    map[string]string `json:"labels,omitempty"`
+	}
+	items := make([]item, 0, len(entries))
+	for _, e := range entries {
+		items = append(items, item{e.Key, e.Value, e.Timestamp, e.Labels})
+	}
+	resp := map[string]any{"keys": items, "next_cursor": nil, "truncated": len(entries) == limit}
+	if len(entries) == limit {
+		resp["next_cursor"] = entries[len(entries)-1].Key
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// countCache briefly remembers /kv/_count results, which scan every key
+// under the prefix.
+var countCache = struct {
+	sync.Mutex
+	entries map[string]cachedCount
+}{entries: map[string]cachedCount{}}
+
+type cachedCount struct {
+	count   int64
+	expires time.Time
+}
+
+// handleCount serves GET /kv/_count?namespace=&prefix=, returning the number
+// of live keys under the prefix. Results are cached for COUNT_CACHE_TTL.
+func handleCount(w http.ResponseWriter, r *http.Request) {
+	namespace, ok := namespaceQuery(r)
+	if !ok {
+		writeError(w, http.StatusNotFound, codeNamespaceNotFound, "Namespace not found")
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	cacheKey := qualifiedKey(namespace, prefix)
+	now := time.Now()
+
+	countCache.Lock()
+	cached, hit := countCache.entries[cacheKey]
+	countCache.Unlock()
+	if hit && now.Before(cached.expires) {
+		json.NewEncoder(w).Encode(map[string]any{"namespace": namespace, "prefix": prefix, "count": cached.count})
+		return
+	}
+
+	count, err := countLiveKeys(r.Context(), namespace, prefix)
+	if err != nil {
+		log.Printf("ERROR: CockroachDB count query failed for prefix '%s': %v", prefix, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	if ttl := time.Duration(cfg.CountCacheTTL); ttl > 0 {
+		countCache.Lock()
+		for k, e := range countCache.entries {
+			if now.After(e.expires) {
+				delete(countCache.entries, k)
+			}
+		}
+		countCache.entries[cacheKey] = cachedCount{count: count, expires: now.Add(ttl)}
+		countCache.Unlock()
+	}
+	json.NewEncoder(w).Encode(map[string]any{"namespace": namespace, "prefix": prefix, "count": count})
+}
+
+// historyCursor is the next_before cursor continuing history after last: its
+// hlc, or for entries written before hlc was recorded, its timestamp.
+func historyCursor(last LogEntry) string {
+	if last.HLC != "" {
+		return last.HLC
+	}
+	return last.Timestamp.Format(time.RFC3339Nano)
+}
+
+// handleHistory serves GET /kv/{key}/_history?limit=&before=, returning the
+// key's log entries newest first, tombstones included, at most
+// HISTORY_MAX_LIMIT per page. When a page is full, truncated is true and
+// next_before continues it.
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	namespace, key := requestKey(r)
+	limit, ok := queryLimit(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "Invalid limit")
+		return
+	}
+	before := r.URL.Query().Get("before")
+	if before != "" && !hlcPattern.MatchString(before) {
+		if _, err := time.Parse(time.RFC3339Nano, before); err != nil {
+			writeError(w, http.StatusBadRequest, codeValidationFailed, "Invalid before cursor (want a next_before value)")
+			return
+		}
+	}
+	limit = clampLimitTo(limit, cfg.HistoryMaxLimit)
+	entries, err := historyForKey(r.Context(), namespace, key, limit, before)
+	if err != nil {
+		log.Printf("ERROR: CockroachDB history query failed for key '%s': %v", key, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	if entries == nil {
+		entries = []LogEntry{}
+	}
+	resp := map[string]any{"namespace": namespace, "key": key, "entries": entries, "next_before": nil, "truncated": len(entries) == limit}
+	if len(entries) == limit {
+		resp["next_before"] = historyCursor(entries[len(entries)-1])
+	}
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// --- Multi-Region Locality ---
+//
+// When regions are configured, the database is made multi-region (the first
+// region is the primary) and kv_log is given a table locality:
+//   - regional_by_row: each row is homed in the region that wrote it (hidden
+//     crdb_region column). Writes and same-region reads are fast; reads of keys
+//     written elsewhere cross regions. Suits write-heavy, region-affine keys.
+//   - global: every region holds a readable replica. Reads are fast everywhere;
+//     writes pay a cross-region commit wait. Suits read-mostly keys.
+// The hydrator applies the same settings, so whichever binary creates kv_log
+// first, the table ends up with the same locality.
+
+const (
+	localityRegionalByRow = "regional_by_row"
+	localityGlobal        = "global"
+)
+
+// parseRegions splits a comma-separated region list, dropping blanks.
+func parseRegions(raw string) []string {
+	var regions []string
+	for _, r := range strings.Split(raw, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			regions = append(regions, r)
+		}
+	}
+	return regions
+}
+
+func validateLocality(regions []string, locality string) error {
+	switch locality {
+	case "":
+		return nil
+	case localityRegionalByRow, localityGlobal:
+		if len(regions) == 0 {
+			return fmt.Errorf("table_locality %q requires db_regions", locality)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown table_locality %q (want regional_by_row or global)", locality)
+}
+
+// configureLocality makes the current database multi-region and sets the
+// locality of the logTable. Every statement is idempotent.
+func configureLocality(regions []string, locality string) error {
+	if len(regions) == 0 {
+		return nil
+	}
+	var dbName string
+	if err := db.QueryRow(`SELECT current_database()`).Scan(&dbName); err != nil {
+		return err
+	}
+	statements := []string{fmt.Sprintf(`ALTER DATABASE %q SET PRIMARY REGION %q`, dbName, regions[0])}
+	for _, region := range regions[1:] {
+		statements = append(statements, fmt.Sprintf(`ALTER DATABASE %q ADD REGION IF NOT EXISTS %q`, dbName, region))
+	}
+	switch locality {
+	case localityRegionalByRow:
+		statements = append(statements, `ALTER TABLE `+logTable()+` SET LOCALITY REGIONAL BY ROW`)
+	case localityGlobal:
+		statements = append(statements, `ALTER TABLE `+logTable()+` SET LOCALITY GLOBAL`)
+	}
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("%s: %w", stmt, err)
+		}
+	}
+	log.Printf("Database %s is multi-region (regions=%v); %s locality=%s", dbName, regions, logTable(), locality)
+	return nil
+}
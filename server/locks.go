@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Locks ---
+//
+// /locks/{name} exposes leases built on the log's conditional writes. A lock
+// is a key in the internal locksNamespace, which /kv/ cannot address, whose
+// latest entry holds the lease and carries its TTL in ttl_seconds:
+//
+//   - POST acquires the lock if it is free, answering 409 if it is held.
+//   - PUT renews a held lease for another ttl, given the holder's token.
+//   - DELETE releases it, given the holder's token.
+//   - GET reports the current lease, or 404.
+//
+// Every write reads the latest entry and appends the new one in a single
+// transaction, conditioned on the version read, so concurrent acquirers in
+// any region cannot both win. A lease not renewed within its ttl counts as
+// free from then on, even before the expirer tombstones it, so a crashed
+// holder cannot block the lock forever. Expiry is judged by CockroachDB's
+// clock, which also stamps lease entries, so server clocks do not matter.
+//
+// The fencing token is the version of the entry that acquired the lease, so
+// every acquisition gets a larger token than the one before. Renewals keep
+// the token. Clients pass it along to the resource they guard, which can
+// then reject requests carrying an older token.
+
+// locksNamespace holds lock keys. Registered namespaces cannot start with
+// '_', so it never clashes with one.
+const locksNamespace = "_locks"
+
+const (
+	defaultLockTTL = 30 * time.Second
+	minLockTTL     = time.Second
+)
+
+var (
+	errLockHeld    = errors.New("lock is held")
+	errLockNotHeld = errors.New("lock is not held")
+	errLockToken   = errors.New("fencing token does not match the current lease")
+)
+
+// lease is the value of a lock's latest entry.
+type lease struct {
+	Holder string `json:"holder,omitempty"`
+	Token  int64  `json:"token"`
+}
+
+// lockResponse describes the current lease of a lock.
+type lockResponse struct {
+	Name      string    `json:"name"`
+	Holder    string    `json:"holder,omitempty"`
+	Token     int64     `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func newLockResponse(name string, entry LogEntry) (lockResponse, error) {
+	var l lease
+	if err := json.Unmarshal([]byte(entry.Value), &l); err != nil {
+		return lockResponse{}, fmt.Errorf("decoding lease of lock '%s': %w", name, err)
+	}
+	return lockResponse{
+		Name:      name,
+		Holder:    l.Holder,
+		Token:     l.Token,
+		ExpiresAt: entry.Timestamp.Add(time.Duration(entry.TTLSeconds) * time.Second),
+	}, nil
+}
+
+// handleLock serves /locks/{name}.
+func handleLock(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBodyBytes)
+	name := strings.TrimPrefix(r.URL.Path, "/locks/")
+	if name == "" || strings.Contains(name, "/") {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "Lock names must be non-empty and must not contain '/'")
+		return
+	}
+	if r.Method != http.MethodGet && rejectIfReadOnly(w) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		getLock(w, r, name)
+	case http.MethodPost:
+		acquireLock(w, r, name)
+	case http.MethodPut:
+		renewLock(w, r, name)
+	case http.MethodDelete:
+		releaseLock(w, r, name)
+	default:
+		w.Header().Set("Allow", "GET, POST, PUT, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// lockTTL parses the ttl query parameter, rounded to whole seconds.
+func lockTTL(r *http.Request) (int64, bool) {
+	ttl := defaultLockTTL
+	if raw := r.URL.Query().Get("ttl"); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil || parsed < minLockTTL {
+			return 0, false
+		}
+		ttl = parsed
+	}
+	return int64(ttl.Round(time.Second) / time.Second), true
+}
+
+// lockToken reads the holder's fencing token from the token query parameter
+// or the X-Fencing-Token header.
+func lockToken(r *http.Request) (int64, bool) {
+	raw := r.URL.Query().Get("token")
+	if raw == "" {
+		raw = r.Header.Get("X-Fencing-Token")
+	}
+	token, err := strconv.ParseInt(raw, 10, 64)
+	return token, err == nil && token > 0
+}
+
+func getLock(w http.ResponseWriter, r *http.Request, name string) {
+	entry, err := latestForKey(r.Context(), locksNamespace, name, false)
+	var now time.Time
+	if err == nil {
+		err = db.QueryRowContext(r.Context(), `SELECT now()`).Scan(&now)
+	}
+	if err != nil {
+		log.Printf("ERROR: CockroachDB query failed for lock '%s': %v", name, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	if entry == nil || entry.Deleted || !now.Before(entry.Timestamp.Add(time.Duration(entry.TTLSeconds)*time.Second)) {
+		writeError(w, http.StatusNotFound, codeNotFound, "Lock is not held")
+		return
+	}
+	writeLockResponse(w, http.StatusOK, name, *entry)
+}
+
+func acquireLock(w http.ResponseWriter, r *http.Request, name string) {
+	ttl, ok := lockTTL(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "ttl must be a duration of at least 1s")
+		return
+	}
+	var payload struct {
+		Holder string `json:"holder"`
+	}
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	if len(body) > 0 && !decodeJSONBody(w, bytes.NewReader(body), &payload) {
+		return
+	}
+	entry, err := writeLease(r.Context(), name, func(current *LogEntry) (*lease, error) {
+		if current != nil {
+			return nil, errLockHeld
+		}
+		return &lease{Holder: payload.Holder}, nil
+	}, ttl)
+	if !lockWriteOK(w, name, err) {
+		return
+	}
+	log.Printf("Lock '%s' acquired (token %d, ttl %ds)", name, entry.Version, ttl)
+	writeLockResponse(w, http.StatusCreated, name, *entry)
+}
+
+func renewLock(w http.ResponseWriter, r *http.Request, name string) {
+	ttl, ok := lockTTL(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "ttl must be a duration of at least 1s")
+		return
+	}
+	token, ok := lockToken(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "A fencing token is required (token or X-Fencing-Token)")
+		return
+	}
+	entry, err := writeLease(r.Context(), name, func(current *LogEntry) (*lease, error) {
+		return heldLease(current, token)
+	}, ttl)
+	if !lockWriteOK(w, name, err) {
+		return
+	}
+	writeLockResponse(w, http.StatusOK, name, *entry)
+}
+
+func releaseLock(w http.ResponseWriter, r *http.Request, name string) {
+	token, ok := lockToken(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "A fencing token is required (token or X-Fencing-Token)")
+		return
+	}
+	_, err := writeLease(r.Context(), name, func(current *LogEntry) (*lease, error) {
+		_, err := heldLease(current, token)
+		return nil, err
+	}, 0)
+	if !lockWriteOK(w, name, err) {
+		return
+	}
+	log.Printf("Lock '%s' released (token %d)", name, token)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// heldLease returns the lease of current if it was acquired with token.
+func heldLease(current *LogEntry, token int64) (*lease, error) {
+	if current == nil {
+		return nil, errLockNotHeld
+	}
+	var held lease
+	if err := json.Unmarshal([]byte(current.Value), &held); err != nil {
+		return nil, fmt.Errorf("decoding lease: %w", err)
+	}
+	if held.Token != token {
+		return nil, errLockToken
+	}
+	return &held, nil
+}
+
+// lockWriteOK maps the error of a lease write to a response, reporting
+// whether the write succeeded.
+func lockWriteOK(w http.ResponseWriter, name string, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errLockHeld):
+		writeError(w, http.StatusConflict, codeConflict, "Conflict: lock is held")
+	case errors.Is(err, errLockToken):
+		writeError(w, http.StatusConflict, codeConflict, "Conflict: fencing token does not match the current lease")
+	case errors.Is(err, errLockNotHeld):
+		writeError(w, http.StatusConflict, codeConflict, "Conflict: lock is not held (released or expired)")
+	case errors.Is(err, errVersionConflict):
+		writeError(w, http.StatusConflict, codeWriteConflict, "Conflict: lock kept changing, retry")
+	default:
+		log.Printf("ERROR: Failed to write lease of lock '%s' to CockroachDB: %v", name, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+	}
+	return false
+}
+
+func writeLockResponse(w http.ResponseWriter, status int, name string, entry LogEntry) {
+	resp, err := newLockResponse(name, entry)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// writeLease runs decide on the lock's current lease, nil when the lock is
+// free, and appends its result: the returned lease with ttlSeconds, or a
+// tombstone when it returns nil. A new lease without a token gets the version
+// of its own entry as token. Conflicts with concurrent writers are retried.
+func writeLease(ctx context.Context, name string, decide func(current *LogEntry) (*lease, error), ttlSeconds int64) (*LogEntry, error) {
+	var err error
+	for attempt := 0; attempt < 5; attempt++ {
+		var entry *LogEntry
+		entry, err = tryWriteLease(ctx, name, decide, ttlSeconds)
+		if !errors.Is(err, errVersionConflict) {
+			return entry, err
+		}
+	}
+	return nil, err
+}
+
+func tryWriteLease(ctx context.Context, name string, decide func(current *LogEntry) (*lease, error), ttlSeconds int64) (*LogEntry, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// The transaction's own timestamp both judges expiry and stamps the new
+	// entry, so every region measures leases with the same clock.
+	var now time.Time
+	if err := tx.QueryRowContext(ctx, `SELECT now()`).Scan(&now); err != nil {
+		return nil, err
+	}
+	latest, err := lockLatestEntry(ctx, tx, locksNamespace, name)
+	if err != nil && !errors.Is(err, errKeyNotFound) {
+		return nil, err
+	}
+	var current *LogEntry
+	if err == nil && now.Before(latest.Timestamp.Add(time.Duration(latest.TTLSeconds)*time.Second)) {
+		current = &latest
+	}
+	next, err := decide(current)
+	if err != nil {
+		return nil, err
+	}
+	entry := &LogEntry{
+		Namespace:    locksNamespace,
+		Key:          name,
+		Timestamp:    now.UTC(),
+		OriginRegion: cfg.OriginRegion,
+	}
+	if next == nil {
+		entry.Deleted = true
+	} else {
+		if next.Token == 0 {
+			// insertLogEntry gives the entry exactly this version, since it
+			// only inserts while the key is still at latest.Version.
+			next.Token = latest.Version + 1
+		}
+		value, _ := json.Marshal(next)
+		entry.Value = string(value)
+		entry.TTLSeconds = ttlSeconds
+	}
+	if err := insertLogEntry(ctx, tx, entry, &latest.Version); err != nil {
+		return nil, err
+	}
+	if err := pruneVersions(ctx, tx, locksNamespace, name); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		if isWriteConflict(err) {
+			return nil, errVersionConflict
+		}
+		return nil, err
+	}
+	applyWriteToCache(*entry)
+	return entry, nil
+}
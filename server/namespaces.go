@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Namespaces ---
+//
+// A namespace is a separate keyspace in kv_log, so different apps can share a
+// deployment without key collisions. Keys in a namespace are addressed as
+// /kv/{namespace}/{key}; anything else belongs to the default namespace, so
+// existing clients are unaffected. Because a default-namespace key may itself
+// contain slashes, only registered namespaces are recognised in paths, and a
+// namespace cannot be registered while default keys live under its name.
+//
+// The Redis key of an entry is its path form (see qualifiedKey and redisKey),
+// which cannot collide: default keys under a registered namespace's name are
+// unreachable.
+
+const defaultNamespace = "default"
+
+var namespaceNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// qualifiedKey is the path below /kv/ of key in namespace, and its Redis key
+// before REDIS_KEY_PREFIX.
+func qualifiedKey(namespace, key string) string {
+	if namespace == defaultNamespace {
+		return key
+	}
+	return namespace + "/" + key
+}
+
+// namespaceRegistry caches the registered namespace names. Other servers'
+// registrations are picked up on the next refresh.
+var namespaceRegistry = struct {
+	sync.RWMutex
+	names map[string]bool
+}{names: map[string]bool{}}
+
+func isNamespace(name string) bool {
+	namespaceRegistry.RLock()
+	defer namespaceRegistry.RUnlock()
+	return namespaceRegistry.names[name]
+}
+
+func refreshNamespaces() error {
+	rows, err := db.Query(`SELECT name FROM kv_namespaces`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	names := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		names[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	namespaceRegistry.Lock()
+	namespaceRegistry.names = names
+	namespaceRegistry.Unlock()
+	return nil
+}
+
+// runNamespaceRefresher reloads the registry, and the namespaces' value
+// schemas, every interval, forever.
+func runNamespaceRefresher(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := refreshNamespaces(); err != nil {
+			log.Printf("ERROR: Failed to refresh namespaces: %v", err)
+		}
+		if err := refreshSchemas(); err != nil {
+			log.Printf("ERROR: Failed to refresh schemas: %v", err)
+		}
+	}
+}
+
+// resolveKey splits a key path into its namespace and key.
+func resolveKey(path string) (namespace, key string) {
+	if ns, rest, ok := strings.Cut(path, "/"); ok && rest != "" && isNamespace(ns) {
+		return ns, rest
+	}
+	return defaultNamespace, path
+}
+
+type keyRefKey struct{}
+
+type keyRef struct{ namespace, key string }
+
+// withKeyRef records the namespace and key a request addresses.
+func withKeyRef(r *http.Request, namespace, key string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), keyRefKey{}, keyRef{namespace, key}))
+}
+
+// requestKey returns the namespace and key resolved by routeKV.
+func requestKey(r *http.Request) (namespace, key string) {
+	ref, _ := r.Context().Value(keyRefKey{}).(keyRef)
+	return ref.namespace, ref.key
+}
+
+// namespaceQuery reads the optional ?namespace= parameter of collection
+// endpoints, reporting false for an unknown namespace.
+func namespaceQuery(r *http.Request) (string, bool) {
+	namespace := r.URL.Query().Get("namespace")
+	if namespace == "" || namespace == defaultNamespace {
+		return defaultNamespace, true
+	}
+	return namespace, isNamespace(namespace)
+}
+
+// handleListNamespaces serves GET /kv/_namespaces.
+func handleListNamespaces(w http.ResponseWriter, r *http.Request) {
+	namespaceRegistry.RLock()
+	names := []string{defaultNamespace}
+	for name := range namespaceRegistry.names {
+		names = append(names, name)
+	}
+	namespaceRegistry.RUnlock()
+	json.NewEncoder(w).Encode(map[string]any{"namespaces": names})
+}
+
+// handleNamespace serves GET (stats) and PUT (register, admin only) on
+// /kv/_namespaces/{name}. The stats include the namespace's usage and, when
+// NAMESPACE_QUOTAS limits it, its quota.
+func handleNamespace(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/kv/_namespaces/")
+	if r.Method == http.MethodPut {
+		requireAdmin(func(w http.ResponseWriter, r *http.Request) { createNamespace(w, r, name) })(w, r)
+		return
+	}
+	if name != defaultNamespace && !isNamespace(name) {
+		writeError(w, http.StatusNotFound, codeNamespaceNotFound, "Namespace not found")
+		return
+	}
+	var liveKeys, logEntries int64
+	err := db.QueryRowContext(r.Context(), `
+    SELECT count(*) FILTER (WHERE NOT deleted), coalesce(sum(entries), 0) FROM (
+        SELECT DISTINCT ON (key) key, deleted, count(*) OVER (PARTITION BY key) AS entries FROM `+logTable()+`
+        WHERE namespace = $1
+        ORDER BY key, `+newestFirst+`
+    ) AS latest;
+    `, name).Scan(&liveKeys, &logEntries)
+	var usage namespaceUsage
+	if err == nil {
+		usage, err = usageOf(r.Context(), name)
+	}
+	if err != nil {
+		log.Printf("ERROR: CockroachDB stats query failed for namespace '%s': %v", name, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	stats := map[string]any{"namespace": name, "live_keys": liveKeys, "log_entries": logEntries, "usage": usage}
+	if quota := quotaFor(name); quota != nil {
+		stats["quota"] = quota
+	}
+	json.NewEncoder(w).Encode(stats)
+}
+
+func createNamespace(w http.ResponseWriter, r *http.Request, name string) {
+	if name == defaultNamespace || !namespaceNamePattern.MatchString(name) {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "Namespace names must match [a-z0-9][a-z0-9_-]{0,62} and not be \"default\"")
+		return
+	}
+	shadowed, err := liveKeysByPrefix(r.Context(), defaultNamespace, name+"/", "", nil, 1)
+	if err != nil {
+		log.Printf("ERROR: CockroachDB list query failed for prefix '%s/': %v", name, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	if len(shadowed) > 0 {
+		writeError(w, http.StatusConflict, codeConflict, "Default-namespace keys already exist under this name")
+		return
+	}
+	res, err := db.ExecContext(r.Context(), `INSERT INTO kv_namespaces (name) VALUES ($1) ON CONFLICT (name) DO NOTHING`, name)
+	var created int64
+	if err == nil {
+		created, err = res.RowsAffected()
+	}
+	if err == nil {
+		err = refreshNamespaces()
+	}
+	if err != nil {
+		log.Printf("ERROR: Failed to register namespace '%s': %v", name, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	status := http.StatusOK
+	if created > 0 {
+		status = http.StatusCreated
+		log.Printf("Namespace '%s' registered", name)
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"namespace": name})
+}
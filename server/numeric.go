@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Numeric Values and Range Queries ---
+//
+// Values are opaque strings unless a PUT declares "value_type": "number". The
+// value must then be a JSON number, and besides the string it is stored in
+// kv_log's numeric_value column, indexed by namespace and number, so
+//
+//	GET /kv/_range?prefix=score/&min=10&max=100
+//
+// can return the live keys whose latest value falls in [min, max], ordered by
+// value, like a sorted set. The type belongs to the write: a later write
+// without value_type stores a string again and leaves the range.
+
+const (
+	valueTypeString = "string"
+	valueTypeNumber = "number"
+)
+
+// numberPattern is the JSON number grammar, which CockroachDB's DECIMAL
+// parses exactly.
+var numberPattern = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+
+// parseValueType checks a PUT's value_type against its value and returns the
+// type to store, "" for plain strings.
+func parseValueType(valueType, value string) (string, error) {
+	switch valueType {
+	case "", valueTypeString:
+		return "", nil
+	case valueTypeNumber:
+		if !numberPattern.MatchString(value) {
+			return "", fmt.Errorf("value %q is not a number", value)
+		}
+		return valueTypeNumber, nil
+	default:
+		return "", fmt.Errorf("value_type must be %s or %s", valueTypeString, valueTypeNumber)
+	}
+}
+
+// numericParam is the numeric_value argument of a log insert: the value for
+// numbers, NULL otherwise.
+func numericParam(entry *LogEntry) sql.NullString {
+	return sql.NullString{String: entry.Value, Valid: entry.ValueType == valueTypeNumber && !entry.Deleted}
+}
+
+// rangeItem is one key of a /kv/_range page. Number repeats the value as a
+// JSON number.
+type rangeItem struct {
+	Key       string      `json:"key"`
+	Value     string      `json:"value"`
+	Number    json.Number `json:"number"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+// rangeCursor is the position after the last item of a page: its number and
+// key joined by a colon, which a number never contains.
+func rangeCursor(item rangeItem) string {
+	return string(item.Number) + ":" + item.Key
+}
+
+func parseRangeCursor(cursor string) (number, key string, ok bool) {
+	number, key, ok = strings.Cut(cursor, ":")
+	return number, key, ok && numberPattern.MatchString(number)
+}
+
+// handleRange serves GET /kv/_range?namespace=&prefix=&min=&max=&order=&cursor=&limit=,
+// returning live numeric keys under prefix whose value is between min and
+// max, both inclusive and optional, ordered by value and then key, ascending
+// or with order=desc descending. Pages hold at most LIST_MAX_LIMIT keys; when
+// one is full, truncated is true and next_cursor continues it.
+func handleRange(w http.ResponseWriter, r *http.Request) {
+	limit, ok := queryLimit(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "Invalid limit")
+		return
+	}
+	namespace, ok := namespaceQuery(r)
+	if !ok {
+		writeError(w, http.StatusNotFound, codeNamespaceNotFound, "Namespace not found")
+		return
+	}
+	query := r.URL.Query()
+	for _, bound := range []string{"min", "max"} {
+		if query.Has(bound) && !numberPattern.MatchString(query.Get(bound)) {
+			writeError(w, http.StatusBadRequest, codeValidationFailed, fmt.Sprintf("%s must be a number", bound))
+			return
+		}
+	}
+	descending := false
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		descending = true
+	default:
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "order must be asc or desc")
+		return
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		if _, _, ok := parseRangeCursor(cursor); !ok {
+			writeError(w, http.StatusBadRequest, codeValidationFailed, "Invalid cursor")
+			return
+		}
+	}
+	limit = clampLimitTo(limit, cfg.ListMaxLimit)
+	items, err := liveKeysByNumber(r.Context(), namespace, query.Get("prefix"), query.Get("min"), query.Get("max"), query.Get("cursor"), descending, limit)
+	if err != nil {
+		log.Printf("ERROR: CockroachDB range query failed for prefix '%s': %v", query.Get("prefix"), err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	resp := map[string]any{"keys": items, "next_cursor": nil, "truncated": len(items) == limit}
+	if len(items) == limit {
+		resp["next_cursor"] = rangeCursor(items[len(items)-1])
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// liveKeysByNumber returns up to limit live keys of namespace starting with
+// prefix whose latest entry is a number within [min, max] (either bound may
+// be empty), ordered by number and key, and after cursor in that order. The
+// candidates are keys with any entry in range, found through
+// idx_namespace_numeric_value; each is then checked against its latest entry,
+// so keys that have since changed, been deleted or expired drop out.
+func liveKeysByNumber(ctx context.Context, namespace, prefix, min, max, cursor string, descending bool, limit int) ([]rangeItem, error) {
+	where, args := keyRangeWhere(namespace, prefix, "", []any{clampLimit(limit)})
+	where += " AND numeric_value IS NOT NULL"
+	filter := ""
+	bound := func(op, value string) {
+		args = append(args, value)
+		n := strconv.Itoa(len(args))
+		where += " AND numeric_value " + op + " $" + n + "::DECIMAL"
+		filter += " AND latest.numeric_value " + op + " $" + n + "::DECIMAL"
+	}
+	if min != "" {
+		bound(">=", min)
+	}
+	if max != "" {
+		bound("<=", max)
+	}
+	order, after := "ASC", ">"
+	if descending {
+		order, after = "DESC", "<"
+	}
+	if number, key, ok := parseRangeCursor(cursor); ok {
+		args = append(args, number, key)
+		n := len(args)
+		filter += fmt.Sprintf(" AND (latest.numeric_value, candidates.key) %s ($%d::DECIMAL, $%d)", after, n-1, n)
+	}
+	rows, err := db.QueryContext(ctx, `
+    SELECT candidates.key, latest.value, latest.numeric_value::STRING, latest.timestamp
+    FROM (SELECT DISTINCT key FROM `+logTable()+` `+where+`) AS candidates,
+    LATERAL (
+        SELECT value, numeric_value, timestamp, deleted, `+expiredColumn+` FROM `+logTable()+`
+        WHERE namespace = $2 AND key = candidates.key
+        ORDER BY `+newestFirst+`
+        LIMIT 1
+    ) AS latest
+    WHERE latest.numeric_value IS NOT NULL AND NOT latest.deleted AND NOT latest.expired`+filter+`
+    ORDER BY latest.numeric_value `+order+`, candidates.key `+order+`
+    LIMIT $1;
+    `, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []rangeItem{}
+	for rows.Next() {
+		var item rangeItem
+		var number string
+		if err := rows.Scan(&item.Key, &item.Value, &number, &item.Timestamp); err != nil {
+			return nil, err
+		}
+		item.Number = json.Number(number)
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
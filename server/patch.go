@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// --- JSON Merge Patch ---
+//
+// Both patch formats share the transactional read-modify-write below; see
+// jsonpatch.go for RFC 6902.
+
+var errValueNotJSON = errors.New("stored value is not valid JSON")
+
+// handlePatch applies a patch to a key whose value is a JSON document and
+// appends the result as a new entry. The body is an RFC 6902 JSON Patch when
+// sent as application/json-patch+json, and an RFC 7386 merge patch otherwise.
+func handlePatch(w http.ResponseWriter, r *http.Request) {
+	if rejectIfReadOnly(w) {
+		return
+	}
+	namespace, key := requestKey(r)
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	var apply func(document any) (any, error)
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json-patch+json" {
+		ops, err := parseJSONPatch(body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeValidationFailed, fmt.Sprintf("Invalid JSON Patch: %v", err))
+			return
+		}
+		apply = func(document any) (any, error) { return applyJSONPatch(document, ops) }
+	} else {
+		patch, err := decodeJSONValue(body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeValidationFailed, "Invalid JSON merge patch")
+			return
+		}
+		apply = func(document any) (any, error) { return mergePatch(document, patch), nil }
+	}
+	if schema := schemaFor(namespace, key); schema != nil {
+		patch := apply
+		apply = func(document any) (any, error) {
+			patched, err := patch(document)
+			if err != nil {
+				return nil, err
+			}
+			return patched, validateDocument(schema, patched)
+		}
+	}
+	entry, err := patchLogEntry(r.Context(), namespace, key, nil, apply)
+	var opErr *jsonPatchError
+	var schemaErr *schemaValidationError
+	var quotaErr *errQuotaExceeded
+	switch {
+	case errors.Is(err, errKeyNotFound):
+		writeError(w, http.StatusNotFound, codeKeyNotFound, "Key not found")
+		return
+	case errors.Is(err, errValueNotJSON):
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "Existing value is not valid JSON")
+		return
+	case errors.As(err, &opErr):
+		writeError(w, http.StatusConflict, codeConflict, fmt.Sprintf("JSON Patch cannot be applied: %v", opErr))
+		return
+	case errors.As(err, &schemaErr):
+		writeSchemaValidationError(w, schemaErr)
+		return
+	case errors.As(err, &quotaErr):
+		writeQuotaExceeded(w, quotaErr)
+		return
+	case err != nil:
+		log.Printf("ERROR: Failed to patch key '%s' in CockroachDB: %v", key, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	applyWriteToCache(*entry)
+	log.Printf("PATCH successful for key: %s (version %d)", key, entry.Version)
+	json.NewEncoder(w).Encode(entry)
+}
+
+// patchLogEntry reads the key's latest value, decodes it, transforms it with
+// apply and appends the result, all in one transaction. The append is
+// conditioned on the version that was read, so a concurrent write in between
+// makes it conflict; the whole read-modify-write is then retried on the newer
+// value. apply is called once per attempt on a freshly decoded document.
+// A missing or deleted key is errKeyNotFound, unless initial is set: apply
+// then starts from initial instead.
+func patchLogEntry(ctx context.Context, namespace, key string, initial any, apply func(document any) (any, error)) (*LogEntry, error) {
+	var err error
+	for attempt := 0; attempt < 5; attempt++ {
+		var entry *LogEntry
+		entry, err = tryPatchLogEntry(ctx, namespace, key, initial, apply)
+		if !errors.Is(err, errVersionConflict) {
+			return entry, err
+		}
+	}
+	return nil, err
+}
+
+func tryPatchLogEntry(ctx context.Context, namespace, key string, initial any, apply func(document any) (any, error)) (*LogEntry, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	current, err := lockLatestEntry(ctx, tx, namespace, key)
+	var document any
+	switch {
+	case errors.Is(err, errKeyNotFound) && initial != nil:
+		document = initial
+	case err != nil:
+		return nil, err
+	default:
+		if document, err = decodeJSONValue([]byte(current.Value)); err != nil {
+			return nil, errValueNotJSON
+		}
+	}
+	patched, err := apply(document)
+	if err != nil {
+		return nil, err
+	}
+	value, err := encodeJSONValue(patched)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &LogEntry{
+		Namespace:    namespace,
+		Key:          key,
+		Value:        value,
+		Timestamp:    time.Now().UTC(),
+		OriginRegion: cfg.OriginRegion,
+		Labels:       current.Labels,
+	}
+	if err := insertLogEntry(ctx, tx, entry, &current.Version); err != nil {
+		return nil, err
+	}
+	if err := pruneVersions(ctx, tx, namespace, key); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		if isWriteConflict(err) {
+			return nil, errVersionConflict
+		}
+		return nil, err
+	}
+	return entry, nil
+}
+
+// mergePatch applies patch to target following RFC 7386: objects are merged
+// recursively, null removes a member, and anything else replaces the target.
+func mergePatch(target, patch any) any {
+	patchObject, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]any)
+	if !ok {
+		targetObject = map[string]any{}
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+		} else {
+			targetObject[name] = mergePatch(targetObject[name], value)
+		}
+	}
+	return targetObject
+}
+
+// decodeJSONValue parses a single JSON value, keeping numbers exact.
+func decodeJSONValue(raw []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("trailing data after JSON value")
+	}
+	return v, nil
+}
+
+// encodeJSONValue renders v compactly, without HTML escaping.
+func encodeJSONValue(v any) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
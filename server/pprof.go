@@ -0,0 +1,39 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// --- Profiling ---
+//
+// With ADMIN_ADDR set, a second listener serves the net/http/pprof handlers
+// and /debug/vars, for profiling the hot path under load (see make bench).
+// It is off by default. It has no authentication of its own, so bind it to
+// loopback or a private interface, never to the public one. The API port
+// never serves /debug/pprof: importing net/http/pprof registers it on
+// http.DefaultServeMux, which the API server therefore does not use.
+
+func newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// runAdminServer serves newAdminMux on addr. Only headers are time-limited,
+// since CPU profiles and traces take as long as the client asks for.
+func runAdminServer(addr string) {
+	server := &http.Server{Addr: addr, Handler: newAdminMux(), ReadHeaderTimeout: 10 * time.Second}
+	log.Printf("Serving pprof and /debug/vars on %s", addr)
+	if err := server.ListenAndServe(); err != nil {
+		log.Printf("ERROR: Admin listener on %s stopped: %v", addr, err)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// --- Two-Phase Writes ---
+//
+// Clients coordinating a write here with one in another system can split it
+// in two:
+//
+//   - POST /kv/{key}/_prepare?ttl=30s with {"value": ...} records the value as
+//     pending and answers 201 with a prepare_id. Reads do not see it.
+//   - POST /kv/{key}/_commit?prepare_id=N writes it to the key.
+//   - POST /kv/{key}/_abort?prepare_id=N discards it.
+//
+// A pending write is an entry in the internal preparedNamespace, which /kv/
+// cannot address, holding the value and the version the key had when it was
+// prepared, with the prepare's ttl in ttl_seconds, just like a lock's lease.
+// So no read path ever sees it, and a prepare that is neither committed nor
+// aborted within its ttl counts as aborted from then on; the expirer later
+// tombstones it. A key has at most one pending write, and its prepare_id is
+// the version of its entry, so a coordinator that lost track of a timed-out
+// prepare cannot commit a newer one.
+//
+// Prepares do not lock the key. A commit appends the value in the
+// transaction that tombstones the pending entry, conditioned on the key
+// still being at the version it was prepared against; a key written in
+// between fails the commit with 409 and the prepare stays pending until it is
+// aborted or times out.
+
+// preparedNamespace holds pending writes, keyed by preparedKey.
+const preparedNamespace = "_prepared"
+
+var (
+	errPrepareExists  = errors.New("key has a pending write")
+	errPrepareMissing = errors.New("no pending write with this prepare_id")
+	errPrepareStale   = errors.New("key was written since the prepare")
+)
+
+// preparedWrite is the value of a pending entry.
+type preparedWrite struct {
+	Value       string `json:"value"`
+	BaseVersion int64  `json:"base_version"`
+}
+
+// preparedKey names the pending entry of key. Namespace names never contain
+// '/', so the two parts cannot run into each other.
+func preparedKey(namespace, key string) string {
+	return namespace + "/" + key
+}
+
+// prepareID reads the prepare_id query parameter.
+func prepareID(r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("prepare_id"), 10, 64)
+	return id, err == nil && id > 0
+}
+
+// handlePrepare serves POST /kv/{key}/_prepare.
+func handlePrepare(w http.ResponseWriter, r *http.Request) {
+	if rejectIfReadOnly(w) {
+		return
+	}
+	namespace, key := requestKey(r)
+	ttl, ok := lockTTL(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "ttl must be a duration of at least 1s")
+		return
+	}
+	var payload struct {
+		Value *string `json:"value"`
+	}
+	body, ok := readBody(w, r)
+	if !ok || !decodeJSONBody(w, bytes.NewReader(body), &payload) {
+		return
+	}
+	if payload.Value == nil {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "Bad request: value is required")
+		return
+	}
+	if rejectIfEmptyValue(w, *payload.Value) {
+		return
+	}
+	if err := validateValue(namespace, key, *payload.Value); err != nil {
+		var schemaErr *schemaValidationError
+		if errors.As(err, &schemaErr) {
+			writeSchemaValidationError(w, schemaErr)
+			return
+		}
+		log.Printf("ERROR: Failed to validate value of key '%s': %v", key, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	entry, err := writePrepared(r.Context(), namespace, key, func(tx *sql.Tx, now time.Time, pending *LogEntry) (*LogEntry, error) {
+		if pending != nil {
+			return nil, errPrepareExists
+		}
+		current, err := lockLatestEntry(r.Context(), tx, namespace, key)
+		if err != nil && !errors.Is(err, errKeyNotFound) {
+			return nil, err
+		}
+		value, _ := json.Marshal(preparedWrite{Value: *payload.Value, BaseVersion: current.Version})
+		return &LogEntry{Value: string(value), TTLSeconds: ttl}, nil
+	})
+	if !prepareWriteOK(w, key, err) {
+		return
+	}
+	log.Printf("PREPARE successful for key: %s (prepare_id %d, ttl %ds)", key, entry.Version, ttl)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"key":        key,
+		"prepare_id": entry.Version,
+		"expires_at": entry.Timestamp.Add(time.Duration(entry.TTLSeconds) * time.Second),
+	})
+}
+
+// handleCommit serves POST /kv/{key}/_commit.
+func handleCommit(w http.ResponseWriter, r *http.Request) {
+	if rejectIfReadOnly(w) {
+		return
+	}
+	namespace, key := requestKey(r)
+	id, ok := prepareID(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "A prepare_id is required")
+		return
+	}
+	var committed *LogEntry
+	_, err := writePrepared(r.Context(), namespace, key, func(tx *sql.Tx, now time.Time, pending *LogEntry) (*LogEntry, error) {
+		if pending == nil || pending.Version != id {
+			return nil, errPrepareMissing
+		}
+		var prepared preparedWrite
+		if err := json.Unmarshal([]byte(pending.Value), &prepared); err != nil {
+			return nil, fmt.Errorf("decoding pending write: %w", err)
+		}
+		current, err := lockLatestEntry(r.Context(), tx, namespace, key)
+		if err != nil && !errors.Is(err, errKeyNotFound) {
+			return nil, err
+		}
+		if current.Version != prepared.BaseVersion {
+			return nil, errPrepareStale
+		}
+		committed = &LogEntry{
+			Namespace:    namespace,
+			Key:          key,
+			Value:        prepared.Value,
+			Timestamp:    now.UTC(),
+			OriginRegion: cfg.OriginRegion,
+		}
+		if err := insertLogEntry(r.Context(), tx, committed, &current.Version); err != nil {
+			return nil, err
+		}
+		return nil, pruneVersions(r.Context(), tx, namespace, key)
+	})
+	if !prepareWriteOK(w, key, err) {
+		return
+	}
+	applyWriteToCache(*committed)
+	log.Printf("COMMIT successful for key: %s (prepare_id %d, version %d)", key, id, committed.Version)
+	json.NewEncoder(w).Encode(committed)
+}
+
+// handleAbort serves POST /kv/{key}/_abort.
+func handleAbort(w http.ResponseWriter, r *http.Request) {
+	if rejectIfReadOnly(w) {
+		return
+	}
+	namespace, key := requestKey(r)
+	id, ok := prepareID(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "A prepare_id is required")
+		return
+	}
+	_, err := writePrepared(r.Context(), namespace, key, func(tx *sql.Tx, now time.Time, pending *LogEntry) (*LogEntry, error) {
+		if pending == nil || pending.Version != id {
+			return nil, errPrepareMissing
+		}
+		return nil, nil
+	})
+	if !prepareWriteOK(w, key, err) {
+		return
+	}
+	log.Printf("ABORT successful for key: %s (prepare_id %d)", key, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// prepareWriteOK maps the error of a two-phase write to a response,
+// reporting whether the write succeeded.
+func prepareWriteOK(w http.ResponseWriter, key string, err error) bool {
+	var quotaErr *errQuotaExceeded
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errPrepareExists):
+		writeError(w, http.StatusConflict, codeConflict, "Conflict: key already has a pending write")
+	case errors.Is(err, errPrepareMissing):
+		writeError(w, http.StatusConflict, codeConflict, "Conflict: no pending write with this prepare_id (committed, aborted or timed out)")
+	case errors.Is(err, errPrepareStale):
+		writeError(w, http.StatusConflict, codeConflict, "Conflict: key was written since the prepare")
+	case errors.Is(err, errVersionConflict):
+		writeError(w, http.StatusConflict, codeWriteConflict, "Conflict: key kept changing, retry")
+	case errors.As(err, &quotaErr):
+		writeQuotaExceeded(w, quotaErr)
+	default:
+		log.Printf("ERROR: Failed two-phase write of key '%s' in CockroachDB: %v", key, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+	}
+	return false
+}
+
+// writePrepared runs decide on key's pending write, nil when there is none or
+// it timed out, and appends its result to the pending entry: the returned
+// entry as the new pending write, or a tombstone when it returns nil. decide
+// runs in the same transaction and may write the key itself. Conflicts with
+// concurrent writers are retried.
+func writePrepared(ctx context.Context, namespace, key string, decide func(tx *sql.Tx, now time.Time, pending *LogEntry) (*LogEntry, error)) (*LogEntry, error) {
+	var err error
+	for attempt := 0; attempt < 5; attempt++ {
+		var entry *LogEntry
+		entry, err = tryWritePrepared(ctx, namespace, key, decide)
+		if !errors.Is(err, errVersionConflict) {
+			return entry, err
+		}
+	}
+	return nil, err
+}
+
+func tryWritePrepared(ctx context.Context, namespace, key string, decide func(tx *sql.Tx, now time.Time, pending *LogEntry) (*LogEntry, error)) (*LogEntry, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// As for leases, the transaction's own timestamp judges the timeout.
+	var now time.Time
+	if err := tx.QueryRowContext(ctx, `SELECT now()`).Scan(&now); err != nil {
+		return nil, err
+	}
+	name := preparedKey(namespace, key)
+	latest, err := lockLatestEntry(ctx, tx, preparedNamespace, name)
+	if err != nil && !errors.Is(err, errKeyNotFound) {
+		return nil, err
+	}
+	var pending *LogEntry
+	if err == nil && now.Before(latest.Timestamp.Add(time.Duration(latest.TTLSeconds)*time.Second)) {
+		pending = &latest
+	}
+	next, err := decide(tx, now, pending)
+	if err != nil {
+		return nil, err
+	}
+	entry := &LogEntry{
+		Namespace:    preparedNamespace,
+		Key:          name,
+		Timestamp:    now.UTC(),
+		OriginRegion: cfg.OriginRegion,
+	}
+	if next == nil {
+		entry.Deleted = true
+	} else {
+		entry.Value, entry.TTLSeconds = next.Value, next.TTLSeconds
+	}
+	if err := insertLogEntry(ctx, tx, entry, &latest.Version); err != nil {
+		return nil, err
+	}
+	if err := pruneVersions(ctx, tx, preparedNamespace, name); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		if isWriteConflict(err) {
+			return nil, errVersionConflict
+		}
+		return nil, err
+	}
+	applyWriteToCache(*entry)
+	return entry, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// --- Returning the Previous Value ---
+//
+// PUT /kv/{key}?return=prev answers with the value the write replaced as well
+// as the new entry, so change-tracking clients need no GET before the PUT.
+// The latest entry is read and locked in the transaction that appends the new
+// one, and the append is conditioned on the version read, so prev is exactly
+// the version the write superseded even with concurrent writers. Plain PUTs
+// skip the read and stay a single INSERT.
+
+// previousValue is the live value a PUT replaced.
+type previousValue struct {
+	Value     string            `json:"value"`
+	Version   int64             `json:"version"`
+	Timestamp time.Time         `json:"timestamp"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// putWithPrevResponse is the new entry plus prev, which is null when the key
+// was missing, deleted or expired.
+type putWithPrevResponse struct {
+	LogEntry
+	Prev *previousValue `json:"prev"`
+}
+
+// handlePutReturningPrev appends entry and answers with the value it
+// replaced. expectedVersion is the optional If-Match version.
+func handlePutReturningPrev(w http.ResponseWriter, r *http.Request, entry LogEntry, expectedVersion *int64) {
+	prev, err := putReturningPrev(r.Context(), &entry, expectedVersion)
+	if errors.Is(err, errVersionConflict) {
+		if expectedVersion != nil {
+			writeError(w, http.StatusConflict, codeVersionConflict, fmt.Sprintf("Version conflict: key is no longer at version %d", *expectedVersion))
+		} else {
+			writeError(w, http.StatusConflict, codeWriteConflict, "Conflict: key kept changing, retry the write")
+		}
+		return
+	}
+	var quotaErr *errQuotaExceeded
+	if errors.As(err, &quotaErr) {
+		writeQuotaExceeded(w, quotaErr)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: Failed to write to CockroachDB for key '%s': %v", entry.Key, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	applyWriteToCache(entry)
+	log.Printf("PUT successful for key: %s (version %d, returning previous value)", entry.Key, entry.Version)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(putWithPrevResponse{LogEntry: entry, Prev: prev})
+}
+
+// putReturningPrev appends entry and returns the live value it replaced, or
+// nil. Without expectedVersion, a concurrent write between the read and the
+// append is retried; with it, the conflict is returned as errVersionConflict.
+func putReturningPrev(ctx context.Context, entry *LogEntry, expectedVersion *int64) (*previousValue, error) {
+	var err error
+	for attempt := 0; attempt < 5; attempt++ {
+		var prev *previousValue
+		prev, err = tryPutReturningPrev(ctx, entry, expectedVersion)
+		if !errors.Is(err, errVersionConflict) || expectedVersion != nil {
+			return prev, err
+		}
+	}
+	return nil, err
+}
+
+func tryPutReturningPrev(ctx context.Context, entry *LogEntry, expectedVersion *int64) (*previousValue, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	current, err := lockLatestEntry(ctx, tx, entry.Namespace, entry.Key)
+	if err != nil && !errors.Is(err, errKeyNotFound) {
+		return nil, err
+	}
+	var prev *previousValue
+	if err == nil && !current.Expired {
+		prev = &previousValue{Value: current.Value, Version: current.Version, Timestamp: current.Timestamp, Labels: current.Labels}
+	}
+	if expectedVersion != nil && current.Version != *expectedVersion {
+		return nil, errVersionConflict
+	}
+	if err := insertLogEntry(ctx, tx, entry, &current.Version); err != nil {
+		return nil, err
+	}
+	if err := pruneVersions(ctx, tx, entry.Namespace, entry.Key); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		if isWriteConflict(err) {
+			return nil, errVersionConflict
+		}
+		return nil, err
+	}
+	return prev, nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// --- Query Layer ---
+//
+// Every read of kv_log goes through these helpers so that result sets are
+// always bounded and the SQL stays friendly to idx_namespace_key_hlc.
+
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+)
+
+// clampLimit bounds a caller-supplied page size to [1, maxQueryLimit],
+// substituting defaultQueryLimit when none was given.
+func clampLimit(limit int) int {
+	if limit <= 0 {
+		return defaultQueryLimit
+	}
+	return min(limit, maxQueryLimit)
+}
+
+// clampLimitTo is clampLimit for an endpoint with its own, possibly lower,
+// cap.
+func clampLimitTo(limit, maxLimit int) int {
+	return min(clampLimit(limit), maxLimit)
+}
+
+// entryColumns is the column list scanEntry expects, in order.
+const entryColumns = "value, timestamp, deleted, origin_region, version, ttl_seconds, labels, hlc, home_region, value_type, target_key, " + expiredColumn
+
+// expiredColumn computes whether an entry is past its ttl_seconds. It is
+// judged by CockroachDB's clock, the same one the expirer uses, so a read
+// never disagrees with it about whether a key has expired.
+const expiredColumn = "(ttl_seconds IS NOT NULL AND timestamp + ttl_seconds * INTERVAL '1 second' < now()) AS expired"
+
+// scanEntry reads a row selected with entryColumns into entry. NULLs in
+// nullable columns are read as zero values.
+func scanEntry(row interface{ Scan(...any) error }, entry *LogEntry) error {
+	var value, origin, hlc, home, valueType, targetKey sql.NullString
+	var version, ttl sql.NullInt64
+	var labels []byte
+	if err := row.Scan(&value, &entry.Timestamp, &entry.Deleted, &origin, &version, &ttl, &labels, &hlc, &home, &valueType, &targetKey, &entry.Expired); err != nil {
+		return err
+	}
+	entry.Value = value.String
+	entry.OriginRegion = origin.String
+	entry.HLC = hlc.String
+	entry.HomeRegion = home.String
+	entry.ValueType = valueType.String
+	entry.TargetKey = targetKey.String
+	entry.Version = version.Int64
+	entry.TTLSeconds = ttl.Int64
+	var err error
+	entry.Labels, err = decodeLabels(labels)
+	return err
+}
+
+// latestForKey returns the newest log entry for key in namespace, tombstones
+// included, or nil if the key has never been written. The query is cancelled
+// with ctx, usually the request's. With followerRead set the query runs AS OF
+// SYSTEM TIME follower_read_timestamp() so the nearest replica can serve it,
+// at the cost of bounded staleness. The read is bounded
+// by DB_READ_TIMEOUT and gated by the circuit breaker, returning
+// errDBUnavailable while it is open, and by DB_READ_CONCURRENCY, returning
+// errDBReadsSaturated when no slot frees up in time. The limiter comes first
+// so that a rejected read never leaves the breaker's half-open probe pending.
+func latestForKey(ctx context.Context, namespace, key string, followerRead bool) (*LogEntry, error) {
+	if dbReadLimiter != nil {
+		if !dbReadLimiter.acquire() {
+			return nil, errDBReadsSaturated
+		}
+		defer dbReadLimiter.release()
+	}
+	dbReadsInFlight.Add(1)
+	defer dbReadsInFlight.Add(-1)
+	if dbReadBreaker == nil {
+		return queryLatestForKey(ctx, namespace, key, followerRead)
+	}
+	if !dbReadBreaker.allow() {
+		return nil, errDBUnavailable
+	}
+	entry, err := queryLatestForKey(ctx, namespace, key, followerRead)
+	if err != nil && ctx.Err() != nil {
+		// A cancelled request says nothing about CockroachDB's health.
+		dbReadBreaker.abandon()
+		return nil, err
+	}
+	dbReadBreaker.record(err)
+	return entry, err
+}
+
+func queryLatestForKey(ctx context.Context, namespace, key string, followerRead bool) (*LogEntry, error) {
+	queryCtx := ctx
+	if timeout := time.Duration(cfg.DBReadTimeout); timeout > 0 {
+		var cancel context.CancelFunc
+		queryCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	asOf := ""
+	if followerRead {
+		asOf = "AS OF SYSTEM TIME follower_read_timestamp()"
+	}
+	sqlStatement := `
+    SELECT ` + entryColumns + ` FROM ` + logTable() + ` ` + asOf + `
+    WHERE namespace = $1 AND key = $2
+    ORDER BY ` + newestFirst + `
+    LIMIT 1;
+    `
+	entry := LogEntry{Namespace: namespace, Key: key}
+	err := scanEntry(db.QueryRowContext(queryCtx, sqlStatement, namespace, key), &entry)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// historyForKey returns up to limit entries for key in namespace, newest
+// first, starting after the entry that before names; see historyCursor.
+func historyForKey(ctx context.Context, namespace, key string, limit int, before string) ([]LogEntry, error) {
+	args := []any{key, clampLimit(limit), namespace}
+	where := "namespace = $3 AND key = $1"
+	if hlcPattern.MatchString(before) {
+		args = append(args, before)
+		where += " AND (hlc < $4::DECIMAL OR hlc IS NULL)"
+	} else if before != "" {
+		// Only entries without an hlc are paged by timestamp; see hlc.go.
+		args = append(args, before)
+		where += " AND hlc IS NULL AND timestamp < $4::TIMESTAMPTZ"
+	}
+	rows, err := db.QueryContext(ctx, `
+    SELECT `+entryColumns+` FROM `+logTable()+`
+    WHERE `+where+`
+    ORDER BY `+newestFirst+`
+    LIMIT $2;
+    `, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []LogEntry
+	for rows.Next() {
+		entry := LogEntry{Namespace: namespace, Key: key}
+		if err := scanEntry(rows, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// liveKeysByPrefix returns up to limit live keys of namespace starting with
+// prefix, in key order, together with their latest value and labels. Only
+// keys strictly after cursor are returned, so the last key of a page is the
+// cursor for the next one. The prefix is matched as a key range rather than
+// with LIKE so the scan can use idx_namespace_key_hlc. With selector
+// set, only keys whose latest entry has all of its labels are returned; the
+// candidates are first narrowed through idx_labels.
+//
+// Keys are read in batches of limit, each the next keys after the previous
+// batch with only their latest entry, so a run of tombstoned keys costs a few
+// more batches instead of a scan of everything under the prefix.
+func liveKeysByPrefix(ctx context.Context, namespace, prefix, cursor string, selector map[string]string, limit int) ([]LogEntry, error) {
+	limit = clampLimit(limit)
+	var entries []LogEntry
+	for len(entries) < limit {
+		batch, last, scanned, err := liveKeysBatch(ctx, namespace, prefix, cursor, selector, limit)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, batch[:min(len(batch), limit-len(entries))]...)
+		if scanned < limit {
+			break
+		}
+		cursor = last
+	}
+	return entries, nil
+}
+
+// liveKeysBatch reads the latest entry of the next limit keys after cursor
+// and returns the live ones matching selector, along with the last key read
+// and how many were read.
+func liveKeysBatch(ctx context.Context, namespace, prefix, cursor string, selector map[string]string, limit int) ([]LogEntry, string, int, error) {
+	where, args := keyRangeWhere(namespace, prefix, cursor, []any{limit})
+	matches := "TRUE"
+	if len(selector) > 0 {
+		args = append(args, labelsParam(selector))
+		matches = "latest.labels @> $" + strconv.Itoa(len(args)) + "::JSONB"
+		where += " AND labels @> $" + strconv.Itoa(len(args)) + "::JSONB"
+	}
+	// keyRangeWhere put namespace in $2, right after the limit.
+	rows, err := db.QueryContext(ctx, `
+    SELECT k.key, latest.value, latest.timestamp, latest.deleted, latest.labels, latest.hlc, `+matches+` FROM (
+        SELECT DISTINCT key FROM `+logTable()+`
+        `+where+`
+        ORDER BY key
+        LIMIT $1
+    ) AS k, LATERAL (
+        SELECT value, timestamp, deleted, labels, hlc FROM `+logTable()+`
+        WHERE namespace = $2 AND key = k.key
+        ORDER BY `+newestFirst+`
+        LIMIT 1
+    ) AS latest
+    ORDER BY k.key;
+    `, args...)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	defer rows.Close()
+	var entries []LogEntry
+	var last string
+	scanned := 0
+	for rows.Next() {
+		entry := LogEntry{Namespace: namespace}
+		var value, hlc sql.NullString
+		var labels []byte
+		var matched bool
+		if err := rows.Scan(&entry.Key, &value, &entry.Timestamp, &entry.Deleted, &labels, &hlc, &matched); err != nil {
+			return nil, "", 0, err
+		}
+		last = entry.Key
+		scanned++
+		if entry.Deleted || !matched {
+			continue
+		}
+		entry.Value = value.String
+		entry.HLC = hlc.String
+		if entry.Labels, err = decodeLabels(labels); err != nil {
+			return nil, "", 0, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, last, scanned, rows.Err()
+}
+
+// latestByPrefix is liveKeysByPrefix including tombstoned keys, returning the
+// full latest entry of each key.
+func latestByPrefix(ctx context.Context, namespace, prefix, cursor string, limit int) ([]LogEntry, error) {
+	where, args := keyRangeWhere(namespace, prefix, cursor, []any{clampLimit(limit)})
+	rows, err := db.QueryContext(ctx, `
+    SELECT DISTINCT ON (key) key, `+entryColumns+` FROM `+logTable()+`
+    `+where+`
+    ORDER BY key, `+newestFirst+`
+    LIMIT $1;
+    `, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []LogEntry
+	for rows.Next() {
+		entry := LogEntry{Namespace: namespace}
+		var key string
+		if err := scanEntry(keyedRow{rows, &key}, &entry); err != nil {
+			return nil, err
+		}
+		entry.Key = key
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// keyedRow scans a leading key column before the entryColumns scanEntry
+// expects.
+type keyedRow struct {
+	row interface{ Scan(...any) error }
+	key *string
+}
+
+func (k keyedRow) Scan(dest ...any) error {
+	return k.row.Scan(append([]any{k.key}, dest...)...)
+}
+
+// countLiveKeys returns the number of live keys of namespace starting with
+// prefix. It scans every matching key, so callers should cache the result.
+func countLiveKeys(ctx context.Context, namespace, prefix string) (int64, error) {
+	where, args := keyRangeWhere(namespace, prefix, "", nil)
+	var count int64
+	err := db.QueryRowContext(ctx, `
+    SELECT count(*) FROM (
+        SELECT DISTINCT ON (key) deleted FROM `+logTable()+`
+        `+where+`
+        ORDER BY key, `+newestFirst+`
+    ) AS latest
+    WHERE NOT deleted;
+    `, args...).Scan(&count)
+	return count, err
+}
+
+// keyRangeWhere builds a WHERE clause selecting namespace's keys that start
+// with prefix and sort after cursor (either may be empty), appending its
+// placeholders' values to args.
+func keyRangeWhere(namespace, prefix, cursor string, args []any) (string, []any) {
+	var conds []string
+	addCond := func(column, op string, arg string) {
+		args = append(args, arg)
+		conds = append(conds, column+" "+op+" $"+strconv.Itoa(len(args)))
+	}
+	addCond("namespace", "=", namespace)
+	if prefix != "" {
+		addCond("key", ">=", prefix)
+		if end, ok := prefixEnd(prefix); ok {
+			addCond("key", "<", end)
+		}
+	}
+	if cursor != "" {
+		addCond("key", ">", cursor)
+	}
+	return "WHERE " + strings.Join(conds, " AND "), args
+}
+
+// prefixEnd returns the smallest string greater than every string with the
+// given prefix. It works on runes so the bound stays valid UTF-8; UTF-8 byte
+// order matches code point order. It reports false when no bound exists.
+func prefixEnd(prefix string) (string, bool) {
+	runes := []rune(prefix)
+	for i := len(runes) - 1; i >= 0; i-- {
+		if runes[i] < unicode.MaxRune {
+			runes[i]++
+			if runes[i] >= 0xD800 && runes[i] <= 0xDFFF {
+				runes[i] = 0xE000 // Surrogates cannot be encoded in UTF-8.
+			}
+			return string(runes[:i+1]), true
+		}
+	}
+	return "", false
+}
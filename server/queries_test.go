@@ -0,0 +1,210 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"kvstore-cdc/migrations"
+)
+
+// --- Query Layer Tests ---
+//
+// These run against the CockroachDB named by TEST_DATABASE_URL, such as
+// postgresql://root@localhost:26257/defaultdb?sslmode=disable, and are
+// skipped without one. Each test migrates a database of its own, dropped when
+// it ends.
+
+// openTestDB points db at a fresh, migrated database.
+func openTestDB(t *testing.T) {
+	t.Helper()
+	raw := os.Getenv("TEST_DATABASE_URL")
+	if raw == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	admin, err := sql.Open("postgres", raw)
+	if err != nil {
+		t.Fatalf("open %s: %v", raw, err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	name := fmt.Sprintf("kv_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE DATABASE " + name); err != nil {
+		t.Fatalf("create database: %v", err)
+	}
+	t.Cleanup(func() { admin.Exec("DROP DATABASE " + name + " CASCADE") })
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatalf("parse TEST_DATABASE_URL: %v", err)
+	}
+	u.Path = "/" + name
+	conn, err := sql.Open("postgres", u.String())
+	if err != nil {
+		t.Fatalf("open %s: %v", name, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := migrations.Run(ctx, conn); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	previousDB, previousCfg := db, cfg
+	db, cfg = conn, defaultConfig()
+	t.Cleanup(func() { db, cfg = previousDB, previousCfg })
+}
+
+// testSeed writes log entries with increasing hlcs, so each is newer than
+// the ones written before it.
+type testSeed struct {
+	t   *testing.T
+	hlc int
+}
+
+func (s *testSeed) put(key, value string, labels map[string]string) {
+	s.write(key, value, false, labels)
+}
+
+func (s *testSeed) delete(key string) {
+	s.write(key, "", true, nil)
+}
+
+func (s *testSeed) write(key, value string, deleted bool, labels map[string]string) {
+	s.t.Helper()
+	s.hlc++
+	_, err := db.Exec(`
+    INSERT INTO `+logTable()+` (namespace, key, value, timestamp, deleted, labels, hlc, version)
+    VALUES ('default', $1, NULLIF($2, ''), now(), $3, $4, $5::DECIMAL, $6);
+    `, key, value, deleted, labelsParam(labels), strconv.Itoa(s.hlc)+".0000000000", s.hlc)
+	if err != nil {
+		s.t.Fatalf("seed %s: %v", key, err)
+	}
+}
+
+func keysOf(entries []LogEntry) []string {
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.Key
+	}
+	return keys
+}
+
+func TestLatestForKey(t *testing.T) {
+	openTestDB(t)
+	seed := &testSeed{t: t}
+	seed.put("a", "1", nil)
+	seed.put("a", "2", nil)
+	seed.put("b", "1", nil)
+	seed.delete("b")
+
+	entry, err := latestForKey(ctx, "default", "a", false)
+	if err != nil || entry == nil || entry.Value != "2" || entry.Deleted {
+		t.Errorf("latestForKey(a) = %+v, %v; want value 2", entry, err)
+	}
+	entry, err = latestForKey(ctx, "default", "b", false)
+	if err != nil || entry == nil || !entry.Deleted {
+		t.Errorf("latestForKey(b) = %+v, %v; want its tombstone", entry, err)
+	}
+	entry, err = latestForKey(ctx, "default", "missing", false)
+	if err != nil || entry != nil {
+		t.Errorf("latestForKey(missing) = %+v, %v; want nil", entry, err)
+	}
+	entry, err = latestForKey(ctx, "other", "a", false)
+	if err != nil || entry != nil {
+		t.Errorf("latestForKey in another namespace = %+v, %v; want nil", entry, err)
+	}
+}
+
+func TestHistoryForKey(t *testing.T) {
+	openTestDB(t)
+	seed := &testSeed{t: t}
+	for i := 1; i <= 5; i++ {
+		seed.put("a", strconv.Itoa(i), nil)
+	}
+	seed.put("b", "other", nil)
+
+	var values []string
+	before := ""
+	for {
+		page, err := historyForKey(ctx, "default", "a", 2, before)
+		if err != nil {
+			t.Fatalf("historyForKey(a, %q): %v", before, err)
+		}
+		for _, entry := range page {
+			values = append(values, entry.Value)
+		}
+		if len(page) < 2 {
+			break
+		}
+		before = historyCursor(page[len(page)-1])
+	}
+	if fmt.Sprint(values) != "[5 4 3 2 1]" {
+		t.Errorf("history of a = %v; want [5 4 3 2 1]", values)
+	}
+}
+
+func TestLiveKeysByPrefix(t *testing.T) {
+	openTestDB(t)
+	seed := &testSeed{t: t}
+	// More tombstoned keys than a page, ahead of the live ones.
+	for i := 0; i < 7; i++ {
+		key := fmt.Sprintf("p/%02d", i)
+		seed.put(key, "gone", nil)
+		seed.delete(key)
+	}
+	for i := 7; i < 12; i++ {
+		seed.put(fmt.Sprintf("p/%02d", i), strconv.Itoa(i), nil)
+	}
+	seed.put("p/09", "nine", nil)
+	seed.delete("p/10")
+	seed.put("q/00", "outside", nil)
+
+	var pages [][]string
+	cursor := ""
+	for {
+		page, err := liveKeysByPrefix(ctx, "default", "p/", cursor, nil, 3)
+		if err != nil {
+			t.Fatalf("liveKeysByPrefix(p/, %q): %v", cursor, err)
+		}
+		pages = append(pages, keysOf(page))
+		if len(page) < 3 {
+			break
+		}
+		cursor = page[len(page)-1].Key
+	}
+	if fmt.Sprint(pages) != "[[p/07 p/08 p/09] [p/11]]" {
+		t.Errorf("pages = %v; want [[p/07 p/08 p/09] [p/11]]", pages)
+	}
+
+	entries, err := liveKeysByPrefix(ctx, "default", "p/09", "", nil, 0)
+	if err != nil || len(entries) != 1 || entries[0].Value != "nine" {
+		t.Errorf("liveKeysByPrefix(p/09) = %+v, %v; want its latest value", entries, err)
+	}
+}
+
+func TestLiveKeysByPrefixSelector(t *testing.T) {
+	openTestDB(t)
+	seed := &testSeed{t: t}
+	blue := map[string]string{"color": "blue"}
+	seed.put("a", "1", blue)
+	seed.put("b", "1", blue)
+	seed.put("b", "2", map[string]string{"color": "red"}) // No longer blue.
+	seed.put("c", "1", map[string]string{"color": "blue", "size": "l"})
+	seed.put("d", "1", blue)
+	seed.delete("d")
+	seed.put("e", "1", nil)
+
+	entries, err := liveKeysByPrefix(ctx, "default", "", "", blue, 1)
+	if err != nil || fmt.Sprint(keysOf(entries)) != "[a]" {
+		t.Fatalf("first page = %v, %v; want [a]", keysOf(entries), err)
+	}
+	entries, err = liveKeysByPrefix(ctx, "default", "", "a", blue, 10)
+	if err != nil || fmt.Sprint(keysOf(entries)) != "[c]" {
+		t.Errorf("second page = %v, %v; want [c]", keysOf(entries), err)
+	}
+	if len(entries) == 1 && entries[0].Labels["size"] != "l" {
+		t.Errorf("labels of c = %v; want its latest labels", entries[0].Labels)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// --- Namespace Quotas ---
+//
+// NAMESPACE_QUOTAS caps what a namespace may hold, as comma-separated
+// namespace=max_keys:max_bytes pairs, where 0 or an empty limit means
+// unlimited: "orders=10000:104857600,default=:1073741824". A namespace's
+// usage is its live keys and the bytes of their keys and values, and every
+// write that would raise a limited figure past its limit gets 507. Writes that
+// leave usage as it is or lower it, deletes among them, are always accepted,
+// so a namespace over its quota, after the quota was lowered, can shrink.
+//
+// Counting a namespace per write would scan it, so usage is kept in
+// namespace_usage instead: every statement that writes entries also adds the
+// change it makes to its namespace's row, in the same statement. Each
+// namespace has usageShards rows, picked by a hash of the key, so writes to
+// different keys rarely contend on one. The check reads them just before the
+// write without locking them, so concurrent writes to a namespace near its
+// limit may overshoot it by the writes in flight. Usage is kept for every
+// namespace, limited or not, and shown by GET /kv/_namespaces/{name}.
+
+// usageShards is the number of namespace_usage rows of each namespace.
+const usageShards = 16
+
+// namespaceQuota holds a namespace's limits; 0 means unlimited.
+type namespaceQuota struct {
+	MaxKeys  int64 `json:"max_keys,omitempty"`
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+}
+
+// namespaceQuotas is the parsed NAMESPACE_QUOTAS.
+var namespaceQuotas map[string]namespaceQuota
+
+// parseNamespaceQuotas parses NAMESPACE_QUOTAS.
+func parseNamespaceQuotas(raw string) (map[string]namespaceQuota, error) {
+	quotas := map[string]namespaceQuota{}
+	for _, pair := range strings.Split(raw, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		namespace, limits, ok := strings.Cut(pair, "=")
+		namespace = strings.TrimSpace(namespace)
+		maxKeys, maxBytes, hasBytes := strings.Cut(limits, ":")
+		if !ok || !hasBytes || namespace == "" {
+			return nil, fmt.Errorf("%q is not namespace=max_keys:max_bytes", pair)
+		}
+		if _, dup := quotas[namespace]; dup {
+			return nil, fmt.Errorf("namespace %s is listed twice", namespace)
+		}
+		var quota namespaceQuota
+		for _, limit := range []struct {
+			raw string
+			dst *int64
+		}{{maxKeys, &quota.MaxKeys}, {maxBytes, &quota.MaxBytes}} {
+			if limit.raw = strings.TrimSpace(limit.raw); limit.raw == "" {
+				continue
+			}
+			n, err := strconv.ParseInt(limit.raw, 10, 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("limit %q of namespace %s must be a non-negative integer", limit.raw, namespace)
+			}
+			*limit.dst = n
+		}
+		quotas[namespace] = quota
+	}
+	return quotas, nil
+}
+
+// quotaFor returns namespace's quota, or nil when it is unlimited.
+func quotaFor(namespace string) *namespaceQuota {
+	quota, ok := namespaceQuotas[namespace]
+	if !ok || (quota.MaxKeys == 0 && quota.MaxBytes == 0) {
+		return nil
+	}
+	return &quota
+}
+
+// errQuotaExceeded is returned for a write that would take a namespace past
+// one of its limits.
+type errQuotaExceeded struct {
+	namespace string
+	limit     string // "max_keys" or "max_bytes"
+	max       int64
+	usage     int64
+}
+
+func (e *errQuotaExceeded) Error() string {
+	return fmt.Sprintf("namespace %s would exceed its %s quota of %d (usage %d)", e.namespace, e.limit, e.max, e.usage)
+}
+
+// namespaceUsage is what a namespace holds, as kept in namespace_usage.
+type namespaceUsage struct {
+	LiveKeys  int64 `json:"live_keys"`
+	LiveBytes int64 `json:"live_bytes"`
+}
+
+// liveKeySQL and liveBytesSQL are what the entry aliased as e, a key's latest,
+// adds to its namespace's usage: nothing when it is a tombstone or missing.
+func liveKeySQL(e string) string {
+	return `(CASE WHEN NOT ` + e + `.deleted THEN 1 ELSE 0 END)`
+}
+
+func liveBytesSQL(e string) string {
+	return `(CASE WHEN NOT ` + e + `.deleted THEN octet_length(` + e + `.key) + coalesce(octet_length(` + e + `.value), 0) ELSE 0 END)`
+}
+
+// usageUpdateSQL is the common table expression "usage", which adds to
+// namespace_usage the change the entries of the CTE "written" make over the
+// entries of "previous", the latest of their keys before the write. Both have
+// namespace, key, deleted and value columns. Statements including it also
+// select from it, so it is never left out of the plan.
+func usageUpdateSQL() string {
+	return `usage AS (
+        INSERT INTO namespace_usage (namespace, shard, live_keys, live_bytes)
+        SELECT w.namespace, mod(fnv32(w.key), ` + strconv.Itoa(usageShards) + `),
+            sum(` + liveKeySQL("w") + ` - ` + liveKeySQL("p") + `),
+            sum(` + liveBytesSQL("w") + ` - ` + liveBytesSQL("p") + `)
+        FROM written AS w LEFT JOIN previous AS p ON p.namespace = w.namespace AND p.key = w.key
+        GROUP BY 1, 2
+        ON CONFLICT (namespace, shard) DO UPDATE SET
+            live_keys = namespace_usage.live_keys + excluded.live_keys,
+            live_bytes = namespace_usage.live_bytes + excluded.live_bytes
+        RETURNING 1
+    )`
+}
+
+// checkQuota returns an *errQuotaExceeded when writing entry would take its
+// namespace past a limit. It reads through q, the pool or the write's
+// transaction.
+func checkQuota(ctx context.Context, q sqlQuerier, entry *LogEntry) error {
+	quota := quotaFor(entry.Namespace)
+	if quota == nil || entry.Deleted {
+		return nil
+	}
+	var usage namespaceUsage
+	var previousBytes int64
+	err := q.QueryRowContext(ctx, `
+    SELECT coalesce(sum(live_keys), 0), coalesce(sum(live_bytes), 0), coalesce((
+        SELECT CASE WHEN NOT deleted THEN octet_length(key) + coalesce(octet_length(value), 0) END
+        FROM `+logTable()+`
+        WHERE namespace = $1 AND key = $2
+        ORDER BY `+newestFirst+`
+        LIMIT 1
+    ), -1)
+    FROM namespace_usage WHERE namespace = $1;
+    `, entry.Namespace, entry.Key).Scan(&usage.LiveKeys, &usage.LiveBytes, &previousBytes)
+	if err != nil {
+		return err
+	}
+	// previousBytes is -1 unless the key is live, which counts its bytes.
+	var addedKeys int64
+	if previousBytes < 0 {
+		addedKeys, previousBytes = 1, 0
+	}
+	addedBytes := int64(len(entry.Key)+len(entry.Value)) - previousBytes
+	switch {
+	case quota.MaxKeys > 0 && addedKeys > 0 && usage.LiveKeys+addedKeys > quota.MaxKeys:
+		return &errQuotaExceeded{entry.Namespace, "max_keys", quota.MaxKeys, usage.LiveKeys}
+	case quota.MaxBytes > 0 && addedBytes > 0 && usage.LiveBytes+addedBytes > quota.MaxBytes:
+		return &errQuotaExceeded{entry.Namespace, "max_bytes", quota.MaxBytes, usage.LiveBytes}
+	}
+	return nil
+}
+
+// usageOf returns namespace's usage.
+func usageOf(ctx context.Context, namespace string) (namespaceUsage, error) {
+	var usage namespaceUsage
+	err := db.QueryRowContext(ctx, `
+    SELECT coalesce(sum(live_keys), 0), coalesce(sum(live_bytes), 0)
+    FROM namespace_usage WHERE namespace = $1;
+    `, namespace).Scan(&usage.LiveKeys, &usage.LiveBytes)
+	return usage, err
+}
+
+// writeQuotaExceeded answers 507 for a write refused by err, with the limit
+// it would have exceeded.
+func writeQuotaExceeded(w http.ResponseWriter, err *errQuotaExceeded) {
+	writeErrorDetails(w, http.StatusInsufficientStorage, codeQuotaExceeded, "Insufficient storage: namespace quota exceeded", map[string]any{
+		"namespace": err.namespace,
+		"quota":     err.limit,
+		"limit":     err.max,
+		"usage":     err.usage,
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"time"
+)
+
+// --- CockroachDB Read Concurrency ---
+//
+// A burst of misses on many distinct cold keys, say after a cache flush,
+// sends one query per key to CockroachDB at once. DB_READ_CONCURRENCY bounds
+// how many single-key reads may run concurrently; a read that cannot get a
+// slot within DB_READ_QUEUE_TIMEOUT fails with errDBReadsSaturated, which
+// handlers turn into 503 like an open circuit breaker. Writes are not gated.
+
+var errDBReadsSaturated = fmt.Errorf("%w: too many concurrent reads", errDBUnavailable)
+
+// readLimiter is a counting semaphore: a slot is a value in the channel.
+type readLimiter struct {
+	slots chan struct{}
+	wait  time.Duration
+}
+
+// dbReadLimiter is nil when DB_READ_CONCURRENCY is 0.
+var dbReadLimiter *readLimiter
+
+var (
+	dbReadsInFlight       = expvar.NewInt("db_reads_in_flight")
+	dbReadLimitRejections = expvar.NewInt("db_read_limit_rejections_total")
+)
+
+func newReadLimiter(concurrency int, wait time.Duration) *readLimiter {
+	return &readLimiter{slots: make(chan struct{}, concurrency), wait: wait}
+}
+
+// acquire takes a slot, waiting at most l.wait for one to free up.
+func (l *readLimiter) acquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		dbReadLimitRejections.Add(1)
+		return false
+	}
+}
+
+// release frees a slot taken by acquire.
+func (l *readLimiter) release() {
+	<-l.slots
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// --- Read-Only Mode ---
+//
+// A region can be put into read-only mode during migrations or incidents:
+// PUT, PATCH and DELETE are rejected with 503 before doing any work, while
+// reads, listings and watches carry on. The flag starts from READ_ONLY and is
+// toggled at runtime through PUT /kv/_read_only. It is process-local, so each
+// server of a region is switched separately, and a restart returns to
+// READ_ONLY.
+
+// readOnlyRetryAfter is the Retry-After sent with rejected writes.
+const readOnlyRetryAfter = 30 * time.Second
+
+var (
+	readOnly         atomic.Bool
+	readOnlyRejected = expvar.NewInt("read_only_rejections_total")
+)
+
+func init() {
+	expvar.Publish("read_only", expvar.Func(func() any { return readOnly.Load() }))
+}
+
+// rejectIfReadOnly answers 503 and returns true when writes are disabled.
+func rejectIfReadOnly(w http.ResponseWriter) bool {
+	if !readOnly.Load() {
+		return false
+	}
+	readOnlyRejected.Add(1)
+	w.Header().Set("Retry-After", strconv.Itoa(int(readOnlyRetryAfter.Seconds())))
+	writeError(w, http.StatusServiceUnavailable, codeReadOnly, "Service unavailable: this region is in read-only mode")
+	return true
+}
+
+// setReadOnly switches read-only mode and logs the change.
+func setReadOnly(enabled bool, reason string) {
+	if readOnly.Swap(enabled) == enabled {
+		return
+	}
+	if enabled {
+		log.Printf("WARNING: Read-only mode enabled (%s); writes are rejected with 503.", reason)
+	} else {
+		log.Printf("Read-only mode disabled (%s); writes are accepted again.", reason)
+	}
+}
+
+// handleReadOnly serves GET /kv/_read_only, and PUT (admin only) with a body
+// of {"read_only": true|false} to toggle it.
+func handleReadOnly(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		requireAdmin(putReadOnly)(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]bool{"read_only": readOnly.Load()})
+}
+
+func putReadOnly(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		ReadOnly *bool `json:"read_only"`
+	}
+	body, ok := readBody(w, r)
+	if !ok || !decodeJSONBody(w, bytes.NewReader(body), &payload) {
+		return
+	}
+	if payload.ReadOnly == nil {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "Missing read_only")
+		return
+	}
+	setReadOnly(*payload.ReadOnly, "admin request from "+r.RemoteAddr)
+	json.NewEncoder(w).Encode(map[string]bool{"read_only": readOnly.Load()})
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"expvar"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Redis Memory Stats ---
+//
+// Every REDIS_STATS_INTERVAL the server samples Redis and publishes the
+// result as redis_stats on /debug/vars, so operators can watch memory
+// pressure over time and tune CACHE_TTL and the maxmemory policy. Totals come
+// from INFO memory, stats and keyspace, summed over the masters in Cluster
+// mode. Per-key figures come from SCANning up to REDIS_STATS_SAMPLE_SIZE of
+// this store's keys (those under REDIS_KEY_PREFIX) and asking each for its
+// TTL and MEMORY USAGE. The scan resumes where the previous one stopped, so
+// successive samples walk the whole keyspace instead of seeing the same keys,
+// and KEYS is never used.
+
+// redisStats is one sample.
+type redisStats struct {
+	SampledAt        time.Time      `json:"sampled_at"`
+	UsedMemoryBytes  int64          `json:"used_memory_bytes"`
+	MaxMemoryBytes   int64          `json:"maxmemory_bytes"`
+	MaxMemoryPolicy  string         `json:"maxmemory_policy"`
+	EvictedKeysTotal int64          `json:"evicted_keys_total"`
+	ExpiredKeysTotal int64          `json:"expired_keys_total"`
+	Keys             int64          `json:"keys"`
+	KeysWithTTL      int64          `json:"keys_with_ttl"`
+	Sample           redisKeySample `json:"sample"`
+}
+
+// redisKeySample describes the keys one scan visited.
+type redisKeySample struct {
+	Keys          int     `json:"keys"`
+	WithTTL       int     `json:"with_ttl"`
+	WithoutTTL    int     `json:"without_ttl"`
+	MemoryBytes   int64   `json:"memory_bytes"`
+	AvgTTLSeconds float64 `json:"avg_ttl_seconds"`
+}
+
+var (
+	lastRedisStats atomic.Pointer[redisStats]
+	// redisScanCursors holds each node's SCAN cursor between samples.
+	redisScanCursors sync.Map
+)
+
+func init() {
+	expvar.Publish("redis_stats", expvar.Func(func() any { return lastRedisStats.Load() }))
+}
+
+// runRedisStatsSampler samples Redis every interval.
+func runRedisStatsSampler(interval time.Duration, sampleSize int) {
+	for {
+		stats, err := sampleRedisStats(sampleSize)
+		if err != nil {
+			redisErrors.Add(1)
+			log.Printf("WARNING: Redis stats sample failed: %v", err)
+		} else {
+			if prev := lastRedisStats.Load(); prev != nil && stats.EvictedKeysTotal > prev.EvictedKeysTotal {
+				log.Printf("WARNING: Redis evicted %d keys in the last %v (used %d of %d bytes, policy %s)",
+					stats.EvictedKeysTotal-prev.EvictedKeysTotal, interval, stats.UsedMemoryBytes, stats.MaxMemoryBytes, stats.MaxMemoryPolicy)
+			}
+			lastRedisStats.Store(stats)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// forEachRedisNode runs fn on every master, or on the only node outside
+// Cluster mode.
+func forEachRedisNode(fn func(node *redis.Client) error) error {
+	switch c := redisClient.(type) {
+	case *redis.ClusterClient:
+		return c.ForEachMaster(ctx, func(_ context.Context, node *redis.Client) error { return fn(node) })
+	case *redis.Client:
+		return fn(c)
+	}
+	return nil
+}
+
+func sampleRedisStats(sampleSize int) (*redisStats, error) {
+	stats := &redisStats{SampledAt: time.Now().UTC()}
+	var mu sync.Mutex
+	var ttlSum time.Duration
+	var nodes int
+	err := forEachRedisNode(func(node *redis.Client) error {
+		info := map[string]string{}
+		for _, section := range []string{"memory", "stats", "keyspace"} {
+			raw, err := node.Info(ctx, section).Result()
+			if err != nil {
+				return err
+			}
+			parseRedisInfo(raw, info)
+		}
+		keys, withTTL := parseKeyspace(info["db"+strconv.Itoa(node.Options().DB)])
+		mu.Lock()
+		nodes++
+		stats.UsedMemoryBytes += infoInt(info, "used_memory")
+		stats.MaxMemoryBytes += infoInt(info, "maxmemory")
+		stats.MaxMemoryPolicy = info["maxmemory_policy"]
+		stats.EvictedKeysTotal += infoInt(info, "evicted_keys")
+		stats.ExpiredKeysTotal += infoInt(info, "expired_keys")
+		stats.Keys += keys
+		stats.KeysWithTTL += withTTL
+		mu.Unlock()
+
+		sample, sum, err := sampleRedisKeys(node, sampleSize)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		stats.Sample.Keys += sample.Keys
+		stats.Sample.WithTTL += sample.WithTTL
+		stats.Sample.WithoutTTL += sample.WithoutTTL
+		stats.Sample.MemoryBytes += sample.MemoryBytes
+		ttlSum += sum
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if stats.Sample.WithTTL > 0 {
+		stats.Sample.AvgTTLSeconds = ttlSum.Seconds() / float64(stats.Sample.WithTTL)
+	}
+	return stats, nil
+}
+
+// sampleRedisKeys scans up to sampleSize of this store's keys on node,
+// continuing from its previous cursor, and returns what it found with the
+// sum of the remaining TTLs.
+func sampleRedisKeys(node *redis.Client, sampleSize int) (redisKeySample, time.Duration, error) {
+	var sample redisKeySample
+	var ttlSum time.Duration
+	addr := node.Options().Addr
+	cursor := uint64(0)
+	if saved, ok := redisScanCursors.Load(addr); ok {
+		cursor = saved.(uint64)
+	}
+	for sample.Keys < sampleSize {
+		keys, next, err := node.Scan(ctx, cursor, cfg.RedisKeyPrefix+"*", 100).Result()
+		if err != nil {
+			return sample, 0, err
+		}
+		cursor = next
+		pipe := node.Pipeline()
+		ttls := make([]*redis.DurationCmd, 0, len(keys))
+		sizes := make([]*redis.IntCmd, 0, len(keys))
+		for _, key := range keys {
+			if key == versionsHashKey() || key == hydratorCursorKey() || key == hydratorCursorsKey() {
+				continue
+			}
+			ttls = append(ttls, pipe.TTL(ctx, key))
+			sizes = append(sizes, pipe.MemoryUsage(ctx, key))
+		}
+		if len(ttls) > 0 {
+			// Keys deleted since the SCAN fail individually; skip them.
+			pipe.Exec(ctx)
+		}
+		for i := range ttls {
+			ttl, ttlErr := ttls[i].Result()
+			size, sizeErr := sizes[i].Result()
+			if ttlErr != nil || sizeErr != nil || ttl == -2 {
+				continue
+			}
+			sample.Keys++
+			sample.MemoryBytes += size
+			if ttl > 0 {
+				sample.WithTTL++
+				ttlSum += ttl
+			} else {
+				sample.WithoutTTL++
+			}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	redisScanCursors.Store(addr, cursor)
+	return sample, ttlSum, nil
+}
+
+// parseRedisInfo adds the field:value lines of an INFO reply to info.
+func parseRedisInfo(raw string, info map[string]string) {
+	scanner := bufio.NewScanner(strings.NewReader(raw))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if field, value, ok := strings.Cut(line, ":"); ok && !strings.HasPrefix(line, "#") {
+			info[field] = value
+		}
+	}
+}
+
+func infoInt(info map[string]string, field string) int64 {
+	n, _ := strconv.ParseInt(info[field], 10, 64)
+	return n
+}
+
+// parseKeyspace reads the key counts of an INFO keyspace line such as
+// "keys=12,expires=3,avg_ttl=1000".
+func parseKeyspace(line string) (keys, withTTL int64) {
+	for _, part := range strings.Split(line, ",") {
+		name, value, _ := strings.Cut(part, "=")
+		n, _ := strconv.ParseInt(value, 10, 64)
+		switch name {
+		case "keys":
+			keys = n
+		case "expires":
+			withTTL = n
+		}
+	}
+	return keys, withTTL
+}
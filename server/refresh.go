@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// --- Cache Refresh Endpoints ---
+//
+// A targeted repair for stale cache entries: the cached value is rewritten
+// from the latest kv_log entry, or removed when the key is tombstoned, has
+// expired or was never written. The consistency checker covers whole-cache
+// audits.
+
+// Refresh actions reported per key.
+const (
+	refreshSet     = "set"
+	refreshDeleted = "deleted"
+)
+
+// refreshCacheEntry makes the cache agree with entry, the latest log entry
+// for namespace/key (nil if there is none), and returns the action taken.
+func refreshCacheEntry(namespace, key string, entry *LogEntry) (string, error) {
+	if entry != nil && !entry.Deleted {
+		if _, live := cacheExpiry(*entry); live {
+			return refreshSet, cacheSet(*entry)
+		}
+	}
+	return refreshDeleted, cacheDel(redisKey(namespace, key))
+}
+
+// handleRefresh serves POST /kv/{key}/_refresh.
+func handleRefresh(w http.ResponseWriter, r *http.Request) {
+	namespace, key := requestKey(r)
+	entry, err := latestForKey(r.Context(), namespace, key, false)
+	if errors.Is(err, errDBUnavailable) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Duration(cfg.DBBreakerCooldown).Seconds())))
+		writeError(w, http.StatusServiceUnavailable, codeDBUnavailable, "Service unavailable: CockroachDB is overloaded")
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: CockroachDB query failed for key '%s': %v", key, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	action, err := refreshCacheEntry(namespace, key, entry)
+	if err != nil {
+		redisErrors.Add(1)
+		log.Printf("ERROR: Failed to refresh cache for key '%s': %v", key, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	log.Printf("REFRESH for key '%s': %s", qualifiedKey(namespace, key), action)
+	resp := map[string]any{"namespace": namespace, "key": key, "action": action, "version": nil}
+	if entry != nil {
+		resp["version"] = entry.Version
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleRefreshPrefix serves POST /kv/_refresh?namespace=&prefix=&cursor=&limit=,
+// refreshing one page of keys under the prefix in key order, tombstoned keys
+// included. next_cursor is set when more keys may follow.
+func handleRefreshPrefix(w http.ResponseWriter, r *http.Request) {
+	limit, ok := queryLimit(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "Invalid limit")
+		return
+	}
+	namespace, ok := namespaceQuery(r)
+	if !ok {
+		writeError(w, http.StatusNotFound, codeNamespaceNotFound, "Namespace not found")
+		return
+	}
+	query := r.URL.Query()
+	entries, err := latestByPrefix(r.Context(), namespace, query.Get("prefix"), query.Get("cursor"), limit)
+	if err != nil {
+		log.Printf("ERROR: CockroachDB refresh query failed for prefix '%s': %v", query.Get("prefix"), err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	type item struct {
+		Key    string `json:"key"`
+		Action string `json:"action"`
+	}
+	items := make([]item, 0, len(entries))
+	for _, e := range entries {
+		action, err := refreshCacheEntry(namespace, e.Key, &e)
+		if err != nil {
+			redisErrors.Add(1)
+			log.Printf("ERROR: Failed to refresh cache for key '%s': %v", e.Key, err)
+			writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+			return
+		}
+		items = append(items, item{e.Key, action})
+	}
+	log.Printf("REFRESH for prefix '%s': %d keys", qualifiedKey(namespace, query.Get("prefix")), len(items))
+	resp := map[string]any{"namespace": namespace, "keys": items, "next_cursor": nil}
+	if len(entries) == clampLimit(limit) {
+		resp["next_cursor"] = entries[len(entries)-1].Key
+	}
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// --- Cross-Region View ---
+//
+// GET /kv/{key}/_regions asks every region listed in REGION_ADDRESSES for its
+// /_debug view of the key, concurrently and each within REGIONS_TIMEOUT, and
+// returns them side by side. The caller's Authorization header is passed on,
+// so all regions must share ADMIN_TOKEN. This server is only included if its
+// own region is listed. A region whose cache still holds an old value, or
+// that cannot be reached, stands out at a glance, which makes this the live
+// form of the multi-server geo test.
+
+// regionView is one region's answer: the value a GET there would return
+// (the cached one on a hit, otherwise the latest live value in CockroachDB,
+// or null), whether it came from the cache, the timestamp of the latest
+// entry, and whether that region's cache agrees with the log.
+type regionView struct {
+	Value     *string    `json:"value"`
+	Cached    bool       `json:"cached"`
+	Timestamp *time.Time `json:"timestamp"`
+	InSync    bool       `json:"in_sync"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// handleRegions serves GET /kv/{key}/_regions. Diverged is true when two
+// regions that answered report different values.
+func handleRegions(w http.ResponseWriter, r *http.Request) {
+	if len(regionAddresses) == 0 {
+		writeError(w, http.StatusNotFound, codeNotFound, "No regions configured: set REGION_ADDRESSES")
+		return
+	}
+	namespace, key := requestKey(r)
+	views := make(map[string]regionView, len(regionAddresses))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for region, address := range regionAddresses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			view, err := fetchRegionView(r.Context(), address, namespace, key, r.Header.Get("Authorization"))
+			if err != nil {
+				view = regionView{Error: err.Error()}
+			}
+			mu.Lock()
+			views[region] = view
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	diverged := false
+	var first *regionView
+	for _, view := range views {
+		if view.Error != "" {
+			continue
+		}
+		if first == nil {
+			first = &view
+		} else if !sameValue(first.Value, view.Value) {
+			diverged = true
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]any{
+		"namespace": namespace,
+		"key":       key,
+		"regions":   views,
+		"diverged":  diverged,
+	})
+}
+
+func sameValue(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// fetchRegionView reads key's /_debug report from the server at address.
+func fetchRegionView(ctx context.Context, address, namespace, key, authorization string) (regionView, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.RegionsTimeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, address+"/kv/"+escapedKeyPath(namespace, key)+"/_debug", nil)
+	if err != nil {
+		return regionView{}, err
+	}
+	req.Header.Set("Authorization", authorization)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return regionView{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return regionView{}, fmt.Errorf("region returned %s", resp.Status)
+	}
+	var debug struct {
+		Cache struct {
+			Hit   bool   `json:"hit"`
+			Value string `json:"value"`
+			Error string `json:"error"`
+		} `json:"cache"`
+		DB struct {
+			Found     bool      `json:"found"`
+			Value     string    `json:"value"`
+			Deleted   bool      `json:"deleted"`
+			Timestamp time.Time `json:"timestamp"`
+			Error     string    `json:"error"`
+		} `json:"db"`
+		InSync bool `json:"in_sync"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&debug); err != nil {
+		return regionView{}, fmt.Errorf("decoding region response: %w", err)
+	}
+	view := regionView{InSync: debug.InSync}
+	switch {
+	case debug.Cache.Hit:
+		view.Value, view.Cached = &debug.Cache.Value, true
+	case debug.DB.Found && !debug.DB.Deleted:
+		view.Value = &debug.DB.Value
+	}
+	if debug.DB.Found {
+		view.Timestamp = &debug.DB.Timestamp
+	}
+	if debug.Cache.Error != "" {
+		view.Error = "redis: " + debug.Cache.Error
+	} else if debug.DB.Error != "" {
+		view.Error = "cockroachdb: " + debug.DB.Error
+	}
+	return view, nil
+}
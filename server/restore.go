@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// --- Restore ---
+//
+// POST /kv/{key}/_restore undoes a delete. Deletes are tombstones and the log
+// keeps history, so the key's last live value is still there: the newest
+// entry that is not a tombstone. Restoring appends a new entry copying its
+// value, labels and value type, in the transaction that read it and
+// conditioned on the version read, like a PATCH. The restored value never
+// expires, even if the one it copies had a ttl_seconds. A key that is live
+// gets 409; one that was never live, or whose live entries were pruned by
+// MAX_VERSIONS_PER_KEY, gets 404.
+
+var errKeyLive = errors.New("key is not deleted")
+
+// handleRestore serves POST /kv/{key}/_restore.
+func handleRestore(w http.ResponseWriter, r *http.Request) {
+	if rejectIfReadOnly(w) {
+		return
+	}
+	namespace, key := requestKey(r)
+	entry, err := restoreKey(r.Context(), namespace, key)
+	var schemaErr *schemaValidationError
+	var quotaErr *errQuotaExceeded
+	switch {
+	case errors.Is(err, errKeyNotFound):
+		writeError(w, http.StatusNotFound, codeKeyNotFound, "Key has no live value to restore")
+		return
+	case errors.Is(err, errKeyLive):
+		writeError(w, http.StatusConflict, codeConflict, "Conflict: key is not deleted")
+		return
+	case errors.As(err, &schemaErr):
+		writeSchemaValidationError(w, schemaErr)
+		return
+	case errors.As(err, &quotaErr):
+		writeQuotaExceeded(w, quotaErr)
+		return
+	case errors.Is(err, errVersionConflict):
+		writeError(w, http.StatusConflict, codeWriteConflict, "Conflict: key kept changing, retry the restore")
+		return
+	case err != nil:
+		log.Printf("ERROR: Failed to restore key '%s' in CockroachDB: %v", key, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	applyWriteToCache(*entry)
+	log.Printf("RESTORE successful for key: %s (version %d)", key, entry.Version)
+	json.NewEncoder(w).Encode(entry)
+}
+
+// restoreKey appends a copy of key's last live entry, retrying when a
+// concurrent write lands between the read and the append.
+func restoreKey(ctx context.Context, namespace, key string) (*LogEntry, error) {
+	var err error
+	for attempt := 0; attempt < 5; attempt++ {
+		var entry *LogEntry
+		entry, err = tryRestoreKey(ctx, namespace, key)
+		if !errors.Is(err, errVersionConflict) {
+			return entry, err
+		}
+	}
+	return nil, err
+}
+
+func tryRestoreKey(ctx context.Context, namespace, key string) (*LogEntry, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	current, err := lockLatestEntry(ctx, tx, namespace, key)
+	if err == nil && !current.Expired {
+		return nil, errKeyLive
+	}
+	if err != nil && !errors.Is(err, errKeyNotFound) {
+		return nil, err
+	}
+	var live LogEntry
+	err = scanEntry(tx.QueryRowContext(ctx, `
+    SELECT `+entryColumns+` FROM `+logTable()+`
+    WHERE namespace = $1 AND key = $2 AND NOT deleted
+    ORDER BY `+newestFirst+`
+    LIMIT 1;
+    `, namespace, key), &live)
+	if err == sql.ErrNoRows {
+		return nil, errKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := validateValue(namespace, key, live.Value); err != nil {
+		return nil, err
+	}
+	entry := &LogEntry{
+		Namespace:    namespace,
+		Key:          key,
+		Value:        live.Value,
+		Timestamp:    time.Now().UTC(),
+		OriginRegion: cfg.OriginRegion,
+		Labels:       live.Labels,
+		ValueType:    live.ValueType,
+		TargetKey:    live.TargetKey,
+	}
+	if err := insertLogEntry(ctx, tx, entry, &current.Version); err != nil {
+		return nil, err
+	}
+	if err := pruneVersions(ctx, tx, namespace, key); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		if isWriteConflict(err) {
+			return nil, errVersionConflict
+		}
+		return nil, err
+	}
+	return entry, nil
+}
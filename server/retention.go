@@ -0,0 +1,83 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"time"
+)
+
+// --- History Retention ---
+//
+// MAX_VERSIONS_PER_KEY keeps a key's newest N entries and RETENTION_MAX_AGE
+// keeps every entry younger than the given age; with both set, an entry is
+// kept while either rule keeps it, so a key holds whichever of the two sets
+// is larger. A key's latest entry is always kept. The count is enforced when
+// a key is written, since writing is the only thing that pushes an entry out
+// of the newest N, while entries age whether or not the key is written, so
+// with RETENTION_MAX_AGE set a background job also prunes every
+// RETENTION_INTERVAL. Every server runs it; deletes of the same rows by two
+// servers are harmless. Pruned rows reach the hydrators as changefeed
+// deletions, which they ignore.
+
+// retentionBatchSize bounds the rows one pruning statement deletes.
+const retentionBatchSize = 1000
+
+var retentionPruned = expvar.NewInt("retention_pruned_entries_total")
+
+// retentionCutoff is the time before which entries are old enough to be
+// pruned, and false when RETENTION_MAX_AGE is unset.
+func retentionCutoff() (time.Time, bool) {
+	if cfg.RetentionMaxAge <= 0 {
+		return time.Time{}, false
+	}
+	return time.Now().Add(-time.Duration(cfg.RetentionMaxAge)), true
+}
+
+// runRetention prunes entries past retention every interval, forever.
+func runRetention(interval time.Duration) {
+	log.Printf("History retention running every %v (max age %v, max versions per key %d).", interval, time.Duration(cfg.RetentionMaxAge), cfg.MaxVersionsPerKey)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for {
+			n, err := pruneRetentionBatch()
+			if err != nil {
+				log.Printf("ERROR: History retention failed: %v", err)
+				break
+			}
+			if n < retentionBatchSize {
+				break
+			}
+		}
+	}
+}
+
+// pruneRetentionBatch deletes up to retentionBatchSize entries that are
+// older than RETENTION_MAX_AGE and not among their key's newest
+// MAX_VERSIONS_PER_KEY, and returns how many it deleted.
+func pruneRetentionBatch() (int64, error) {
+	cutoff, ok := retentionCutoff()
+	if !ok {
+		return 0, nil
+	}
+	res, err := db.Exec(`
+    DELETE FROM `+logTable()+` WHERE id IN (
+        SELECT id FROM (
+            SELECT id, timestamp, row_number() OVER (PARTITION BY namespace, key ORDER BY `+newestFirst+`) AS newer
+            FROM `+logTable()+`
+            WHERE (namespace, key) IN (SELECT namespace, key FROM `+logTable()+` WHERE timestamp < $1)
+        ) AS ranked
+        WHERE newer > $2 AND timestamp < $1
+        LIMIT $3
+    );
+    `, cutoff, max(cfg.MaxVersionsPerKey, 1), retentionBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	retentionPruned.Add(n)
+	if n > 0 {
+		log.Printf("History retention: pruned %d entries older than %v.", n, cutoff.Format(time.RFC3339))
+	}
+	return n, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// --- Routing ---
+//
+// Everything lives under /kv/. Paths starting with "/kv/_" are collection
+// endpoints, and keys ending in one of the reserved "/_name" suffixes address
+// per-key sub-resources, so neither form can be used as a plain key. A key
+// path may start with a registered namespace (see resolveKey).
+//
+// Keys are routed on the escaped path and decoded afterwards, so an escaped
+// character is always part of the key: /kv/a%2Fb is the key "a/b" even when
+// "a" is a namespace, and /kv/x%2F_history is a key, not x's history. The
+// decoded key is what the log, the cache and responses use.
+
+// keySuffixes are the reserved per-key sub-resources.
+var keySuffixes = []string{"/_history", "/_debug", "/_exists", "/_refresh", "/_append", "/_restore", "/_regions", "/_prepare", "/_commit", "/_abort", "/_touch"}
+
+// splitKeyPath splits a /kv/ path into its key and reserved suffix (if any).
+// Collection endpoints are returned as a suffix with an empty key.
+func splitKeyPath(urlPath string) (key, suffix string) {
+	path := strings.TrimPrefix(urlPath, "/kv/")
+	if strings.HasPrefix(path, "_") {
+		return "", path
+	}
+	for _, s := range keySuffixes {
+		if k, ok := strings.CutSuffix(path, s); ok {
+			return k, s
+		}
+	}
+	return path, ""
+}
+
+// redactKeyPath replaces the key in a /kv/ path with a placeholder, keeping
+// the route itself visible.
+func redactKeyPath(urlPath string) string {
+	if !strings.HasPrefix(urlPath, "/kv/") {
+		return urlPath
+	}
+	key, suffix := splitKeyPath(urlPath)
+	if key == "" {
+		return urlPath
+	}
+	return "/kv/{key}" + suffix
+}
+
+// resolveKeyPath is resolveKey for a still-escaped key path: the namespace
+// is split off at the first literal slash, then each part is decoded.
+// net/http already rejects most malformed escapes with 400 before routing,
+// but the decoding is checked here too.
+func resolveKeyPath(escaped string) (namespace, key string, err error) {
+	namespace = defaultNamespace
+	if ns, rest, ok := strings.Cut(escaped, "/"); ok && rest != "" {
+		if decoded, err := url.PathUnescape(ns); err == nil && isNamespace(decoded) {
+			namespace, escaped = decoded, rest
+		}
+	}
+	key, err = url.PathUnescape(escaped)
+	return namespace, key, err
+}
+
+// escapedKeyPath is the inverse of resolveKeyPath: the path under /kv/ that
+// addresses key in namespace.
+func escapedKeyPath(namespace, key string) string {
+	path := url.PathEscape(key)
+	if namespace != defaultNamespace {
+		path = url.PathEscape(namespace) + "/" + path
+	}
+	return path
+}
+
+// routeKV dispatches a /kv/ request to its handler.
+func routeKV(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBodyBytes)
+
+	key, suffix := splitKeyPath(r.URL.EscapedPath())
+	switch {
+	case key == "" && suffix == "_list":
+		allowMethods(w, r, handleList, http.MethodGet)
+		return
+	case key == "" && suffix == "_range":
+		allowMethods(w, r, handleRange, http.MethodGet)
+		return
+	case key == "" && suffix == "_changes":
+		allowMethods(w, r, handleChanges, http.MethodGet)
+		return
+	case key == "" && suffix == "_count":
+		allowMethods(w, r, handleCount, http.MethodGet)
+		return
+	case key == "" && suffix == "_resolved":
+		allowMethods(w, r, handleResolved, http.MethodGet)
+		return
+	case key == "" && suffix == "_watch":
+		allowMethods(w, r, handleWatch, http.MethodGet)
+		return
+	case key == "" && suffix == "_refresh":
+		allowMethods(w, r, requireAdmin(handleRefreshPrefix), http.MethodPost)
+		return
+	case key == "" && suffix == "_selftest":
+		allowMethods(w, r, requireAdmin(handleSelftest), http.MethodGet)
+		return
+	case key == "" && suffix == "_hot_keys":
+		allowMethods(w, r, requireAdmin(handleHotKeys), http.MethodGet, http.MethodDelete)
+		return
+	case key == "" && suffix == "_snapshot":
+		allowMethods(w, r, handleSnapshot, http.MethodPost)
+		return
+	case key == "" && suffix == "_batch/delete":
+		allowMethods(w, r, handleBatchDelete, http.MethodPost)
+		return
+	case key == "" && suffix == "_batch/touch":
+		allowMethods(w, r, handleBatchTouch, http.MethodPost)
+		return
+	case key == "" && suffix == "_batch/import":
+		allowMethods(w, r, handleImport, http.MethodPost)
+		return
+	case key == "" && suffix == "_swap":
+		allowMethods(w, r, handleSwap, http.MethodPost)
+		return
+	case key == "" && suffix == "_read_only":
+		allowMethods(w, r, handleReadOnly, http.MethodGet, http.MethodPut)
+		return
+	case key == "" && suffix == "_namespaces":
+		allowMethods(w, r, handleListNamespaces, http.MethodGet)
+		return
+	case key == "" && strings.HasPrefix(suffix, "_namespaces/"):
+		allowMethods(w, r, handleNamespace, http.MethodGet, http.MethodPut)
+		return
+	case key == "" && strings.HasPrefix(suffix, "_schemas/"):
+		allowMethods(w, r, handleSchemas, http.MethodGet, http.MethodPut, http.MethodDelete)
+		return
+	}
+
+	namespace, key, err := resolveKeyPath(key)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Malformed percent-encoding in key")
+		return
+	}
+	r = withKeyRef(r, namespace, key)
+	switch {
+	case suffix == "/_history":
+		allowMethods(w, r, handleHistory, http.MethodGet)
+		return
+	case suffix == "/_exists":
+		recordAccess(http.MethodGet, namespace, key)
+		allowMethods(w, r, handleExists, http.MethodGet, http.MethodHead)
+		return
+	case suffix == "/_debug":
+		allowMethods(w, r, requireAdmin(handleDebug), http.MethodGet)
+		return
+	case suffix == "/_refresh":
+		allowMethods(w, r, requireAdmin(handleRefresh), http.MethodPost)
+		return
+	case suffix == "/_regions":
+		allowMethods(w, r, requireAdmin(handleRegions), http.MethodGet)
+		return
+	case suffix == "/_append":
+		recordAccess(http.MethodPost, namespace, key)
+		if rejectIfNotHome(w, r, namespace, key) {
+			return
+		}
+		allowMethods(w, r, handleAppend, http.MethodPost)
+		return
+	case suffix == "/_restore":
+		recordAccess(http.MethodPost, namespace, key)
+		if rejectIfNotHome(w, r, namespace, key) {
+			return
+		}
+		allowMethods(w, r, handleRestore, http.MethodPost)
+		return
+	case suffix == "/_touch":
+		recordAccess(http.MethodPost, namespace, key)
+		if rejectIfNotHome(w, r, namespace, key) {
+			return
+		}
+		allowMethods(w, r, handleTouch, http.MethodPost)
+		return
+	case suffix == "/_prepare":
+		recordAccess(http.MethodPost, namespace, key)
+		if rejectIfNotHome(w, r, namespace, key) {
+			return
+		}
+		allowMethods(w, r, handlePrepare, http.MethodPost)
+		return
+	case suffix == "/_commit":
+		recordAccess(http.MethodPost, namespace, key)
+		if rejectIfNotHome(w, r, namespace, key) {
+			return
+		}
+		allowMethods(w, r, handleCommit, http.MethodPost)
+		return
+	case suffix == "/_abort":
+		recordAccess(http.MethodPost, namespace, key)
+		if rejectIfNotHome(w, r, namespace, key) {
+			return
+		}
+		allowMethods(w, r, handleAbort, http.MethodPost)
+		return
+	}
+
+	recordAccess(r.Method, namespace, key)
+	if rejectIfNotHome(w, r, namespace, key) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		handleGet(w, r)
+	case http.MethodHead:
+		handleExists(w, r)
+	case http.MethodPut:
+		handlePut(w, r)
+	case http.MethodPatch:
+		handlePatch(w, r)
+	case http.MethodDelete:
+		handleDelete(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// allowMethods runs h if the request uses one of methods, and answers 405
+// with an Allow header otherwise.
+func allowMethods(w http.ResponseWriter, r *http.Request, h http.HandlerFunc, methods ...string) {
+	for _, m := range methods {
+		if r.Method == m {
+			h(w, r)
+			return
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+}
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// --- Value Schemas ---
+//
+// A namespace may register JSON Schemas for key prefixes. Every PUT and PATCH
+// to a key under a registered prefix must then produce a JSON value that
+// matches the most specific (longest) prefix's schema, or it is rejected with
+// 422 before anything is appended. Namespaces without schemas accept any
+// value. Schemas live in the kv_schemas table and are cached like the
+// namespace registry, so other servers pick up a change on their next
+// refresh.
+//
+// The validator implements the commonly used subset of JSON Schema
+// (draft 2020-12 keywords): type, enum, const, the numeric, string, array and
+// object bounds, pattern, properties, required, additionalProperties, items,
+// allOf, anyOf, oneOf and not. Other keywords, such as $schema, title or
+// format, are accepted and ignored.
+
+// registeredSchema is a schema as registered, with its compiled form.
+type registeredSchema struct {
+	Prefix   string          `json:"prefix"`
+	Schema   json.RawMessage `json:"schema"`
+	compiled *jsonSchema
+}
+
+// schemaRegistry caches kv_schemas by namespace, each list sorted by
+// descending prefix length so the first match is the most specific.
+var schemaRegistry = struct {
+	sync.RWMutex
+	byNamespace map[string][]registeredSchema
+}{byNamespace: map[string][]registeredSchema{}}
+
+func refreshSchemas() error {
+	rows, err := db.Query(`SELECT namespace, prefix, schema FROM kv_schemas`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	byNamespace := map[string][]registeredSchema{}
+	for rows.Next() {
+		var namespace, prefix, raw string
+		if err := rows.Scan(&namespace, &prefix, &raw); err != nil {
+			return err
+		}
+		compiled, err := compileSchemaDocument([]byte(raw))
+		if err != nil {
+			// Only valid schemas are stored, so this means a newer server
+			// wrote a keyword this one does not understand.
+			log.Printf("WARNING: Ignoring schema for namespace '%s' prefix '%s': %v", namespace, prefix, err)
+			continue
+		}
+		byNamespace[namespace] = append(byNamespace[namespace], registeredSchema{prefix, json.RawMessage(raw), compiled})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, schemas := range byNamespace {
+		sort.Slice(schemas, func(i, j int) bool { return len(schemas[i].Prefix) > len(schemas[j].Prefix) })
+	}
+	schemaRegistry.Lock()
+	schemaRegistry.byNamespace = byNamespace
+	schemaRegistry.Unlock()
+	return nil
+}
+
+// schemaFor returns the schema governing key in namespace, or nil.
+func schemaFor(namespace, key string) *registeredSchema {
+	schemaRegistry.RLock()
+	defer schemaRegistry.RUnlock()
+	for i, s := range schemaRegistry.byNamespace[namespace] {
+		if strings.HasPrefix(key, s.Prefix) {
+			return &schemaRegistry.byNamespace[namespace][i]
+		}
+	}
+	return nil
+}
+
+// schemaValidationError lists why a value does not match its schema.
+type schemaValidationError struct {
+	Prefix string
+	Errors []string
+}
+
+func (e *schemaValidationError) Error() string {
+	return fmt.Sprintf("value does not match the schema for prefix %q: %s", e.Prefix, strings.Join(e.Errors, "; "))
+}
+
+// validateValue checks a raw value against the schema governing key, if any,
+// returning a *schemaValidationError on mismatch.
+func validateValue(namespace, key, value string) error {
+	schema := schemaFor(namespace, key)
+	if schema == nil {
+		return nil
+	}
+	document, err := decodeJSONValue([]byte(value))
+	if err != nil {
+		return &schemaValidationError{schema.Prefix, []string{"value is not valid JSON"}}
+	}
+	return validateDocument(schema, document)
+}
+
+func validateDocument(schema *registeredSchema, document any) error {
+	var errs []string
+	schema.compiled.validate(document, "", &errs)
+	if len(errs) > 0 {
+		return &schemaValidationError{schema.Prefix, errs}
+	}
+	return nil
+}
+
+// writeSchemaValidationError answers 422 with the validation errors.
+func writeSchemaValidationError(w http.ResponseWriter, err *schemaValidationError) {
+	writeErrorDetails(w, http.StatusUnprocessableEntity, codeValidationFailed, "Value does not match the namespace schema", map[string]any{
+		"prefix": err.Prefix,
+		"errors": err.Errors,
+	})
+}
+
+// handleSchemas serves /kv/_schemas/{namespace}: GET lists the namespace's
+// schemas, PUT ?prefix= registers or replaces one (the body is the schema)
+// and DELETE ?prefix= removes one. Changes are admin only.
+func handleSchemas(w http.ResponseWriter, r *http.Request) {
+	namespace := strings.TrimPrefix(r.URL.Path, "/kv/_schemas/")
+	if namespace != defaultNamespace && !isNamespace(namespace) {
+		writeError(w, http.StatusNotFound, codeNamespaceNotFound, "Namespace not found")
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		requireAdmin(func(w http.ResponseWriter, r *http.Request) { putSchema(w, r, namespace) })(w, r)
+	case http.MethodDelete:
+		requireAdmin(func(w http.ResponseWriter, r *http.Request) { deleteSchema(w, r, namespace) })(w, r)
+	default:
+		schemaRegistry.RLock()
+		schemas := append([]registeredSchema{}, schemaRegistry.byNamespace[namespace]...)
+		schemaRegistry.RUnlock()
+		sort.Slice(schemas, func(i, j int) bool { return schemas[i].Prefix < schemas[j].Prefix })
+		json.NewEncoder(w).Encode(map[string]any{"namespace": namespace, "schemas": schemas})
+	}
+}
+
+func putSchema(w http.ResponseWriter, r *http.Request, namespace string) {
+	prefix := r.URL.Query().Get("prefix")
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Failed to read request body")
+		return
+	}
+	if _, err := compileSchemaDocument(body); err != nil {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, fmt.Sprintf("Invalid schema: %v", err))
+		return
+	}
+	raw, _ := decodeJSONValue(body)
+	schema, _ := encodeJSONValue(raw)
+	_, err = db.ExecContext(r.Context(), `UPSERT INTO kv_schemas (namespace, prefix, schema, updated_at) VALUES ($1, $2, $3, now())`, namespace, prefix, schema)
+	if err == nil {
+		err = refreshSchemas()
+	}
+	if err != nil {
+		log.Printf("ERROR: Failed to register schema for namespace '%s' prefix '%s': %v", namespace, prefix, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	log.Printf("Schema registered for namespace '%s' prefix '%s'", namespace, prefix)
+	json.NewEncoder(w).Encode(map[string]any{"namespace": namespace, "prefix": prefix, "schema": json.RawMessage(schema)})
+}
+
+func deleteSchema(w http.ResponseWriter, r *http.Request, namespace string) {
+	prefix := r.URL.Query().Get("prefix")
+	res, err := db.ExecContext(r.Context(), `DELETE FROM kv_schemas WHERE namespace = $1 AND prefix = $2`, namespace, prefix)
+	var removed int64
+	if err == nil {
+		removed, err = res.RowsAffected()
+	}
+	if err == nil {
+		err = refreshSchemas()
+	}
+	if err != nil {
+		log.Printf("ERROR: Failed to remove schema for namespace '%s' prefix '%s': %v", namespace, prefix, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	if removed == 0 {
+		writeError(w, http.StatusNotFound, codeNotFound, "Schema not found")
+		return
+	}
+	log.Printf("Schema removed for namespace '%s' prefix '%s'", namespace, prefix)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- JSON Schema Validation ---
+
+// jsonSchema is a compiled schema. Unset keywords are nil.
+type jsonSchema struct {
+	always *bool // Set for the boolean schemas true and false.
+
+	types    []string
+	enum     []any
+	constVal *any
+
+	minimum, maximum                   *big.Float
+	exclusiveMinimum, exclusiveMaximum *big.Float
+
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+
+	items              *jsonSchema
+	minItems, maxItems *int
+	uniqueItems        bool
+
+	properties           map[string]*jsonSchema
+	required             []string
+	additionalProperties *jsonSchema
+	minProps, maxProps   *int
+
+	allOf, anyOf, oneOf []*jsonSchema
+	not                 *jsonSchema
+}
+
+var jsonSchemaTypes = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "integer": true, "string": true,
+}
+
+// compileSchemaDocument parses and compiles a schema document.
+func compileSchemaDocument(raw []byte) (*jsonSchema, error) {
+	doc, err := decodeJSONValue(raw)
+	if err != nil {
+		return nil, errors.New("schema is not valid JSON")
+	}
+	return compileSchema(doc, "")
+}
+
+func compileSchema(doc any, path string) (*jsonSchema, error) {
+	if b, ok := doc.(bool); ok {
+		return &jsonSchema{always: &b}, nil
+	}
+	obj, ok := doc.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: a schema must be an object or a boolean", displayPointer(path))
+	}
+	s := &jsonSchema{}
+	for keyword, v := range obj {
+		fail := func(want string) error {
+			return fmt.Errorf("%s: %s must be %s", displayPointer(path+"/"+keyword), keyword, want)
+		}
+		number := func(dst **big.Float) error {
+			n, ok := schemaNumber(v)
+			if !ok {
+				return fail("a number")
+			}
+			*dst = n
+			return nil
+		}
+		count := func(dst **int) error {
+			n, ok := schemaCount(v)
+			if !ok {
+				return fail("a non-negative integer")
+			}
+			*dst = &n
+			return nil
+		}
+		subschema := func(dst **jsonSchema) (err error) {
+			*dst, err = compileSchema(v, path+"/"+keyword)
+			return err
+		}
+		subschemas := func(dst *[]*jsonSchema) error {
+			list, ok := v.([]any)
+			if !ok || len(list) == 0 {
+				return fail("a non-empty array of schemas")
+			}
+			*dst = make([]*jsonSchema, len(list))
+			for i, sub := range list {
+				var err error
+				if (*dst)[i], err = compileSchema(sub, fmt.Sprintf("%s/%s/%d", path, keyword, i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		var err error
+		switch keyword {
+		case "type":
+			s.types = schemaStrings(v)
+			if s.types == nil {
+				err = fail("a type name or a list of them")
+			}
+			for _, name := range s.types {
+				if !jsonSchemaTypes[name] {
+					err = fail("one of null, boolean, object, array, number, integer or string")
+				}
+			}
+		case "enum":
+			if s.enum, ok = v.([]any); !ok {
+				err = fail("an array")
+			}
+		case "const":
+			s.constVal = &v
+		case "minimum":
+			err = number(&s.minimum)
+		case "maximum":
+			err = number(&s.maximum)
+		case "exclusiveMinimum":
+			err = number(&s.exclusiveMinimum)
+		case "exclusiveMaximum":
+			err = number(&s.exclusiveMaximum)
+		case "minLength":
+			err = count(&s.minLength)
+		case "maxLength":
+			err = count(&s.maxLength)
+		case "minItems":
+			err = count(&s.minItems)
+		case "maxItems":
+			err = count(&s.maxItems)
+		case "minProperties":
+			err = count(&s.minProps)
+		case "maxProperties":
+			err = count(&s.maxProps)
+		case "pattern":
+			p, ok := v.(string)
+			if !ok {
+				err = fail("a string")
+			} else if s.pattern, err = regexp.Compile(p); err != nil {
+				err = fail("a valid regular expression")
+			}
+		case "uniqueItems":
+			if s.uniqueItems, ok = v.(bool); !ok {
+				err = fail("a boolean")
+			}
+		case "required":
+			if _, ok := v.([]any); ok {
+				s.required = schemaStrings(v)
+			}
+			if s.required == nil {
+				err = fail("an array of strings")
+			}
+		case "properties":
+			props, ok := v.(map[string]any)
+			if !ok {
+				err = fail("an object")
+				break
+			}
+			s.properties = make(map[string]*jsonSchema, len(props))
+			for name, sub := range props {
+				if s.properties[name], err = compileSchema(sub, path+"/properties/"+escapePointerToken(name)); err != nil {
+					break
+				}
+			}
+		case "items":
+			err = subschema(&s.items)
+		case "additionalProperties":
+			err = subschema(&s.additionalProperties)
+		case "not":
+			err = subschema(&s.not)
+		case "allOf":
+			err = subschemas(&s.allOf)
+		case "anyOf":
+			err = subschemas(&s.anyOf)
+		case "oneOf":
+			err = subschemas(&s.oneOf)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// schemaStrings reads a string or an array of strings, returning nil for
+// anything else.
+func schemaStrings(v any) []string {
+	if str, ok := v.(string); ok {
+		return []string{str}
+	}
+	list, ok := v.([]any)
+	if !ok {
+		return nil
+	}
+	strs := []string{}
+	for _, e := range list {
+		str, ok := e.(string)
+		if !ok {
+			return nil
+		}
+		strs = append(strs, str)
+	}
+	return strs
+}
+
+func schemaNumber(v any) (*big.Float, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return nil, false
+	}
+	f, ok := new(big.Float).SetString(string(n))
+	return f, ok
+}
+
+func schemaCount(v any) (int, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	i, err := n.Int64()
+	if err != nil || i < 0 || i > int64(^uint32(0)>>1) {
+		return 0, false
+	}
+	return int(i), true
+}
+
+// validate appends a message for each way v fails s, prefixed with the JSON
+// Pointer of the offending value.
+func (s *jsonSchema) validate(v any, path string, errs *[]string) {
+	addErr := func(format string, args ...any) {
+		*errs = append(*errs, displayPointer(path)+": "+fmt.Sprintf(format, args...))
+	}
+	if s.always != nil {
+		if !*s.always {
+			addErr("no value is allowed here")
+		}
+		return
+	}
+	if len(s.types) > 0 && !matchesType(v, s.types) {
+		addErr("must be %s, not %s", strings.Join(s.types, " or "), jsonTypeName(v))
+		return
+	}
+	if s.enum != nil && !containsJSON(s.enum, v) {
+		addErr("must be one of the enumerated values")
+	}
+	if s.constVal != nil && !jsonEqual(*s.constVal, v) {
+		addErr("must equal the constant value")
+	}
+
+	switch x := v.(type) {
+	case json.Number:
+		n, _ := new(big.Float).SetString(string(x))
+		if s.minimum != nil && n.Cmp(s.minimum) < 0 {
+			addErr("must be >= %s", s.minimum.Text('g', -1))
+		}
+		if s.maximum != nil && n.Cmp(s.maximum) > 0 {
+			addErr("must be <= %s", s.maximum.Text('g', -1))
+		}
+		if s.exclusiveMinimum != nil && n.Cmp(s.exclusiveMinimum) <= 0 {
+			addErr("must be > %s", s.exclusiveMinimum.Text('g', -1))
+		}
+		if s.exclusiveMaximum != nil && n.Cmp(s.exclusiveMaximum) >= 0 {
+			addErr("must be < %s", s.exclusiveMaximum.Text('g', -1))
+		}
+	case string:
+		length := utf8.RuneCountInString(x)
+		if s.minLength != nil && length < *s.minLength {
+			addErr("must be at least %d characters long", *s.minLength)
+		}
+		if s.maxLength != nil && length > *s.maxLength {
+			addErr("must be at most %d characters long", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(x) {
+			addErr("must match pattern %q", s.pattern.String())
+		}
+	case []any:
+		if s.minItems != nil && len(x) < *s.minItems {
+			addErr("must have at least %d items", *s.minItems)
+		}
+		if s.maxItems != nil && len(x) > *s.maxItems {
+			addErr("must have at most %d items", *s.maxItems)
+		}
+		if s.uniqueItems {
+			for i := range x {
+				if containsJSON(x[:i], x[i]) {
+					addErr("items must be unique, but item %d repeats an earlier one", i)
+					break
+				}
+			}
+		}
+		if s.items != nil {
+			for i, item := range x {
+				s.items.validate(item, fmt.Sprintf("%s/%d", path, i), errs)
+			}
+		}
+	case map[string]any:
+		if s.minProps != nil && len(x) < *s.minProps {
+			addErr("must have at least %d properties", *s.minProps)
+		}
+		if s.maxProps != nil && len(x) > *s.maxProps {
+			addErr("must have at most %d properties", *s.maxProps)
+		}
+		for _, name := range s.required {
+			if _, ok := x[name]; !ok {
+				addErr("missing required property %q", name)
+			}
+		}
+		names := make([]string, 0, len(x))
+		for name := range x {
+			names = append(names, name)
+		}
+		sort.Strings(names) // Report errors in a stable order.
+		for _, name := range names {
+			childPath := path + "/" + escapePointerToken(name)
+			if sub, ok := s.properties[name]; ok {
+				sub.validate(x[name], childPath, errs)
+			} else if s.additionalProperties != nil {
+				if s.additionalProperties.always != nil && !*s.additionalProperties.always {
+					addErr("property %q is not allowed", name)
+				} else {
+					s.additionalProperties.validate(x[name], childPath, errs)
+				}
+			}
+		}
+	}
+
+	for _, sub := range s.allOf {
+		sub.validate(v, path, errs)
+	}
+	if s.anyOf != nil && countMatches(s.anyOf, v, path) == 0 {
+		addErr("must match at least one schema in anyOf")
+	}
+	if s.oneOf != nil {
+		if n := countMatches(s.oneOf, v, path); n != 1 {
+			addErr("must match exactly one schema in oneOf, but matches %d", n)
+		}
+	}
+	if s.not != nil && countMatches([]*jsonSchema{s.not}, v, path) == 1 {
+		addErr("must not match the schema in not")
+	}
+}
+
+func countMatches(schemas []*jsonSchema, v any, path string) int {
+	n := 0
+	for _, sub := range schemas {
+		var errs []string
+		sub.validate(v, path, &errs)
+		if len(errs) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func matchesType(v any, types []string) bool {
+	name := jsonTypeName(v)
+	for _, t := range types {
+		if t == name || (t == "number" && name == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonTypeName names v's JSON Schema type, reporting whole numbers as
+// integer.
+func jsonTypeName(v any) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	case json.Number:
+		if f, ok := new(big.Float).SetString(string(x)); ok && f.IsInt() {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func containsJSON(list []any, v any) bool {
+	for _, e := range list {
+		if jsonEqual(e, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func escapePointerToken(token string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+}
+
+// displayPointer shows the root pointer, which is empty, as "/".
+func displayPointer(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
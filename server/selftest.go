@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// --- Self-Test ---
+//
+// GET /kv/_selftest (admin) runs the write-read-delete cycle a client would,
+// against this server's CockroachDB and Redis, and reports each step:
+//
+//	write           append a random value, updating the cache per CACHE_MODE
+//	read            read it back like a GET, from Redis or CockroachDB
+//	delete          append a tombstone
+//	verify_deleted  read CockroachDB and confirm the key is gone
+//	cleanup         remove all but the tombstone from kv_log
+//
+// The probe key lives in the reserved _selftest namespace and is fixed per
+// host, so repeated runs leave one tombstone per server instead of a trail of
+// random keys, and the hydrator's per-key bookkeeping does not grow. Only one
+// run happens at a time, and a result is reused for SELFTEST_INTERVAL so
+// monitors polling often do not turn into a stream of writes. The response
+// is 200 when every step passed and 503 otherwise.
+
+// selftestNamespace holds the probe keys. Registered namespaces cannot start
+// with '_', so it never clashes with one.
+const selftestNamespace = "_selftest"
+
+type selftestStep struct {
+	Name       string  `json:"name"`
+	OK         bool    `json:"ok"`
+	DurationMS float64 `json:"duration_ms"`
+	Detail     string  `json:"detail,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+type selftestResult struct {
+	Status     string         `json:"status"`
+	Key        string         `json:"key"`
+	RanAt      time.Time      `json:"ran_at"`
+	DurationMS float64        `json:"duration_ms"`
+	Cached     bool           `json:"cached"`
+	Steps      []selftestStep `json:"steps"`
+}
+
+// selftest holds the last result; its mutex also serializes runs.
+var selftest struct {
+	sync.Mutex
+	last *selftestResult
+}
+
+// handleSelftest serves GET /kv/_selftest.
+func handleSelftest(w http.ResponseWriter, r *http.Request) {
+	if rejectIfReadOnly(w) {
+		return
+	}
+	selftest.Lock()
+	var result selftestResult
+	if selftest.last != nil && time.Since(selftest.last.RanAt) < time.Duration(cfg.SelftestInterval) {
+		result = *selftest.last
+		result.Cached = true
+	} else {
+		result = runSelftest()
+		selftest.last = &result
+	}
+	selftest.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if result.Status != "pass" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// selftestKey is this host's probe key: its region and hostname.
+func selftestKey() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	if cfg.OriginRegion != "" {
+		return cfg.OriginRegion + "/" + host
+	}
+	return host
+}
+
+// runSelftest runs the steps in order. A failed write or delete ends the run;
+// other failures are reported and the run goes on, so the key is deleted
+// even when it could not be read back. It uses the process context rather
+// than the request's, since the result is shared with later callers.
+func runSelftest() selftestResult {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	value := hex.EncodeToString(buf)
+	result := selftestResult{Status: "pass", Key: selftestKey(), RanAt: time.Now().UTC(), Steps: []selftestStep{}}
+	start := time.Now()
+	step := func(name string, fn func() (string, error)) bool {
+		began := time.Now()
+		detail, err := fn()
+		s := selftestStep{Name: name, OK: err == nil, DurationMS: float64(time.Since(began).Microseconds()) / 1000, Detail: detail}
+		if err != nil {
+			s.Error = err.Error()
+			result.Status = "fail"
+		}
+		result.Steps = append(result.Steps, s)
+		return err == nil
+	}
+	entry := LogEntry{Namespace: selftestNamespace, Key: result.Key, OriginRegion: cfg.OriginRegion}
+
+	if !step("write", func() (string, error) {
+		entry.Value, entry.Timestamp = value, time.Now().UTC()
+		if err := appendToLog(ctx, &entry); err != nil {
+			return "", err
+		}
+		applyWriteToCache(entry)
+		return fmt.Sprintf("version %d", entry.Version), nil
+	}) {
+		return finishSelftest(result, start)
+	}
+	step("read", func() (string, error) {
+		cached, _, hit, err := cacheGet(redisKey(selftestNamespace, result.Key))
+		if hit && cached == value {
+			return "from redis", nil
+		}
+		if hit {
+			return "", fmt.Errorf("redis returned %q, expected %q", cached, value)
+		}
+		latest, dbErr := latestForKey(ctx, selftestNamespace, result.Key, false)
+		switch {
+		case dbErr != nil:
+			return "", dbErr
+		case latest == nil || latest.Deleted || latest.Value != value:
+			return "", fmt.Errorf("cockroachdb did not return the value just written")
+		case err != nil:
+			return "from cockroachdb after a redis error: " + err.Error(), nil
+		}
+		return "from cockroachdb", nil
+	})
+	if !step("delete", func() (string, error) {
+		tombstone := LogEntry{Namespace: selftestNamespace, Key: result.Key, Timestamp: time.Now().UTC(), Deleted: true, OriginRegion: cfg.OriginRegion}
+		if err := appendToLog(ctx, &tombstone); err != nil {
+			return "", err
+		}
+		applyWriteToCache(tombstone)
+		return fmt.Sprintf("version %d", tombstone.Version), nil
+	}) {
+		return finishSelftest(result, start)
+	}
+	step("verify_deleted", func() (string, error) {
+		latest, err := latestForKey(ctx, selftestNamespace, result.Key, false)
+		if err != nil {
+			return "", err
+		}
+		if latest == nil || !latest.Deleted {
+			return "", fmt.Errorf("key is still live")
+		}
+		return "", nil
+	})
+	step("cleanup", func() (string, error) {
+		res, err := db.ExecContext(ctx, `
+    DELETE FROM `+logTable()+`
+    WHERE namespace = $1 AND key = $2 AND id NOT IN (
+        SELECT id FROM `+logTable()+`
+        WHERE namespace = $1 AND key = $2
+        ORDER BY `+newestFirst+`
+        LIMIT 1
+    );
+    `, selftestNamespace, result.Key)
+		if err != nil {
+			return "", err
+		}
+		removed, _ := res.RowsAffected()
+		return fmt.Sprintf("removed %d entries", removed), nil
+	})
+	return finishSelftest(result, start)
+}
+
+func finishSelftest(result selftestResult, start time.Time) selftestResult {
+	result.DurationMS = float64(time.Since(start).Microseconds()) / 1000
+	if result.Status != "pass" {
+		log.Printf("WARNING: Self-test failed: %+v", result.Steps)
+	}
+	return result
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// --- Snapshots ---
+//
+// POST /kv/_snapshot reads many keys as of a single commit timestamp, so a
+// client rebuilding a derived view never sees half of a concurrent update.
+// The body names either explicit keys or a prefix:
+//
+//	{"keys": ["a", "b"]}
+//	{"prefix": "orders/", "cursor": "", "limit": 100}
+//
+// Every query of a request runs in one read-only transaction pinned with
+// SET TRANSACTION AS OF SYSTEM TIME. The response's as_of is that timestamp
+// (an HLC, like the hlc of entries); passing it back as as_of pages through a
+// prefix at the same point in time. Passing it as since returns only keys
+// whose latest entry is newer, tombstones included, which is the delta to
+// apply to a view built from the earlier snapshot.
+
+// snapshotEntry is a key's latest entry as of the snapshot.
+type snapshotEntry struct {
+	Key       string            `json:"key"`
+	Value     string            `json:"value"`
+	Timestamp time.Time         `json:"timestamp"`
+	Deleted   bool              `json:"deleted,omitempty"` // Only with since.
+	Version   int64             `json:"version"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	HLC       json.Number       `json:"hlc,omitempty"`
+}
+
+type snapshotRequest struct {
+	Keys   []string `json:"keys"`
+	Prefix string   `json:"prefix"`
+	Cursor string   `json:"cursor"`
+	Limit  int      `json:"limit"`
+	AsOf   string   `json:"as_of"`
+	Since  string   `json:"since"`
+}
+
+// errSnapshotTooOld is returned for an as_of older than the GC threshold,
+// whose versions CockroachDB may already have removed.
+var errSnapshotTooOld = errors.New("as_of is older than the GC threshold")
+
+// handleSnapshot serves POST /kv/_snapshot?namespace=. An as_of of
+// "resolved" reads at the region's watermark; see watermark.go.
+func handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	namespace, ok := namespaceQuery(r)
+	if !ok {
+		writeError(w, http.StatusNotFound, codeNamespaceNotFound, "Namespace not found")
+		return
+	}
+	var req snapshotRequest
+	if !decodeJSONBody(w, r.Body, &req) {
+		return
+	}
+	watermark := resolvedWatermark()
+	if req.AsOf == asOfResolved {
+		if watermark == "" {
+			writeError(w, http.StatusServiceUnavailable, codeUnavailable, "Service unavailable: no hydrator has recorded a resolved timestamp")
+			return
+		}
+		req.AsOf = watermark
+	}
+	if err := req.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, err.Error())
+		return
+	}
+
+	asOf := req.AsOf
+	if asOf == "" {
+		if err := db.QueryRowContext(r.Context(), `SELECT cluster_logical_timestamp()::STRING`).Scan(&asOf); err != nil {
+			log.Printf("ERROR: Failed to read the cluster timestamp for a snapshot: %v", err)
+			writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+			return
+		}
+	}
+	entries, err := readSnapshot(r.Context(), namespace, asOf, req)
+	switch {
+	case errors.Is(err, errSnapshotTooOld):
+		writeError(w, http.StatusGone, codeSnapshotExpired, "as_of is older than the GC threshold; take a new snapshot")
+		return
+	case err != nil && strings.Contains(err.Error(), "in the future"):
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "as_of must not be in the future")
+		return
+	case err != nil:
+		log.Printf("ERROR: CockroachDB snapshot query as of %s failed: %v", asOf, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+
+	items := make([]snapshotEntry, 0, len(entries))
+	for _, e := range entries {
+		items = append(items, snapshotEntry{
+			Key:       e.Key,
+			Value:     e.Value,
+			Timestamp: e.Timestamp,
+			Deleted:   e.Deleted || e.Expired,
+			Version:   e.Version,
+			Labels:    e.Labels,
+			HLC:       json.Number(e.HLC),
+		})
+	}
+	resp := map[string]any{"as_of": json.Number(asOf), "entries": items, "resolved": watermarkJSON(watermark)}
+	if len(req.Keys) > 0 && req.Since == "" {
+		resp["missing"] = missingKeys(req.Keys, items)
+	} else if len(req.Keys) == 0 {
+		resp["next_cursor"] = nil
+		if len(entries) == clampLimit(req.Limit) {
+			resp["next_cursor"] = entries[len(entries)-1].Key
+		}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (req snapshotRequest) validate() error {
+	if len(req.Keys) > 0 && (req.Prefix != "" || req.Cursor != "") {
+		return errors.New("keys cannot be combined with prefix or cursor")
+	}
+	if len(req.Keys) > maxQueryLimit {
+		return fmt.Errorf("at most %d keys may be read in one snapshot", maxQueryLimit)
+	}
+	for _, ts := range []string{req.AsOf, req.Since} {
+		if ts != "" && !hlcPattern.MatchString(ts) {
+			return fmt.Errorf("%q is not an HLC timestamp", ts)
+		}
+	}
+	if req.AsOf != "" && req.Since != "" && compareHLC(req.Since, req.AsOf) > 0 {
+		return errors.New("since must not be after as_of")
+	}
+	return nil
+}
+
+// readSnapshot returns the latest entries as of asOf: for the requested keys,
+// or one page of keys under the prefix. Without since only live keys are
+// returned; with it, every key whose latest entry is newer than since.
+func readSnapshot(ctx context.Context, namespace, asOf string, req snapshotRequest) ([]LogEntry, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	// asOf matched hlcPattern (or came from CockroachDB), so it is a plain
+	// decimal and safe to inline.
+	if _, err := tx.ExecContext(ctx, `SET TRANSACTION AS OF SYSTEM TIME '`+asOf+`'`); err != nil {
+		return nil, snapshotError(err)
+	}
+
+	var where string
+	var args []any
+	if len(req.Keys) > 0 {
+		args = []any{maxQueryLimit, namespace, pq.Array(req.Keys)}
+		where = "WHERE namespace = $2 AND key = ANY($3)"
+	} else {
+		where, args = keyRangeWhere(namespace, req.Prefix, req.Cursor, []any{clampLimit(req.Limit)})
+	}
+	filter := "NOT deleted AND NOT expired"
+	if req.Since != "" {
+		args = append(args, req.Since)
+		filter = "hlc > $" + strconv.Itoa(len(args)) + "::DECIMAL"
+	}
+	rows, err := tx.QueryContext(ctx, `
+    SELECT * FROM (
+        SELECT DISTINCT ON (key) key, `+entryColumns+` FROM `+logTable()+`
+        `+where+`
+        ORDER BY key, `+newestFirst+`
+    ) AS latest
+    WHERE `+filter+`
+    ORDER BY key
+    LIMIT $1;
+    `, args...)
+	if err != nil {
+		return nil, snapshotError(err)
+	}
+	defer rows.Close()
+	var entries []LogEntry
+	for rows.Next() {
+		entry := LogEntry{Namespace: namespace}
+		if err := scanEntry(keyedRow{rows, &entry.Key}, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, snapshotError(err)
+	}
+	return entries, tx.Commit()
+}
+
+// snapshotError maps CockroachDB's rejection of a timestamp below the GC
+// threshold to errSnapshotTooOld.
+func snapshotError(err error) error {
+	if strings.Contains(err.Error(), "GC threshold") {
+		return errSnapshotTooOld
+	}
+	return err
+}
+
+// missingKeys lists the requested keys without an entry in items: keys that
+// did not exist, were deleted or had expired as of the snapshot.
+func missingKeys(keys []string, items []snapshotEntry) []string {
+	found := make(map[string]bool, len(items))
+	for _, item := range items {
+		found[item.Key] = true
+	}
+	missing := []string{}
+	for _, key := range keys {
+		if !found[key] {
+			missing = append(missing, key)
+			found[key] = true // Report duplicates once.
+		}
+	}
+	return missing
+}
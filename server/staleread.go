@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// --- Stale Reads During Outages ---
+//
+// A GET whose CockroachDB read fails, whether the circuit breaker is open or
+// the query itself failed, normally answers 503 or 500 even when Redis still
+// holds a value for the key: the cache was skipped because it is bypassed
+// while the hydrator lags, or the key was missing a moment ago and has been
+// filled since. With SERVE_STALE_ON_OUTAGE set, such a GET looks in the cache
+// once more and serves what it finds, marked with X-Stale: true and a
+// Warning header, since the value may trail writes the database already
+// holds. Callers that need fresh data opt out per request with
+// Cache-Control: no-cache, and version 2 responses, which need metadata the
+// cache lacks, never fall back.
+
+var staleReads = expvar.NewInt("stale_reads_total")
+
+// serveStale answers a GET whose database read failed with err from the
+// cache, reporting whether it did.
+func serveStale(w http.ResponseWriter, r *http.Request, namespace, key string, err error) bool {
+	if !cfg.ServeStaleOnOutage || needsEntryMetadata(r) || r.Context().Err() != nil {
+		return false
+	}
+	if strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+		return false
+	}
+	val, version, hit, cacheErr := cacheLookup(redisKey(namespace, key))
+	if cacheErr != nil {
+		redisErrors.Add(1)
+		return false
+	}
+	if !hit {
+		return false
+	}
+	staleReads.Add(1)
+	reason := "query failed"
+	if errors.Is(err, errDBUnavailable) {
+		reason = "unavailable"
+	}
+	log.Printf("WARNING: Serving possibly stale cached value of key '%s': CockroachDB %s: %v", key, reason, err)
+	w.Header().Set("X-Stale", "true")
+	w.Header().Set("Warning", `110 - "Response is Stale"`)
+	setReadSource(w, sourceRedis)
+	writeValue(w, r, key, val, version)
+	return true
+}
@@ -0,0 +1,34 @@
+package main
+
+// --- Storage Modes ---
+//
+// By default every write appends to kv_log, and reads pick a key's newest
+// entry. With STORAGE_MODE=upsert, writes UPSERT the key's single row in
+// kv_current instead, whose primary key is (namespace, key), so a read is a
+// point lookup and a key's history never accumulates. kv_current has the same
+// columns as kv_log, and every query reads and writes whichever table
+// logTable names, so the rest of the API behaves the same over a history
+// one entry long. The mode must be the same for every server and hydrator on
+// a cluster; data written in one mode is not visible in the other.
+
+const (
+	storageLog    = "log"
+	storageUpsert = "upsert"
+)
+
+// logTable is the table entries are written to and read from.
+func logTable() string {
+	if cfg.StorageMode == storageUpsert {
+		return "kv_current"
+	}
+	return "kv_log"
+}
+
+// writeVerb starts the statements that write an entry: appending to kv_log,
+// or replacing the key's row in kv_current.
+func writeVerb() string {
+	if cfg.StorageMode == storageUpsert {
+		return "UPSERT INTO " + logTable()
+	}
+	return "INSERT INTO " + logTable()
+}
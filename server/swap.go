@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// --- Swap ---
+//
+// POST /kv/_swap exchanges the values of two keys of one namespace in a
+// single transaction, for pairs such as active/standby pointers that must
+// never both name the same thing. Both keys are locked with lockLatestEntry,
+// in key order so two swaps of the same pair cannot deadlock, and each new
+// entry is conditioned on the version read, like a PATCH. A value moves with
+// its value type; labels and home regions stay with their keys, and neither
+// new entry expires. A key that is missing, deleted or expired gets 404 by
+// default; with "missing": "empty" it counts as the empty string, which
+// ALLOW_EMPTY_VALUES must then accept. Aliases cannot be swapped.
+//
+// Reads from CockroachDB, snapshots included, see both keys change at once.
+// The cache is updated per key as for any other write, so a cached read may
+// briefly see one side of the swap before the other.
+
+const (
+	swapMissingError = "error"
+	swapMissingEmpty = "empty"
+)
+
+var (
+	// errSwapAlias is returned when either key of a swap is an alias.
+	errSwapAlias = errors.New("aliases cannot be swapped")
+	// errSwapEmpty is returned when a swap would write the empty string
+	// without ALLOW_EMPTY_VALUES.
+	errSwapEmpty = errors.New("value must not be empty")
+)
+
+// errSwapMissing names the key of a swap that has no live value.
+type errSwapMissing struct {
+	key string
+}
+
+func (e *errSwapMissing) Error() string {
+	return "key " + e.key + " has no live value"
+}
+
+type swapRequest struct {
+	KeyA    string `json:"key_a"`
+	KeyB    string `json:"key_b"`
+	Missing string `json:"missing"`
+}
+
+// swapResponse holds the entries written for each key.
+type swapResponse struct {
+	KeyA *LogEntry `json:"key_a"`
+	KeyB *LogEntry `json:"key_b"`
+}
+
+// handleSwap serves POST /kv/_swap with a body of
+// {"key_a": ..., "key_b": ..., "missing": "error"|"empty"}, in the namespace
+// given by ?namespace=.
+func handleSwap(w http.ResponseWriter, r *http.Request) {
+	if rejectIfReadOnly(w) {
+		return
+	}
+	namespace, ok := namespaceQuery(r)
+	if !ok {
+		writeError(w, http.StatusNotFound, codeNamespaceNotFound, "Unknown namespace")
+		return
+	}
+	var payload swapRequest
+	if !decodeJSONBody(w, r.Body, &payload) {
+		return
+	}
+	if payload.Missing == "" {
+		payload.Missing = swapMissingError
+	}
+	switch {
+	case payload.KeyA == "" || payload.KeyB == "":
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "key_a and key_b are required")
+		return
+	case payload.KeyA == payload.KeyB:
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "key_a and key_b must differ")
+		return
+	case payload.Missing != swapMissingError && payload.Missing != swapMissingEmpty:
+		writeError(w, http.StatusBadRequest, codeValidationFailed, `missing must be "error" or "empty"`)
+		return
+	}
+
+	resp, err := swapKeys(r.Context(), namespace, payload)
+	var homed *errHomedElsewhere
+	var missing *errSwapMissing
+	var schemaErr *schemaValidationError
+	var quotaErr *errQuotaExceeded
+	switch {
+	case errors.As(err, &homed):
+		writeMisdirected(w, homed.key, homed.home)
+		return
+	case errors.As(err, &missing):
+		writeErrorDetails(w, http.StatusNotFound, codeKeyNotFound, "Key not found", map[string]any{"key": missing.key})
+		return
+	case errors.Is(err, errSwapEmpty):
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "Bad request: value must not be empty")
+		return
+	case errors.Is(err, errSwapAlias):
+		writeError(w, http.StatusConflict, codeConflict, "Conflict: aliases cannot be swapped")
+		return
+	case errors.As(err, &schemaErr):
+		writeSchemaValidationError(w, schemaErr)
+		return
+	case errors.As(err, &quotaErr):
+		writeQuotaExceeded(w, quotaErr)
+		return
+	case errors.Is(err, errVersionConflict):
+		writeError(w, http.StatusConflict, codeWriteConflict, "Conflict: keys kept changing, retry the swap")
+		return
+	case err != nil:
+		log.Printf("ERROR: Failed to swap keys '%s' and '%s' in CockroachDB: %v", payload.KeyA, payload.KeyB, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	applyWriteToCache(*resp.KeyA)
+	applyWriteToCache(*resp.KeyB)
+	log.Printf("SWAP successful in namespace '%s' for keys: %s (version %d), %s (version %d)", namespace, payload.KeyA, resp.KeyA.Version, payload.KeyB, resp.KeyB.Version)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// swapKeys exchanges the values of the two keys of req, retrying when a
+// concurrent write lands between the reads and the appends.
+func swapKeys(ctx context.Context, namespace string, req swapRequest) (swapResponse, error) {
+	var err error
+	for attempt := 0; attempt < 5; attempt++ {
+		var resp swapResponse
+		resp, err = trySwapKeys(ctx, namespace, req)
+		if !errors.Is(err, errVersionConflict) {
+			return resp, err
+		}
+	}
+	return swapResponse{}, err
+}
+
+func trySwapKeys(ctx context.Context, namespace string, req swapRequest) (swapResponse, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return swapResponse{}, err
+	}
+	defer tx.Rollback()
+
+	keys := []string{req.KeyA, req.KeyB}
+	slices.Sort(keys)
+	current := make(map[string]LogEntry, 2)
+	for _, key := range keys {
+		entry, err := lockLatestEntry(ctx, tx, namespace, key)
+		if err != nil && !errors.Is(err, errKeyNotFound) {
+			return swapResponse{}, err
+		}
+		if isHomedElsewhere(entry.HomeRegion) {
+			return swapResponse{}, &errHomedElsewhere{key: key, home: entry.HomeRegion}
+		}
+		if errors.Is(err, errKeyNotFound) || entry.Expired {
+			if req.Missing != swapMissingEmpty {
+				return swapResponse{}, &errSwapMissing{key: key}
+			}
+			// The value counts as empty; the version still conditions the
+			// append.
+			entry = LogEntry{Namespace: namespace, Key: key, Version: entry.Version, Labels: entry.Labels}
+		}
+		if isAlias(&entry) {
+			return swapResponse{}, errSwapAlias
+		}
+		current[key] = entry
+	}
+
+	now := time.Now().UTC()
+	written := make(map[string]*LogEntry, 2)
+	for _, key := range keys {
+		other := req.KeyA
+		if key == req.KeyA {
+			other = req.KeyB
+		}
+		source := current[other]
+		if source.Value == "" && !cfg.AllowEmptyValues {
+			return swapResponse{}, errSwapEmpty
+		}
+		if err := validateValue(namespace, key, source.Value); err != nil {
+			return swapResponse{}, err
+		}
+		entry := &LogEntry{
+			Namespace:    namespace,
+			Key:          key,
+			Value:        source.Value,
+			Timestamp:    now,
+			OriginRegion: cfg.OriginRegion,
+			Labels:       current[key].Labels,
+			ValueType:    source.ValueType,
+		}
+		version := current[key].Version
+		if err := insertLogEntry(ctx, tx, entry, &version); err != nil {
+			return swapResponse{}, err
+		}
+		if err := pruneVersions(ctx, tx, namespace, key); err != nil {
+			return swapResponse{}, err
+		}
+		written[key] = entry
+	}
+	if err := tx.Commit(); err != nil {
+		if isWriteConflict(err) {
+			return swapResponse{}, errVersionConflict
+		}
+		return swapResponse{}, err
+	}
+	return swapResponse{KeyA: written[req.KeyA], KeyB: written[req.KeyB]}, nil
+}
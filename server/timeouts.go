@@ -0,0 +1,63 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// --- Statement Timeout ---
+//
+// Context timeouts such as DB_READ_TIMEOUT only stop the server waiting; the
+// statement keeps running in CockroachDB. DB_STATEMENT_TIMEOUT is set as the
+// session's statement_timeout on every pooled connection, so CockroachDB
+// itself cancels a runaway statement, such as a scan over a huge prefix.
+// Work that legitimately runs longer, like schema migrations, uses
+// withStatementTimeout.
+
+// statementTimeoutDSN adds statement_timeout to the connection's startup
+// options. It accepts both URL and key=value connection strings, keeping any
+// options already present.
+func statementTimeoutDSN(dsn string, timeout time.Duration) (string, error) {
+	if timeout <= 0 {
+		return dsn, nil
+	}
+	option := fmt.Sprintf("-c statement_timeout=%d", timeout.Milliseconds())
+	if !strings.HasPrefix(dsn, "postgres://") && !strings.HasPrefix(dsn, "postgresql://") {
+		if strings.Contains(dsn, "options=") {
+			return "", fmt.Errorf("cannot add statement_timeout to a key=value connection string that already sets options")
+		}
+		return strings.TrimSpace(dsn + " options='" + option + "'"), nil
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	if existing := query.Get("options"); existing != "" {
+		option = existing + " " + option
+	}
+	query.Set("options", option)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// withStatementTimeout runs fn on a dedicated connection whose
+// statement_timeout is timeout instead of DB_STATEMENT_TIMEOUT; 0 lifts the
+// limit. The connection is discarded afterwards rather than returned to the
+// pool, so the changed setting never reaches other queries.
+func withStatementTimeout(timeout time.Duration, fn func(conn *sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer conn.Raw(func(any) error { return driver.ErrBadConn })
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("SET statement_timeout = %d", timeout.Milliseconds())); err != nil {
+		return err
+	}
+	return fn(conn)
+}
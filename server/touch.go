@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// --- Touch ---
+//
+// POST /kv/{key}/_touch?ttl=30s extends a key's expiry without the client
+// rewriting its value, for sliding-expiration sessions that touch a key on
+// every use. The expiry is part of the log, as an entry's ttl_seconds counted
+// from its timestamp, so touching appends a copy of the key's latest entry,
+// written now with the new ttl_seconds, in the transaction that read it and
+// conditioned on the version read, like a restore. The value, labels, value
+// type and alias target are kept; the version goes up by one. A key that is
+// missing, deleted or already expired gets 404: an expired value is gone
+// even before the expirer tombstones it, and touching cannot bring it back.
+// POST /kv/_batch/touch does the same for a list of keys in one transaction.
+//
+// The cache is updated right away rather than through the changefeed, so a
+// touched key cannot expire from Redis while the hydrator catches up: the
+// cached key's expiry is reset with EXPIRE, and a key that is not cached is
+// cached afresh. With CACHE_MODE=invalidate the key is dropped instead, like
+// after any write.
+
+// parseTouchTTL parses the ttl query parameter of a touch, a duration such as
+// 30s or 15m, rounded up to whole seconds.
+func parseTouchTTL(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	ttl, err := time.ParseDuration(r.URL.Query().Get("ttl"))
+	if err != nil || ttl <= 0 {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, "ttl must be a positive duration such as 30s")
+		return 0, false
+	}
+	return int64((ttl + time.Second - 1) / time.Second), true
+}
+
+// handleTouch serves POST /kv/{key}/_touch?ttl=.
+func handleTouch(w http.ResponseWriter, r *http.Request) {
+	if rejectIfReadOnly(w) {
+		return
+	}
+	ttlSeconds, ok := parseTouchTTL(w, r)
+	if !ok {
+		return
+	}
+	namespace, key := requestKey(r)
+	_, entries, err := touchKeys(r.Context(), namespace, []string{key}, ttlSeconds)
+	if !writeTouchError(w, err, 1) {
+		return
+	}
+	if len(entries) == 0 {
+		writeError(w, http.StatusNotFound, codeKeyNotFound, "Key not found")
+		return
+	}
+	touchCache(entries[0])
+	log.Printf("TOUCH successful for key: %s (version %d, ttl %ds)", key, entries[0].Version, ttlSeconds)
+	json.NewEncoder(w).Encode(entries[0])
+}
+
+// batchTouchResponse lists which of the requested keys were touched and
+// which were missing, deleted or expired.
+type batchTouchResponse struct {
+	Touched  []string `json:"touched"`
+	NotFound []string `json:"not_found"`
+}
+
+// handleBatchTouch serves POST /kv/_batch/touch?ttl= with a body of
+// {"keys": [...]}, in the namespace given by ?namespace=.
+func handleBatchTouch(w http.ResponseWriter, r *http.Request) {
+	if rejectIfReadOnly(w) {
+		return
+	}
+	namespace, ok := namespaceQuery(r)
+	if !ok {
+		writeError(w, http.StatusNotFound, codeNamespaceNotFound, "Unknown namespace")
+		return
+	}
+	ttlSeconds, ok := parseTouchTTL(w, r)
+	if !ok {
+		return
+	}
+	var payload struct {
+		Keys []string `json:"keys"`
+	}
+	if !decodeJSONBody(w, r.Body, &payload) {
+		return
+	}
+	keys, err := batchKeys(payload.Keys)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeValidationFailed, err.Error())
+		return
+	}
+
+	resp, entries, err := touchKeys(r.Context(), namespace, keys, ttlSeconds)
+	if !writeTouchError(w, err, len(keys)) {
+		return
+	}
+	for _, entry := range entries {
+		touchCache(entry)
+	}
+	log.Printf("Batch TOUCH successful in namespace '%s': %d touched, %d not found (ttl %ds)", namespace, len(resp.Touched), len(resp.NotFound), ttlSeconds)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// writeTouchError answers a touch of n keys that failed with err, reporting
+// whether err was nil and the caller should go on.
+func writeTouchError(w http.ResponseWriter, err error, n int) bool {
+	var homed *errHomedElsewhere
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &homed):
+		writeMisdirected(w, homed.key, homed.home)
+	case errors.Is(err, errVersionConflict):
+		writeError(w, http.StatusConflict, codeWriteConflict, "Conflict: keys kept changing, retry the touch")
+	default:
+		log.Printf("ERROR: Failed to write touch of %d keys to CockroachDB: %v", n, err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+	}
+	return false
+}
+
+// touchKeys re-appends the latest entry of every live key of keys with
+// ttlSeconds in one transaction, retrying when a concurrent writer changes
+// one of them. It returns the entries it wrote, for the caller to apply to
+// the cache.
+func touchKeys(ctx context.Context, namespace string, keys []string, ttlSeconds int64) (batchTouchResponse, []LogEntry, error) {
+	var err error
+	for attempt := 0; attempt < 5; attempt++ {
+		var resp batchTouchResponse
+		var entries []LogEntry
+		resp, entries, err = tryTouchKeys(ctx, namespace, keys, ttlSeconds)
+		if !errors.Is(err, errVersionConflict) {
+			return resp, entries, err
+		}
+	}
+	return batchTouchResponse{}, nil, err
+}
+
+func tryTouchKeys(ctx context.Context, namespace string, keys []string, ttlSeconds int64) (batchTouchResponse, []LogEntry, error) {
+	resp := batchTouchResponse{Touched: []string{}, NotFound: []string{}}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return resp, nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	var entries []LogEntry
+	for _, key := range keys {
+		current, err := lockLatestEntry(ctx, tx, namespace, key)
+		if errors.Is(err, errKeyNotFound) || (err == nil && current.Expired) {
+			resp.NotFound = append(resp.NotFound, key)
+			continue
+		}
+		if err != nil {
+			return resp, nil, err
+		}
+		if isHomedElsewhere(current.HomeRegion) {
+			return resp, nil, &errHomedElsewhere{key: key, home: current.HomeRegion}
+		}
+		entry := LogEntry{
+			Namespace:    namespace,
+			Key:          key,
+			Value:        current.Value,
+			Timestamp:    now,
+			OriginRegion: cfg.OriginRegion,
+			TTLSeconds:   ttlSeconds,
+			Labels:       current.Labels,
+			ValueType:    current.ValueType,
+			TargetKey:    current.TargetKey,
+		}
+		if err := insertLogEntry(ctx, tx, &entry, &current.Version); err != nil {
+			return resp, nil, err
+		}
+		if err := pruneVersions(ctx, tx, namespace, key); err != nil {
+			return resp, nil, err
+		}
+		entries = append(entries, entry)
+		resp.Touched = append(resp.Touched, key)
+	}
+	if err := tx.Commit(); err != nil {
+		if isWriteConflict(err) {
+			return resp, nil, errVersionConflict
+		}
+		return resp, nil, err
+	}
+	return resp, entries, nil
+}
+
+// touchCache applies a touch to Redis: the cached key gets the new entry's
+// expiry and version, and a key that is not cached is cached with them.
+func touchCache(entry LogEntry) {
+	if activeCacheMode == cacheModeInvalidate {
+		applyWriteToCache(entry)
+		return
+	}
+	expiry, live := cacheExpiry(entry)
+	if !live {
+		return
+	}
+	cacheKey := redisKey(entry.Namespace, entry.Key)
+	extended, err := redisClient.Expire(ctx, cacheKey, expiry).Result()
+	if err == nil && extended {
+		err = redisClient.HSet(ctx, versionsHashKey(), cacheKey, entry.Version).Err()
+	} else if err == nil {
+		err = cacheSet(entry)
+	}
+	if err != nil {
+		redisErrors.Add(1)
+		log.Printf("ERROR: Failed to apply touch to the cache for key '%s': %v", entry.Key, err)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// --- Versioning ---
+//
+// Every write to a key, deletes included, is assigned the next version:
+// one more than the highest version already logged for the key (0 if none).
+// The unique index on (namespace, key, version) makes two concurrent writers unable to
+// claim the same version; the loser sees errVersionConflict.
+
+var (
+	errVersionConflict = errors.New("version conflict")
+	errKeyNotFound     = errors.New("key not found")
+	errValueMismatch   = errors.New("current value does not match the expected value")
+	errKeyExists       = errors.New("key already exists")
+)
+
+// sqlQuerier is satisfied by both *sql.DB and *sql.Tx.
+type sqlQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// insertLogEntry appends entry using q, which may be the pool or a
+// transaction, and sets entry.Version. With expectedVersion set, the insert
+// only happens if the key's current version equals it; otherwise, and when a
+// concurrent writer wins the race, it returns errVersionConflict. A write
+// that would exceed its namespace's quota returns an *errQuotaExceeded.
+func insertLogEntry(ctx context.Context, q sqlQuerier, entry *LogEntry, expectedVersion *int64) error {
+	if err := checkQuota(ctx, q, entry); err != nil {
+		return err
+	}
+	err := q.QueryRowContext(ctx, `
+    WITH previous AS (
+        SELECT namespace, key, deleted, value FROM `+logTable()+`
+        WHERE namespace = $8 AND key = $1
+        ORDER BY `+newestFirst+`
+        LIMIT 1
+    ), written AS (
+        `+writeVerb()+` (namespace, key, value, timestamp, deleted, origin_region, ttl_seconds, labels, version, hlc, home_region, value_type, numeric_value, target_key)
+        SELECT $8, $1, $2, $3, $4, $5, $7, $9::JSONB, current + 1, cluster_logical_timestamp(),
+            NULLIF(coalesce($10::STRING, (`+latestHomeRegionQuery("$8", "$1")+`)), ''), $11, $12::DECIMAL, $13
+        FROM (SELECT coalesce(max(version), 0) AS current FROM `+logTable()+` WHERE namespace = $8 AND key = $1) AS latest
+        WHERE $6::INT8 IS NULL OR current = $6::INT8
+        RETURNING namespace, key, deleted, value, version, coalesce(home_region, '') AS home_region
+    ), `+usageUpdateSQL()+`
+    SELECT version, home_region FROM written, (SELECT count(*) FROM usage) AS applied;
+    `, entry.Key, entry.Value, entry.Timestamp, entry.Deleted, nullIfEmpty(entry.OriginRegion), expectedVersion, nullIfZero(entry.TTLSeconds), entry.Namespace, labelsParam(entry.Labels), homeRegionParam(entry), nullIfEmpty(entry.ValueType), numericParam(entry), nullIfEmpty(entry.TargetKey)).Scan(&entry.Version, &entry.HomeRegion)
+	if err == sql.ErrNoRows || isWriteConflict(err) {
+		return errVersionConflict
+	}
+	return err
+}
+
+// writeLogEntry is insertLogEntry on the pool. With MAX_VERSIONS_PER_KEY set
+// it runs in a transaction that also prunes the key's oldest versions.
+func writeLogEntry(ctx context.Context, entry *LogEntry, expectedVersion *int64) error {
+	if cfg.MaxVersionsPerKey <= 0 {
+		return insertLogEntry(ctx, db, entry, expectedVersion)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := insertLogEntry(ctx, tx, entry, expectedVersion); err != nil {
+		return err
+	}
+	if err := pruneVersions(ctx, tx, entry.Namespace, entry.Key); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		if isWriteConflict(err) {
+			return errVersionConflict
+		}
+		return err
+	}
+	return nil
+}
+
+// pruneVersions deletes all but the newest MAX_VERSIONS_PER_KEY entries of
+// key, sparing those RETENTION_MAX_AGE still keeps; see retention.go. Callers
+// run it in the transaction that appended the newest entry, so the latest
+// state is never pruned. It does nothing when no cap is set.
+func pruneVersions(ctx context.Context, q sqlQuerier, namespace, key string) error {
+	if cfg.MaxVersionsPerKey <= 0 {
+		return nil
+	}
+	args := []any{namespace, key, cfg.MaxVersionsPerKey}
+	olderThan := ""
+	if cutoff, ok := retentionCutoff(); ok {
+		args = append(args, cutoff)
+		olderThan = " AND timestamp < $4"
+	}
+	_, err := q.ExecContext(ctx, `
+    DELETE FROM `+logTable()+`
+    WHERE namespace = $1 AND key = $2`+olderThan+` AND id NOT IN (
+        SELECT id FROM `+logTable()+`
+        WHERE namespace = $1 AND key = $2
+        ORDER BY `+newestFirst+`
+        LIMIT $3
+    );
+    `, args...)
+	return err
+}
+
+// lockLatestEntry reads the latest entry of key inside tx and locks it for
+// the rest of the transaction. It returns errKeyNotFound when the key is
+// missing or deleted.
+func lockLatestEntry(ctx context.Context, tx *sql.Tx, namespace, key string) (LogEntry, error) {
+	current := LogEntry{Namespace: namespace, Key: key}
+	err := scanEntry(tx.QueryRowContext(ctx, `
+    SELECT `+entryColumns+` FROM `+logTable()+`
+    WHERE namespace = $1 AND key = $2
+    ORDER BY `+newestFirst+`
+    LIMIT 1
+    FOR UPDATE;
+    `, namespace, key), &current)
+	if err == sql.ErrNoRows || (err == nil && current.Deleted) {
+		return current, errKeyNotFound
+	}
+	return current, err
+}
+
+// deleteIfValue appends a tombstone for key only if its latest value equals
+// expected. Like a PATCH, the check and the append share a transaction and
+// the append is conditioned on the version that was read; if another write
+// lands in between, the check is retried against the newer value. It returns
+// errKeyNotFound or errValueMismatch when the condition fails.
+func deleteIfValue(ctx context.Context, namespace, key, expected string) (*LogEntry, error) {
+	var err error
+	for attempt := 0; attempt < 5; attempt++ {
+		var entry *LogEntry
+		entry, err = tryDeleteIfValue(ctx, namespace, key, expected)
+		if !errors.Is(err, errVersionConflict) {
+			return entry, err
+		}
+	}
+	return nil, err
+}
+
+func tryDeleteIfValue(ctx context.Context, namespace, key, expected string) (*LogEntry, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	current, err := lockLatestEntry(ctx, tx, namespace, key)
+	if err != nil {
+		return nil, err
+	}
+	if current.Value != expected {
+		return nil, errValueMismatch
+	}
+	entry := &LogEntry{
+		Namespace:    namespace,
+		Key:          key,
+		Timestamp:    time.Now().UTC(),
+		Deleted:      true,
+		OriginRegion: cfg.OriginRegion,
+	}
+	if err := insertLogEntry(ctx, tx, entry, &current.Version); err != nil {
+		return nil, err
+	}
+	if err := pruneVersions(ctx, tx, namespace, key); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		if isWriteConflict(err) {
+			return nil, errVersionConflict
+		}
+		return nil, err
+	}
+	return entry, nil
+}
+
+// putIfAbsent appends entry only if its key has no live value: it was never
+// written, or its latest entry is a tombstone. The append is conditioned on
+// the version that was read, so of several concurrent creators exactly one
+// succeeds; the others retry, find the key live and get errKeyExists.
+func putIfAbsent(ctx context.Context, entry *LogEntry) error {
+	var err error
+	for attempt := 0; attempt < 5; attempt++ {
+		if err = tryPutIfAbsent(ctx, entry); !errors.Is(err, errVersionConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+func tryPutIfAbsent(ctx context.Context, entry *LogEntry) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, err := lockLatestEntry(ctx, tx, entry.Namespace, entry.Key)
+	if err == nil {
+		return errKeyExists
+	}
+	if !errors.Is(err, errKeyNotFound) {
+		return err
+	}
+	if err := insertLogEntry(ctx, tx, entry, &current.Version); err != nil {
+		return err
+	}
+	if err := pruneVersions(ctx, tx, entry.Namespace, entry.Key); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		if isWriteConflict(err) {
+			return errVersionConflict
+		}
+		return err
+	}
+	return nil
+}
+
+// expectedValue reads the optional expected value of a conditional DELETE,
+// from the expected_value query parameter or else the X-Expected-Value
+// header. It reports false when neither is present.
+func expectedValue(r *http.Request) (string, bool) {
+	if query := r.URL.Query(); query.Has("expected_value") {
+		return query.Get("expected_value"), true
+	}
+	if values := r.Header.Values("X-Expected-Value"); len(values) > 0 {
+		return values[0], true
+	}
+	return "", false
+}
+
+// isWriteConflict reports whether err means another writer claimed the
+// version first: a violation of idx_namespace_key_version, or a serialization failure
+// that CockroachDB could not retry itself inside an explicit transaction.
+func isWriteConflict(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && (pqErr.Code == "23505" || pqErr.Code == "40001")
+}
+
+// parseIfMatch reads an optional numeric If-Match header. Quotes are
+// tolerated so ETag-style "3" works too. It reports false for malformed values.
+func parseIfMatch(r *http.Request) (*int64, bool) {
+	raw := strings.TrimSpace(r.Header.Get("If-Match"))
+	if raw == "" {
+		return nil, true
+	}
+	version, err := strconv.ParseInt(strings.Trim(raw, `"`), 10, 64)
+	if err != nil || version < 0 {
+		return nil, false
+	}
+	return &version, true
+}
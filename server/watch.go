@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Watch ---
+//
+// GET /kv/_watch?namespace=&prefix= streams a prefix as Server-Sent Events so
+// a client can maintain a materialized view: one "snapshot" event per live
+// key, a "ready" event, then a "change" event for every later write under the
+// prefix, deletes included. Changes come from the hydrator, which publishes
+// each event it applies to this region's cache on changesChannel.
+//
+// The subscription is confirmed before the snapshot is read, so a write
+// landing in between is delivered as a change even if the snapshot already
+// saw it. Such duplicates are dropped by commit timestamp (see hlc.go): a
+// change no newer than what the stream has already sent for its key is
+// skipped. Changes are buffered per stream up to WATCH_BUFFER_SIZE; a client
+// that falls further behind gets an "overflow" event and is disconnected, and
+// must reconnect to resynchronize.
+
+// changesChannel is the Redis Pub/Sub channel the hydrator publishes applied
+// changes on.
+func changesChannel() string {
+	return cfg.RedisKeyPrefix + "kv:changes"
+}
+
+// watchHeartbeatInterval spaces SSE comments on idle streams, so proxies and
+// clients can tell a quiet stream from a dead one.
+const watchHeartbeatInterval = 15 * time.Second
+
+var (
+	watchStreams   = expvar.NewInt("watch_streams")
+	watchOverflows = expvar.NewInt("watch_overflows_total")
+)
+
+// watchEvent is the data of snapshot and change events.
+type watchEvent struct {
+	Key       string            `json:"key"`
+	Value     string            `json:"value"`
+	Timestamp time.Time         `json:"timestamp"`
+	Deleted   bool              `json:"deleted"`
+	Version   int64             `json:"version,omitempty"` // Changes only.
+	Labels    map[string]string `json:"labels,omitempty"`
+	// HLC is the commit timestamp, sent as a JSON number; see hlc.go.
+	HLC json.Number `json:"hlc,omitempty"`
+}
+
+// handleWatch serves GET /kv/_watch?namespace=&prefix=.
+func handleWatch(w http.ResponseWriter, r *http.Request) {
+	namespace, ok := namespaceQuery(r)
+	if !ok {
+		writeError(w, http.StatusNotFound, codeNamespaceNotFound, "Namespace not found")
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+
+	sub := redisClient.Subscribe(r.Context(), changesChannel())
+	defer sub.Close()
+	if _, err := sub.Receive(r.Context()); err != nil {
+		redisErrors.Add(1)
+		log.Printf("ERROR: Failed to subscribe to %s for watch on prefix '%s': %v", changesChannel(), prefix, err)
+		writeError(w, http.StatusServiceUnavailable, codeUnavailable, "Change notifications unavailable")
+		return
+	}
+	changes := make(chan watchEvent, cfg.WatchBufferSize)
+	var overflowed atomic.Bool
+	go forwardChanges(r.Context(), sub, namespace, prefix, changes, &overflowed)
+
+	watchStreams.Add(1)
+	defer watchStreams.Add(-1)
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{}) // The stream outlives WRITE_TIMEOUT.
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	sent := map[string]watchEvent{}
+	cursor := ""
+	for {
+		entries, err := liveKeysByPrefix(r.Context(), namespace, prefix, cursor, nil, maxQueryLimit)
+		if err != nil {
+			log.Printf("ERROR: CockroachDB list query failed for watch on prefix '%s': %v", prefix, err)
+			writeSSE(w, rc, "error", map[string]string{"error": "snapshot failed"})
+			return
+		}
+		for _, e := range entries {
+			snapshot := watchEvent{Key: e.Key, Value: e.Value, Timestamp: e.Timestamp, Labels: e.Labels, HLC: json.Number(e.HLC)}
+			sent[e.Key] = snapshot
+			if writeSSE(w, rc, "snapshot", snapshot) != nil {
+				return
+			}
+		}
+		if len(entries) < maxQueryLimit {
+			break
+		}
+		cursor = entries[len(entries)-1].Key
+	}
+	if writeSSE(w, rc, "ready", map[string]int{"keys": len(sent)}) != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(watchHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case change, ok := <-changes:
+			if !ok {
+				if overflowed.Load() {
+					watchOverflows.Add(1)
+					log.Printf("WARNING: Watch on prefix '%s' fell more than %d changes behind; disconnecting.", prefix, cfg.WatchBufferSize)
+					writeSSE(w, rc, "overflow", map[string]int{"buffer_size": cfg.WatchBufferSize})
+				}
+				return
+			}
+			if last, seen := sent[change.Key]; seen && !change.newerThan(last) {
+				continue
+			}
+			sent[change.Key] = change
+			if writeSSE(w, rc, "change", change) != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// newerThan reports whether e was committed after last. Rows written before
+// hlc was recorded have none and are older than every row that has one;
+// among themselves they fall back to timestamps.
+func (e watchEvent) newerThan(last watchEvent) bool {
+	switch {
+	case e.HLC != "" && last.HLC != "":
+		return compareHLC(string(e.HLC), string(last.HLC)) > 0
+	case e.HLC != "" || last.HLC != "":
+		return e.HLC != ""
+	}
+	return e.Timestamp.After(last.Timestamp)
+}
+
+// forwardChanges relays published changes under prefix into changes until
+// the subscription fails or the request ends. When the buffer is full it sets
+// overflowed instead of blocking. It closes changes on return.
+func forwardChanges(ctx context.Context, sub *redis.PubSub, namespace, prefix string, changes chan<- watchEvent, overflowed *atomic.Bool) {
+	defer close(changes)
+	for {
+		msg, err := sub.ReceiveMessage(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				redisErrors.Add(1)
+				log.Printf("ERROR: Watch subscription on prefix '%s' failed: %v", prefix, err)
+			}
+			return
+		}
+		var change struct {
+			Namespace string `json:"namespace"`
+			watchEvent
+		}
+		if err := json.Unmarshal([]byte(msg.Payload), &change); err != nil {
+			log.Printf("WARNING: Ignoring malformed change notification: %v", err)
+			continue
+		}
+		if change.Namespace == "" {
+			change.Namespace = defaultNamespace // Written before namespaces existed.
+		}
+		if change.Namespace != namespace || !strings.HasPrefix(change.Key, prefix) {
+			continue
+		}
+		select {
+		case changes <- change.watchEvent:
+		default:
+			overflowed.Store(true)
+			return
+		}
+	}
+}
+
+// writeSSE sends one Server-Sent Event with data encoded as JSON.
+func writeSSE(w http.ResponseWriter, rc *http.ResponseController, event string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
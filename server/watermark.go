@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Resolved Watermark ---
+//
+// The hydrators save every resolved timestamp of their changefeed in Redis
+// as their cursor, after applying every event before it, so the oldest cursor
+// of the region is a watermark: every write committed at or before it is in
+// this region's cache. GET /kv/_resolved returns it, and /kv/_changes and
+// /kv/_snapshot return it as resolved next to their results, so a consumer
+// building a derived view knows how far the cache has caught up. A snapshot
+// taken with "as_of": "resolved" reads the log at the watermark, so it agrees
+// with what the cache held then. The watermark is null while no hydrator has
+// recorded a cursor, and it is only as fresh as the hydrators'
+// CHANGEFEED_RESOLVED_INTERVAL.
+
+// asOfResolved is the as_of of a snapshot pinned to the watermark.
+const asOfResolved = "resolved"
+
+// resolvedWatermark returns the region's watermark, or "" when there is none
+// or Redis cannot be read.
+func resolvedWatermark() string {
+	cursor, err := oldestHydratorCursor()
+	if err != nil && err != redis.Nil {
+		redisErrors.Add(1)
+		log.Printf("WARNING: Failed to read the hydrator cursors for the resolved watermark: %v", err)
+	}
+	return cursor
+}
+
+// watermarkJSON is the watermark as a JSON number, or nil when there is none.
+func watermarkJSON(watermark string) any {
+	if watermark == "" {
+		return nil
+	}
+	return json.Number(watermark)
+}
+
+// handleResolved serves GET /kv/_resolved.
+func handleResolved(w http.ResponseWriter, r *http.Request) {
+	watermark := resolvedWatermark()
+	resp := map[string]any{"resolved": watermarkJSON(watermark), "resolved_time": nil, "lag_seconds": nil}
+	wall, _, _ := strings.Cut(watermark, ".")
+	if nanos, err := strconv.ParseInt(wall, 10, 64); err == nil {
+		resolved := time.Unix(0, nanos).UTC()
+		resp["resolved_time"] = resolved
+		resp["lag_seconds"] = max(time.Since(resolved), 0).Seconds()
+	}
+	json.NewEncoder(w).Encode(resp)
+}